@@ -0,0 +1,441 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+)
+
+// Admin roles, from most to least privileged
+const (
+	adminRoleSuperadmin = "superadmin"
+	adminRoleOperator   = "operator"
+	adminRoleReadOnly   = "readonly"
+)
+
+var adminRoles = map[string]bool{adminRoleSuperadmin: true, adminRoleOperator: true, adminRoleReadOnly: true}
+
+// Verified admins by token digest
+var admincache = cache.New(5*time.Minute, 10*time.Minute)
+
+// AdminPrincipal is an account allowed to use the admin endpoints. The -admintoken
+// flag is a built-in superadmin without an id.
+type AdminPrincipal struct {
+	ID        string    `json:"id" db:"id"`
+	Name      string    `json:"name" db:"name"`
+	Role      string    `json:"role" db:"role"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// AdminAuditEntry records an admin request that changed something
+type AdminAuditEntry struct {
+	ID         string    `json:"id" db:"id"`
+	AdminID    string    `json:"admin_id" db:"admin_id"`
+	AdminName  string    `json:"admin_name" db:"admin_name"`
+	Role       string    `json:"role" db:"role"`
+	Action     string    `json:"action" db:"action"`
+	Method     string    `json:"method" db:"method"`
+	Path       string    `json:"path" db:"path"`
+	Target     string    `json:"target" db:"target"`
+	Status     int       `json:"status" db:"status"`
+	RemoteAddr string    `json:"remote_addr" db:"remote_addr"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
+
+// Audit action names by route, other routes are recorded as "<method> <route>"
+var adminAuditActions = map[string]string{
+	"POST /admin/users":                    "user.create",
+	"PUT /admin/users/{id}":                "user.edit",
+	"DELETE /admin/users/{id}":             "user.delete",
+	"DELETE /admin/users/{id}/full":        "user.delete_complete",
+	"POST /admin/users/{id}/rotate-token":  "user.rotate_token",
+	"POST /admin/s3/retention/sweep":       "s3.retention_sweep",
+	"POST /admin/admins":                   "admin.create",
+	"PUT /admin/admins/{id}":               "admin.edit",
+	"DELETE /admin/admins/{id}":            "admin.delete",
+	"POST /admin/admins/{id}/rotate-token": "admin.rotate_token",
+	"POST /chatwoot/config":                "chatwoot.config",
+	"POST /chatwoot/auto-create":           "chatwoot.auto_create",
+}
+
+// Resolves the Authorization header to an admin
+func (s *server) resolveAdmin(token string) (*AdminPrincipal, error) {
+	if token == "" {
+		return nil, errInvalidToken
+	}
+	if *adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) == 1 {
+		return &AdminPrincipal{Name: "admintoken", Role: adminRoleSuperadmin}, nil
+	}
+
+	digest := tokenDigest(token)
+	if cached, found := admincache.Get(digest); found {
+		admin := *cached.(*AdminPrincipal)
+		return &admin, nil
+	}
+
+	var candidates []storedToken
+	if err := s.db.Select(&candidates, "SELECT id, token_hash, token_salt FROM admins WHERE token_lookup = $1", tokenLookupID(token)); err != nil {
+		return nil, err
+	}
+	match, ok := matchStoredToken(s.db, "admins", "token_hash", token, candidates)
+	if !ok {
+		return nil, errInvalidToken
+	}
+	admin := &AdminPrincipal{}
+	if err := s.db.Get(admin, "SELECT id, name, role, created_at FROM admins WHERE id = $1", match.ID); err != nil {
+		return nil, err
+	}
+	admincache.Set(digest, admin, cache.DefaultExpiration)
+	result := *admin
+	return &result, nil
+}
+
+// Whether a role may call a route. Read-only admins are limited to GET and only superadmins manage admins.
+func adminRoleAllows(role, method, pathTemplate string) bool {
+	if role == adminRoleSuperadmin {
+		return true
+	}
+	if strings.HasPrefix(pathTemplate, "/admin/admins") {
+		return false
+	}
+	if role == adminRoleOperator {
+		return true
+	}
+	return role == adminRoleReadOnly && method == http.MethodGet
+}
+
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if t, err := route.GetPathTemplate(); err == nil {
+			return t
+		}
+	}
+	return r.URL.Path
+}
+
+// Captures the status written by the handler for the audit log
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Records every admin request that may change state. Bodies are not stored, they carry tokens and keys.
+func (s *server) auditadmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		recorder := &auditResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		admin, _ := r.Context().Value("admin").(*AdminPrincipal)
+		if admin == nil {
+			return
+		}
+		template := routeTemplate(r)
+		action, ok := adminAuditActions[r.Method+" "+template]
+		if !ok {
+			action = r.Method + " " + template
+		}
+		id, err := GenerateRandomID()
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to generate audit entry id")
+			return
+		}
+		entry := AdminAuditEntry{
+			ID:         id,
+			AdminID:    admin.ID,
+			AdminName:  admin.Name,
+			Role:       admin.Role,
+			Action:     action,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Target:     mux.Vars(r)["id"],
+			Status:     recorder.status,
+			RemoteAddr: r.RemoteAddr,
+			CreatedAt:  time.Now(),
+		}
+		if _, err := s.db.Exec(`INSERT INTO admin_audit (id, admin_id, admin_name, role, action, method, path, target, status, remote_addr, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+			entry.ID, entry.AdminID, entry.AdminName, entry.Role, entry.Action, entry.Method, entry.Path, entry.Target, entry.Status, entry.RemoteAddr, entry.CreatedAt); err != nil {
+			log.Error().Err(err).Str("action", action).Msg("Failed to record admin audit entry")
+		}
+	})
+}
+
+func (s *server) adminError(w http.ResponseWriter, status int, message string) {
+	s.respondWithJSON(w, status, map[string]interface{}{
+		"code":    status,
+		"error":   message,
+		"success": false,
+	})
+}
+
+func (s *server) ListAdmins() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admins := []AdminPrincipal{}
+		if err := s.db.Select(&admins, "SELECT id, name, role, created_at FROM admins ORDER BY created_at"); err != nil {
+			s.adminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"code":    http.StatusOK,
+			"data":    admins,
+			"success": true,
+		})
+	}
+}
+
+// Creates an admin, the token is generated unless given and only returned here
+func (s *server) AddAdmin() http.HandlerFunc {
+	type adminStruct struct {
+		Name  string `json:"name"`
+		Role  string `json:"role"`
+		Token string `json:"token"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var t adminStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.adminError(w, http.StatusBadRequest, "invalid request payload")
+			return
+		}
+		if t.Name == "" {
+			s.adminError(w, http.StatusBadRequest, "missing name")
+			return
+		}
+		if !adminRoles[t.Role] {
+			s.adminError(w, http.StatusBadRequest, "role must be superadmin, operator or readonly")
+			return
+		}
+
+		var err error
+		if t.Token == "" {
+			if t.Token, err = newToken(); err != nil {
+				s.adminError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		var candidates []storedToken
+		if err := s.db.Select(&candidates, "SELECT id, token_hash, token_salt FROM admins WHERE token_lookup = $1", tokenLookupID(t.Token)); err != nil {
+			s.adminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		if _, inUse := matchStoredToken(s.db, "admins", "token_hash", t.Token, candidates); inUse || t.Token == *adminToken {
+			s.adminError(w, http.StatusConflict, "token already in use")
+			return
+		}
+
+		id, err := GenerateRandomID()
+		if err != nil {
+			s.adminError(w, http.StatusInternalServerError, "failed to generate admin ID")
+			return
+		}
+		lookup, hash, salt, err := newTokenColumns(t.Token)
+		if err != nil {
+			s.adminError(w, http.StatusInternalServerError, "failed to hash token")
+			return
+		}
+		admin := AdminPrincipal{ID: id, Name: t.Name, Role: t.Role, CreatedAt: time.Now()}
+		if _, err := s.db.Exec("INSERT INTO admins (id, name, role, token_lookup, token_hash, token_salt, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+			admin.ID, admin.Name, admin.Role, lookup, hash, salt, admin.CreatedAt); err != nil {
+			s.adminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		s.respondWithJSON(w, http.StatusCreated, map[string]interface{}{
+			"code":    http.StatusCreated,
+			"data":    map[string]interface{}{"admin": admin, "token": t.Token},
+			"success": true,
+		})
+	}
+}
+
+// Changes an admin's name or role
+func (s *server) EditAdmin() http.HandlerFunc {
+	type adminStruct struct {
+		Name string `json:"name"`
+		Role string `json:"role"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		var t adminStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.adminError(w, http.StatusBadRequest, "invalid request payload")
+			return
+		}
+		if t.Role != "" && !adminRoles[t.Role] {
+			s.adminError(w, http.StatusBadRequest, "role must be superadmin, operator or readonly")
+			return
+		}
+
+		result, err := s.db.Exec("UPDATE admins SET name = CASE WHEN $1 = '' THEN name ELSE $1 END, role = CASE WHEN $2 = '' THEN role ELSE $2 END WHERE id = $3",
+			t.Name, t.Role, id)
+		if err != nil {
+			s.adminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			s.adminError(w, http.StatusNotFound, "admin not found")
+			return
+		}
+		s.forgetAdmin(id)
+
+		s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"code":    http.StatusOK,
+			"message": "admin updated successfully",
+			"success": true,
+		})
+	}
+}
+
+// Issues a new token for an admin, the old one stops working immediately
+func (s *server) RotateAdminToken() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		token, err := newToken()
+		if err != nil {
+			s.adminError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		lookup, hash, salt, err := newTokenColumns(token)
+		if err != nil {
+			s.adminError(w, http.StatusInternalServerError, "failed to hash token")
+			return
+		}
+		s.forgetAdmin(id)
+		result, err := s.db.Exec("UPDATE admins SET token_lookup = $1, token_hash = $2, token_salt = $3 WHERE id = $4", lookup, hash, salt, id)
+		if err != nil {
+			s.adminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			s.adminError(w, http.StatusNotFound, "admin not found")
+			return
+		}
+
+		s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"code":    http.StatusOK,
+			"data":    map[string]interface{}{"id": id, "token": token},
+			"success": true,
+		})
+	}
+}
+
+func (s *server) DeleteAdmin() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		s.forgetAdmin(id)
+		result, err := s.db.Exec("DELETE FROM admins WHERE id = $1", id)
+		if err != nil {
+			s.adminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			s.adminError(w, http.StatusNotFound, "admin not found")
+			return
+		}
+
+		s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"code":    http.StatusOK,
+			"data":    map[string]string{"id": id},
+			"success": true,
+		})
+	}
+}
+
+// Drops the cached credentials of an admin so role and token changes apply at once
+func (s *server) forgetAdmin(id string) {
+	for digest, item := range admincache.Items() {
+		if item.Object.(*AdminPrincipal).ID == id {
+			admincache.Delete(digest)
+		}
+	}
+}
+
+// Returns the calling admin, so the dashboard can adapt to its role
+func (s *server) GetAdminSelf() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"code":    http.StatusOK,
+			"data":    r.Context().Value("admin"),
+			"success": true,
+		})
+	}
+}
+
+// Lists audit entries, newest first, filtered by admin_id, action, target, since and until (RFC 3339)
+func (s *server) GetAdminAudit() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		where := []string{}
+		args := []interface{}{}
+		for _, field := range []string{"admin_id", "action", "target"} {
+			if value := query.Get(field); value != "" {
+				args = append(args, value)
+				where = append(where, field+" = $"+strconv.Itoa(len(args)))
+			}
+		}
+		for param, op := range map[string]string{"since": ">=", "until": "<"} {
+			if value := query.Get(param); value != "" {
+				t, err := time.Parse(time.RFC3339, value)
+				if err != nil {
+					s.adminError(w, http.StatusBadRequest, param+" must be an RFC 3339 timestamp")
+					return
+				}
+				args = append(args, t)
+				where = append(where, "created_at "+op+" $"+strconv.Itoa(len(args)))
+			}
+		}
+
+		limit := 100
+		if value := query.Get("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 1000 {
+				s.adminError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+				return
+			}
+			limit = n
+		}
+		offset, _ := strconv.Atoi(query.Get("offset"))
+		if offset < 0 {
+			offset = 0
+		}
+
+		sqlQuery := "SELECT * FROM admin_audit"
+		if len(where) > 0 {
+			sqlQuery += " WHERE " + strings.Join(where, " AND ")
+		}
+		sqlQuery += " ORDER BY created_at DESC LIMIT " + strconv.Itoa(limit) + " OFFSET " + strconv.Itoa(offset)
+
+		entries := []AdminAuditEntry{}
+		if err := s.db.Select(&entries, sqlQuery, args...); err != nil {
+			log.Error().Err(err).Msg("Failed to read admin audit log")
+			s.adminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"code":    http.StatusOK,
+			"data":    entries,
+			"success": true,
+		})
+	}
+}
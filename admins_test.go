@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestAdminRoleAllows(t *testing.T) {
+	tests := []struct {
+		role, method, path string
+		want               bool
+	}{
+		{adminRoleSuperadmin, "POST", "/admin/admins", true},
+		{adminRoleSuperadmin, "DELETE", "/admin/users/{id}/full", true},
+		{adminRoleOperator, "POST", "/admin/users", true},
+		{adminRoleOperator, "POST", "/chatwoot/config", true},
+		{adminRoleOperator, "GET", "/admin/audit", true},
+		{adminRoleOperator, "GET", "/admin/admins", false},
+		{adminRoleOperator, "POST", "/admin/admins/{id}/rotate-token", false},
+		{adminRoleReadOnly, "GET", "/admin/users", true},
+		{adminRoleReadOnly, "GET", "/admin/audit", true},
+		{adminRoleReadOnly, "PUT", "/admin/users/{id}", false},
+		{adminRoleReadOnly, "GET", "/admin/admins", false},
+		{"unknown", "GET", "/admin/users", false},
+	}
+	for _, tt := range tests {
+		if got := adminRoleAllows(tt.role, tt.method, tt.path); got != tt.want {
+			t.Errorf("%s %s %s: got %v, want %v", tt.role, tt.method, tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	aiDefaultContextMessages = 20
+	aiMaxContextMessages     = 100
+	aiDefaultTimeoutSeconds  = 60
+	aiMaxResponseBytes       = 4 * 1024 * 1024
+	aiMaxAudioBytes          = 25 * 1024 * 1024
+)
+
+// Settings are read on every incoming message, keep them for a short while
+var aiAgentCache = cache.New(time.Minute, 5*time.Minute)
+
+type AIAgentConfig struct {
+	Enabled            bool    `json:"enabled" db:"enabled"`
+	BaseURL            string  `json:"base_url" db:"base_url"`
+	APIKey             string  `json:"api_key" db:"api_key"`
+	Model              string  `json:"model" db:"model"`
+	SystemPrompt       string  `json:"system_prompt" db:"system_prompt"`
+	HandoffKeyword     string  `json:"handoff_keyword" db:"handoff_keyword"`
+	HandoffMessage     string  `json:"handoff_message" db:"handoff_message"`
+	ContextMessages    int     `json:"context_messages" db:"context_messages"`
+	Temperature        float64 `json:"temperature" db:"temperature"`
+	MaxTokens          int     `json:"max_tokens" db:"max_tokens"`
+	TimeoutSeconds     int     `json:"timeout_seconds" db:"timeout_seconds"`
+	TranscriptionURL   string  `json:"transcription_url" db:"transcription_url"`
+	TranscriptionModel string  `json:"transcription_model" db:"transcription_model"`
+}
+
+type aiChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+func (cfg *AIAgentConfig) Validate() error {
+	if !isHTTPURL(cfg.BaseURL) {
+		return errors.New("base_url must be an http(s) url")
+	}
+	if cfg.Model == "" {
+		return errors.New("missing model")
+	}
+	if cfg.TranscriptionURL != "" && !isHTTPURL(cfg.TranscriptionURL) {
+		return errors.New("transcription_url must be an http(s) url")
+	}
+	if cfg.ContextMessages < 0 || cfg.ContextMessages > aiMaxContextMessages {
+		return fmt.Errorf("context_messages must be between 0 and %d", aiMaxContextMessages)
+	}
+	if cfg.TimeoutSeconds < 0 || cfg.MaxTokens < 0 {
+		return errors.New("timeout_seconds and max_tokens cannot be negative")
+	}
+	return nil
+}
+
+func (cfg *AIAgentConfig) httpClient() *http.Client {
+	timeout := cfg.TimeoutSeconds
+	if timeout == 0 {
+		timeout = aiDefaultTimeoutSeconds
+	}
+	// Not the SSRF-safe client on purpose: the model usually runs next to wuzapi (llama.cpp, Ollama)
+	return &http.Client{Timeout: time.Duration(timeout) * time.Second}
+}
+
+// Accepts either the API root (http://host/v1) or the full chat completions URL
+func (cfg *AIAgentConfig) completionsURL() string {
+	url := strings.TrimRight(cfg.BaseURL, "/")
+	if strings.HasSuffix(url, "/chat/completions") {
+		return url
+	}
+	return url + "/chat/completions"
+}
+
+func (s *server) getAIAgentConfig(userID string) (*AIAgentConfig, error) {
+	if cached, found := aiAgentCache.Get(userID); found {
+		return cached.(*AIAgentConfig), nil
+	}
+	var cfg AIAgentConfig
+	err := s.db.Get(&cfg, `
+		SELECT enabled, base_url, api_key, model, system_prompt, handoff_keyword, handoff_message,
+			context_messages, temperature, max_tokens, timeout_seconds, transcription_url, transcription_model
+		FROM ai_agents WHERE user_id = $1`, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		aiAgentCache.Set(userID, (*AIAgentConfig)(nil), cache.DefaultExpiration)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	aiAgentCache.Set(userID, &cfg, cache.DefaultExpiration)
+	return &cfg, nil
+}
+
+func (s *server) isAIHandedOff(userID string, chatJID string) bool {
+	var count int
+	err := s.db.Get(&count, "SELECT COUNT(*) FROM ai_handoffs WHERE user_id = $1 AND chat_jid = $2", userID, chatJID)
+	return err == nil && count > 0
+}
+
+// Previous exchanges of the chat as chat completion messages, oldest first. Messages sent through
+// the API are stored as "me", those sent from the phone or by an agent under one of own
+func (s *server) buildAIContext(userID string, chatJID string, currentID string, limit int, own []types.JID) []aiChatMessage {
+	var rows []struct {
+		SenderJID   string         `db:"sender_jid"`
+		MessageType string         `db:"message_type"`
+		TextContent sql.NullString `db:"text_content"`
+	}
+	err := s.db.Select(&rows, `
+		SELECT sender_jid, message_type, text_content FROM message_history
+		WHERE user_id = $1 AND chat_jid = $2 AND message_id != $3
+		ORDER BY timestamp DESC LIMIT $4`, userID, chatJID, currentID, limit)
+	if err != nil {
+		log.Warn().Err(err).Str("userID", userID).Msg("Failed to load AI context from history")
+		return nil
+	}
+
+	messages := make([]aiChatMessage, 0, len(rows))
+	for i := len(rows) - 1; i >= 0; i-- {
+		text := strings.TrimSpace(rows[i].TextContent.String)
+		if text == "" {
+			continue
+		}
+		role := "user"
+		if isOwnSender(rows[i].SenderJID, own) {
+			role = "assistant"
+		}
+		messages = append(messages, aiChatMessage{Role: role, Content: text})
+	}
+	return messages
+}
+
+func isOwnSender(senderJID string, own []types.JID) bool {
+	if senderJID == "me" {
+		return true
+	}
+	sender, err := types.ParseJID(senderJID)
+	if err != nil {
+		return false
+	}
+	sender = sender.ToNonAD()
+	for _, jid := range own {
+		if sender == jid {
+			return true
+		}
+	}
+	return false
+}
+
+// Account JIDs, phone number and LID, without the device
+func ownJIDs(client *whatsmeow.Client) []types.JID {
+	var own []types.JID
+	if client.Store.ID != nil {
+		own = append(own, client.Store.ID.ToNonAD())
+	}
+	if !client.Store.LID.IsEmpty() {
+		own = append(own, client.Store.LID.ToNonAD())
+	}
+	return own
+}
+
+// Calls an OpenAI-compatible chat completions endpoint and returns the first choice
+func callChatCompletion(ctx context.Context, cfg *AIAgentConfig, messages []aiChatMessage) (string, error) {
+	payload := map[string]interface{}{
+		"model":    cfg.Model,
+		"messages": messages,
+	}
+	if cfg.Temperature > 0 {
+		payload["temperature"] = cfg.Temperature
+	}
+	if cfg.MaxTokens > 0 {
+		payload["max_tokens"] = cfg.MaxTokens
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", cfg.completionsURL(), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.APIKey)
+	}
+
+	resp, err := cfg.httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, aiMaxResponseBytes))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("chat completion failed with status %d: %s", resp.StatusCode, truncateString(string(respBody), 200))
+	}
+
+	var result struct {
+		Choices []struct {
+			Message aiChatMessage `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return "", fmt.Errorf("invalid chat completion response: %w", err)
+	}
+	if len(result.Choices) == 0 {
+		return "", errors.New("chat completion returned no choices")
+	}
+	return strings.TrimSpace(result.Choices[0].Message.Content), nil
+}
+
+// Sends audio to an OpenAI-compatible /audio/transcriptions endpoint
+func transcribeAudio(ctx context.Context, cfg *AIAgentConfig, audio []byte, mimeType string) (string, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	model := cfg.TranscriptionModel
+	if model == "" {
+		model = "whisper-1"
+	}
+	writer.WriteField("model", model)
+	fileName := "audio.ogg"
+	if strings.Contains(mimeType, "mpeg") {
+		fileName = "audio.mp3"
+	} else if strings.Contains(mimeType, "mp4") {
+		fileName = "audio.m4a"
+	}
+	part, err := writer.CreateFormFile("file", fileName)
+	if err != nil {
+		return "", err
+	}
+	part.Write(audio)
+	writer.Close()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", cfg.TranscriptionURL, &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	if cfg.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.APIKey)
+	}
+
+	resp, err := cfg.httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, aiMaxResponseBytes))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("transcription failed with status %d: %s", resp.StatusCode, truncateString(string(respBody), 200))
+	}
+
+	var result struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return "", fmt.Errorf("invalid transcription response: %w", err)
+	}
+	return strings.TrimSpace(result.Text), nil
+}
+
+func truncateString(value string, max int) string {
+	if len(value) <= max {
+		return value
+	}
+	return value[:max] + "..."
+}
+
+// Answers incoming direct messages with the configured model
+func (mycli *MyClient) handleAIMessage(evt *events.Message) {
+	if evt.Info.IsFromMe || evt.Info.IsGroup || evt.Info.Chat.Server != types.DefaultUserServer {
+		return
+	}
+	s := mycli.s
+	cfg, err := s.getAIAgentConfig(mycli.userID)
+	if err != nil {
+		log.Error().Err(err).Str("userID", mycli.userID).Msg("Failed to load AI agent settings")
+		return
+	}
+	if cfg == nil || !cfg.Enabled {
+		return
+	}
+
+	chat := evt.Info.Chat.String()
+	if s.isAIHandedOff(mycli.userID, chat) {
+		return
+	}
+
+	timeout := cfg.TimeoutSeconds
+	if timeout == 0 {
+		timeout = aiDefaultTimeoutSeconds
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	text := incomingMessageText(evt.Message)
+	if audio := evt.Message.GetAudioMessage(); audio != nil && cfg.TranscriptionURL != "" {
+		if audio.GetFileLength() > aiMaxAudioBytes {
+			log.Warn().Str("userID", mycli.userID).Msg("Audio too large for transcription")
+			return
+		}
+		data, err := mycli.WAClient.Download(ctx, audio)
+		if err != nil {
+			log.Error().Err(err).Str("userID", mycli.userID).Msg("Failed to download audio for transcription")
+			return
+		}
+		text, err = transcribeAudio(ctx, cfg, data, audio.GetMimetype())
+		if err != nil {
+			log.Error().Err(err).Str("userID", mycli.userID).Msg("Failed to transcribe audio")
+			return
+		}
+	}
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+
+	if cfg.HandoffKeyword != "" && matchesBranchRule(FlowBranchRule{Match: "keyword", Value: cfg.HandoffKeyword}, text) {
+		_, err := s.db.Exec(`
+			INSERT INTO ai_handoffs (user_id, chat_jid, created_at) VALUES ($1, $2, $3)
+			ON CONFLICT (user_id, chat_jid) DO NOTHING`, mycli.userID, chat, time.Now())
+		if err != nil {
+			log.Error().Err(err).Str("userID", mycli.userID).Msg("Failed to record AI handoff")
+			return
+		}
+		log.Info().Str("userID", mycli.userID).Str("chat", chat).Msg("AI responder handed chat over to a human")
+		if cfg.HandoffMessage != "" {
+			mycli.sendAutomatedMessage(evt.Info.Chat, &waE2E.Message{Conversation: proto.String(cfg.HandoffMessage)}, "text", cfg.HandoffMessage)
+		}
+		return
+	}
+
+	limit := cfg.ContextMessages
+	if limit == 0 {
+		limit = aiDefaultContextMessages
+	}
+	var messages []aiChatMessage
+	if cfg.SystemPrompt != "" {
+		messages = append(messages, aiChatMessage{Role: "system", Content: cfg.SystemPrompt})
+	}
+	messages = append(messages, s.buildAIContext(mycli.userID, chat, evt.Info.ID, limit, ownJIDs(mycli.WAClient))...)
+	messages = append(messages, aiChatMessage{Role: "user", Content: text})
+
+	mycli.WAClient.SendChatPresence(ctx, evt.Info.Chat, types.ChatPresenceComposing, types.ChatPresenceMediaText)
+	answer, err := callChatCompletion(ctx, cfg, messages)
+	mycli.WAClient.SendChatPresence(context.Background(), evt.Info.Chat, types.ChatPresencePaused, types.ChatPresenceMediaText)
+	if err != nil {
+		log.Error().Err(err).Str("userID", mycli.userID).Msg("AI responder failed")
+		return
+	}
+	if answer == "" {
+		return
+	}
+
+	if _, err := mycli.sendAutomatedMessage(evt.Info.Chat, &waE2E.Message{Conversation: proto.String(answer)}, "text", answer); err != nil {
+		log.Error().Err(err).Str("userID", mycli.userID).Msg("Failed to send AI reply")
+	}
+}
+
+// Configure the AI responder
+func (s *server) SetAIAgent() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		cfg := AIAgentConfig{Enabled: true}
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode payload"))
+			return
+		}
+		if err := cfg.Validate(); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		// Keep the stored key when the client sends back the masked value from GET
+		if cfg.APIKey == "***" {
+			if current, err := s.getAIAgentConfig(txtid); err == nil && current != nil {
+				cfg.APIKey = current.APIKey
+			}
+		}
+
+		_, err := s.db.Exec(`
+			INSERT INTO ai_agents (user_id, enabled, base_url, api_key, model, system_prompt, handoff_keyword, handoff_message,
+				context_messages, temperature, max_tokens, timeout_seconds, transcription_url, transcription_model, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, CURRENT_TIMESTAMP)
+			ON CONFLICT (user_id) DO UPDATE SET
+				enabled = excluded.enabled,
+				base_url = excluded.base_url,
+				api_key = excluded.api_key,
+				model = excluded.model,
+				system_prompt = excluded.system_prompt,
+				handoff_keyword = excluded.handoff_keyword,
+				handoff_message = excluded.handoff_message,
+				context_messages = excluded.context_messages,
+				temperature = excluded.temperature,
+				max_tokens = excluded.max_tokens,
+				timeout_seconds = excluded.timeout_seconds,
+				transcription_url = excluded.transcription_url,
+				transcription_model = excluded.transcription_model,
+				updated_at = excluded.updated_at`,
+			txtid, cfg.Enabled, cfg.BaseURL, cfg.APIKey, cfg.Model, cfg.SystemPrompt, cfg.HandoffKeyword, cfg.HandoffMessage,
+			cfg.ContextMessages, cfg.Temperature, cfg.MaxTokens, cfg.TimeoutSeconds, cfg.TranscriptionURL, cfg.TranscriptionModel)
+		if err != nil {
+			log.Error().Err(err).Str("userID", txtid).Msg("Failed to save AI agent settings")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to save AI agent settings"))
+			return
+		}
+		aiAgentCache.Delete(txtid)
+
+		response := map[string]interface{}{"Details": "AI agent configured", "Enabled": cfg.Enabled}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Get AI responder settings
+func (s *server) GetAIAgent() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		cfg, err := s.getAIAgentConfig(txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to load AI agent settings"))
+			return
+		}
+		if cfg == nil {
+			s.Respond(w, r, http.StatusNotFound, errors.New("AI agent not configured"))
+			return
+		}
+
+		masked := *cfg
+		if masked.APIKey != "" {
+			masked.APIKey = "***"
+		}
+		responseJson, err := json.Marshal(masked)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Remove AI responder settings
+func (s *server) DeleteAIAgent() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		if _, err := s.db.Exec("DELETE FROM ai_agents WHERE user_id = $1", txtid); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to delete AI agent settings"))
+			return
+		}
+		aiAgentCache.Delete(txtid)
+
+		response := map[string]interface{}{"Details": "AI agent removed"}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// List chats handed over to a human
+func (s *server) GetAIHandoffs() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		handoffs := []struct {
+			ChatJID   string    `json:"chat_jid" db:"chat_jid"`
+			CreatedAt time.Time `json:"created_at" db:"created_at"`
+		}{}
+		err := s.db.Select(&handoffs, "SELECT chat_jid, created_at FROM ai_handoffs WHERE user_id = $1 ORDER BY created_at DESC", txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to list handoffs"))
+			return
+		}
+
+		responseJson, err := json.Marshal(handoffs)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Give a chat back to the AI responder
+func (s *server) DeleteAIHandoff() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		chatJID := r.URL.Query().Get("chat_jid")
+		if chatJID == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing chat_jid"))
+			return
+		}
+
+		if _, err := s.db.Exec("DELETE FROM ai_handoffs WHERE user_id = $1 AND chat_jid = $2", txtid, chatJID); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to delete handoff"))
+			return
+		}
+
+		response := map[string]interface{}{"Details": "AI responder resumed", "ChatJID": chatJID}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestCallChatCompletion(t *testing.T) {
+	var request struct {
+		Model    string          `json:"model"`
+		Messages []aiChatMessage `json:"messages"`
+	}
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" || r.Header.Get("Authorization") != "Bearer local" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices": [{"index": 0, "message": {"role": "assistant", "content": " We open at 9am. "}}]}`))
+	}))
+	defer stub.Close()
+
+	cfg := &AIAgentConfig{BaseURL: stub.URL + "/v1", APIKey: "local", Model: "llama3"}
+	answer, err := callChatCompletion(context.Background(), cfg, []aiChatMessage{
+		{Role: "system", Content: "You are a shop assistant"},
+		{Role: "user", Content: "When do you open?"},
+	})
+	if err != nil {
+		t.Fatalf("callChatCompletion failed: %v", err)
+	}
+	if answer != "We open at 9am." {
+		t.Errorf("Unexpected answer %q", answer)
+	}
+	if request.Model != "llama3" || len(request.Messages) != 2 || request.Messages[0].Role != "system" {
+		t.Errorf("Unexpected request %+v", request)
+	}
+
+	cfg.BaseURL = stub.URL + "/v1/chat/completions"
+	if _, err := callChatCompletion(context.Background(), cfg, nil); err != nil {
+		t.Errorf("Full completions URL should be accepted: %v", err)
+	}
+
+	cfg.APIKey = "wrong"
+	if _, err := callChatCompletion(context.Background(), cfg, nil); err == nil {
+		t.Error("Expected error on non-200 response")
+	}
+}
+
+func TestIsOwnSender(t *testing.T) {
+	own := []types.JID{types.NewJID("5511999990000", types.DefaultUserServer), types.NewJID("123456789", types.HiddenUserServer)}
+	for sender, want := range map[string]bool{
+		"me":                              true,
+		"5511999990000@s.whatsapp.net":    true,
+		"5511999990000:12@s.whatsapp.net": true,
+		"123456789:3@lid":                 true,
+		"5511999990001@s.whatsapp.net":    false,
+		"120363000000000000@g.us":         false,
+		"":                                false,
+	} {
+		if got := isOwnSender(sender, own); got != want {
+			t.Errorf("%q: expected %v, got %v", sender, want, got)
+		}
+	}
+}
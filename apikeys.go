@@ -0,0 +1,380 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+)
+
+// API keys are told apart from user tokens by this prefix
+const apiKeyPrefix = "wzk_"
+
+// Scope that grants every route, like the user token
+const apiKeyScopeAll = "*"
+
+var apiKeyScopes = map[string]string{
+	"send":           "Send messages, reactions, presence and read receipts",
+	"read:history":   "Read message history and download media",
+	"read:contacts":  "Look up users, contacts and avatars",
+	"groups:read":    "List groups and read group info",
+	"groups:admin":   "Create, join, leave and manage groups",
+	"media":          "Manage the media library",
+	"automation":     "Manage flows, auto-replies and the AI responder",
+	"session:read":   "Read the session status",
+	"session:manage": "Connect, logout, pair and configure webhooks, proxy, S3, HMAC and connectors",
+}
+
+type apiKeyRouteScope struct {
+	Prefix string
+	Method string
+	Scope  string
+}
+
+// Scope required for each route, the first matching prefix wins. Routes not listed
+// (like the API key management itself) can only be used with the user token.
+var apiKeyRouteScopes = []apiKeyRouteScope{
+	{"/chat/send/", "", "send"},
+	{"/chat/react", "", "send"},
+	{"/chat/delete", "", "send"},
+	{"/chat/presence", "", "send"},
+	{"/chat/markread", "", "send"},
+	{"/chat/archive", "", "send"},
+	{"/user/presence", "", "send"},
+	{"/call/reject", "", "send"},
+	{"/chat/history", "", "read:history"},
+	{"/chat/media/", "", "read:history"},
+	{"/chat/download", "", "read:history"},
+	{"/chat/request-unavailable-message", "", "read:history"},
+	{"/media/s3/", "", "read:history"},
+	{"/media/local/", "", "read:history"},
+	{"/session/history", "GET", "read:history"},
+	{"/user/", "", "read:contacts"},
+	{"/newsletter/", "", "read:contacts"},
+	{"/group/list", "", "groups:read"},
+	{"/group/info", "", "groups:read"},
+	{"/group/invitelink", "", "groups:read"},
+	{"/group/inviteinfo", "", "groups:read"},
+	{"/group/", "", "groups:admin"},
+	{"/media", "", "media"},
+	{"/flows", "", "automation"},
+	{"/autoreply", "", "automation"},
+	{"/session/ai", "", "automation"},
+	{"/session/status", "", "session:read"},
+	{"/session/", "", "session:manage"},
+	{"/status/set/", "", "session:manage"},
+	{"/webhook", "", "session:manage"},
+	{"/connectors/{type}/webhook", "", "send"},
+	{"/connectors/", "", "session:manage"},
+}
+
+// APIKey is a scoped credential for a user, only its hash is stored
+type APIKey struct {
+	ID         string     `json:"id" db:"id"`
+	UserID     string     `json:"-" db:"user_id"`
+	Name       string     `json:"name" db:"name"`
+	Prefix     string     `json:"prefix" db:"prefix"`
+	KeyHash    string     `json:"-" db:"key_hash"`
+	Scopes     string     `json:"-" db:"scopes"`
+	AllowedIPs string     `json:"-" db:"allowed_ips"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty" db:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty" db:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+}
+
+func splitList(value string) []string {
+	if value == "" {
+		return []string{}
+	}
+	return strings.Split(value, ",")
+}
+
+// Lists are stored comma separated, they are exposed as arrays
+func (k APIKey) MarshalJSON() ([]byte, error) {
+	type apiKeyJSON APIKey
+	return json.Marshal(struct {
+		apiKeyJSON
+		Scopes     []string `json:"scopes"`
+		AllowedIPs []string `json:"allowed_ips"`
+	}{apiKeyJSON(k), splitList(k.Scopes), splitList(k.AllowedIPs)})
+}
+
+func (k *APIKey) HasScope(scope string) bool {
+	for _, granted := range splitList(k.Scopes) {
+		if granted == apiKeyScopeAll || granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// An empty allowlist accepts any address
+func (k *APIKey) AllowsIP(remoteAddr string) bool {
+	allowed := splitList(k.AllowedIPs)
+	if len(allowed) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, entry := range allowed {
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if allowedIP := net.ParseIP(entry); allowedIP != nil && allowedIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateAPIKey() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + hex.EncodeToString(buf), nil
+}
+
+// Scope required by a route template, empty when only the user token may call it
+func requiredAPIKeyScope(pathTemplate, method string) string {
+	for _, rule := range apiKeyRouteScopes {
+		if rule.Method != "" && rule.Method != method {
+			continue
+		}
+		if strings.HasPrefix(pathTemplate, rule.Prefix) {
+			return rule.Scope
+		}
+	}
+	return ""
+}
+
+// Resolves an API key to its user, checking expiry and IP allowlist
+func (s *server) resolveAPIKey(key string, r *http.Request) (*APIKey, string, error) {
+	var apiKey APIKey
+	err := s.db.Get(&apiKey, "SELECT * FROM api_keys WHERE key_hash = $1", hashAPIKey(key))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, "", errors.New("unauthorized")
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if apiKey.ExpiresAt != nil && time.Now().After(*apiKey.ExpiresAt) {
+		return nil, "", errors.New("api key expired")
+	}
+	if !apiKey.AllowsIP(r.RemoteAddr) {
+		return nil, "", errors.New("api key not allowed from this address")
+	}
+
+	// Usage is tracked with a minute of granularity to spare a write on every request
+	now := time.Now()
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > time.Minute {
+		go func() {
+			if _, err := s.db.Exec("UPDATE api_keys SET last_used_at = $1 WHERE id = $2", now, apiKey.ID); err != nil {
+				log.Warn().Err(err).Str("key", apiKey.ID).Msg("Failed to update api key usage")
+			}
+		}()
+	}
+	return &apiKey, apiKey.UserID, nil
+}
+
+// Rejects API key requests to routes outside the key's scopes, user tokens pass through
+func (s *server) authscope(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKey, ok := r.Context().Value("apikey").(*APIKey)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		template := r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if t, err := route.GetPathTemplate(); err == nil {
+				template = t
+			}
+		}
+
+		scope := requiredAPIKeyScope(template, r.Method)
+		if scope == "" && !apiKey.HasScope(apiKeyScopeAll) {
+			s.Respond(w, r, http.StatusForbidden, errors.New("this endpoint requires the user token"))
+			return
+		}
+		if scope != "" && !apiKey.HasScope(scope) {
+			s.Respond(w, r, http.StatusForbidden, fmt.Errorf("api key lacks the %s scope", scope))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Stores a new key for the user and returns it, scopes and addresses must be validated already
+func (s *server) createAPIKey(userID, name string, scopes, allowedIPs []string, expiresAt *time.Time) (string, *APIKey, error) {
+	key, err := generateAPIKey()
+	if err != nil {
+		return "", nil, err
+	}
+	id, err := GenerateRandomID()
+	if err != nil {
+		return "", nil, err
+	}
+
+	sort.Strings(scopes)
+	apiKey := &APIKey{
+		ID:         id,
+		UserID:     userID,
+		Name:       name,
+		Prefix:     key[:len(apiKeyPrefix)+8],
+		KeyHash:    hashAPIKey(key),
+		Scopes:     strings.Join(scopes, ","),
+		AllowedIPs: strings.Join(allowedIPs, ","),
+		ExpiresAt:  expiresAt,
+		CreatedAt:  time.Now(),
+	}
+	_, err = s.db.Exec(`INSERT INTO api_keys (id, user_id, name, prefix, key_hash, scopes, allowed_ips, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		apiKey.ID, apiKey.UserID, apiKey.Name, apiKey.Prefix, apiKey.KeyHash, apiKey.Scopes, apiKey.AllowedIPs, apiKey.ExpiresAt, apiKey.CreatedAt)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to save api key: %w", err)
+	}
+	return key, apiKey, nil
+}
+
+// Creates an API key, the key itself is only returned here
+func (s *server) CreateAPIKey() http.HandlerFunc {
+	type apiKeyStruct struct {
+		Name          string     `json:"name"`
+		Scopes        []string   `json:"scopes"`
+		AllowedIPs    []string   `json:"allowed_ips"`
+		ExpiresAt     *time.Time `json:"expires_at"`
+		ExpiresInDays int        `json:"expires_in_days"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		// Keys can't mint other keys
+		if _, ok := r.Context().Value("apikey").(*APIKey); ok {
+			s.Respond(w, r, http.StatusForbidden, errors.New("api keys can only be managed with the user token"))
+			return
+		}
+
+		var t apiKeyStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode payload"))
+			return
+		}
+		if t.Name == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing name in payload"))
+			return
+		}
+		if len(t.Scopes) == 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("at least one scope is required"))
+			return
+		}
+		for _, scope := range t.Scopes {
+			if _, ok := apiKeyScopes[scope]; !ok && scope != apiKeyScopeAll {
+				s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("unknown scope %q", scope))
+				return
+			}
+		}
+		for _, entry := range t.AllowedIPs {
+			_, _, cidrErr := net.ParseCIDR(entry)
+			if cidrErr != nil && net.ParseIP(entry) == nil {
+				s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("invalid IP or CIDR %q", entry))
+				return
+			}
+		}
+		if t.ExpiresAt == nil && t.ExpiresInDays > 0 {
+			expires := time.Now().AddDate(0, 0, t.ExpiresInDays)
+			t.ExpiresAt = &expires
+		}
+		if t.ExpiresAt != nil && t.ExpiresAt.Before(time.Now()) {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("expires_at is in the past"))
+			return
+		}
+
+		key, apiKey, err := s.createAPIKey(txtid, t.Name, t.Scopes, t.AllowedIPs, t.ExpiresAt)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		response := map[string]interface{}{"Details": "API key created, store it now as it won't be shown again", "Key": key, "ApiKey": apiKey}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+func (s *server) ListAPIKeys() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		keys := []APIKey{}
+		if err := s.db.Select(&keys, "SELECT * FROM api_keys WHERE user_id = $1 ORDER BY created_at", txtid); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		responseJson, err := json.Marshal(map[string]interface{}{"ApiKeys": keys, "Scopes": apiKeyScopes})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+func (s *server) DeleteAPIKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		id := mux.Vars(r)["id"]
+
+		if _, ok := r.Context().Value("apikey").(*APIKey); ok {
+			s.Respond(w, r, http.StatusForbidden, errors.New("api keys can only be managed with the user token"))
+			return
+		}
+
+		result, err := s.db.Exec("DELETE FROM api_keys WHERE id = $1 AND user_id = $2", id, txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			s.Respond(w, r, http.StatusNotFound, errors.New("api key not found"))
+			return
+		}
+
+		responseJson, err := json.Marshal(map[string]interface{}{"Details": "API key revoked", "Id": id})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
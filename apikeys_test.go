@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequiredAPIKeyScope(t *testing.T) {
+	tests := []struct {
+		path   string
+		method string
+		scope  string
+	}{
+		{"/chat/send/text", "POST", "send"},
+		{"/chat/history", "GET", "read:history"},
+		{"/media/s3/{key:.+}", "GET", "read:history"},
+		{"/media/local/{key:.+}", "GET", "read:history"},
+		{"/media/{id}", "GET", "media"},
+		{"/group/list", "GET", "groups:read"},
+		{"/group/create", "POST", "groups:admin"},
+		{"/session/status", "GET", "session:read"},
+		{"/session/history", "GET", "read:history"},
+		{"/session/history", "POST", "session:manage"},
+		{"/session/ai", "POST", "automation"},
+		{"/session/logout", "POST", "session:manage"},
+		{"/status/set/text", "POST", "session:manage"},
+		{"/connectors/{type}/webhook", "POST", "send"},
+		{"/session/connectors", "POST", "session:manage"},
+		{"/apikeys", "POST", ""},
+	}
+	for _, tt := range tests {
+		if got := requiredAPIKeyScope(tt.path, tt.method); got != tt.scope {
+			t.Errorf("%s %s: expected %q, got %q", tt.method, tt.path, tt.scope, got)
+		}
+	}
+}
+
+func TestAPIKeyAuthorization(t *testing.T) {
+	s := makeTestServer(t)
+	userID := "apikeyuser"
+	t.Cleanup(func() {
+		userinfocache.Delete(userID)
+		forgetUserLimits(userID)
+	})
+	if _, err := s.db.Exec("INSERT INTO users (id, name, token) VALUES ($1, $2, $3)", userID, "u", "apikeyusertoken"); err != nil {
+		t.Fatal(err)
+	}
+
+	addKey := func(scopes, allowedIPs string, expiresAt *time.Time) string {
+		key, err := generateAPIKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := GenerateRandomID()
+		if _, err := s.db.Exec(`INSERT INTO api_keys (id, user_id, name, prefix, key_hash, scopes, allowed_ips, expires_at, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+			id, userID, "k", key[:len(apiKeyPrefix)+8], hashAPIKey(key), scopes, allowedIPs, expiresAt, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	call := func(method, path, key string) int {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("token", key)
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	sendOnly := addKey("send", "", nil)
+	if code := call("POST", "/session/logout", sendOnly); code != http.StatusForbidden {
+		t.Errorf("Expected a send-only key to be refused on logout, got %d", code)
+	}
+	if code := call("GET", "/flows", sendOnly); code != http.StatusForbidden {
+		t.Errorf("Expected a send-only key to be refused on flows, got %d", code)
+	}
+	if code := call("GET", "/apikeys", addKey("automation", "", nil)); code != http.StatusForbidden {
+		t.Errorf("Expected key management to need the user token, got %d", code)
+	}
+	if code := call("GET", "/flows", addKey("automation", "", nil)); code != http.StatusOK {
+		t.Errorf("Expected an automation key to list flows, got %d", code)
+	}
+	if code := call("GET", "/flows", addKey(apiKeyScopeAll, "", nil)); code != http.StatusOK {
+		t.Errorf("Expected a key with every scope to list flows, got %d", code)
+	}
+
+	expired := time.Now().Add(-time.Hour)
+	if code := call("GET", "/flows", addKey("automation", "", &expired)); code != http.StatusUnauthorized {
+		t.Errorf("Expected an expired key to be refused, got %d", code)
+	}
+	valid := time.Now().Add(time.Hour)
+	if code := call("GET", "/flows", addKey("automation", "", &valid)); code != http.StatusOK {
+		t.Errorf("Expected a key before its expiry to be accepted, got %d", code)
+	}
+
+	// httptest requests come from 192.0.2.1
+	if code := call("GET", "/flows", addKey("automation", "10.0.0.0/8,203.0.113.7", nil)); code != http.StatusUnauthorized {
+		t.Errorf("Expected an address outside the allowlist to be refused, got %d", code)
+	}
+	if code := call("GET", "/flows", addKey("automation", "10.0.0.0/8,192.0.2.0/24", nil)); code != http.StatusOK {
+		t.Errorf("Expected an address inside the allowlist to be accepted, got %d", code)
+	}
+	if code := call("GET", "/flows", "wzk_unknown"); code != http.StatusUnauthorized {
+		t.Errorf("Expected an unknown key to be refused, got %d", code)
+	}
+}
+
+func TestAPIKeyAllowsIP(t *testing.T) {
+	key := APIKey{AllowedIPs: "192.168.1.10,2001:db8::/32"}
+	for addr, allowed := range map[string]bool{
+		"192.168.1.10:5000":   true,
+		"192.168.1.11:5000":   false,
+		"[2001:db8::1]:443":   true,
+		"[2001:db9::1]:443":   false,
+		"not-an-address:8080": false,
+	} {
+		if got := key.AllowsIP(addr); got != allowed {
+			t.Errorf("%s: expected %v, got %v", addr, allowed, got)
+		}
+	}
+	if !(&APIKey{}).AllowsIP("198.51.100.1:1") {
+		t.Error("Expected an empty allowlist to accept any address")
+	}
+}
@@ -0,0 +1,580 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+const defaultAwayCooldownMinutes = 60
+
+var autoReplyMatchTypes = map[string]bool{
+	"exact":    true,
+	"contains": true,
+	"regex":    true,
+	"greeting": true,
+	"away":     true,
+}
+
+var weekdayKeys = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+type AutoReplyRule struct {
+	ID        string `json:"id" db:"id"`
+	UserID    string `json:"-" db:"user_id"`
+	Name      string `json:"name" db:"name"`
+	MatchType string `json:"match_type" db:"match_type"`
+	Pattern   string `json:"pattern" db:"pattern"`
+	ReplyText string `json:"reply_text" db:"reply_text"`
+	MediaURL  string `json:"media_url" db:"media_url"`
+	MediaType string `json:"media_type" db:"media_type"`
+	FileName  string `json:"file_name" db:"file_name"`
+	Enabled   bool   `json:"enabled" db:"enabled"`
+	Priority  int    `json:"priority" db:"priority"`
+}
+
+type BusinessHoursRange struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+type AutoReplySchedule struct {
+	Timezone            string                          `json:"timezone"`
+	BusinessHours       map[string][]BusinessHoursRange `json:"business_hours"`
+	Holidays            []string                        `json:"holidays"`
+	AwayCooldownMinutes int                             `json:"away_cooldown_minutes"`
+}
+
+func (rule *AutoReplyRule) Validate() error {
+	if !autoReplyMatchTypes[rule.MatchType] {
+		return fmt.Errorf("match_type must be one of exact, contains, regex, greeting or away")
+	}
+	switch rule.MatchType {
+	case "exact", "contains":
+		if strings.TrimSpace(rule.Pattern) == "" {
+			return errors.New("missing pattern")
+		}
+	case "regex":
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			return fmt.Errorf("invalid pattern: %v", err)
+		}
+	}
+	if rule.ReplyText == "" && rule.MediaURL == "" {
+		return errors.New("reply_text or media_url is required")
+	}
+	if rule.MediaURL != "" {
+		if !isHTTPURL(rule.MediaURL) {
+			return errors.New("media_url must be an http(s) url")
+		}
+		switch rule.MediaType {
+		case "image", "audio", "video", "document":
+		default:
+			return errors.New("media_type must be image, audio, video or document")
+		}
+	}
+	return nil
+}
+
+// Exact and contains accept a comma separated list of keywords
+func (rule *AutoReplyRule) matches(text string) bool {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return false
+	}
+	switch rule.MatchType {
+	case "exact":
+		for _, keyword := range strings.Split(rule.Pattern, ",") {
+			if matchesKeyword(text, keyword) {
+				return true
+			}
+		}
+	case "contains":
+		lower := strings.ToLower(text)
+		for _, keyword := range strings.Split(rule.Pattern, ",") {
+			keyword = strings.ToLower(strings.TrimSpace(keyword))
+			if keyword != "" && strings.Contains(lower, keyword) {
+				return true
+			}
+		}
+	case "regex":
+		re, err := compileFlowRegex(rule.Pattern)
+		return err == nil && re.MatchString(text)
+	}
+	return false
+}
+
+func (schedule *AutoReplySchedule) Validate() error {
+	if _, err := time.LoadLocation(schedule.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone: %v", err)
+	}
+	for day, ranges := range schedule.BusinessHours {
+		known := false
+		for _, key := range weekdayKeys {
+			known = known || key == day
+		}
+		if !known {
+			return fmt.Errorf("invalid weekday %q, use sun, mon, tue, wed, thu, fri or sat", day)
+		}
+		for _, r := range ranges {
+			start, err1 := parseClock(r.Start)
+			end, err2 := parseClock(r.End)
+			if err1 != nil || err2 != nil || start >= end {
+				return fmt.Errorf("invalid range %s-%s on %s", r.Start, r.End, day)
+			}
+		}
+	}
+	for _, holiday := range schedule.Holidays {
+		if _, err := time.Parse("2006-01-02", holiday); err != nil {
+			return fmt.Errorf("invalid holiday %q, use YYYY-MM-DD", holiday)
+		}
+	}
+	if schedule.AwayCooldownMinutes < 0 {
+		return errors.New("away_cooldown_minutes cannot be negative")
+	}
+	return nil
+}
+
+// Minutes since midnight for a HH:MM clock
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		if value == "24:00" {
+			return 24 * 60, nil
+		}
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Reports whether the given instant falls inside business hours. Without any configured
+// hours the business is considered always open.
+func (schedule *AutoReplySchedule) isOpen(now time.Time) bool {
+	if len(schedule.BusinessHours) == 0 && len(schedule.Holidays) == 0 {
+		return true
+	}
+	loc, err := time.LoadLocation(schedule.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	local := now.In(loc)
+
+	today := local.Format("2006-01-02")
+	for _, holiday := range schedule.Holidays {
+		if holiday == today {
+			return false
+		}
+	}
+	if len(schedule.BusinessHours) == 0 {
+		return true
+	}
+
+	minutes := local.Hour()*60 + local.Minute()
+	for _, r := range schedule.BusinessHours[weekdayKeys[local.Weekday()]] {
+		start, err1 := parseClock(r.Start)
+		end, err2 := parseClock(r.End)
+		if err1 == nil && err2 == nil && minutes >= start && minutes < end {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *server) loadAutoReplySchedule(userID string) (*AutoReplySchedule, error) {
+	var row struct {
+		Timezone      string `db:"timezone"`
+		BusinessHours string `db:"business_hours"`
+		Holidays      string `db:"holidays"`
+		Cooldown      int    `db:"away_cooldown_minutes"`
+	}
+	schedule := &AutoReplySchedule{Timezone: "UTC", AwayCooldownMinutes: defaultAwayCooldownMinutes}
+	err := s.db.Get(&row, "SELECT timezone, business_hours, holidays, away_cooldown_minutes FROM autoreply_settings WHERE user_id = $1", userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return schedule, nil
+	} else if err != nil {
+		return nil, err
+	}
+	schedule.Timezone = row.Timezone
+	schedule.AwayCooldownMinutes = row.Cooldown
+	json.Unmarshal([]byte(row.BusinessHours), &schedule.BusinessHours)
+	json.Unmarshal([]byte(row.Holidays), &schedule.Holidays)
+	return schedule, nil
+}
+
+// Remembers the contact and tells whether this is the first time it writes. Contacts are
+// tracked in autoreply_contacts so this works without message history, the history still
+// counts when it is enabled so chats from before the tracking aren't taken for new ones
+func (s *server) trackAutoReplyContact(userID string, chatJID string, messageID string) bool {
+	result, err := s.db.Exec("INSERT INTO autoreply_contacts (user_id, chat_jid) VALUES ($1, $2) ON CONFLICT (user_id, chat_jid) DO NOTHING", userID, chatJID)
+	if err != nil {
+		log.Error().Err(err).Str("userID", userID).Str("chat", chatJID).Msg("Failed to record auto-reply contact")
+		return false
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		return false
+	}
+	var count int
+	err = s.db.Get(&count, "SELECT COUNT(*) FROM message_history WHERE user_id = $1 AND chat_jid = $2 AND message_id != $3", userID, chatJID, messageID)
+	return err == nil && count == 0
+}
+
+func (s *server) markAutoReplyContact(userID string, chatJID string, column string) {
+	query := fmt.Sprintf(`
+		INSERT INTO autoreply_contacts (user_id, chat_jid, %[1]s)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, chat_jid) DO UPDATE SET %[1]s = excluded.%[1]s`, column)
+	if _, err := s.db.Exec(query, userID, chatJID, time.Now()); err != nil {
+		log.Error().Err(err).Str("userID", userID).Str("chat", chatJID).Msg("Failed to record auto-reply contact")
+	}
+}
+
+func (s *server) awayRecentlySent(userID string, chatJID string, cooldown time.Duration) bool {
+	var sentAt sql.NullTime
+	err := s.db.Get(&sentAt, "SELECT away_sent_at FROM autoreply_contacts WHERE user_id = $1 AND chat_jid = $2", userID, chatJID)
+	return err == nil && sentAt.Valid && time.Since(sentAt.Time) < cooldown
+}
+
+// Runs the embedded automations for an incoming message. Flows take precedence over
+// auto-replies, and the AI responder only answers what neither of them handled.
+func (mycli *MyClient) runAutomations(evt *events.Message) {
+	if mycli.handleFlowMessage(evt) {
+		return
+	}
+	if mycli.handleAutoReply(evt) {
+		return
+	}
+	mycli.handleAIMessage(evt)
+}
+
+// Returns true when the message was answered, or deliberately left unanswered, by an auto-reply
+func (mycli *MyClient) handleAutoReply(evt *events.Message) bool {
+	if evt.Info.IsFromMe || evt.Info.IsGroup || evt.Info.Chat.Server != types.DefaultUserServer {
+		return false
+	}
+	replies, handled := mycli.s.chooseAutoReplies(mycli.userID, evt.Info.Chat.String(), evt.Info.ID, incomingMessageText(evt.Message), time.Now())
+	for _, rule := range replies {
+		mycli.sendAutoReply(rule, evt)
+	}
+	return handled
+}
+
+// Picks the rules answering an incoming message. A first contact gets the greeting, followed by
+// the keyword reply when one matches, and nothing else. Otherwise a keyword reply wins over the
+// away message, which is only sent outside business hours and once per cooldown. handled is true
+// when the AI responder must stay quiet.
+func (s *server) chooseAutoReplies(userID string, chat string, messageID string, text string, now time.Time) (replies []*AutoReplyRule, handled bool) {
+	firstContact := s.trackAutoReplyContact(userID, chat, messageID)
+
+	var rules []AutoReplyRule
+	err := s.db.Select(&rules, "SELECT id, user_id, name, match_type, pattern, reply_text, media_url, media_type, file_name, enabled, priority FROM autoreply_rules WHERE user_id = $1 AND enabled = $2 ORDER BY priority DESC, created_at ASC", userID, true)
+	if err != nil {
+		log.Error().Err(err).Str("userID", userID).Msg("Failed to load auto-reply rules")
+		return nil, false
+	}
+
+	var greeting, away, matched *AutoReplyRule
+	for i := range rules {
+		rule := &rules[i]
+		switch rule.MatchType {
+		case "greeting":
+			if greeting == nil {
+				greeting = rule
+			}
+		case "away":
+			if away == nil {
+				away = rule
+			}
+		default:
+			if matched == nil && rule.matches(text) {
+				matched = rule
+			}
+		}
+	}
+
+	if greeting != nil && firstContact {
+		s.markAutoReplyContact(userID, chat, "greeted_at")
+		replies = append(replies, greeting)
+		if matched != nil {
+			replies = append(replies, matched)
+		}
+		return replies, true
+	}
+
+	if matched != nil {
+		return []*AutoReplyRule{matched}, true
+	}
+
+	if away != nil {
+		schedule, err := s.loadAutoReplySchedule(userID)
+		if err != nil {
+			log.Error().Err(err).Str("userID", userID).Msg("Failed to load auto-reply schedule")
+			return nil, false
+		}
+		if schedule.isOpen(now) {
+			return nil, false
+		}
+		// Still closed: keep quiet during the cooldown instead of letting the AI answer
+		cooldown := time.Duration(schedule.AwayCooldownMinutes) * time.Minute
+		if s.awayRecentlySent(userID, chat, cooldown) {
+			return nil, true
+		}
+		s.markAutoReplyContact(userID, chat, "away_sent_at")
+		return []*AutoReplyRule{away}, true
+	}
+	return nil, false
+}
+
+func (mycli *MyClient) sendAutoReply(rule *AutoReplyRule, evt *events.Message) {
+	vars := map[string]string{
+		"name":    evt.Info.PushName,
+		"phone":   evt.Info.Sender.User,
+		"message": incomingMessageText(evt.Message),
+	}
+	text := interpolateFlowVars(rule.ReplyText, vars)
+
+	var msg *waE2E.Message
+	var mediaBytes int64
+	messageType := "text"
+	if rule.MediaURL != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		data, _, err := fetchURLBytes(ctx, rule.MediaURL, flowMediaMaxBytes)
+		if err != nil {
+			log.Error().Err(err).Str("userID", mycli.userID).Str("rule", rule.ID).Msg("Failed to fetch auto-reply media")
+			return
+		}
+		if err := mycli.s.consumeUsage(mycli.userID, 0, int64(len(data))); err != nil {
+			log.Warn().Err(err).Str("userID", mycli.userID).Str("rule", rule.ID).Msg("Skipping auto-reply media")
+			return
+		}
+		mediaBytes = int64(len(data))
+		msg, err = uploadMediaMessage(ctx, mycli.WAClient, data, rule.MediaType, text, rule.FileName)
+		if err != nil {
+			mycli.s.refundUsage(mycli.userID, 0, mediaBytes)
+			log.Error().Err(err).Str("userID", mycli.userID).Str("rule", rule.ID).Msg("Failed to upload auto-reply media")
+			return
+		}
+		messageType = rule.MediaType
+	} else {
+		msg = &waE2E.Message{Conversation: proto.String(text)}
+	}
+
+	if _, err := mycli.sendAutomatedMessage(evt.Info.Chat, msg, messageType, text); err != nil {
+		if mediaBytes > 0 {
+			mycli.s.refundUsage(mycli.userID, 0, mediaBytes)
+		}
+		log.Error().Err(err).Str("userID", mycli.userID).Str("rule", rule.ID).Msg("Failed to send auto-reply")
+	}
+}
+
+// Create or update an auto-reply rule
+func (s *server) SaveAutoReplyRule() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		rule := AutoReplyRule{Enabled: true}
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode payload"))
+			return
+		}
+		if err := rule.Validate(); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if rule.ID == "" {
+			id, err := GenerateRandomID()
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			rule.ID = id
+		}
+
+		result, err := s.db.Exec(`
+			INSERT INTO autoreply_rules (id, user_id, name, match_type, pattern, reply_text, media_url, media_type, file_name, enabled, priority)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+			ON CONFLICT (id) DO UPDATE SET
+				name = excluded.name,
+				match_type = excluded.match_type,
+				pattern = excluded.pattern,
+				reply_text = excluded.reply_text,
+				media_url = excluded.media_url,
+				media_type = excluded.media_type,
+				file_name = excluded.file_name,
+				enabled = excluded.enabled,
+				priority = excluded.priority,
+				updated_at = CURRENT_TIMESTAMP
+			WHERE autoreply_rules.user_id = excluded.user_id`,
+			rule.ID, txtid, rule.Name, rule.MatchType, rule.Pattern, rule.ReplyText, rule.MediaURL, rule.MediaType, rule.FileName, rule.Enabled, rule.Priority)
+		if err != nil {
+			log.Error().Err(err).Str("userID", txtid).Msg("Failed to save auto-reply rule")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to save rule"))
+			return
+		}
+		// The upsert skips ids owned by another user
+		if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+			s.Respond(w, r, http.StatusNotFound, errors.New("rule not found"))
+			return
+		}
+
+		response := map[string]interface{}{"Details": "Rule saved", "Id": rule.ID}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// List auto-reply rules
+func (s *server) ListAutoReplyRules() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		rules := []AutoReplyRule{}
+		err := s.db.Select(&rules, "SELECT id, user_id, name, match_type, pattern, reply_text, media_url, media_type, file_name, enabled, priority FROM autoreply_rules WHERE user_id = $1 ORDER BY priority DESC, created_at ASC", txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to list rules"))
+			return
+		}
+
+		responseJson, err := json.Marshal(rules)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Get an auto-reply rule
+func (s *server) GetAutoReplyRule() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		var rule AutoReplyRule
+		err := s.db.Get(&rule, "SELECT id, user_id, name, match_type, pattern, reply_text, media_url, media_type, file_name, enabled, priority FROM autoreply_rules WHERE user_id = $1 AND id = $2", txtid, mux.Vars(r)["id"])
+		if errors.Is(err, sql.ErrNoRows) {
+			s.Respond(w, r, http.StatusNotFound, errors.New("rule not found"))
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to load rule"))
+			return
+		}
+
+		responseJson, err := json.Marshal(rule)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Delete an auto-reply rule
+func (s *server) DeleteAutoReplyRule() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		ruleID := mux.Vars(r)["id"]
+
+		result, err := s.db.Exec("DELETE FROM autoreply_rules WHERE user_id = $1 AND id = $2", txtid, ruleID)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to delete rule"))
+			return
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			s.Respond(w, r, http.StatusNotFound, errors.New("rule not found"))
+			return
+		}
+
+		response := map[string]interface{}{"Details": "Rule deleted", "Id": ruleID}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Set business hours, timezone and holidays used by away rules
+func (s *server) SetAutoReplySchedule() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		schedule := AutoReplySchedule{Timezone: "UTC", AwayCooldownMinutes: defaultAwayCooldownMinutes}
+		if err := json.NewDecoder(r.Body).Decode(&schedule); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode payload"))
+			return
+		}
+		if err := schedule.Validate(); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		hours, _ := json.Marshal(schedule.BusinessHours)
+		holidays, _ := json.Marshal(schedule.Holidays)
+		_, err := s.db.Exec(`
+			INSERT INTO autoreply_settings (user_id, timezone, business_hours, holidays, away_cooldown_minutes, updated_at)
+			VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP)
+			ON CONFLICT (user_id) DO UPDATE SET
+				timezone = excluded.timezone,
+				business_hours = excluded.business_hours,
+				holidays = excluded.holidays,
+				away_cooldown_minutes = excluded.away_cooldown_minutes,
+				updated_at = excluded.updated_at`,
+			txtid, schedule.Timezone, string(hours), string(holidays), schedule.AwayCooldownMinutes)
+		if err != nil {
+			log.Error().Err(err).Str("userID", txtid).Msg("Failed to save auto-reply schedule")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to save schedule"))
+			return
+		}
+
+		response := map[string]interface{}{"Details": "Schedule saved", "OpenNow": schedule.isOpen(time.Now())}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Get business hours configuration
+func (s *server) GetAutoReplySchedule() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		schedule, err := s.loadAutoReplySchedule(txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to load schedule"))
+			return
+		}
+
+		response := map[string]interface{}{
+			"timezone":              schedule.Timezone,
+			"business_hours":        schedule.BusinessHours,
+			"holidays":              schedule.Holidays,
+			"away_cooldown_minutes": schedule.AwayCooldownMinutes,
+			"open_now":              schedule.isOpen(time.Now()),
+		}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAutoReplyScheduleIsOpen(t *testing.T) {
+	schedule := AutoReplySchedule{
+		Timezone: "America/Sao_Paulo",
+		BusinessHours: map[string][]BusinessHoursRange{
+			"mon": {{Start: "09:00", End: "12:00"}, {Start: "13:00", End: "18:00"}},
+			"sat": {{Start: "09:00", End: "13:00"}},
+		},
+		Holidays: []string{"2026-12-25"},
+	}
+	if err := schedule.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	loc, _ := time.LoadLocation("America/Sao_Paulo")
+	tests := []struct {
+		name string
+		at   time.Time
+		open bool
+	}{
+		{"monday morning", time.Date(2026, 10, 19, 10, 0, 0, 0, loc), true},
+		{"monday lunch", time.Date(2026, 10, 19, 12, 30, 0, 0, loc), false},
+		{"monday closing time", time.Date(2026, 10, 19, 18, 0, 0, 0, loc), false},
+		{"sunday", time.Date(2026, 10, 18, 10, 0, 0, 0, loc), false},
+		{"utc instant inside local hours", time.Date(2026, 10, 24, 14, 0, 0, 0, time.UTC), true},
+		{"holiday", time.Date(2026, 12, 25, 10, 0, 0, 0, loc), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := schedule.isOpen(tt.at); got != tt.open {
+				t.Errorf("Expected open=%v, got %v", tt.open, got)
+			}
+		})
+	}
+
+	if !(&AutoReplySchedule{Timezone: "UTC"}).isOpen(time.Now()) {
+		t.Error("Schedule without hours should always be open")
+	}
+}
+
+func TestAutoReplyRuleMatches(t *testing.T) {
+	tests := []struct {
+		rule  AutoReplyRule
+		text  string
+		match bool
+	}{
+		{AutoReplyRule{MatchType: "exact", Pattern: "price, prices"}, " Prices ", true},
+		{AutoReplyRule{MatchType: "exact", Pattern: "price"}, "what is the price", false},
+		{AutoReplyRule{MatchType: "contains", Pattern: "price"}, "What is the PRICE?", true},
+		{AutoReplyRule{MatchType: "regex", Pattern: `(?i)^order\s+\d+$`}, "Order 123", true},
+		{AutoReplyRule{MatchType: "regex", Pattern: `^\d+$`}, "abc", false},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.matches(tt.text); got != tt.match {
+			t.Errorf("%s %q against %q: expected %v, got %v", tt.rule.MatchType, tt.rule.Pattern, tt.text, tt.match, got)
+		}
+	}
+}
+
+func TestChooseAutoReplies(t *testing.T) {
+	s := makeTestServer(t)
+	for _, rule := range []AutoReplyRule{
+		{ID: "greet", MatchType: "greeting", ReplyText: "Welcome"},
+		{ID: "price", MatchType: "contains", Pattern: "price", ReplyText: "Our prices"},
+		{ID: "away", MatchType: "away", ReplyText: "We are closed"},
+	} {
+		_, err := s.db.Exec("INSERT INTO autoreply_rules (id, user_id, name, match_type, pattern, reply_text, media_url, media_type, file_name, enabled, priority) VALUES ($1, $2, '', $3, $4, $5, '', '', '', $6, 0)",
+			rule.ID, "user1", rule.MatchType, rule.Pattern, rule.ReplyText, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := s.db.Exec("INSERT INTO autoreply_settings (user_id, timezone, business_hours, holidays, away_cooldown_minutes) VALUES ($1, $2, $3, $4, $5)",
+		"user1", "UTC", `{"mon": [{"start": "09:00", "end": "18:00"}]}`, "[]", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.db.Exec("INSERT INTO message_history (user_id, chat_jid, sender_jid, message_id, timestamp, message_type, text_content) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		"user1", "known@s.whatsapp.net", "me", "old", time.Now(), "text", "hi"); err != nil {
+		t.Fatal(err)
+	}
+
+	sunday := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	monday := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		chat    string
+		text    string
+		now     time.Time
+		replies string
+		handled bool
+	}{
+		{"first contact only gets the greeting", "a@s.whatsapp.net", "hello", sunday, "greet", true},
+		{"returning contact gets the away message", "a@s.whatsapp.net", "hello", sunday, "away", true},
+		{"away message cooldown", "a@s.whatsapp.net", "hello", sunday, "", true},
+		{"keyword wins over away", "a@s.whatsapp.net", "price?", sunday, "price", true},
+		{"first contact with keyword", "b@s.whatsapp.net", "what is the price", sunday, "greet,price", true},
+		{"open hours leave it to the AI", "b@s.whatsapp.net", "hello", monday, "", false},
+		{"chat in history is not new", "known@s.whatsapp.net", "hello", monday, "", false},
+	}
+	for i, tt := range tests {
+		replies, handled := s.chooseAutoReplies("user1", tt.chat, fmt.Sprintf("msg%d", i), tt.text, tt.now)
+		var ids []string
+		for _, rule := range replies {
+			ids = append(ids, rule.ID)
+		}
+		if got := strings.Join(ids, ","); got != tt.replies || handled != tt.handled {
+			t.Errorf("%s: expected %q handled=%v, got %q handled=%v", tt.name, tt.replies, tt.handled, got, handled)
+		}
+	}
+}
+
+func TestSaveAutoReplyRuleOwnership(t *testing.T) {
+	s := makeTestServer(t)
+	save := func(userID string) int {
+		body := `{"id": "rule1", "match_type": "contains", "pattern": "price", "reply_text": "Our prices"}`
+		r := httptest.NewRequest(http.MethodPost, "/autoreply", strings.NewReader(body))
+		r = r.WithContext(context.WithValue(r.Context(), "userinfo", Values{map[string]string{"Id": userID}}))
+		w := httptest.NewRecorder()
+		s.SaveAutoReplyRule().ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := save("user1"); code != http.StatusOK {
+		t.Fatalf("Expected the rule to be created, got %d", code)
+	}
+	if code := save("user2"); code != http.StatusNotFound {
+		t.Errorf("Expected another user's rule id to be refused, got %d", code)
+	}
+}
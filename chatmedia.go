@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/proto/waMmsRetry"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+// How long to wait for the phone to re-upload media after a retry receipt
+const mediaRetryTimeout = 30 * time.Second
+
+// Decrypted media is downloaded to a temporary file and kept briefly, so Range requests don't
+// download it again
+const (
+	chatMediaCacheTTL        = 2 * time.Minute
+	chatMediaCacheMaxBytes   = 64 * 1024 * 1024  // 64MB, larger media isn't kept
+	chatMediaCacheTotalBytes = 512 * 1024 * 1024 // 512MB for all the media kept
+)
+
+// Pending media retry requests, keyed by user and message id
+var mediaRetryWaiters sync.Map
+
+var (
+	chatMediaCache = newChatMediaCache()
+	// One download at a time per media, the requests waiting for it find it in the cache
+	chatMediaLocks = NewKeyedMutex()
+
+	// Guards the reference counts of the media and chatMediaCachedBytes
+	chatMediaMu          sync.Mutex
+	chatMediaCachedBytes int64
+)
+
+func newChatMediaCache() *cache.Cache {
+	c := cache.New(chatMediaCacheTTL, time.Minute)
+	c.OnEvicted(func(_ string, value interface{}) {
+		content := value.(*chatMediaContent)
+		chatMediaMu.Lock()
+		chatMediaCachedBytes -= content.size
+		chatMediaMu.Unlock()
+		content.release()
+	})
+	return c
+}
+
+var (
+	errStoredMediaNotFound = errors.New("message not found or has no media")
+	errChatMediaDownload   = errors.New("failed to download media")
+)
+
+// The parts of a stored events.Message needed to download its media. Only the media
+// fields are decoded, so unrelated message types in datajson can't break the lookup.
+type storedMediaEvent struct {
+	Info    types.MessageInfo
+	Message struct {
+		ImageMessage    *waE2E.ImageMessage
+		VideoMessage    *waE2E.VideoMessage
+		PtvMessage      *waE2E.VideoMessage
+		AudioMessage    *waE2E.AudioMessage
+		DocumentMessage *waE2E.DocumentMessage
+		StickerMessage  *waE2E.StickerMessage
+	}
+}
+
+// A downloadable media message together with what is needed to serve it
+type storedMedia struct {
+	Info     types.MessageInfo
+	Media    whatsmeow.DownloadableMessage
+	MimeType string
+	FileName string
+
+	userID   string
+	rowID    int64
+	dataJSON string
+	field    string // Key of the media in the stored message
+}
+
+// Decrypted media of a message in a temporary file. The file is removed once the cache and
+// the requests serving it have released it
+type chatMediaContent struct {
+	stored *storedMedia
+	file   *os.File
+	size   int64
+	refs   int
+}
+
+// Takes a reference, fails when the file was already removed
+func (c *chatMediaContent) acquire() bool {
+	chatMediaMu.Lock()
+	defer chatMediaMu.Unlock()
+	if c.refs == 0 {
+		return false
+	}
+	c.refs++
+	return true
+}
+
+func (c *chatMediaContent) release() {
+	chatMediaMu.Lock()
+	c.refs--
+	last := c.refs == 0
+	chatMediaMu.Unlock()
+	if last {
+		c.file.Close()
+		os.Remove(c.file.Name())
+	}
+}
+
+// Keeps the media for later requests when it fits the cache limits
+func cacheChatMedia(key string, content *chatMediaContent) {
+	// An expired entry the janitor hasn't dropped yet would be replaced without being released
+	chatMediaCache.Delete(key)
+
+	chatMediaMu.Lock()
+	defer chatMediaMu.Unlock()
+	if content.size > chatMediaCacheMaxBytes || chatMediaCachedBytes+content.size > chatMediaCacheTotalBytes {
+		return
+	}
+	content.refs++
+	chatMediaCachedBytes += content.size
+	chatMediaCache.Set(key, content, cache.DefaultExpiration)
+}
+
+// Looks up a message in the history and returns its media
+func (s *server) getStoredMedia(userID, messageID string) (*storedMedia, error) {
+	var row struct {
+		ID       int64  `db:"id"`
+		DataJson string `db:"datajson"`
+	}
+	err := s.db.Get(&row, s.db.Rebind(`
+		SELECT id, datajson FROM message_history
+		WHERE user_id = ? AND message_id = ? AND datajson IS NOT NULL AND datajson != ''
+		ORDER BY id DESC LIMIT 1`), userID, messageID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errStoredMediaNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var evt storedMediaEvent
+	if err := json.Unmarshal([]byte(row.DataJson), &evt); err != nil {
+		return nil, fmt.Errorf("could not decode stored message: %w", err)
+	}
+
+	stored := &storedMedia{Info: evt.Info, userID: userID, rowID: row.ID, dataJSON: row.DataJson}
+	msg := evt.Message
+	switch {
+	case msg.ImageMessage != nil:
+		stored.Media, stored.MimeType, stored.field = msg.ImageMessage, msg.ImageMessage.GetMimetype(), "imageMessage"
+	case msg.VideoMessage != nil:
+		stored.Media, stored.MimeType, stored.field = msg.VideoMessage, msg.VideoMessage.GetMimetype(), "videoMessage"
+	case msg.PtvMessage != nil:
+		stored.Media, stored.MimeType, stored.field = msg.PtvMessage, msg.PtvMessage.GetMimetype(), "ptvMessage"
+	case msg.AudioMessage != nil:
+		stored.Media, stored.MimeType, stored.field = msg.AudioMessage, msg.AudioMessage.GetMimetype(), "audioMessage"
+	case msg.DocumentMessage != nil:
+		stored.Media, stored.MimeType, stored.field = msg.DocumentMessage, msg.DocumentMessage.GetMimetype(), "documentMessage"
+		stored.FileName = msg.DocumentMessage.GetFileName()
+	case msg.StickerMessage != nil:
+		stored.Media, stored.MimeType, stored.field = msg.StickerMessage, msg.StickerMessage.GetMimetype(), "stickerMessage"
+	default:
+		return nil, errStoredMediaNotFound
+	}
+
+	if stored.MimeType == "" {
+		stored.MimeType = "application/octet-stream"
+	}
+	if stored.FileName == "" {
+		stored.FileName = messageID
+		if exts, _ := mime.ExtensionsByType(strings.Split(stored.MimeType, ";")[0]); len(exts) > 0 {
+			stored.FileName += exts[0]
+		}
+	}
+	return stored, nil
+}
+
+// The CDN answers 403/404/410 once the media link has expired
+func isExpiredMediaError(err error) bool {
+	return errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith403) ||
+		errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith404) ||
+		errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith410)
+}
+
+// Downloads stored media into file, asking the sender's phone to upload it again when the link
+// expired. The new path is saved in the history so later downloads don't need another retry.
+func (s *server) downloadStoredMedia(ctx context.Context, client *whatsmeow.Client, stored *storedMedia, file *os.File) error {
+	err := client.DownloadToFile(ctx, stored.Media, file)
+	if err == nil || !isExpiredMediaError(err) {
+		return err
+	}
+
+	log.Info().Str("messageID", stored.Info.ID).Msg("Media link expired, sending media retry receipt")
+	directPath, err := requestMediaRetry(ctx, client, stored)
+	if err != nil {
+		return err
+	}
+	setMediaDirectPath(stored.Media, directPath)
+	if err := s.saveStoredMediaDirectPath(stored, directPath); err != nil {
+		log.Warn().Err(err).Str("messageID", stored.Info.ID).Msg("Failed to save the re-uploaded media path")
+	}
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return client.DownloadToFile(ctx, stored.Media, file)
+}
+
+// Downloads the media to a temporary file, the caller holds the only reference to it
+func (s *server) downloadChatMedia(ctx context.Context, client *whatsmeow.Client, stored *storedMedia) (*chatMediaContent, error) {
+	file, err := os.CreateTemp("", "wuzapi-media-*")
+	if err != nil {
+		return nil, err
+	}
+	content := &chatMediaContent{stored: stored, file: file, refs: 1}
+	if err := s.downloadStoredMedia(ctx, client, stored, file); err != nil {
+		content.release()
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		content.release()
+		return nil, err
+	}
+	content.size = info.Size()
+	return content, nil
+}
+
+// Returns the media of a message from the cache or downloads it. The caller releases it
+func (s *server) openChatMedia(ctx context.Context, userID, messageID string) (*chatMediaContent, error) {
+	cacheKey := userID + "|" + messageID
+	unlock := chatMediaLocks.Lock(cacheKey)
+	defer unlock()
+
+	if cached, found := chatMediaCache.Get(cacheKey); found && cached.(*chatMediaContent).acquire() {
+		return cached.(*chatMediaContent), nil
+	}
+	stored, err := s.getStoredMedia(userID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	client := clientManager.GetWhatsmeowClient(userID)
+	if client == nil {
+		return nil, errors.New("no session")
+	}
+	content, err := s.downloadChatMedia(ctx, client, stored)
+	if err != nil {
+		log.Error().Err(err).Str("messageID", messageID).Msg("failed to download media")
+		return nil, fmt.Errorf("%w: %w", errChatMediaDownload, err)
+	}
+	cacheChatMedia(cacheKey, content)
+	return content, nil
+}
+
+// Rewrites the media of the stored message to point to the re-uploaded file. The JSON is
+// edited in place so fields wuzapi doesn't decode are kept.
+func (s *server) saveStoredMediaDirectPath(stored *storedMedia, directPath string) error {
+	var evt map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(stored.dataJSON))
+	decoder.UseNumber()
+	if err := decoder.Decode(&evt); err != nil {
+		return err
+	}
+	msg, _ := evt["Message"].(map[string]interface{})
+	media, _ := msg[stored.field].(map[string]interface{})
+	if media == nil {
+		return fmt.Errorf("stored message has no %s", stored.field)
+	}
+	delete(media, "URL")
+	media["directPath"] = directPath
+
+	dataJSON, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	if _, err := s.db.Exec("UPDATE message_history SET datajson = $1 WHERE id = $2", string(dataJSON), stored.rowID); err != nil {
+		return err
+	}
+	stored.dataJSON = string(dataJSON)
+	return nil
+}
+
+func requestMediaRetry(ctx context.Context, client *whatsmeow.Client, stored *storedMedia) (string, error) {
+	mediaKey := stored.Media.GetMediaKey()
+	waiter := make(chan *events.MediaRetry, 1)
+	key := stored.userID + "|" + stored.Info.ID
+	mediaRetryWaiters.Store(key, waiter)
+	defer mediaRetryWaiters.Delete(key)
+
+	if err := client.SendMediaRetryReceipt(ctx, &stored.Info, mediaKey); err != nil {
+		return "", fmt.Errorf("failed to send media retry receipt: %w", err)
+	}
+
+	select {
+	case evt := <-waiter:
+		notif, err := whatsmeow.DecryptMediaRetryNotification(evt, mediaKey)
+		if err != nil {
+			return "", err
+		}
+		if notif.GetResult() != waMmsRetry.MediaRetryNotification_SUCCESS || notif.GetDirectPath() == "" {
+			return "", fmt.Errorf("media is no longer available (%s)", notif.GetResult())
+		}
+		return notif.GetDirectPath(), nil
+	case <-time.After(mediaRetryTimeout):
+		return "", errors.New("timed out waiting for the phone to re-upload the media")
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// Called from the event handler, hands the retry notification to the waiting download
+func deliverMediaRetry(userID string, evt *events.MediaRetry) bool {
+	waiter, ok := mediaRetryWaiters.Load(userID + "|" + evt.MessageID)
+	if !ok {
+		return false
+	}
+	select {
+	case waiter.(chan *events.MediaRetry) <- evt:
+	default:
+	}
+	return true
+}
+
+// Points the message to the re-uploaded file, the old URL is no longer valid
+func setMediaDirectPath(media whatsmeow.DownloadableMessage, directPath string) {
+	switch m := media.(type) {
+	case *waE2E.ImageMessage:
+		m.URL, m.DirectPath = nil, proto.String(directPath)
+	case *waE2E.VideoMessage:
+		m.URL, m.DirectPath = nil, proto.String(directPath)
+	case *waE2E.AudioMessage:
+		m.URL, m.DirectPath = nil, proto.String(directPath)
+	case *waE2E.DocumentMessage:
+		m.URL, m.DirectPath = nil, proto.String(directPath)
+	case *waE2E.StickerMessage:
+		m.URL, m.DirectPath = nil, proto.String(directPath)
+	}
+}
+
+// Downloads the media of a message from the history and streams it back, with Range support
+func (s *server) GetChatMedia() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		messageID := mux.Vars(r)["messageId"]
+
+		content, err := s.openChatMedia(context.WithoutCancel(r.Context()), txtid, messageID)
+		if errors.Is(err, errStoredMediaNotFound) {
+			s.Respond(w, r, http.StatusNotFound, err)
+			return
+		} else if errors.Is(err, errChatMediaDownload) {
+			s.Respond(w, r, http.StatusBadGateway, err)
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		defer content.release()
+		stored := content.stored
+
+		disposition := "inline"
+		if r.URL.Query().Get("download") == "true" {
+			disposition = "attachment"
+		}
+		w.Header().Set("Content-Type", stored.MimeType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": stored.FileName}))
+		w.Header().Set("Cache-Control", "private, max-age=3600")
+		http.ServeContent(w, r, stored.FileName, stored.Info.Timestamp, io.NewSectionReader(content.file, 0, content.size))
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestStoredMediaDirectPath(t *testing.T) {
+	s := makeTestServer(t)
+	evt := events.Message{
+		Info: types.MessageInfo{ID: "m1", Timestamp: time.Unix(1700000000, 0)},
+		Message: &waE2E.Message{DocumentMessage: &waE2E.DocumentMessage{
+			URL:               proto.String("https://mmg.whatsapp.net/old"),
+			DirectPath:        proto.String("/v/old"),
+			Mimetype:          proto.String("application/pdf"),
+			FileName:          proto.String("invoice.pdf"),
+			Caption:           proto.String("your invoice"),
+			MediaKeyTimestamp: proto.Int64(1700000000123),
+		}},
+	}
+	dataJSON, _ := json.Marshal(evt)
+	if _, err := s.db.Exec("INSERT INTO message_history (user_id, chat_jid, sender_jid, message_id, timestamp, message_type, text_content, datajson) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		"user1", "chat@s.whatsapp.net", "chat@s.whatsapp.net", "m1", time.Now(), "document", "", string(dataJSON)); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := s.getStoredMedia("user1", "m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.FileName != "invoice.pdf" || stored.MimeType != "application/pdf" {
+		t.Errorf("Unexpected media %+v", stored)
+	}
+	if _, err := s.getStoredMedia("user2", "m1"); err != errStoredMediaNotFound {
+		t.Errorf("Expected another user's message to be hidden, got %v", err)
+	}
+
+	if err := s.saveStoredMediaDirectPath(stored, "/v/new"); err != nil {
+		t.Fatal(err)
+	}
+	stored, err = s.getStoredMedia("user1", "m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := stored.Media.(*waE2E.DocumentMessage)
+	if doc.GetDirectPath() != "/v/new" || doc.URL != nil {
+		t.Errorf("Expected the new direct path without the old URL, got %q %q", doc.GetDirectPath(), doc.GetURL())
+	}
+	if doc.GetCaption() != "your invoice" || doc.GetMediaKeyTimestamp() != 1700000000123 {
+		t.Errorf("Expected the other fields to be kept, got %+v", doc)
+	}
+}
+
+// Media in a temporary file, with the reference of the request that downloaded it
+func testChatMedia(t *testing.T, stored *storedMedia, data string) *chatMediaContent {
+	file, err := os.CreateTemp(t.TempDir(), "media-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+	return &chatMediaContent{stored: stored, file: file, size: int64(len(data)), refs: 1}
+}
+
+func TestChatMediaCacheLimits(t *testing.T) {
+	stored := &storedMedia{Info: types.MessageInfo{ID: "m3"}}
+	before := chatMediaCachedBytes
+
+	// Cached media outlives the request until it is evicted, and only then is removed
+	content := testChatMedia(t, stored, "abc")
+	cacheChatMedia("user1|m3", content)
+	content.release()
+	if chatMediaCachedBytes != before+3 {
+		t.Errorf("Expected 3 more cached bytes, got %d", chatMediaCachedBytes-before)
+	}
+	cached, found := chatMediaCache.Get("user1|m3")
+	if !found || !cached.(*chatMediaContent).acquire() {
+		t.Fatal("Expected the media to stay cached")
+	}
+	chatMediaCache.Delete("user1|m3")
+	if _, err := os.Stat(content.file.Name()); err != nil {
+		t.Error("Expected the file to be kept while a request serves it")
+	}
+	content.release()
+	if _, err := os.Stat(content.file.Name()); !os.IsNotExist(err) {
+		t.Error("Expected the file to be removed once released")
+	}
+	if content.acquire() || chatMediaCachedBytes != before {
+		t.Errorf("Expected released media to be gone, %d cached bytes left", chatMediaCachedBytes-before)
+	}
+
+	// Media that would go over the total isn't kept
+	chatMediaCachedBytes = chatMediaCacheTotalBytes - 2
+	defer func() { chatMediaCachedBytes = before }()
+	content = testChatMedia(t, stored, "abc")
+	cacheChatMedia("user1|m3", content)
+	if _, found := chatMediaCache.Get("user1|m3"); found {
+		t.Error("Expected the media not to be cached over the total limit")
+	}
+	content.release()
+	if _, err := os.Stat(content.file.Name()); !os.IsNotExist(err) {
+		t.Error("Expected uncached media to be removed after the request")
+	}
+}
+
+func TestGetChatMediaCached(t *testing.T) {
+	s := makeTestServer(t)
+	content := testChatMedia(t, &storedMedia{Info: types.MessageInfo{ID: "m2"}, MimeType: "audio/ogg", FileName: "m2.ogg"}, "0123456789")
+	cacheChatMedia("user1|m2", content)
+	content.release()
+	defer chatMediaCache.Delete("user1|m2")
+
+	get := func(messageID string, rangeHeader string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/chat/media/"+messageID, nil)
+		r = mux.SetURLVars(r, map[string]string{"messageId": messageID})
+		r = r.WithContext(context.WithValue(r.Context(), "userinfo", Values{map[string]string{"Id": "user1"}}))
+		if rangeHeader != "" {
+			r.Header.Set("Range", rangeHeader)
+		}
+		w := httptest.NewRecorder()
+		s.GetChatMedia().ServeHTTP(w, r)
+		return w
+	}
+
+	// No session is connected, the cached copy is served
+	w := get("m2", "bytes=2-4")
+	if w.Code != http.StatusPartialContent || w.Body.String() != "234" {
+		t.Errorf("Expected bytes 2-4 from the cache, got %d %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Type") != "audio/ogg" {
+		t.Errorf("Unexpected content type %q", w.Header().Get("Content-Type"))
+	}
+
+	if w := get("missing", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a message not in the history, got %d", w.Code)
+	}
+}
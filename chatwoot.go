@@ -13,11 +13,9 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
-	"go.mau.fi/whatsmeow"
-	"go.mau.fi/whatsmeow/proto/waE2E"
-	"go.mau.fi/whatsmeow/types"
-	"google.golang.org/protobuf/proto"
+	"github.com/patrickmn/go-cache"
 )
 
 // --- CONFIGURAÇÃO ---
@@ -43,6 +41,9 @@ type ChatwootConfig struct {
 var (
 	cwCfg      ChatwootConfig
 	cwCfgMutex sync.RWMutex
+
+	// ID da conversa do Chatwoot por telefone, usado para o indicador de digitação
+	cwConversationCache = cache.New(10*time.Minute, 20*time.Minute)
 )
 
 const configFile = "chatwoot.json"
@@ -126,24 +127,83 @@ type CwAttachment struct {
 	ThumbUrl    string `json:"thumb_url"`
 }
 
+type CwContactInbox struct {
+	SourceID string `json:"source_id"`
+}
+
+type CwConversationMeta struct {
+	Sender struct {
+		PhoneNumber string `json:"phone_number"`
+	} `json:"sender"`
+}
+
 type CwWebhook struct {
 	Event        string         `json:"event"`
 	MessageType  string         `json:"message_type"`
 	Content      string         `json:"content"`
 	Attachments  []CwAttachment `json:"attachments"`
+	IsPrivate    bool           `json:"is_private"`
 	Sender       struct {
 		Name string `json:"name"`
 	} `json:"sender"`
 	Conversation struct {
-		ContactInbox struct {
-			SourceID string `json:"source_id"`
-		} `json:"contact_inbox"`
-		Contact struct {
+		ID           int                `json:"id"`
+		ContactInbox CwContactInbox     `json:"contact_inbox"`
+		Meta         CwConversationMeta `json:"meta"`
+		Contact      struct {
 			PhoneNumber string `json:"phone_number"`
 		} `json:"contact"`
 	} `json:"conversation"`
+	// Eventos conversation_updated enviam a conversa na raiz do payload
+	ID              int                `json:"id"`
+	ContactInbox    CwContactInbox     `json:"contact_inbox"`
+	Meta            CwConversationMeta `json:"meta"`
+	AgentLastSeenAt CwTimestamp        `json:"agent_last_seen_at"`
+}
+
+// Horário enviado pelo Chatwoot como unix timestamp ou, em versões antigas, como texto ISO 8601
+type CwTimestamp struct {
+	time.Time
 }
 
+func (t *CwTimestamp) UnmarshalJSON(data []byte) error {
+	var seconds float64
+	if err := json.Unmarshal(data, &seconds); err == nil {
+		if seconds > 0 {
+			t.Time = time.Unix(int64(seconds), 0)
+		}
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil || text == "" {
+		return nil
+	}
+	parsed, err := time.Parse(time.RFC3339, text)
+	if err != nil {
+		return nil
+	}
+	t.Time = parsed
+	return nil
+}
+
+// Telefone do contato, procurando nos formatos de payload de mensagem,
+// digitação e atualização de conversa
+func (p CwWebhook) phoneNumber() string {
+	for _, phone := range []string{
+		p.Conversation.Contact.PhoneNumber,
+		p.Conversation.Meta.Sender.PhoneNumber,
+		p.Conversation.ContactInbox.SourceID,
+		p.Meta.Sender.PhoneNumber,
+		p.ContactInbox.SourceID,
+	} {
+		if phone != "" {
+			return phone
+		}
+	}
+	return ""
+}
+
+
 // --- UTILITÁRIOS ---
 
 func sendJsonError(w http.ResponseWriter, msg string, code int) {
@@ -156,10 +216,6 @@ func sendJsonError(w http.ResponseWriter, msg string, code int) {
 
 func (s *server) HandleSetChatwootConfig() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Header.Get("Authorization") != os.Getenv("WUZAPI_ADMIN_TOKEN") {
-			sendJsonError(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
 		var newCfg ChatwootConfig
 		if err := json.NewDecoder(r.Body).Decode(&newCfg); err != nil {
 			sendJsonError(w, "JSON inválido", http.StatusBadRequest)
@@ -173,10 +229,6 @@ func (s *server) HandleSetChatwootConfig() http.HandlerFunc {
 
 func (s *server) HandleGetChatwootConfig() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Header.Get("Authorization") != os.Getenv("WUZAPI_ADMIN_TOKEN") {
-			sendJsonError(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
 		cwCfgMutex.RLock()
 		defer cwCfgMutex.RUnlock()
 		w.Header().Set("Content-Type", "application/json")
@@ -198,10 +250,6 @@ func (s *server) HandleAutoCreateInbox() http.HandlerFunc {
 			return
 		}
 
-		if r.Header.Get("Authorization") != os.Getenv("WUZAPI_ADMIN_TOKEN") {
-			sendJsonError(w, "Token de Admin inválido", http.StatusUnauthorized)
-			return
-		}
 
 		if body.SessionToken == "" {
 			sendJsonError(w, "Instance Token obrigatório", http.StatusBadRequest)
@@ -211,7 +259,28 @@ func (s *server) HandleAutoCreateInbox() http.HandlerFunc {
 		cfg := body.Config
 		cfg.URL = strings.TrimSuffix(cfg.URL, "/")
 		
-		webhookEndpoint := fmt.Sprintf("%s/chatwoot/webhook?token=%s", body.WuzapiURL, body.SessionToken)
+		// The inbox gets its own key, a user token in the URL would break on the next rotation
+		userID, err := s.resolveUserToken(body.SessionToken)
+		if err != nil {
+			sendJsonError(w, "Instance Token inválido", http.StatusUnauthorized)
+			return
+		}
+		webhookKey, apiKey, err := s.createAPIKey(userID, "Chatwoot inbox "+cfg.InboxName, []string{"send"}, nil, nil)
+		if err != nil {
+			sendJsonError(w, "Erro ao criar chave: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// The key is only kept once the inbox exists
+		inboxCreated := false
+		defer func() {
+			if inboxCreated {
+				return
+			}
+			if _, err := s.db.Exec("DELETE FROM api_keys WHERE id = $1 AND user_id = $2", apiKey.ID, userID); err != nil {
+				fmt.Printf("[Chatwoot] Erro ao revogar chave da caixa: %v\n", err)
+			}
+		}()
+		webhookEndpoint := fmt.Sprintf("%s/chatwoot/webhook?token=%s", body.WuzapiURL, webhookKey)
 
 		cwPayload := CreateInboxRequest{
 			Name: cfg.InboxName,
@@ -249,6 +318,8 @@ func (s *server) HandleAutoCreateInbox() http.HandlerFunc {
 			return
 		}
 
+		inboxCreated = true
+
 		cfg.InboxID = strconv.Itoa(cwResp.Id)
 		saveConfigToDisk(cfg)
 
@@ -263,22 +334,33 @@ func (s *server) HandleAutoCreateInbox() http.HandlerFunc {
 
 // --- LÓGICA DE CONTATO ---
 
-func getOrCreateContact(baseURL, accountID, token string, inboxID int, phone, name string) int {
+func searchContact(baseURL, accountID, token, phone string) int {
 	searchURL := fmt.Sprintf("%s/api/v1/accounts/%s/contacts/search?q=%s", baseURL, accountID, strings.Replace(phone, "+", "%2B", -1))
 	req, _ := http.NewRequest("GET", searchURL, nil)
 	req.Header.Set("api_access_token", token)
 	client := &http.Client{}
 	resp, err := client.Do(req)
-	if err == nil && resp.StatusCode == 200 {
-		body, _ := io.ReadAll(resp.Body)
-		var searchRes ChatwootSearchResponse
-		json.Unmarshal(body, &searchRes)
-		resp.Body.Close()
-		if len(searchRes.Payload) > 0 {
-			return searchRes.Payload[0].ID
-		}
+	if err != nil {
+		return 0
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return 0
+	}
+	var searchRes ChatwootSearchResponse
+	json.NewDecoder(resp.Body).Decode(&searchRes)
+	if len(searchRes.Payload) > 0 {
+		return searchRes.Payload[0].ID
+	}
+	return 0
+}
+
+func getOrCreateContact(baseURL, accountID, token string, inboxID int, phone, name string) int {
+	if contactID := searchContact(baseURL, accountID, token, phone); contactID != 0 {
+		return contactID
 	}
-	
+
+	client := &http.Client{}
 	createURL := fmt.Sprintf("%s/api/v1/accounts/%s/contacts", baseURL, accountID)
 	payload := map[string]interface{}{
 		"inbox_id":     inboxID,
@@ -309,15 +391,16 @@ func SendToChatwoot(pushName string, senderUser string, text string) {
 	cwCfgMutex.RLock()
 	cfg := cwCfg
 	cwCfgMutex.RUnlock()
+	sendTextToChatwoot(cfg, pushName, senderUser, text)
+}
 
+func sendTextToChatwoot(cfg ChatwootConfig, pushName string, senderUser string, text string) {
 	if !cfg.Enabled || cfg.URL == "" || cfg.Token == "" {
 		return
 	}
 
 	cwInboxID, _ := strconv.Atoi(cfg.InboxID)
-	phoneClean := strings.Replace(senderUser, "+", "", -1)
-	phoneClean = strings.Split(phoneClean, "@")[0]
-	phoneNumber := "+" + phoneClean
+	phoneNumber := chatwootPhone(senderUser)
 
 	contactID := getOrCreateContact(cfg.URL, cfg.AccountID, cfg.Token, cwInboxID, phoneNumber, pushName)
 	if contactID == 0 {
@@ -349,15 +432,16 @@ func SendAttachmentToChatwoot(pushName, senderUser, caption, fileName string, fi
 	cwCfgMutex.RLock()
 	cfg := cwCfg
 	cwCfgMutex.RUnlock()
+	sendAttachmentToChatwoot(cfg, pushName, senderUser, caption, fileName, fileData)
+}
 
+func sendAttachmentToChatwoot(cfg ChatwootConfig, pushName, senderUser, caption, fileName string, fileData []byte) {
 	if !cfg.Enabled || cfg.URL == "" || cfg.Token == "" {
 		return
 	}
 
 	cwInboxID, _ := strconv.Atoi(cfg.InboxID)
-	phoneClean := strings.Replace(senderUser, "+", "", -1)
-	phoneClean = strings.Split(phoneClean, "@")[0]
-	phoneNumber := "+" + phoneClean
+	phoneNumber := chatwootPhone(senderUser)
 
 	contactID := getOrCreateContact(cfg.URL, cfg.AccountID, cfg.Token, cwInboxID, phoneNumber, pushName)
 	if contactID == 0 {
@@ -388,6 +472,85 @@ func SendAttachmentToChatwoot(pushName, senderUser, caption, fileName string, fi
 	}
 }
 
+// --- DIGITAÇÃO E LEITURA ---
+
+func chatwootPhone(senderUser string) string {
+	phoneClean := strings.Replace(senderUser, "+", "", -1)
+	phoneClean = strings.Split(phoneClean, "@")[0]
+	return "+" + phoneClean
+}
+
+// Busca a conversa do contato na caixa configurada, sem criar contato novo
+func getConversationID(cfg ChatwootConfig, phone string) int {
+	cacheKey := fmt.Sprintf("%s|%s|%s", cfg.URL, cfg.InboxID, phone)
+	if cached, found := cwConversationCache.Get(cacheKey); found {
+		return cached.(int)
+	}
+
+	contactID := searchContact(cfg.URL, cfg.AccountID, cfg.Token, phone)
+	if contactID == 0 {
+		return 0
+	}
+
+	url := fmt.Sprintf("%s/api/v1/accounts/%s/contacts/%d/conversations", cfg.URL, cfg.AccountID, contactID)
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("api_access_token", cfg.Token)
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return 0
+	}
+
+	var convRes struct {
+		Payload []struct {
+			ID      int    `json:"id"`
+			InboxID int    `json:"inbox_id"`
+			Status  string `json:"status"`
+		} `json:"payload"`
+	}
+	json.NewDecoder(resp.Body).Decode(&convRes)
+
+	cwInboxID, _ := strconv.Atoi(cfg.InboxID)
+	for _, conv := range convRes.Payload {
+		if conv.InboxID == cwInboxID && conv.Status != "resolved" {
+			cwConversationCache.Set(cacheKey, conv.ID, cache.DefaultExpiration)
+			return conv.ID
+		}
+	}
+	return 0
+}
+
+// Espelha o "digitando..." do WhatsApp na conversa do Chatwoot
+func sendTypingToChatwoot(cfg ChatwootConfig, senderUser string, typing bool) {
+	if !cfg.Enabled || cfg.URL == "" || cfg.Token == "" {
+		return
+	}
+
+	conversationID := getConversationID(cfg, chatwootPhone(senderUser))
+	if conversationID == 0 {
+		return
+	}
+
+	status := "off"
+	if typing {
+		status = "on"
+	}
+	url := fmt.Sprintf("%s/api/v1/accounts/%s/conversations/%d/toggle_typing_status", cfg.URL, cfg.AccountID, conversationID)
+	jsonPayload, _ := json.Marshal(map[string]string{"typing_status": status})
+	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(jsonPayload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("api_access_token", cfg.Token)
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
 // --- WEBHOOK: CHATWOOT -> WHATSAPP (Agente respondendo) ---
 
 func (s *server) HandleChatwootWebhook() http.HandlerFunc {
@@ -398,134 +561,182 @@ func (s *server) HandleChatwootWebhook() http.HandlerFunc {
 			return
 		}
 
-		var payload CwWebhook
-		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		// Inboxes created by auto-create carry an API key with the send scope
+		var userID string
+		var err error
+		if strings.HasPrefix(token, apiKeyPrefix) {
+			var apiKey *APIKey
+			apiKey, userID, err = s.resolveAPIKey(token, r)
+			if err == nil && !apiKey.HasScope("send") {
+				err = errInvalidToken
+			}
+		} else {
+			userID, err = s.resolveUserToken(token)
+		}
+		if err != nil {
+			fmt.Printf("[Chatwoot] Erro: token inválido\n")
 			w.WriteHeader(http.StatusOK)
 			return
 		}
 
-		// Apenas processa mensagens criadas que são OUTGOING (do Agente)
-		// Mensagens incoming já foram tratadas pelo client.go
-		if payload.Event != "message_created" || payload.MessageType != "outgoing" {
+		userInfo, found := userinfocache.Get(userID)
+		if !found {
+			fmt.Printf("[Chatwoot] Erro: Sessão não encontrada para o usuário %s\n", userID)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if _, ok := userInfo.(Values); !ok {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
 
-		cwCfgMutex.RLock()
-		cfg := cwCfg
-		cwCfgMutex.RUnlock()
-
-		userInfo, found := userinfocache.Get(token)
-		if !found {
-			fmt.Printf("[Chatwoot] Erro: Sessão não encontrada para o token %s\n", token)
+		connector := getUserConnector(s.db, userID, "chatwoot")
+		if connector == nil {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
 
+		replies, err := connector.ParseAgentReply(r)
 		w.WriteHeader(http.StatusOK)
+		if err != nil || len(replies) == 0 {
+			return
+		}
 
-		go func() {
-			vals, ok := userInfo.(Values)
-			if !ok {
-				return
-			}
-			userID := vals.Get("Id")
-			// Chama a função global do client.go (ou main.go)
-			// Assume que clientManager é acessível globalmente
-			client := clientManager.GetWhatsmeowClient(userID)
-			if client == nil || !client.IsConnected() {
-				return
-			}
+		go deliverConnectorReplies(userID, replies)
+	}
+}
 
-			// Recupera telefone
-			phone := payload.Conversation.Contact.PhoneNumber
-			if phone == "" {
-				phone = payload.Conversation.ContactInbox.SourceID
-			}
-			phone = strings.ReplaceAll(phone, "+", "")
-			phone = strings.ReplaceAll(phone, " ", "")
-			if len(phone) < 8 {
-				return
-			}
-			
-			// Parse seguro
-			jid, err := types.ParseJID(phone)
-			if err != nil {
-				jid, err = types.ParseJID(phone + "@s.whatsapp.net")
-				if err != nil {
-					fmt.Println("[Chatwoot] Erro ao parsear JID:", err)
-					return
-				}
-			}
+// --- CONECTOR ---
 
-			// 1. Envio de Mídia
-			if len(payload.Attachments) > 0 {
-				for _, att := range payload.Attachments {
-					sendChatwootMedia(client, jid, att)
-				}
-			} else {
-				// 2. Envio de Texto
-				finalMessage := payload.Content
-				if cfg.SignMessages && payload.Sender.Name != "" {
-					delimiter := strings.ReplaceAll(cfg.SignatureDelimiter, `\n`, "\n")
-					finalMessage = fmt.Sprintf("%s%s%s", finalMessage, delimiter, payload.Sender.Name)
-				}
-				if finalMessage != "" {
-					client.SendMessage(context.Background(), jid, &waE2E.Message{Conversation: proto.String(finalMessage)})
-				}
-			}
-		}()
+type chatwootConnector struct {
+	cfg ChatwootConfig
+}
+
+func newChatwootConnector(config json.RawMessage) (HelpdeskConnector, error) {
+	cfg := ChatwootConfig{
+		SignatureDelimiter: "\n",
+		DaysLimit:          7,
+	}
+	if len(config) > 0 {
+		if err := json.Unmarshal(config, &cfg); err != nil {
+			return nil, err
+		}
+	}
+	cfg.URL = strings.TrimSuffix(cfg.URL, "/")
+	if cfg.URL == "" || cfg.Token == "" || cfg.AccountID == "" {
+		return nil, fmt.Errorf("url, token e account_id são obrigatórios")
 	}
+	cfg.Enabled = true
+	return &chatwootConnector{cfg: cfg}, nil
 }
 
-func sendChatwootMedia(client *whatsmeow.Client, jid types.JID, att CwAttachment) {
-	resp, err := http.Get(att.DataUrl)
-	if err != nil {
-		return
+func (c *chatwootConnector) Type() string {
+	return "chatwoot"
+}
+
+func (c *chatwootConnector) OnInboundMessage(ctx context.Context, msg ConnectorMessage) error {
+	for _, ignore := range c.cfg.IgnoreJIDs {
+		if strings.Contains(msg.Chat.String(), ignore) {
+			return nil
+		}
 	}
-	defer resp.Body.Close()
-	data, _ := io.ReadAll(resp.Body)
 
-	uploadResp, err := client.Upload(context.Background(), data, whatsmeow.MediaImage)
-	if err != nil {
-		return
+	// Se for mídia sem legenda, coloca um texto descritivo
+	cwText := msg.Text
+	if cwText == "" {
+		switch msg.MediaType {
+		case "image":
+			cwText = "[Imagem]"
+		case "audio":
+			cwText = "[Áudio]"
+		case "video":
+			cwText = "[Vídeo]"
+		case "document":
+			cwText = "[Documento]"
+		case "sticker":
+			cwText = "[Sticker]"
+		}
+	}
+	if cwText == "" {
+		return nil
 	}
 
-	switch att.FileType {
-	case "image":
-		msg := &waE2E.ImageMessage{
-			URL:           proto.String(uploadResp.URL),
-			DirectPath:    proto.String(uploadResp.DirectPath),
-			MediaKey:      uploadResp.MediaKey,
-			Mimetype:      proto.String(http.DetectContentType(data)),
-			FileEncSHA256: uploadResp.FileEncSHA256,
-			FileSHA256:    uploadResp.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(data))),
+	sendTextToChatwoot(c.cfg, msg.PushName, msg.Phone, cwText)
+	return nil
+}
+
+// O canal API do Chatwoot não expõe o status de leitura do contato
+func (c *chatwootConnector) OnReceipt(ctx context.Context, receipt ConnectorReceipt) error {
+	return nil
+}
+
+func (c *chatwootConnector) OnChatPresence(ctx context.Context, phone string, typing bool) error {
+	sendTypingToChatwoot(c.cfg, phone, typing)
+	return nil
+}
+
+func (c *chatwootConnector) ParseAgentReply(r *http.Request) ([]ConnectorReply, error) {
+	var payload CwWebhook
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		return nil, err
+	}
+	phone := payload.phoneNumber()
+
+	// Processa mensagens OUTGOING (do Agente), digitação e leitura
+	// Mensagens incoming já foram tratadas pelo OnInboundMessage
+	switch payload.Event {
+	case "message_created":
+		if payload.MessageType != "outgoing" {
+			return nil, nil
+		}
+	case "conversation_typing_on":
+		// Notas privadas não devem aparecer para o cliente
+		if payload.IsPrivate {
+			return nil, nil
 		}
-		client.SendMessage(context.Background(), jid, &waE2E.Message{ImageMessage: msg})
-	case "audio":
-		msg := &waE2E.AudioMessage{
-			URL:           proto.String(uploadResp.URL),
-			DirectPath:    proto.String(uploadResp.DirectPath),
-			MediaKey:      uploadResp.MediaKey,
-			Mimetype:      proto.String("audio/ogg; codecs=opus"),
-			FileEncSHA256: uploadResp.FileEncSHA256,
-			FileSHA256:    uploadResp.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(data))),
-			PTT:           proto.Bool(true),
+		return []ConnectorReply{{Phone: phone, Action: ConnectorActionTypingOn}}, nil
+	case "conversation_typing_off":
+		if payload.IsPrivate {
+			return nil, nil
 		}
-		client.SendMessage(context.Background(), jid, &waE2E.Message{AudioMessage: msg})
+		return []ConnectorReply{{Phone: phone, Action: ConnectorActionTypingOff}}, nil
+	case "conversation_updated":
+		// A conversa é atualizada por vários motivos (status, etiquetas, atribuição...),
+		// só marca como lidas as mensagens que o agente já visualizou
+		if payload.AgentLastSeenAt.IsZero() {
+			return nil, nil
+		}
+		return []ConnectorReply{{Phone: phone, Action: ConnectorActionRead, ReadUntil: payload.AgentLastSeenAt.Time}}, nil
 	default:
-		msg := &waE2E.DocumentMessage{
-			URL:           proto.String(uploadResp.URL),
-			DirectPath:    proto.String(uploadResp.DirectPath),
-			MediaKey:      uploadResp.MediaKey,
-			Mimetype:      proto.String(http.DetectContentType(data)),
-			FileEncSHA256: uploadResp.FileEncSHA256,
-			FileSHA256:    uploadResp.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(data))),
-			FileName:      proto.String("arquivo"),
+		return nil, nil
+	}
+
+	// 1. Envio de Mídia
+	if len(payload.Attachments) > 0 {
+		var replies []ConnectorReply
+		for _, att := range payload.Attachments {
+			fileName := ""
+			if att.FileType != "image" && att.FileType != "audio" && att.FileType != "video" {
+				fileName = "arquivo"
+			}
+			replies = append(replies, ConnectorReply{
+				Phone:     phone,
+				MediaURL:  att.DataUrl,
+				MediaType: att.FileType,
+				FileName:  fileName,
+			})
 		}
-		client.SendMessage(context.Background(), jid, &waE2E.Message{DocumentMessage: msg})
+		return replies, nil
+	}
+
+	// 2. Envio de Texto
+	finalMessage := payload.Content
+	if c.cfg.SignMessages && payload.Sender.Name != "" {
+		delimiter := strings.ReplaceAll(c.cfg.SignatureDelimiter, `\n`, "\n")
+		finalMessage = fmt.Sprintf("%s%s%s", finalMessage, delimiter, payload.Sender.Name)
+	}
+	if finalMessage == "" {
+		return nil, nil
 	}
+	return []ConnectorReply{{Phone: phone, Text: finalMessage}}, nil
 }
@@ -55,6 +55,25 @@ func (cm *ClientManager) DeleteWhatsmeowClient(id string) {
 	delete(cm.clients, id)
 }
 
+// Counts sessions, connected ones and logged in ones
+func (cm *ClientManager) sessionCounts() (total, connected, loggedIn int) {
+	cm.RLock()
+	defer cm.RUnlock()
+	for _, c := range cm.clients {
+		if c == nil || c.client == nil {
+			continue
+		}
+		total++
+		if c.client.IsConnected() {
+			connected++
+		}
+		if c.client.IsLoggedIn() {
+			loggedIn++
+		}
+	}
+	return total, connected, loggedIn
+}
+
 // Helper para a integração Chatwoot
 func (cm *ClientManager) GetWhatsmeowClient(id string) *whatsmeow.Client {
 	cm.RLock()
@@ -0,0 +1,696 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+// Actions a connector can ask for besides sending a message
+const (
+	ConnectorActionTypingOn  = "typing_on"
+	ConnectorActionTypingOff = "typing_off"
+	ConnectorActionRead      = "read"
+)
+
+const connectorMediaMaxBytes = 64 * 1024 * 1024 // 64MB
+
+// HelpdeskConnector bridges a WhatsApp session to an external helpdesk or bot platform
+type HelpdeskConnector interface {
+	Type() string
+	// OnInboundMessage forwards a message received on WhatsApp to the helpdesk
+	OnInboundMessage(ctx context.Context, msg ConnectorMessage) error
+	// OnReceipt forwards delivery and read receipts to the helpdesk
+	OnReceipt(ctx context.Context, receipt ConnectorReceipt) error
+	// ParseAgentReply decodes a helpdesk webhook into what must be delivered on WhatsApp
+	ParseAgentReply(r *http.Request) ([]ConnectorReply, error)
+}
+
+// ConnectorPresence is implemented by connectors that can show the customer typing
+type ConnectorPresence interface {
+	OnChatPresence(ctx context.Context, phone string, typing bool) error
+}
+
+type ConnectorMessage struct {
+	UserID    string
+	MessageID string
+	Chat      types.JID
+	Sender    types.JID
+	Phone     string
+	PushName  string
+	Text      string
+	MediaType string
+	MimeType  string
+	FileName  string
+	Timestamp time.Time
+	IsGroup   bool
+	Download  func(ctx context.Context) ([]byte, error)
+}
+
+type ConnectorReceipt struct {
+	UserID     string
+	MessageIDs []string
+	Chat       types.JID
+	Phone      string
+	State      string
+	Timestamp  time.Time
+}
+
+type ConnectorReply struct {
+	Phone     string    `json:"phone"`
+	Text      string    `json:"text,omitempty"`
+	MediaURL  string    `json:"media_url,omitempty"`
+	MediaType string    `json:"media_type,omitempty"`
+	FileName  string    `json:"file_name,omitempty"`
+	Action    string    `json:"action,omitempty"`
+	ReadUntil time.Time `json:"read_until,omitzero"` // Read action: only messages up to this time, all when zero
+}
+
+type connectorUnreadMessage struct {
+	ID        string
+	Chat      types.JID
+	Sender    types.JID
+	Timestamp time.Time
+}
+
+var connectorFactories = map[string]func(config json.RawMessage) (HelpdeskConnector, error){
+	"chatwoot": newChatwootConnector,
+	"ticket":   newTicketConnector,
+}
+
+var (
+	connectorCache = cache.New(5*time.Minute, 10*time.Minute)
+	// Incoming messages not yet read by an agent, keyed by user and phone
+	connectorUnreadCache = cache.New(24*time.Hour, time.Hour)
+	// Serializes updates of a key of connectorUnreadCache, messages are dispatched concurrently
+	connectorUnreadLocks = NewKeyedMutex()
+)
+
+// Loads the enabled connectors for a user. The global Chatwoot config
+// (chatwoot.json or env) still applies to users without their own Chatwoot connector.
+func getUserConnectors(db *sqlx.DB, userID string) []HelpdeskConnector {
+	var connectors []HelpdeskConnector
+	if cached, found := connectorCache.Get(userID); found {
+		connectors = cached.([]HelpdeskConnector)
+	} else {
+		var rows []struct {
+			Type   string `db:"type"`
+			Config string `db:"config"`
+		}
+		err := db.Select(&rows, "SELECT type, config FROM helpdesk_connectors WHERE user_id = $1 AND enabled = $2", userID, true)
+		if err != nil {
+			log.Error().Err(err).Str("userID", userID).Msg("Failed to load helpdesk connectors")
+		}
+		for _, row := range rows {
+			factory, ok := connectorFactories[row.Type]
+			if !ok {
+				continue
+			}
+			connector, err := factory(json.RawMessage(row.Config))
+			if err != nil {
+				log.Warn().Err(err).Str("userID", userID).Str("type", row.Type).Msg("Skipping invalid helpdesk connector")
+				continue
+			}
+			connectors = append(connectors, connector)
+		}
+		connectorCache.Set(userID, connectors, cache.DefaultExpiration)
+	}
+
+	for _, connector := range connectors {
+		if connector.Type() == "chatwoot" {
+			return connectors
+		}
+	}
+
+	cwCfgMutex.RLock()
+	cfg := cwCfg
+	cwCfgMutex.RUnlock()
+	if cfg.Enabled && cfg.URL != "" && cfg.Token != "" {
+		connectors = append(connectors[:len(connectors):len(connectors)], &chatwootConnector{cfg: cfg})
+	}
+	return connectors
+}
+
+func getUserConnector(db *sqlx.DB, userID string, connectorType string) HelpdeskConnector {
+	for _, connector := range getUserConnectors(db, userID) {
+		if connector.Type() == connectorType {
+			return connector
+		}
+	}
+	return nil
+}
+
+func buildConnectorMessage(mycli *MyClient, evt *events.Message) ConnectorMessage {
+	msg := ConnectorMessage{
+		UserID:    mycli.userID,
+		MessageID: evt.Info.ID,
+		Chat:      evt.Info.Chat,
+		Sender:    evt.Info.Sender,
+		Phone:     evt.Info.Sender.User,
+		PushName:  evt.Info.PushName,
+		Timestamp: evt.Info.Timestamp,
+		IsGroup:   evt.Info.IsGroup,
+	}
+
+	m := evt.Message
+	switch {
+	case m.GetConversation() != "":
+		msg.Text = m.GetConversation()
+	case m.GetExtendedTextMessage() != nil:
+		msg.Text = m.GetExtendedTextMessage().GetText()
+	case m.GetImageMessage() != nil:
+		msg.MediaType, msg.MimeType, msg.Text = "image", m.GetImageMessage().GetMimetype(), m.GetImageMessage().GetCaption()
+	case m.GetAudioMessage() != nil:
+		msg.MediaType, msg.MimeType = "audio", m.GetAudioMessage().GetMimetype()
+	case m.GetVideoMessage() != nil:
+		msg.MediaType, msg.MimeType, msg.Text = "video", m.GetVideoMessage().GetMimetype(), m.GetVideoMessage().GetCaption()
+	case m.GetDocumentMessage() != nil:
+		msg.MediaType, msg.MimeType, msg.Text = "document", m.GetDocumentMessage().GetMimetype(), m.GetDocumentMessage().GetCaption()
+		msg.FileName = m.GetDocumentMessage().GetFileName()
+	case m.GetStickerMessage() != nil:
+		msg.MediaType, msg.MimeType = "sticker", m.GetStickerMessage().GetMimetype()
+	}
+
+	if msg.MediaType != "" {
+		waClient := mycli.WAClient
+		msg.Download = func(ctx context.Context) ([]byte, error) {
+			return waClient.DownloadAny(ctx, m)
+		}
+	}
+	return msg
+}
+
+func dispatchInboundToConnectors(db *sqlx.DB, msg ConnectorMessage) {
+	connectors := getUserConnectors(db, msg.UserID)
+	if len(connectors) == 0 {
+		return
+	}
+
+	trackConnectorUnread(msg)
+	for _, connector := range connectors {
+		ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+		if err := connector.OnInboundMessage(ctx, msg); err != nil {
+			log.Error().Err(err).Str("userID", msg.UserID).Str("connector", connector.Type()).Str("messageID", msg.MessageID).Msg("Failed to forward message to helpdesk")
+		}
+		cancel()
+	}
+}
+
+func dispatchReceiptToConnectors(db *sqlx.DB, receipt ConnectorReceipt) {
+	for _, connector := range getUserConnectors(db, receipt.UserID) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := connector.OnReceipt(ctx, receipt); err != nil {
+			log.Error().Err(err).Str("userID", receipt.UserID).Str("connector", connector.Type()).Msg("Failed to forward receipt to helpdesk")
+		}
+		cancel()
+	}
+}
+
+func dispatchPresenceToConnectors(db *sqlx.DB, userID string, phone string, typing bool) {
+	for _, connector := range getUserConnectors(db, userID) {
+		presence, ok := connector.(ConnectorPresence)
+		if !ok {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := presence.OnChatPresence(ctx, phone, typing); err != nil {
+			log.Error().Err(err).Str("userID", userID).Str("connector", connector.Type()).Msg("Failed to forward chat presence to helpdesk")
+		}
+		cancel()
+	}
+}
+
+func connectorUnreadKey(userID string, phone string) string {
+	phone = strings.TrimPrefix(phone, "+")
+	phone = strings.Split(phone, "@")[0]
+	return userID + ":" + phone
+}
+
+// Remembers incoming messages so they can be marked as read once an agent reads them
+func trackConnectorUnread(msg ConnectorMessage) {
+	key := connectorUnreadKey(msg.UserID, msg.Phone)
+	unlock := connectorUnreadLocks.Lock(key)
+	defer unlock()
+
+	var pending []connectorUnreadMessage
+	if cached, found := connectorUnreadCache.Get(key); found {
+		pending = cached.([]connectorUnreadMessage)
+	}
+	pending = append(pending, connectorUnreadMessage{ID: msg.MessageID, Chat: msg.Chat, Sender: msg.Sender, Timestamp: msg.Timestamp})
+	connectorUnreadCache.Set(key, pending, cache.DefaultExpiration)
+}
+
+// Takes the tracked messages received up to readUntil, or all of them when it is zero. Later
+// messages stay tracked until the agent reads them too
+func takeConnectorRead(userID string, phone string, readUntil time.Time) []connectorUnreadMessage {
+	key := connectorUnreadKey(userID, phone)
+	unlock := connectorUnreadLocks.Lock(key)
+	defer unlock()
+
+	cached, found := connectorUnreadCache.Get(key)
+	if !found {
+		return nil
+	}
+	var read, unread []connectorUnreadMessage
+	for _, msg := range cached.([]connectorUnreadMessage) {
+		if readUntil.IsZero() || !msg.Timestamp.After(readUntil) {
+			read = append(read, msg)
+		} else {
+			unread = append(unread, msg)
+		}
+	}
+	if len(read) == 0 {
+		return nil
+	}
+	if len(unread) > 0 {
+		connectorUnreadCache.Set(key, unread, cache.DefaultExpiration)
+	} else {
+		connectorUnreadCache.Delete(key)
+	}
+	return read
+}
+
+type connectorReadReceipt struct {
+	chat   types.JID
+	sender types.JID
+	ids    []types.MessageID
+}
+
+// Groups messages by chat and sender, read receipts name both, in the order they were received
+func groupConnectorRead(messages []connectorUnreadMessage) []connectorReadReceipt {
+	var receipts []connectorReadReceipt
+	index := make(map[[2]types.JID]int)
+	for _, msg := range messages {
+		key := [2]types.JID{msg.Chat, msg.Sender}
+		i, found := index[key]
+		if !found {
+			i = len(receipts)
+			index[key] = i
+			receipts = append(receipts, connectorReadReceipt{chat: msg.Chat, sender: msg.Sender})
+		}
+		receipts[i].ids = append(receipts[i].ids, msg.ID)
+	}
+	return receipts
+}
+
+// Marks the tracked messages received up to readUntil as read, or all of them when it is zero
+func markConnectorChatRead(client *whatsmeow.Client, userID string, phone string, readUntil time.Time) error {
+	for _, receipt := range groupConnectorRead(takeConnectorRead(userID, phone, readUntil)) {
+		if err := client.MarkRead(context.Background(), receipt.ids, time.Now(), receipt.chat, receipt.sender); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseConnectorPhone(phone string) (types.JID, bool) {
+	phone = strings.ReplaceAll(phone, "+", "")
+	phone = strings.ReplaceAll(phone, " ", "")
+	if len(phone) < 8 {
+		return types.JID{}, false
+	}
+
+	if strings.Contains(phone, "@") {
+		jid, err := types.ParseJID(phone)
+		return jid, err == nil
+	}
+	return types.NewJID(phone, types.DefaultUserServer), true
+}
+
+// Delivers helpdesk replies and actions on the user's WhatsApp session. Messages are sent as
+// automated messages, so they count against the quota and are saved to history
+func deliverConnectorReplies(userID string, replies []ConnectorReply) {
+	mycli := clientManager.GetMyClient(userID)
+	if mycli == nil || mycli.WAClient == nil || !mycli.WAClient.IsConnected() {
+		log.Warn().Str("userID", userID).Int("replies", len(replies)).Msg("Dropping helpdesk replies, session not connected")
+		return
+	}
+	client := mycli.WAClient
+
+	for _, reply := range replies {
+		jid, ok := parseConnectorPhone(reply.Phone)
+		if !ok {
+			log.Warn().Str("userID", userID).Str("phone", reply.Phone).Msg("Could not parse helpdesk reply phone")
+			continue
+		}
+
+		var err error
+		switch {
+		case reply.Action == ConnectorActionTypingOn:
+			err = client.SendChatPresence(context.Background(), jid, types.ChatPresenceComposing, types.ChatPresenceMediaText)
+		case reply.Action == ConnectorActionTypingOff:
+			err = client.SendChatPresence(context.Background(), jid, types.ChatPresencePaused, types.ChatPresenceMediaText)
+		case reply.Action == ConnectorActionRead:
+			err = markConnectorChatRead(client, userID, reply.Phone, reply.ReadUntil)
+		case reply.MediaURL != "":
+			err = sendConnectorMedia(mycli, jid, reply)
+		case reply.Text != "":
+			_, err = mycli.sendAutomatedMessage(jid, &waE2E.Message{Conversation: proto.String(reply.Text)}, "text", reply.Text)
+		}
+		if err != nil {
+			log.Error().Err(err).Str("userID", userID).Str("phone", reply.Phone).Str("action", reply.Action).Msg("Failed to deliver helpdesk reply")
+		}
+	}
+}
+
+func sendConnectorMedia(mycli *MyClient, jid types.JID, reply ConnectorReply) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	data, _, err := fetchURLBytes(ctx, reply.MediaURL, connectorMediaMaxBytes)
+	if err != nil {
+		return fmt.Errorf("failed to fetch media: %w", err)
+	}
+	if err := mycli.s.consumeUsage(mycli.userID, 0, int64(len(data))); err != nil {
+		return err
+	}
+	msg, err := uploadMediaMessage(ctx, mycli.WAClient, data, reply.MediaType, reply.Text, reply.FileName)
+	if err == nil {
+		_, err = mycli.sendAutomatedMessage(jid, msg, reply.MediaType, reply.Text)
+	}
+	if err != nil {
+		mycli.s.refundUsage(mycli.userID, 0, int64(len(data)))
+	}
+	return err
+}
+
+// Generic "ticket" REST connector. WuzAPI posts inbound messages to
+// {base_url}/messages and receipts to {base_url}/receipts; the helpdesk
+// answers by posting replies to /connectors/ticket/webhook.
+type TicketConnectorConfig struct {
+	BaseURL        string `json:"base_url"`
+	AuthToken      string `json:"auth_token"`
+	TimeoutSeconds int    `json:"timeout_seconds"`
+	IncludeMedia   bool   `json:"include_media"`
+}
+
+type ticketConnector struct {
+	cfg    TicketConnectorConfig
+	client *http.Client
+}
+
+func newTicketConnector(config json.RawMessage) (HelpdeskConnector, error) {
+	var cfg TicketConnectorConfig
+	if err := json.Unmarshal(config, &cfg); err != nil {
+		return nil, err
+	}
+	cfg.BaseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+	if !isHTTPURL(cfg.BaseURL) {
+		return nil, errors.New("base_url must be an http(s) URL")
+	}
+	if cfg.TimeoutSeconds <= 0 {
+		cfg.TimeoutSeconds = 15
+	}
+	return &ticketConnector{
+		cfg:    cfg,
+		client: &http.Client{Timeout: time.Duration(cfg.TimeoutSeconds) * time.Second},
+	}, nil
+}
+
+func (t *ticketConnector) Type() string {
+	return "ticket"
+}
+
+func (t *ticketConnector) post(ctx context.Context, path string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", t.cfg.BaseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.cfg.AuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+t.cfg.AuthToken)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("ticket endpoint %s returned %d: %s", path, resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
+
+func (t *ticketConnector) OnInboundMessage(ctx context.Context, msg ConnectorMessage) error {
+	payload := map[string]interface{}{
+		"session_id": msg.UserID,
+		"message_id": msg.MessageID,
+		"chat":       msg.Chat.String(),
+		"phone":      msg.Phone,
+		"name":       msg.PushName,
+		"text":       msg.Text,
+		"is_group":   msg.IsGroup,
+		"timestamp":  msg.Timestamp.Unix(),
+	}
+	if msg.MediaType != "" {
+		media := map[string]interface{}{
+			"type":      msg.MediaType,
+			"mime_type": msg.MimeType,
+			"file_name": msg.FileName,
+		}
+		if t.cfg.IncludeMedia && msg.Download != nil {
+			data, err := msg.Download(ctx)
+			if err != nil {
+				log.Warn().Err(err).Str("messageID", msg.MessageID).Msg("Could not download media for ticket connector")
+			} else {
+				media["data"] = base64.StdEncoding.EncodeToString(data)
+			}
+		}
+		payload["media"] = media
+	}
+	return t.post(ctx, "/messages", payload)
+}
+
+func (t *ticketConnector) OnReceipt(ctx context.Context, receipt ConnectorReceipt) error {
+	return t.post(ctx, "/receipts", map[string]interface{}{
+		"session_id":  receipt.UserID,
+		"message_ids": receipt.MessageIDs,
+		"chat":        receipt.Chat.String(),
+		"phone":       receipt.Phone,
+		"state":       receipt.State,
+		"timestamp":   receipt.Timestamp.Unix(),
+	})
+}
+
+// Accepts a single reply, an array of replies or {"replies": [...]}
+func (t *ticketConnector) ParseAgentReply(r *http.Request) ([]ConnectorReply, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1024*1024))
+	if err != nil {
+		return nil, err
+	}
+	body = bytes.TrimSpace(body)
+
+	var replies []ConnectorReply
+	if len(body) > 0 && body[0] == '[' {
+		err = json.Unmarshal(body, &replies)
+	} else {
+		var wrapper struct {
+			Replies []ConnectorReply `json:"replies"`
+			ConnectorReply
+		}
+		err = json.Unmarshal(body, &wrapper)
+		replies = wrapper.Replies
+		if len(replies) == 0 && wrapper.Phone != "" {
+			replies = []ConnectorReply{wrapper.ConnectorReply}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(replies) == 0 {
+		return nil, errors.New("no replies in payload")
+	}
+
+	for _, reply := range replies {
+		if reply.Phone == "" {
+			return nil, errors.New("missing phone in reply")
+		}
+		if reply.Text == "" && reply.MediaURL == "" && reply.Action == "" {
+			return nil, errors.New("reply needs text, media_url or action")
+		}
+	}
+	return replies, nil
+}
+
+// Set or replace a helpdesk connector for the user
+func (s *server) SetConnector() http.HandlerFunc {
+	type connectorStruct struct {
+		Type    string          `json:"type"`
+		Enabled *bool           `json:"enabled"`
+		Config  json.RawMessage `json:"config"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		decoder := json.NewDecoder(r.Body)
+		var t connectorStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode payload"))
+			return
+		}
+
+		factory, ok := connectorFactories[t.Type]
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("unknown connector type"))
+			return
+		}
+		if _, err := factory(t.Config); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("invalid connector config: %v", err))
+			return
+		}
+
+		enabled := true
+		if t.Enabled != nil {
+			enabled = *t.Enabled
+		}
+
+		_, err = s.db.Exec(`
+			INSERT INTO helpdesk_connectors (user_id, type, enabled, config)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (user_id, type) DO UPDATE SET
+				enabled = excluded.enabled,
+				config = excluded.config,
+				updated_at = CURRENT_TIMESTAMP`,
+			txtid, t.Type, enabled, string(t.Config))
+		if err != nil {
+			log.Error().Err(err).Str("userID", txtid).Msg("Failed to save helpdesk connector")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to save connector"))
+			return
+		}
+		connectorCache.Delete(txtid)
+
+		response := map[string]interface{}{"Details": "Connector saved successfully", "Type": t.Type, "Enabled": enabled}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// List the user's helpdesk connectors, with secrets masked
+func (s *server) GetConnectors() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		var rows []struct {
+			Type    string `db:"type"`
+			Enabled bool   `db:"enabled"`
+			Config  string `db:"config"`
+		}
+		err := s.db.Select(&rows, "SELECT type, enabled, config FROM helpdesk_connectors WHERE user_id = $1 ORDER BY type", txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to get connectors"))
+			return
+		}
+
+		connectors := make([]map[string]interface{}, 0, len(rows))
+		for _, row := range rows {
+			var config map[string]interface{}
+			json.Unmarshal([]byte(row.Config), &config)
+			for _, secret := range []string{"token", "auth_token"} {
+				if _, ok := config[secret]; ok {
+					config[secret] = "***"
+				}
+			}
+			connectors = append(connectors, map[string]interface{}{
+				"type":    row.Type,
+				"enabled": row.Enabled,
+				"config":  config,
+			})
+		}
+
+		responseJson, err := json.Marshal(connectors)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Remove a helpdesk connector
+func (s *server) DeleteConnector() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		connectorType := mux.Vars(r)["type"]
+
+		result, err := s.db.Exec("DELETE FROM helpdesk_connectors WHERE user_id = $1 AND type = $2", txtid, connectorType)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to delete connector"))
+			return
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			s.Respond(w, r, http.StatusNotFound, errors.New("connector not found"))
+			return
+		}
+		connectorCache.Delete(txtid)
+
+		response := map[string]interface{}{"Details": "Connector deleted successfully"}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Receives agent replies from a helpdesk connector
+func (s *server) ConnectorWebhook() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		connectorType := mux.Vars(r)["type"]
+
+		connector := getUserConnector(s.db, txtid, connectorType)
+		if connector == nil {
+			s.Respond(w, r, http.StatusNotFound, errors.New("connector not configured"))
+			return
+		}
+
+		replies, err := connector.ParseAgentReply(r)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("could not parse connector payload: %v", err))
+			return
+		}
+
+		if clientManager.GetWhatsmeowClient(txtid) == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
+			return
+		}
+		go deliverConnectorReplies(txtid, replies)
+
+		response := map[string]interface{}{"Details": "Accepted", "Replies": len(replies)}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestTicketConnectorInboundAndReceipt(t *testing.T) {
+	received := map[string]map[string]interface{}{}
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer stub-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("Stub could not decode body: %v", err)
+		}
+		received[r.URL.Path] = body
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer stub.Close()
+
+	connector, err := newTicketConnector(json.RawMessage(`{"base_url": "` + stub.URL + `/", "auth_token": "stub-secret", "include_media": true}`))
+	if err != nil {
+		t.Fatalf("Failed to create connector: %v", err)
+	}
+
+	chat := types.NewJID("5511999999999", types.DefaultUserServer)
+	err = connector.OnInboundMessage(context.Background(), ConnectorMessage{
+		UserID:    "user-1",
+		MessageID: "MSG1",
+		Chat:      chat,
+		Sender:    chat,
+		Phone:     chat.User,
+		PushName:  "Alice",
+		Text:      "invoice attached",
+		MediaType: "document",
+		MimeType:  "application/pdf",
+		FileName:  "invoice.pdf",
+		Timestamp: time.Unix(1700000000, 0),
+		Download: func(ctx context.Context) ([]byte, error) {
+			return []byte("%PDF"), nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("OnInboundMessage failed: %v", err)
+	}
+
+	message := received["/messages"]
+	if message["message_id"] != "MSG1" || message["phone"] != "5511999999999" || message["text"] != "invoice attached" {
+		t.Errorf("Unexpected message payload: %v", message)
+	}
+	media, _ := message["media"].(map[string]interface{})
+	if media["file_name"] != "invoice.pdf" || media["data"] != "JVBERg==" {
+		t.Errorf("Unexpected media payload: %v", media)
+	}
+
+	err = connector.OnReceipt(context.Background(), ConnectorReceipt{
+		UserID:     "user-1",
+		MessageIDs: []string{"OUT1"},
+		Chat:       chat,
+		Phone:      chat.User,
+		State:      "Read",
+		Timestamp:  time.Unix(1700000001, 0),
+	})
+	if err != nil {
+		t.Fatalf("OnReceipt failed: %v", err)
+	}
+	if received["/receipts"]["state"] != "Read" {
+		t.Errorf("Unexpected receipt payload: %v", received["/receipts"])
+	}
+}
+
+func TestTicketConnectorReportsHTTPErrors(t *testing.T) {
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "ticket queue closed", http.StatusServiceUnavailable)
+	}))
+	defer stub.Close()
+
+	connector, err := newTicketConnector(json.RawMessage(`{"base_url": "` + stub.URL + `"}`))
+	if err != nil {
+		t.Fatalf("Failed to create connector: %v", err)
+	}
+
+	err = connector.OnInboundMessage(context.Background(), ConnectorMessage{Phone: "5511999999999", Text: "hi"})
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("Expected 503 error, got %v", err)
+	}
+}
+
+func TestTicketConnectorParseAgentReply(t *testing.T) {
+	connector, err := newTicketConnector(json.RawMessage(`{"base_url": "http://127.0.0.1:9"}`))
+	if err != nil {
+		t.Fatalf("Failed to create connector: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		body    string
+		replies int
+		wantErr bool
+	}{
+		{"single", `{"phone": "5511999999999", "text": "hello"}`, 1, false},
+		{"array", `[{"phone": "5511999999999", "text": "a"}, {"phone": "5511999999999", "action": "typing_on"}]`, 2, false},
+		{"wrapped", `{"replies": [{"phone": "5511999999999", "media_url": "http://example.com/a.png", "media_type": "image"}]}`, 1, false},
+		{"missing phone", `{"text": "hello"}`, 0, true},
+		{"empty reply", `{"phone": "5511999999999"}`, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/connectors/ticket/webhook", strings.NewReader(tt.body))
+			replies, err := connector.ParseAgentReply(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if len(replies) != tt.replies {
+				t.Errorf("Expected %d replies, got %d", tt.replies, len(replies))
+			}
+		})
+	}
+}
+
+func TestChatwootConnectorParseAgentReply(t *testing.T) {
+	connector, err := newChatwootConnector(json.RawMessage(`{"url": "http://chatwoot.local", "token": "x", "account_id": "1", "sign_messages": true}`))
+	if err != nil {
+		t.Fatalf("Failed to create connector: %v", err)
+	}
+
+	body := `{"event": "message_created", "message_type": "outgoing", "content": "Hi", "sender": {"name": "Bob"},
+		"conversation": {"meta": {"sender": {"phone_number": "+5511999999999"}}}}`
+	replies, err := connector.ParseAgentReply(httptest.NewRequest("POST", "/chatwoot/webhook", strings.NewReader(body)))
+	if err != nil {
+		t.Fatalf("ParseAgentReply failed: %v", err)
+	}
+	if len(replies) != 1 || replies[0].Text != "Hi\nBob" || replies[0].Phone != "+5511999999999" {
+		t.Errorf("Unexpected replies: %+v", replies)
+	}
+
+	body = `{"event": "conversation_typing_on", "is_private": false, "conversation": {"contact_inbox": {"source_id": "5511999999999"}}}`
+	replies, err = connector.ParseAgentReply(httptest.NewRequest("POST", "/chatwoot/webhook", strings.NewReader(body)))
+	if err != nil {
+		t.Fatalf("ParseAgentReply failed: %v", err)
+	}
+	if len(replies) != 1 || replies[0].Action != ConnectorActionTypingOn {
+		t.Errorf("Unexpected replies: %+v", replies)
+	}
+
+	body = `{"event": "conversation_updated", "id": 7, "meta": {"sender": {"phone_number": "+5511999999999"}}, "agent_last_seen_at": 0}`
+	replies, err = connector.ParseAgentReply(httptest.NewRequest("POST", "/chatwoot/webhook", strings.NewReader(body)))
+	if err != nil {
+		t.Fatalf("ParseAgentReply failed: %v", err)
+	}
+	if len(replies) != 0 {
+		t.Errorf("Expected no read before an agent saw the conversation, got %+v", replies)
+	}
+
+	body = `{"event": "conversation_updated", "id": 7, "meta": {"sender": {"phone_number": "+5511999999999"}}, "agent_last_seen_at": 1700000000}`
+	replies, err = connector.ParseAgentReply(httptest.NewRequest("POST", "/chatwoot/webhook", strings.NewReader(body)))
+	if err != nil {
+		t.Fatalf("ParseAgentReply failed: %v", err)
+	}
+	if len(replies) != 1 || replies[0].Action != ConnectorActionRead || !replies[0].ReadUntil.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("Unexpected replies: %+v", replies)
+	}
+}
+
+func TestChatwootAutoCreateInboxRevokesKeyOnError(t *testing.T) {
+	s := makeTestServer(t)
+	if _, err := s.db.Exec("INSERT INTO users (id, name, token) VALUES ($1, $2, $3)", "inboxuser", "u", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := setUserToken(s.db, "inboxuser", "inbox-user-token", 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { forgetUserTokens("inboxuser") })
+
+	chatwoot := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid inbox", http.StatusUnprocessableEntity)
+	}))
+	defer chatwoot.Close()
+
+	body := `{"config": {"url": "` + chatwoot.URL + `", "account_id": "1", "inbox_name": "Support"}, "session_token": "inbox-user-token", "wuzapi_url": "http://wuzapi.local"}`
+	w := httptest.NewRecorder()
+	s.HandleAutoCreateInbox().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/chatwoot/auto-create", strings.NewReader(body)))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected the Chatwoot error to be passed on, got %d %s", w.Code, w.Body.String())
+	}
+
+	var keys int
+	if err := s.db.Get(&keys, "SELECT COUNT(*) FROM api_keys WHERE user_id = $1", "inboxuser"); err != nil || keys != 0 {
+		t.Errorf("Expected the inbox key to be revoked, got %d (%v)", keys, err)
+	}
+}
+
+func TestConnectorUnreadTracking(t *testing.T) {
+	defer connectorUnreadCache.Flush()
+	group := types.NewJID("120363000000000000", types.GroupServer)
+	alice := types.NewJID("5511999990001", types.DefaultUserServer)
+	bob := types.NewJID("5511999990002", types.DefaultUserServer)
+	start := time.Now()
+
+	// Messages are dispatched from concurrent goroutines, none may be lost
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sender := alice
+			if i%2 == 1 {
+				sender = bob
+			}
+			trackConnectorUnread(ConnectorMessage{UserID: "u1", Phone: "+5511999990001", MessageID: "m" + strconv.Itoa(i), Chat: group, Sender: sender, Timestamp: start.Add(time.Duration(i) * time.Second)})
+		}(i)
+	}
+	wg.Wait()
+
+	read := takeConnectorRead("u1", "5511999990001", start.Add(39*time.Second))
+	if len(read) != 40 {
+		t.Fatalf("expected 40 messages read, got %d", len(read))
+	}
+	receipts := groupConnectorRead(read)
+	if len(receipts) != 2 {
+		t.Fatalf("expected one receipt per sender, got %d", len(receipts))
+	}
+	for _, receipt := range receipts {
+		if receipt.chat != group || len(receipt.ids) != 20 {
+			t.Errorf("unexpected receipt %+v", receipt)
+		}
+		for _, msg := range read {
+			if slices.Contains(receipt.ids, msg.ID) && msg.Sender != receipt.sender {
+				t.Errorf("message %s sent by %s in the receipt of %s", msg.ID, msg.Sender, receipt.sender)
+			}
+		}
+	}
+
+	if rest := takeConnectorRead("u1", "5511999990001", time.Time{}); len(rest) != 10 {
+		t.Errorf("expected the 10 later messages to stay tracked, got %d", len(rest))
+	}
+	if rest := takeConnectorRead("u1", "5511999990001", time.Time{}); rest != nil {
+		t.Errorf("expected nothing left, got %d", len(rest))
+	}
+}
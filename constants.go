@@ -32,6 +32,9 @@ var supportedEventTypes = []string{
 	"PairError",
 	"QR",
 	"QRScannedWithoutMultidevice",
+	"AccountExpired",
+	"Reconnecting",
+	"Reconnected",
 
 	// Privacy and Settings
 	"PrivacySettings",
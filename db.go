@@ -131,6 +131,9 @@ func (s *server) saveMessageToHistory(userID, chatJID, senderJID, messageID, mes
 	if err != nil {
 		return fmt.Errorf("failed to save message to history: %w", err)
 	}
+	if err := s.enforceHistoryQuota(userID); err != nil {
+		return fmt.Errorf("failed to enforce history quota: %w", err)
+	}
 	return nil
 }
 
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Connection history of a session, kept in memory since the process started
+type sessionDiagnostics struct {
+	mu                     sync.Mutex
+	connects               int
+	lastConnectedAt        time.Time
+	lastDisconnectedAt     time.Time
+	lastDisconnectReason   string
+	pendingReason          string // Cause seen before the websocket closed
+	keepAliveFailures      int
+	lastKeepAliveFailureAt time.Time
+	streamErrors           int
+	lastStreamError        string
+	lastMessageReceivedAt  time.Time
+	lastMessageSentAt      time.Time
+
+	pendingWebhooks atomic.Int64 // Deliveries in progress, retries included
+}
+
+var sessionDiagnosticsMap sync.Map
+
+func sessionDiagnosticsFor(userID string) *sessionDiagnostics {
+	if diag, ok := sessionDiagnosticsMap.Load(userID); ok {
+		return diag.(*sessionDiagnostics)
+	}
+	diag, _ := sessionDiagnosticsMap.LoadOrStore(userID, &sessionDiagnostics{})
+	return diag.(*sessionDiagnostics)
+}
+
+func forgetSessionDiagnostics(userID string) {
+	sessionDiagnosticsMap.Delete(userID)
+}
+
+// Records the connection events handled by myEventHandler
+func (d *sessionDiagnostics) recordEvent(rawEvt interface{}) {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch evt := rawEvt.(type) {
+	case *events.Connected:
+		d.connects++
+		d.lastConnectedAt = now
+		d.pendingReason = ""
+	case *events.Disconnected:
+		d.lastDisconnectedAt = now
+		d.lastDisconnectReason = d.pendingReason
+		if d.lastDisconnectReason == "" {
+			d.lastDisconnectReason = "connection closed by server"
+		}
+		d.pendingReason = ""
+	case *events.KeepAliveTimeout:
+		d.keepAliveFailures++
+		d.lastKeepAliveFailureAt = now
+		d.pendingReason = "keepalive timeout"
+	case *events.StreamError:
+		d.streamErrors++
+		d.lastStreamError = evt.Code
+		d.pendingReason = "stream error " + evt.Code
+	}
+}
+
+func (d *sessionDiagnostics) recordMessage(sent bool) {
+	now := time.Now()
+	d.mu.Lock()
+	if sent {
+		d.lastMessageSentAt = now
+	} else {
+		d.lastMessageReceivedAt = now
+	}
+	d.mu.Unlock()
+}
+
+// Zero times are reported as null
+func diagnosticsTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func (d *sessionDiagnostics) report() map[string]interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return map[string]interface{}{
+		"last_connected_at":          diagnosticsTime(d.lastConnectedAt),
+		"last_disconnected_at":       diagnosticsTime(d.lastDisconnectedAt),
+		"last_disconnect_reason":     d.lastDisconnectReason,
+		"reconnects":                 max(d.connects-1, 0),
+		"keepalive_failures":         d.keepAliveFailures,
+		"last_keepalive_failure_at":  diagnosticsTime(d.lastKeepAliveFailureAt),
+		"stream_errors":              d.streamErrors,
+		"last_stream_error":          d.lastStreamError,
+		"last_message_received_at":   diagnosticsTime(d.lastMessageReceivedAt),
+		"last_message_sent_at":       diagnosticsTime(d.lastMessageSentAt),
+		"pending_webhook_deliveries": d.pendingWebhooks.Load(),
+	}
+}
+
+// Proxy URL without its password
+func redactProxyURL(proxyURL string) string {
+	parsed, err := url.Parse(proxyURL)
+	if err != nil {
+		return ""
+	}
+	return parsed.Redacted()
+}
+
+// Connection history, webhook backlog, proxy and device details of the session
+func (s *server) GetSessionDiagnostics() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		response := sessionDiagnosticsFor(txtid).report()
+		response["id"] = txtid
+		response["connected"] = false
+		response["logged_in"] = false
+
+		var proxyURL string
+		s.db.QueryRow("SELECT COALESCE(proxy_url, '') FROM users WHERE id = $1", txtid).Scan(&proxyURL)
+		response["proxy"] = map[string]interface{}{
+			"enabled":   proxyURL != "",
+			"proxy_url": redactProxyURL(proxyURL),
+		}
+
+		device := map[string]interface{}{
+			"os":            store.DeviceProps.GetOs(),
+			"platform_type": store.DeviceProps.GetPlatformType().String(),
+		}
+		if client := clientManager.GetWhatsmeowClient(txtid); client != nil {
+			response["connected"] = client.IsConnected()
+			response["logged_in"] = client.IsLoggedIn()
+			if client.Store != nil {
+				device["jid"] = client.Store.GetJID().String()
+				device["lid"] = client.Store.LID.String()
+				device["platform"] = client.Store.Platform
+				device["business_name"] = client.Store.BusinessName
+				device["push_name"] = client.Store.PushName
+				device["registration_id"] = client.Store.RegistrationID
+				device["initialized"] = client.Store.Initialized
+			}
+		}
+		response["device"] = device
+
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		s.Respond(w, r, http.StatusOK, string(responseJson))
+	}
+}
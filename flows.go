@@ -0,0 +1,942 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	flowMaxStepsPerMessage = 50
+	flowDefaultWaitTimeout = 24 * time.Hour
+	flowHTTPTimeout        = 10 * time.Second
+	flowHTTPMaxBytes       = 1024 * 1024 // 1MB
+	flowMediaMaxBytes      = 32 * 1024 * 1024
+)
+
+var flowVariablePattern = regexp.MustCompile(`\{\{\s*([\w.]+)\s*\}\}`)
+
+// Serializes flow processing per chat so two quick messages don't race on the same state
+var flowChatLocks = NewKeyedMutex()
+
+// Compiled trigger, branch and auto-reply expressions, by pattern
+var flowRegexCache = cache.New(time.Hour, 10*time.Minute)
+
+func compileFlowRegex(pattern string) (*regexp.Regexp, error) {
+	if cached, found := flowRegexCache.Get(pattern); found {
+		return cached.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	flowRegexCache.Set(pattern, re, cache.DefaultExpiration)
+	return re, nil
+}
+
+type FlowDefinition struct {
+	ID       string       `json:"id,omitempty"`
+	Name     string       `json:"name"`
+	Enabled  bool         `json:"enabled"`
+	Priority int          `json:"priority"`
+	Start    string       `json:"start"`
+	Triggers FlowTriggers `json:"triggers"`
+	Chats    []string     `json:"chats,omitempty"`
+	Nodes    []FlowNode   `json:"nodes"`
+}
+
+type FlowTriggers struct {
+	Keywords []string `json:"keywords,omitempty"`
+	Regex    string   `json:"regex,omitempty"`
+	Any      bool     `json:"any,omitempty"`
+}
+
+type FlowNode struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Next string `json:"next,omitempty"`
+
+	// send_text, send_media, send_buttons, send_list
+	Text       string            `json:"text,omitempty"`
+	MediaType  string            `json:"media_type,omitempty"`
+	URL        string            `json:"url,omitempty"`
+	FileName   string            `json:"file_name,omitempty"`
+	Buttons    []FlowButton      `json:"buttons,omitempty"`
+	ButtonText string            `json:"button_text,omitempty"`
+	Sections   []FlowListSection `json:"sections,omitempty"`
+	Footer     string            `json:"footer,omitempty"`
+
+	// wait_reply, set_variable, branch, http
+	Variable       string            `json:"variable,omitempty"`
+	Value          string            `json:"value,omitempty"`
+	TimeoutSeconds int               `json:"timeout_seconds,omitempty"`
+	Rules          []FlowBranchRule  `json:"rules,omitempty"`
+	Default        string            `json:"default,omitempty"`
+	Method         string            `json:"method,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	Body           string            `json:"body,omitempty"`
+}
+
+type FlowButton struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+}
+
+type FlowListSection struct {
+	Title string        `json:"title"`
+	Rows  []FlowListRow `json:"rows"`
+}
+
+type FlowListRow struct {
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+}
+
+type FlowBranchRule struct {
+	Match string `json:"match"` // keyword, contains, regex
+	Value string `json:"value"`
+	Next  string `json:"next"`
+}
+
+type FlowSession struct {
+	UserID      string            `json:"-" db:"user_id"`
+	ChatJID     string            `json:"chat_jid" db:"chat_jid"`
+	FlowID      string            `json:"flow_id" db:"flow_id"`
+	CurrentNode string            `json:"current_node" db:"current_node"`
+	VarsJSON    string            `json:"-" db:"variables"`
+	ExpiresAt   sql.NullTime      `json:"-" db:"expires_at"`
+	UpdatedAt   time.Time         `json:"updated_at" db:"updated_at"`
+	Variables   map[string]string `json:"variables" db:"-"`
+}
+
+var flowNodeTypes = map[string]bool{
+	"send_text":    true,
+	"send_media":   true,
+	"send_buttons": true,
+	"send_list":    true,
+	"wait_reply":   true,
+	"branch":       true,
+	"set_variable": true,
+	"http":         true,
+}
+
+// Checks node types, references and regular expressions before a flow is stored
+func (f *FlowDefinition) Validate() error {
+	if f.Name == "" {
+		return errors.New("missing name")
+	}
+	if len(f.Nodes) == 0 {
+		return errors.New("flow has no nodes")
+	}
+	if f.Triggers.Regex != "" {
+		if _, err := compileFlowRegex(f.Triggers.Regex); err != nil {
+			return fmt.Errorf("invalid trigger regex: %v", err)
+		}
+	}
+
+	nodes := make(map[string]FlowNode, len(f.Nodes))
+	for _, node := range f.Nodes {
+		if node.ID == "" {
+			return errors.New("node without id")
+		}
+		if _, dup := nodes[node.ID]; dup {
+			return fmt.Errorf("duplicate node id %q", node.ID)
+		}
+		if !flowNodeTypes[node.Type] {
+			return fmt.Errorf("node %q has unknown type %q", node.ID, node.Type)
+		}
+		nodes[node.ID] = node
+	}
+	if f.Start == "" {
+		f.Start = f.Nodes[0].ID
+	}
+	if _, ok := nodes[f.Start]; !ok {
+		return fmt.Errorf("start node %q not found", f.Start)
+	}
+
+	exists := func(id string) bool {
+		_, ok := nodes[id]
+		return id == "" || ok
+	}
+	for _, node := range f.Nodes {
+		if !exists(node.Next) {
+			return fmt.Errorf("node %q points to unknown node %q", node.ID, node.Next)
+		}
+		switch node.Type {
+		case "send_text":
+			if node.Text == "" {
+				return fmt.Errorf("node %q needs text", node.ID)
+			}
+		case "send_media":
+			if !isHTTPURL(node.URL) {
+				return fmt.Errorf("node %q needs an http(s) url", node.ID)
+			}
+		case "send_buttons":
+			if node.Text == "" || len(node.Buttons) == 0 || len(node.Buttons) > 3 {
+				return fmt.Errorf("node %q needs text and 1 to 3 buttons", node.ID)
+			}
+		case "send_list":
+			if node.Text == "" || node.ButtonText == "" || len(node.Sections) == 0 {
+				return fmt.Errorf("node %q needs text, button_text and sections", node.ID)
+			}
+		case "wait_reply", "set_variable":
+			if node.Variable == "" {
+				return fmt.Errorf("node %q needs a variable", node.ID)
+			}
+		case "http":
+			if !isHTTPURL(node.URL) {
+				return fmt.Errorf("node %q needs an http(s) url", node.ID)
+			}
+		case "branch":
+			if !exists(node.Default) {
+				return fmt.Errorf("node %q default points to unknown node %q", node.ID, node.Default)
+			}
+			for _, rule := range node.Rules {
+				if !exists(rule.Next) {
+					return fmt.Errorf("node %q rule points to unknown node %q", node.ID, rule.Next)
+				}
+				switch rule.Match {
+				case "keyword", "contains":
+				case "regex":
+					if _, err := compileFlowRegex(rule.Value); err != nil {
+						return fmt.Errorf("node %q has invalid regex: %v", node.ID, err)
+					}
+				default:
+					return fmt.Errorf("node %q has unknown match %q", node.ID, rule.Match)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (f *FlowDefinition) node(id string) (FlowNode, bool) {
+	for _, node := range f.Nodes {
+		if node.ID == id {
+			return node, true
+		}
+	}
+	return FlowNode{}, false
+}
+
+func (f *FlowDefinition) appliesToChat(chat string) bool {
+	if len(f.Chats) == 0 {
+		return true
+	}
+	for _, allowed := range f.Chats {
+		if allowed == chat || strings.Split(allowed, "@")[0] == strings.Split(chat, "@")[0] {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *FlowDefinition) triggeredBy(text string) bool {
+	if f.Triggers.Any {
+		return true
+	}
+	for _, keyword := range f.Triggers.Keywords {
+		if matchesKeyword(text, keyword) {
+			return true
+		}
+	}
+	if f.Triggers.Regex != "" {
+		if re, err := compileFlowRegex(f.Triggers.Regex); err == nil && re.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesKeyword(text string, keyword string) bool {
+	return strings.EqualFold(strings.TrimSpace(text), strings.TrimSpace(keyword))
+}
+
+func matchesBranchRule(rule FlowBranchRule, value string) bool {
+	switch rule.Match {
+	case "keyword":
+		for _, keyword := range strings.Split(rule.Value, ",") {
+			if matchesKeyword(value, keyword) {
+				return true
+			}
+		}
+	case "contains":
+		return strings.Contains(strings.ToLower(value), strings.ToLower(rule.Value))
+	case "regex":
+		re, err := compileFlowRegex(rule.Value)
+		return err == nil && re.MatchString(value)
+	}
+	return false
+}
+
+func interpolateFlowVars(text string, vars map[string]string) string {
+	return interpolateFlowVarsEscaped(text, vars, nil)
+}
+
+// Replaces the variables with their values passed through escape, so message text can't change
+// the structure of what it is pasted into
+func interpolateFlowVarsEscaped(text string, vars map[string]string, escape func(string) string) string {
+	return flowVariablePattern.ReplaceAllStringFunc(text, func(match string) string {
+		name := flowVariablePattern.FindStringSubmatch(match)[1]
+		if escape == nil {
+			return vars[name]
+		}
+		return escape(vars[name])
+	})
+}
+
+// Escapes a value for use inside a JSON string
+func escapeFlowJSON(value string) string {
+	encoded, _ := json.Marshal(value)
+	return string(encoded[1 : len(encoded)-1])
+}
+
+// Values in the path are path escaped and values after the "?" query escaped
+func interpolateFlowURL(rawURL string, vars map[string]string) string {
+	path, query, hasQuery := strings.Cut(rawURL, "?")
+	interpolated := interpolateFlowVarsEscaped(path, vars, url.PathEscape)
+	if hasQuery {
+		interpolated += "?" + interpolateFlowVarsEscaped(query, vars, url.QueryEscape)
+	}
+	return interpolated
+}
+
+// Line breaks would end the header
+func stripFlowHeaderBreaks(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
+
+// Text of an incoming message, including button and list selections
+func incomingMessageText(msg *waE2E.Message) string {
+	switch {
+	case msg.GetConversation() != "":
+		return msg.GetConversation()
+	case msg.GetExtendedTextMessage() != nil:
+		return msg.GetExtendedTextMessage().GetText()
+	case msg.GetButtonsResponseMessage() != nil:
+		return msg.GetButtonsResponseMessage().GetSelectedButtonID()
+	case msg.GetListResponseMessage() != nil:
+		return msg.GetListResponseMessage().GetSingleSelectReply().GetSelectedRowID()
+	case msg.GetTemplateButtonReplyMessage() != nil:
+		return msg.GetTemplateButtonReplyMessage().GetSelectedID()
+	case msg.GetImageMessage() != nil:
+		return msg.GetImageMessage().GetCaption()
+	case msg.GetVideoMessage() != nil:
+		return msg.GetVideoMessage().GetCaption()
+	case msg.GetDocumentMessage() != nil:
+		return msg.GetDocumentMessage().GetCaption()
+	}
+	return ""
+}
+
+func (s *server) loadFlow(userID string, flowID string) (*FlowDefinition, error) {
+	var row struct {
+		Definition string `db:"definition"`
+		Enabled    bool   `db:"enabled"`
+		Priority   int    `db:"priority"`
+	}
+	err := s.db.Get(&row, "SELECT definition, enabled, priority FROM flows WHERE user_id = $1 AND id = $2", userID, flowID)
+	if err != nil {
+		return nil, err
+	}
+	var flow FlowDefinition
+	if err := json.Unmarshal([]byte(row.Definition), &flow); err != nil {
+		return nil, err
+	}
+	flow.ID = flowID
+	flow.Enabled = row.Enabled
+	flow.Priority = row.Priority
+	return &flow, nil
+}
+
+func (s *server) loadFlowSession(userID string, chatJID string) (*FlowSession, error) {
+	var session FlowSession
+	err := s.db.Get(&session, "SELECT user_id, chat_jid, flow_id, current_node, variables, expires_at, updated_at FROM flow_sessions WHERE user_id = $1 AND chat_jid = $2", userID, chatJID)
+	if err != nil {
+		return nil, err
+	}
+	session.Variables = map[string]string{}
+	json.Unmarshal([]byte(session.VarsJSON), &session.Variables)
+	return &session, nil
+}
+
+func (s *server) saveFlowSession(session *FlowSession) error {
+	vars, err := json.Marshal(session.Variables)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`
+		INSERT INTO flow_sessions (user_id, chat_jid, flow_id, current_node, variables, expires_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (user_id, chat_jid) DO UPDATE SET
+			flow_id = excluded.flow_id,
+			current_node = excluded.current_node,
+			variables = excluded.variables,
+			expires_at = excluded.expires_at,
+			updated_at = excluded.updated_at`,
+		session.UserID, session.ChatJID, session.FlowID, session.CurrentNode, string(vars), session.ExpiresAt, time.Now())
+	return err
+}
+
+func (s *server) deleteFlowSession(userID string, chatJID string) {
+	if _, err := s.db.Exec("DELETE FROM flow_sessions WHERE user_id = $1 AND chat_jid = $2", userID, chatJID); err != nil {
+		log.Error().Err(err).Str("userID", userID).Str("chat", chatJID).Msg("Failed to delete flow session")
+	}
+}
+
+// Feeds an incoming message to the flow engine. Returns true when a flow handled it.
+func (mycli *MyClient) handleFlowMessage(evt *events.Message) bool {
+	if evt.Info.IsFromMe || evt.Info.Chat.Server == types.BroadcastServer {
+		return false
+	}
+	text := incomingMessageText(evt.Message)
+	chat := evt.Info.Chat.String()
+
+	unlock := flowChatLocks.Lock(mycli.userID + "|" + chat)
+	defer unlock()
+
+	s := mycli.s
+	session, err := s.loadFlowSession(mycli.userID, chat)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Error().Err(err).Str("userID", mycli.userID).Msg("Failed to load flow session")
+		return false
+	}
+
+	var flow *FlowDefinition
+	if session != nil {
+		if session.ExpiresAt.Valid && time.Now().After(session.ExpiresAt.Time) {
+			s.deleteFlowSession(mycli.userID, chat)
+			session = nil
+		} else if flow, err = s.loadFlow(mycli.userID, session.FlowID); err != nil || !flow.Enabled {
+			s.deleteFlowSession(mycli.userID, chat)
+			session = nil
+		}
+	}
+
+	if session != nil {
+		// The session is parked on a wait_reply node: store the answer and move on
+		node, ok := flow.node(session.CurrentNode)
+		if !ok || node.Type != "wait_reply" {
+			s.deleteFlowSession(mycli.userID, chat)
+			return false
+		}
+		session.Variables[node.Variable] = text
+		session.Variables["last_message"] = text
+		session.CurrentNode = node.Next
+	} else {
+		flow = s.findTriggeredFlow(mycli.userID, chat, text)
+		if flow == nil {
+			return false
+		}
+		session = &FlowSession{
+			UserID:      mycli.userID,
+			ChatJID:     chat,
+			FlowID:      flow.ID,
+			CurrentNode: flow.Start,
+			Variables: map[string]string{
+				"phone":        evt.Info.Sender.User,
+				"name":         evt.Info.PushName,
+				"chat":         chat,
+				"message":      text,
+				"last_message": text,
+			},
+		}
+		log.Info().Str("userID", mycli.userID).Str("flow", flow.ID).Str("chat", chat).Msg("Starting flow")
+	}
+
+	mycli.runFlow(flow, session, evt.Info.Chat)
+	return true
+}
+
+func (s *server) findTriggeredFlow(userID string, chat string, text string) *FlowDefinition {
+	var rows []struct {
+		ID         string `db:"id"`
+		Definition string `db:"definition"`
+		Priority   int    `db:"priority"`
+	}
+	err := s.db.Select(&rows, "SELECT id, definition, priority FROM flows WHERE user_id = $1 AND enabled = $2 ORDER BY priority DESC, created_at ASC", userID, true)
+	if err != nil {
+		log.Error().Err(err).Str("userID", userID).Msg("Failed to load flows")
+		return nil
+	}
+	for _, row := range rows {
+		var flow FlowDefinition
+		if err := json.Unmarshal([]byte(row.Definition), &flow); err != nil {
+			continue
+		}
+		flow.ID = row.ID
+		flow.Enabled = true
+		flow.Priority = row.Priority
+		if flow.appliesToChat(chat) && flow.triggeredBy(text) {
+			return &flow
+		}
+	}
+	return nil
+}
+
+// Executes nodes until the flow waits for a reply or ends
+func (mycli *MyClient) runFlow(flow *FlowDefinition, session *FlowSession, chat types.JID) {
+	s := mycli.s
+	for step := 0; step < flowMaxStepsPerMessage; step++ {
+		if session.CurrentNode == "" {
+			log.Info().Str("userID", mycli.userID).Str("flow", flow.ID).Str("chat", session.ChatJID).Msg("Flow finished")
+			s.deleteFlowSession(mycli.userID, session.ChatJID)
+			return
+		}
+		node, ok := flow.node(session.CurrentNode)
+		if !ok {
+			s.deleteFlowSession(mycli.userID, session.ChatJID)
+			return
+		}
+
+		if node.Type == "wait_reply" {
+			timeout := flowDefaultWaitTimeout
+			if node.TimeoutSeconds > 0 {
+				timeout = time.Duration(node.TimeoutSeconds) * time.Second
+			}
+			session.ExpiresAt = sql.NullTime{Time: time.Now().Add(timeout), Valid: true}
+			if err := s.saveFlowSession(session); err != nil {
+				log.Error().Err(err).Str("userID", mycli.userID).Str("flow", flow.ID).Msg("Failed to save flow session")
+			}
+			return
+		}
+
+		next, err := mycli.executeFlowNode(node, session.Variables, chat)
+		if err != nil {
+			log.Error().Err(err).Str("userID", mycli.userID).Str("flow", flow.ID).Str("node", node.ID).Msg("Flow node failed")
+			s.deleteFlowSession(mycli.userID, session.ChatJID)
+			return
+		}
+		session.CurrentNode = next
+	}
+
+	log.Warn().Str("userID", mycli.userID).Str("flow", flow.ID).Msg("Flow stopped after too many steps without waiting for a reply")
+	s.deleteFlowSession(mycli.userID, session.ChatJID)
+}
+
+func (mycli *MyClient) executeFlowNode(node FlowNode, vars map[string]string, chat types.JID) (string, error) {
+	switch node.Type {
+	case "send_text":
+		text := interpolateFlowVars(node.Text, vars)
+		_, err := mycli.sendAutomatedMessage(chat, &waE2E.Message{Conversation: proto.String(text)}, "text", text)
+		return node.Next, err
+
+	case "send_media":
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		data, _, err := fetchURLBytes(ctx, interpolateFlowURL(node.URL, vars), flowMediaMaxBytes)
+		if err != nil {
+			return "", fmt.Errorf("failed to fetch media: %w", err)
+		}
+		if err := mycli.s.consumeUsage(mycli.userID, 0, int64(len(data))); err != nil {
+			return "", err
+		}
+		caption := interpolateFlowVars(node.Text, vars)
+		msg, err := uploadMediaMessage(ctx, mycli.WAClient, data, node.MediaType, caption, node.FileName)
+		if err == nil {
+			_, err = mycli.sendAutomatedMessage(chat, msg, node.MediaType, caption)
+		}
+		if err != nil {
+			mycli.s.refundUsage(mycli.userID, 0, int64(len(data)))
+			return "", err
+		}
+		return node.Next, nil
+
+	case "send_buttons":
+		var buttons []*waE2E.ButtonsMessage_Button
+		for _, button := range node.Buttons {
+			buttons = append(buttons, &waE2E.ButtonsMessage_Button{
+				ButtonID:       proto.String(button.ID),
+				ButtonText:     &waE2E.ButtonsMessage_Button_ButtonText{DisplayText: proto.String(interpolateFlowVars(button.Text, vars))},
+				Type:           waE2E.ButtonsMessage_Button_RESPONSE.Enum(),
+				NativeFlowInfo: &waE2E.ButtonsMessage_Button_NativeFlowInfo{},
+			})
+		}
+		text := interpolateFlowVars(node.Text, vars)
+		msg := &waE2E.Message{ViewOnceMessage: &waE2E.FutureProofMessage{
+			Message: &waE2E.Message{
+				ButtonsMessage: &waE2E.ButtonsMessage{
+					ContentText: proto.String(text),
+					HeaderType:  waE2E.ButtonsMessage_EMPTY.Enum(),
+					Buttons:     buttons,
+				},
+			},
+		}}
+		_, err := mycli.sendAutomatedMessage(chat, msg, "buttons", text)
+		return node.Next, err
+
+	case "send_list":
+		var sections []*waE2E.ListMessage_Section
+		for _, section := range node.Sections {
+			var rows []*waE2E.ListMessage_Row
+			for _, row := range section.Rows {
+				rowID := row.ID
+				if rowID == "" {
+					rowID = row.Title
+				}
+				rows = append(rows, &waE2E.ListMessage_Row{
+					RowID:       proto.String(rowID),
+					Title:       proto.String(interpolateFlowVars(row.Title, vars)),
+					Description: proto.String(interpolateFlowVars(row.Description, vars)),
+				})
+			}
+			sections = append(sections, &waE2E.ListMessage_Section{
+				Title: proto.String(section.Title),
+				Rows:  rows,
+			})
+		}
+		text := interpolateFlowVars(node.Text, vars)
+		listMsg := &waE2E.ListMessage{
+			Title:       proto.String(text),
+			Description: proto.String(text),
+			ButtonText:  proto.String(node.ButtonText),
+			ListType:    waE2E.ListMessage_SINGLE_SELECT.Enum(),
+			Sections:    sections,
+		}
+		if node.Footer != "" {
+			listMsg.FooterText = proto.String(node.Footer)
+		}
+		msg := &waE2E.Message{ViewOnceMessage: &waE2E.FutureProofMessage{
+			Message: &waE2E.Message{ListMessage: listMsg},
+		}}
+		_, err := mycli.sendAutomatedMessage(chat, msg, "list", text)
+		return node.Next, err
+
+	case "set_variable":
+		vars[node.Variable] = interpolateFlowVars(node.Value, vars)
+		return node.Next, nil
+
+	case "branch":
+		value := vars["last_message"]
+		if node.Variable != "" {
+			value = vars[node.Variable]
+		}
+		for _, rule := range node.Rules {
+			if matchesBranchRule(rule, value) {
+				return rule.Next, nil
+			}
+		}
+		return node.Default, nil
+
+	case "http":
+		return node.Next, callFlowHTTP(node, vars)
+	}
+	return "", fmt.Errorf("unknown node type %q", node.Type)
+}
+
+// Calls an external endpoint and stores the response body in the node variable.
+// Top level fields of a JSON object response are also stored as variable.field.
+func callFlowHTTP(node FlowNode, vars map[string]string) error {
+	method := strings.ToUpper(node.Method)
+	if method == "" {
+		method = "GET"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), flowHTTPTimeout)
+	defer cancel()
+
+	var body io.Reader
+	if node.Body != "" {
+		body = strings.NewReader(interpolateFlowVarsEscaped(node.Body, vars, escapeFlowJSON))
+	}
+	req, err := http.NewRequestWithContext(ctx, method, interpolateFlowURL(node.URL, vars), body)
+	if err != nil {
+		return err
+	}
+	if node.Body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for key, value := range node.Headers {
+		req.Header.Set(key, interpolateFlowVarsEscaped(value, vars, stripFlowHeaderBreaks))
+	}
+
+	resp, err := globalHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, flowHTTPMaxBytes))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("http node got status %d", resp.StatusCode)
+	}
+
+	if node.Variable == "" {
+		return nil
+	}
+	vars[node.Variable] = string(respBody)
+	var fields map[string]interface{}
+	if json.Unmarshal(respBody, &fields) == nil {
+		for key, value := range fields {
+			switch v := value.(type) {
+			case string:
+				vars[node.Variable+"."+key] = v
+			case nil:
+				vars[node.Variable+"."+key] = ""
+			default:
+				encoded, _ := json.Marshal(v)
+				vars[node.Variable+"."+key] = string(encoded)
+			}
+		}
+	}
+	return nil
+}
+
+// Upload or update a flow
+func (s *server) SaveFlow() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		var flow FlowDefinition
+		if err := json.NewDecoder(r.Body).Decode(&flow); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode payload"))
+			return
+		}
+		if err := flow.Validate(); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("invalid flow: %v", err))
+			return
+		}
+
+		if flow.ID == "" {
+			id, err := GenerateRandomID()
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			flow.ID = id
+		}
+		definition, err := json.Marshal(flow)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		result, err := s.db.Exec(`
+			INSERT INTO flows (id, user_id, name, definition, enabled, priority)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (id) DO UPDATE SET
+				name = excluded.name,
+				definition = excluded.definition,
+				enabled = excluded.enabled,
+				priority = excluded.priority,
+				updated_at = CURRENT_TIMESTAMP
+			WHERE flows.user_id = excluded.user_id`,
+			flow.ID, txtid, flow.Name, string(definition), flow.Enabled, flow.Priority)
+		if err != nil {
+			log.Error().Err(err).Str("userID", txtid).Msg("Failed to save flow")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to save flow"))
+			return
+		}
+		// The upsert skips ids owned by another user
+		if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+			s.Respond(w, r, http.StatusNotFound, errors.New("flow not found"))
+			return
+		}
+
+		response := map[string]interface{}{"Details": "Flow saved", "Id": flow.ID, "Enabled": flow.Enabled}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// List flows
+func (s *server) ListFlows() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		flows := []struct {
+			ID        string    `json:"id" db:"id"`
+			Name      string    `json:"name" db:"name"`
+			Enabled   bool      `json:"enabled" db:"enabled"`
+			Priority  int       `json:"priority" db:"priority"`
+			UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+		}{}
+		err := s.db.Select(&flows, "SELECT id, name, enabled, priority, updated_at FROM flows WHERE user_id = $1 ORDER BY priority DESC, created_at ASC", txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to list flows"))
+			return
+		}
+
+		responseJson, err := json.Marshal(flows)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Get a flow definition
+func (s *server) GetFlow() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		flow, err := s.loadFlow(txtid, mux.Vars(r)["id"])
+		if errors.Is(err, sql.ErrNoRows) {
+			s.Respond(w, r, http.StatusNotFound, errors.New("flow not found"))
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to load flow"))
+			return
+		}
+
+		responseJson, err := json.Marshal(flow)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Enable or disable a flow
+func (s *server) SetFlowEnabled(enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		flowID := mux.Vars(r)["id"]
+
+		flow, err := s.loadFlow(txtid, flowID)
+		if errors.Is(err, sql.ErrNoRows) {
+			s.Respond(w, r, http.StatusNotFound, errors.New("flow not found"))
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to load flow"))
+			return
+		}
+		flow.Enabled = enabled
+		definition, _ := json.Marshal(flow)
+
+		_, err = s.db.Exec("UPDATE flows SET enabled = $1, definition = $2, updated_at = CURRENT_TIMESTAMP WHERE user_id = $3 AND id = $4", enabled, string(definition), txtid, flowID)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to update flow"))
+			return
+		}
+		if !enabled {
+			s.db.Exec("DELETE FROM flow_sessions WHERE user_id = $1 AND flow_id = $2", txtid, flowID)
+		}
+
+		response := map[string]interface{}{"Details": "Flow updated", "Id": flowID, "Enabled": enabled}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Delete a flow and its running sessions
+func (s *server) DeleteFlow() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		flowID := mux.Vars(r)["id"]
+
+		result, err := s.db.Exec("DELETE FROM flows WHERE user_id = $1 AND id = $2", txtid, flowID)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to delete flow"))
+			return
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			s.Respond(w, r, http.StatusNotFound, errors.New("flow not found"))
+			return
+		}
+		s.db.Exec("DELETE FROM flow_sessions WHERE user_id = $1 AND flow_id = $2", txtid, flowID)
+
+		response := map[string]interface{}{"Details": "Flow deleted", "Id": flowID}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Inspect running flow sessions, optionally for a single chat
+func (s *server) GetFlowSessions() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		chatJID := r.URL.Query().Get("chat_jid")
+
+		var sessions []FlowSession
+		var err error
+		if chatJID != "" {
+			err = s.db.Select(&sessions, "SELECT user_id, chat_jid, flow_id, current_node, variables, expires_at, updated_at FROM flow_sessions WHERE user_id = $1 AND chat_jid = $2", txtid, chatJID)
+		} else {
+			err = s.db.Select(&sessions, "SELECT user_id, chat_jid, flow_id, current_node, variables, expires_at, updated_at FROM flow_sessions WHERE user_id = $1 ORDER BY updated_at DESC", txtid)
+		}
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to list flow sessions"))
+			return
+		}
+
+		result := make([]map[string]interface{}, 0, len(sessions))
+		for _, session := range sessions {
+			vars := map[string]string{}
+			json.Unmarshal([]byte(session.VarsJSON), &vars)
+			entry := map[string]interface{}{
+				"chat_jid":     session.ChatJID,
+				"flow_id":      session.FlowID,
+				"current_node": session.CurrentNode,
+				"variables":    vars,
+				"updated_at":   session.UpdatedAt,
+			}
+			if session.ExpiresAt.Valid {
+				entry["expires_at"] = session.ExpiresAt.Time
+			}
+			result = append(result, entry)
+		}
+
+		responseJson, err := json.Marshal(result)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Reset the flow session of a chat
+func (s *server) DeleteFlowSession() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		chatJID := r.URL.Query().Get("chat_jid")
+		if chatJID == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing chat_jid"))
+			return
+		}
+
+		s.deleteFlowSession(txtid, chatJID)
+
+		response := map[string]interface{}{"Details": "Flow session reset", "ChatJID": chatJID}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestFlowValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		flow FlowDefinition
+		ok   bool
+	}{
+		{"valid", FlowDefinition{Name: "f", Nodes: []FlowNode{{ID: "a", Type: "send_text", Text: "hi"}}}, true},
+		{"missing name", FlowDefinition{Nodes: []FlowNode{{ID: "a", Type: "send_text", Text: "hi"}}}, false},
+		{"no nodes", FlowDefinition{Name: "f"}, false},
+		{"unknown type", FlowDefinition{Name: "f", Nodes: []FlowNode{{ID: "a", Type: "jump"}}}, false},
+		{"duplicate id", FlowDefinition{Name: "f", Nodes: []FlowNode{{ID: "a", Type: "send_text", Text: "x"}, {ID: "a", Type: "send_text", Text: "y"}}}, false},
+		{"unknown next", FlowDefinition{Name: "f", Nodes: []FlowNode{{ID: "a", Type: "send_text", Text: "x", Next: "b"}}}, false},
+		{"unknown start", FlowDefinition{Name: "f", Start: "b", Nodes: []FlowNode{{ID: "a", Type: "send_text", Text: "x"}}}, false},
+		{"bad trigger regex", FlowDefinition{Name: "f", Triggers: FlowTriggers{Regex: "("}, Nodes: []FlowNode{{ID: "a", Type: "send_text", Text: "x"}}}, false},
+		{"bad branch regex", FlowDefinition{Name: "f", Nodes: []FlowNode{{ID: "a", Type: "branch", Rules: []FlowBranchRule{{Match: "regex", Value: "["}}}}}, false},
+		{"unknown match", FlowDefinition{Name: "f", Nodes: []FlowNode{{ID: "a", Type: "branch", Rules: []FlowBranchRule{{Match: "fuzzy", Value: "x"}}}}}, false},
+		{"wait without variable", FlowDefinition{Name: "f", Nodes: []FlowNode{{ID: "a", Type: "wait_reply"}}}, false},
+		{"media without url", FlowDefinition{Name: "f", Nodes: []FlowNode{{ID: "a", Type: "send_media", URL: "file:///etc/passwd"}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.flow.Validate()
+			if (err == nil) != tt.ok {
+				t.Errorf("Expected ok=%v, got %v", tt.ok, err)
+			}
+		})
+	}
+
+	flow := FlowDefinition{Name: "f", Nodes: []FlowNode{{ID: "first", Type: "send_text", Text: "x"}}}
+	if err := flow.Validate(); err != nil || flow.Start != "first" {
+		t.Errorf("Expected start to default to the first node, got %q (%v)", flow.Start, err)
+	}
+}
+
+func TestFlowTriggersAndBranches(t *testing.T) {
+	flow := FlowDefinition{Triggers: FlowTriggers{Keywords: []string{"menu"}, Regex: `(?i)^order\s+\d+$`}}
+	for text, triggered := range map[string]bool{" MENU ": true, "menu please": false, "Order 42": true, "order x": false} {
+		if got := flow.triggeredBy(text); got != triggered {
+			t.Errorf("triggeredBy(%q): expected %v, got %v", text, triggered, got)
+		}
+	}
+	if !(&FlowDefinition{Triggers: FlowTriggers{Any: true}}).triggeredBy("anything") {
+		t.Error("Expected any trigger to match every message")
+	}
+
+	tests := []struct {
+		rule  FlowBranchRule
+		value string
+		match bool
+	}{
+		{FlowBranchRule{Match: "keyword", Value: "yes, y"}, "Y", true},
+		{FlowBranchRule{Match: "keyword", Value: "yes"}, "yes please", false},
+		{FlowBranchRule{Match: "contains", Value: "Price"}, "what is the price?", true},
+		{FlowBranchRule{Match: "regex", Value: `^\d{5}-\d{3}$`}, "01310-100", true},
+		{FlowBranchRule{Match: "regex", Value: `^\d{5}-\d{3}$`}, "0131", false},
+		{FlowBranchRule{Match: "regex", Value: `(`}, "(", false},
+	}
+	for _, tt := range tests {
+		if got := matchesBranchRule(tt.rule, tt.value); got != tt.match {
+			t.Errorf("%s %q against %q: expected %v, got %v", tt.rule.Match, tt.rule.Value, tt.value, tt.match, got)
+		}
+	}
+
+	first, _ := compileFlowRegex(`^\d+$`)
+	second, _ := compileFlowRegex(`^\d+$`)
+	if first != second {
+		t.Error("Expected the compiled regex to be cached")
+	}
+}
+
+func TestInterpolateFlowVars(t *testing.T) {
+	vars := map[string]string{"name": "Ana", "order.status": "shipped"}
+	got := interpolateFlowVars("Hi {{name}}, your order is {{ order.status }}{{missing}}.", vars)
+	if got != "Hi Ana, your order is shipped." {
+		t.Errorf("Unexpected text %q", got)
+	}
+
+	// Message text can't add JSON fields, query parameters or headers
+	vars = map[string]string{"message": `hi", "admin": true, "x": "a&b=c/d`, "id": "../1 2"}
+	body := interpolateFlowVarsEscaped(`{"text": "{{message}}"}`, vars, escapeFlowJSON)
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &decoded); err != nil || len(decoded) != 1 || decoded["text"] != vars["message"] {
+		t.Errorf("Unexpected body %s (%v)", body, err)
+	}
+	if got := interpolateFlowURL("https://example.com/orders/{{id}}?q={{message}}", vars); got != "https://example.com/orders/..%2F1%202?q=hi%22%2C+%22admin%22%3A+true%2C+%22x%22%3A+%22a%26b%3Dc%2Fd" {
+		t.Errorf("Unexpected url %q", got)
+	}
+	if got := interpolateFlowVarsEscaped("Bearer {{message}}", map[string]string{"message": "x\r\nX-Admin: 1"}, stripFlowHeaderBreaks); got != "Bearer xX-Admin: 1" {
+		t.Errorf("Unexpected header %q", got)
+	}
+}
+
+func flowTestMessage(text string) *events.Message {
+	chat := types.NewJID("5511999999999", types.DefaultUserServer)
+	return &events.Message{
+		Info: types.MessageInfo{
+			MessageSource: types.MessageSource{Chat: chat, Sender: chat},
+			PushName:      "Ana",
+		},
+		Message: &waE2E.Message{Conversation: proto.String(text)},
+	}
+}
+
+func TestRunFlowStateTransitions(t *testing.T) {
+	s := makeTestServer(t)
+	mycli := &MyClient{userID: "user1", s: s, db: s.db}
+	chat := flowTestMessage("").Info.Chat.String()
+
+	flow := FlowDefinition{
+		Name:     "survey",
+		Enabled:  true,
+		Triggers: FlowTriggers{Keywords: []string{"start"}},
+		Nodes: []FlowNode{
+			{ID: "ask", Type: "wait_reply", Variable: "answer", Next: "route"},
+			{ID: "route", Type: "branch", Variable: "answer", Default: "ask", Rules: []FlowBranchRule{
+				{Match: "keyword", Value: "yes", Next: "thanks"},
+			}},
+			{ID: "thanks", Type: "set_variable", Variable: "summary", Value: "{{name}} said {{answer}}", Next: "done"},
+			{ID: "done", Type: "wait_reply", Variable: "feedback"},
+		},
+	}
+	if err := flow.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	definition, _ := json.Marshal(flow)
+	if _, err := s.db.Exec("INSERT INTO flows (id, user_id, name, definition, enabled, priority) VALUES ($1, $2, $3, $4, $5, $6)",
+		"flow1", "user1", flow.Name, string(definition), true, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if mycli.handleFlowMessage(flowTestMessage("hello")) {
+		t.Fatal("Expected a message without trigger to be ignored")
+	}
+
+	if !mycli.handleFlowMessage(flowTestMessage("start")) {
+		t.Fatal("Expected the trigger to start the flow")
+	}
+	session, err := s.loadFlowSession("user1", chat)
+	if err != nil || session.CurrentNode != "ask" || !session.ExpiresAt.Valid {
+		t.Fatalf("Expected the session to wait on ask, got %+v (%v)", session, err)
+	}
+
+	// Unknown answer: the branch falls back to asking again
+	mycli.handleFlowMessage(flowTestMessage("maybe"))
+	if session, _ = s.loadFlowSession("user1", chat); session == nil || session.CurrentNode != "ask" {
+		t.Fatalf("Expected the default branch to ask again, got %+v", session)
+	}
+
+	mycli.handleFlowMessage(flowTestMessage("YES"))
+	session, err = s.loadFlowSession("user1", chat)
+	if err != nil || session.CurrentNode != "done" {
+		t.Fatalf("Expected the session to wait on done, got %+v (%v)", session, err)
+	}
+	if session.Variables["summary"] != "Ana said YES" {
+		t.Errorf("Unexpected variables %v", session.Variables)
+	}
+
+	mycli.handleFlowMessage(flowTestMessage("great"))
+	if session, err = s.loadFlowSession("user1", chat); err == nil {
+		t.Errorf("Expected the finished flow to delete its session, got %+v", session)
+	}
+	if size := flowChatLocks.size(); size != 0 {
+		t.Errorf("Expected chat locks to be released, %d left", size)
+	}
+}
+
+func TestSaveFlowOwnership(t *testing.T) {
+	s := makeTestServer(t)
+	save := func(userID string, body string) int {
+		r := httptest.NewRequest(http.MethodPost, "/flows", strings.NewReader(body))
+		r = r.WithContext(context.WithValue(r.Context(), "userinfo", Values{map[string]string{"Id": userID}}))
+		w := httptest.NewRecorder()
+		s.SaveFlow().ServeHTTP(w, r)
+		return w.Code
+	}
+
+	body := `{"id": "flow1", "name": "f", "nodes": [{"id": "a", "type": "send_text", "text": "hi"}]}`
+	if code := save("user1", body); code != http.StatusOK {
+		t.Fatalf("Expected the flow to be created, got %d", code)
+	}
+	if code := save("user1", body); code != http.StatusOK {
+		t.Fatalf("Expected the owner to update the flow, got %d", code)
+	}
+	if code := save("user2", body); code != http.StatusNotFound {
+		t.Errorf("Expected another user's flow id to be refused, got %d", code)
+	}
+	if _, err := s.loadFlow("user2", "flow1"); err == nil {
+		t.Error("Expected the flow to stay with its owner")
+	}
+}
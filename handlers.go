@@ -122,12 +122,22 @@ func (s *server) GetHealth() http.HandlerFunc {
 
 func (s *server) authadmin(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token := r.Header.Get("Authorization")
-		if token != *adminToken {
+		var admin *AdminPrincipal
+		var err error
+		if bearer := bearerToken(r); bearer != "" && jwtAuth != nil {
+			admin, err = jwtAuth.Admin(bearer)
+		} else {
+			admin, err = s.resolveAdmin(r.Header.Get("Authorization"))
+		}
+		if err != nil {
 			s.Respond(w, r, http.StatusUnauthorized, errors.New("unauthorized"))
 			return
 		}
-		next.ServeHTTP(w, r)
+		if !adminRoleAllows(admin.Role, r.Method, routeTemplate(r)) {
+			s.Respond(w, r, http.StatusForbidden, errors.New("insufficient admin role"))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "admin", admin)))
 	})
 }
 
@@ -150,11 +160,35 @@ func (s *server) authalice(next http.Handler) http.Handler {
 			token = strings.Join(r.URL.Query()["token"], "")
 		}
 
-		myuserinfo, found := userinfocache.Get(token)
+		// API keys act on behalf of their user, restricted to their scopes by authscope. JWT
+		// bearer tokens are bound to a user by a claim.
+		var apiKey *APIKey
+		var userID string
+		var err error
+		if bearer := bearerToken(r); token == "" && bearer != "" && jwtAuth != nil {
+			userID, err = jwtAuth.UserID(bearer)
+		} else if strings.HasPrefix(token, apiKeyPrefix) {
+			apiKey, userID, err = s.resolveAPIKey(token, r)
+		} else {
+			userID, err = s.resolveUserToken(token)
+		}
+		if err != nil {
+			s.Respond(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		if limits, err := s.userLimits(userID); err != nil {
+			s.Respond(w, r, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		} else if limits.expired(time.Now()) {
+			s.Respond(w, r, http.StatusForbidden, errAccountExpired)
+			return
+		}
+
+		myuserinfo, found := userinfocache.Get(userID)
 		if !found {
 			log.Info().Msg("Looking for user information in DB")
 			// Checks DB from matching user and store user values in context
-			rows, err := s.db.Query("SELECT id,name,webhook,jid,events,proxy_url,qrcode,history,hmac_key IS NOT NULL AND length(hmac_key) > 0 FROM users WHERE token=$1 LIMIT 1", token)
+			rows, err := s.db.Query("SELECT id,name,webhook,jid,events,proxy_url,qrcode,history,hmac_key IS NOT NULL AND length(hmac_key) > 0 FROM users WHERE id=$1 LIMIT 1", userID)
 			if err != nil {
 				s.Respond(w, r, http.StatusInternalServerError, err)
 				return
@@ -180,7 +214,6 @@ func (s *server) authalice(next http.Handler) http.Handler {
 					"Name":    name,
 					"Jid":     jid,
 					"Webhook": webhook,
-					"Token":   token,
 					"Proxy":   proxy_url,
 					"Events":  events,
 					"Qrcode":  qrcode,
@@ -188,7 +221,7 @@ func (s *server) authalice(next http.Handler) http.Handler {
 					"HasHmac": strconv.FormatBool(hasHmac),
 				}}
 
-				userinfocache.Set(token, v, cache.NoExpiration)
+				userinfocache.Set(txtid, v, cache.NoExpiration)
 				log.Info().Str("name", name).Msg("User info name from DB")
 				ctx = context.WithValue(r.Context(), "userinfo", v)
 			}
@@ -202,6 +235,10 @@ func (s *server) authalice(next http.Handler) http.Handler {
 			s.Respond(w, r, http.StatusUnauthorized, errors.New("unauthorized"))
 			return
 		}
+		if apiKey != nil {
+			ctx = context.WithValue(ctx, "apikey", apiKey)
+		}
+		spanFromContext(ctx).SetAttr("wuzapi.user_id", txtid)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -219,7 +256,6 @@ func (s *server) Connect() http.HandlerFunc {
 		webhook := r.Context().Value("userinfo").(Values).Get("Webhook")
 		jid := r.Context().Value("userinfo").(Values).Get("Jid")
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		token := r.Context().Value("userinfo").(Values).Get("Token")
 		eventstring := ""
 
 		// Decodes request BODY looking for events to subscribe
@@ -262,11 +298,11 @@ func (s *server) Connect() http.HandlerFunc {
 		}
 		log.Info().Str("events", eventstring).Msg("Setting subscribed events")
 		v := updateUserInfo(r.Context().Value("userinfo"), "Events", eventstring)
-		userinfocache.Set(token, v, cache.NoExpiration)
+		userinfocache.Set(txtid, v, cache.NoExpiration)
 
 		log.Info().Str("jid", jid).Msg("Attempt to connect")
-		killchannel[txtid] = make(chan bool, 1)
-		go s.startClient(txtid, jid, token, subscribedEvents)
+		openKillChannel(txtid)
+		go s.startClient(txtid, jid, subscribedEvents)
 
 		if t.Immediate == false {
 			log.Warn().Msg("Waiting 10 seconds")
@@ -301,13 +337,15 @@ func (s *server) Disconnect() http.HandlerFunc {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		jid := r.Context().Value("userinfo").(Values).Get("Jid")
-		token := r.Context().Value("userinfo").(Values).Get("Token")
 
 		if clientManager.GetWhatsmeowClient(txtid) == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
 			return
 		}
-		if clientManager.GetWhatsmeowClient(txtid).IsConnected() == true {
+		// A supervised session may be down between reconnection attempts or waiting out a ban,
+		// stopping the supervisor keeps it from coming back
+		supervised := stopSessionSupervisor(txtid)
+		if clientManager.GetWhatsmeowClient(txtid).IsConnected() == true || supervised {
 			//if clientManager.GetWhatsmeowClient(txtid).IsLoggedIn() == true {
 			log.Info().Str("jid", jid).Msg("Disconnection successfull")
 			_, err := s.db.Exec("UPDATE users SET connected=0,events=$1 WHERE id=$2", "", txtid)
@@ -316,16 +354,13 @@ func (s *server) Disconnect() http.HandlerFunc {
 			}
 			log.Info().Str("txtid", txtid).Msg("Update DB on disconnection")
 			v := updateUserInfo(r.Context().Value("userinfo"), "Events", "")
-			userinfocache.Set(token, v, cache.NoExpiration)
+			userinfocache.Set(txtid, v, cache.NoExpiration)
 
 			response := map[string]interface{}{"Details": "Disconnected"}
 			responseJson, err := json.Marshal(response)
 
 			clientManager.DeleteWhatsmeowClient(txtid)
-			select {
-			case killchannel[txtid] <- true:
-			default:
-			}
+			signalKill(txtid)
 
 			if err != nil {
 				s.Respond(w, r, http.StatusInternalServerError, err)
@@ -390,7 +425,6 @@ func (s *server) GetWebhook() http.HandlerFunc {
 func (s *server) DeleteWebhook() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		token := r.Context().Value("userinfo").(Values).Get("Token")
 
 		// Update the database to remove the webhook and clear events
 		_, err := s.db.Exec("UPDATE users SET webhook='', events='' WHERE id=$1", txtid)
@@ -402,7 +436,7 @@ func (s *server) DeleteWebhook() http.HandlerFunc {
 		// Update the user info cache
 		v := updateUserInfo(r.Context().Value("userinfo"), "Webhook", "")
 		v = updateUserInfo(v, "Events", "")
-		userinfocache.Set(token, v, cache.NoExpiration)
+		userinfocache.Set(txtid, v, cache.NoExpiration)
 
 		response := map[string]interface{}{"Details": "Webhook and events deleted successfully"}
 		responseJson, err := json.Marshal(response)
@@ -423,7 +457,6 @@ func (s *server) UpdateWebhook() http.HandlerFunc {
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		token := r.Context().Value("userinfo").(Values).Get("Token")
 
 		decoder := json.NewDecoder(r.Body)
 		var t updateWebhookStruct
@@ -474,7 +507,7 @@ func (s *server) UpdateWebhook() http.HandlerFunc {
 
 		v := updateUserInfo(r.Context().Value("userinfo"), "Webhook", webhook)
 		v = updateUserInfo(v, "Events", eventstring)
-		userinfocache.Set(token, v, cache.NoExpiration)
+		userinfocache.Set(txtid, v, cache.NoExpiration)
 
 		response := map[string]interface{}{"webhook": webhook, "events": validEvents, "active": t.Active}
 		responseJson, err := json.Marshal(response)
@@ -494,7 +527,6 @@ func (s *server) SetWebhook() http.HandlerFunc {
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		token := r.Context().Value("userinfo").(Values).Get("Token")
 
 		decoder := json.NewDecoder(r.Body)
 		var t webhookStruct
@@ -542,7 +574,7 @@ func (s *server) SetWebhook() http.HandlerFunc {
 
 		v := updateUserInfo(r.Context().Value("userinfo"), "Webhook", webhook)
 		v = updateUserInfo(v, "Events", eventstring)
-		userinfocache.Set(token, v, cache.NoExpiration)
+		userinfocache.Set(txtid, v, cache.NoExpiration)
 
 		response := map[string]interface{}{"webhook": webhook}
 		responseJson, err := json.Marshal(response)
@@ -626,10 +658,7 @@ func (s *server) Logout() http.HandlerFunc {
 				} else {
 					log.Info().Str("jid", jid).Msg("Logged out")
 					clientManager.DeleteWhatsmeowClient(txtid)
-					select {
-					case killchannel[txtid] <- true:
-					default:
-					}
+					signalKill(txtid)
 				}
 			} else {
 				if clientManager.GetWhatsmeowClient(txtid).IsConnected() == true {
@@ -719,7 +748,6 @@ func (s *server) GetStatus() http.HandlerFunc {
 			Str("Jid", userInfo.Get("Jid")).
 			Str("Name", userInfo.Get("Name")).
 			Str("Webhook", userInfo.Get("Webhook")).
-			Str("Token", userInfo.Get("Token")).
 			Str("Events", userInfo.Get("Events")).
 			Str("Proxy", userInfo.Get("Proxy")).
 			Str("History", userInfo.Get("History")).
@@ -785,7 +813,6 @@ func (s *server) GetStatus() http.HandlerFunc {
 			"name":            userInfo.Get("Name"),
 			"connected":       isConnected,
 			"loggedIn":        isLoggedIn,
-			"token":           userInfo.Get("Token"),
 			"jid":             userInfo.Get("Jid"),
 			"webhook":         userInfo.Get("Webhook"),
 			"events":          userInfo.Get("Events"),
@@ -816,6 +843,7 @@ func (s *server) SendDocument() http.HandlerFunc {
 		FileName    string
 		Id          string
 		MimeType    string
+		MediaId     string `json:"media_id,omitempty"`
 		ContextInfo waE2E.ContextInfo
 	}
 
@@ -830,13 +858,26 @@ func (s *server) SendDocument() http.HandlerFunc {
 			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
 		var t documentStruct
 		var err error
-		err = decoder.Decode(&t)
-		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
-			return
+		var upload *multipartMedia
+		if isMultipartRequest(r) {
+			upload, err = readMultipartMedia(r, "Document", uploadLimitBytes("document"), &t)
+			if err != nil {
+				s.respondMultipartError(w, r, err, uploadLimitBytes("document"))
+				return
+			}
+			defer upload.Close()
+			if t.FileName == "" {
+				t.FileName = upload.FileName
+			}
+		} else {
+			decoder := json.NewDecoder(r.Body)
+			err = decoder.Decode(&t)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+				return
+			}
 		}
 
 		if t.Phone == "" {
@@ -844,7 +885,7 @@ func (s *server) SendDocument() http.HandlerFunc {
 			return
 		}
 
-		if t.Document == "" {
+		if t.Document == "" && upload == nil && t.MediaId == "" {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Document in Payload"))
 			return
 		}
@@ -867,17 +908,41 @@ func (s *server) SendDocument() http.HandlerFunc {
 			msgid = t.Id
 		}
 
+		if t.MediaId != "" {
+			s.sendLibraryMedia(w, r, t.MediaId, "document", recipient, msgid, t.Caption, false, &t.ContextInfo)
+			return
+		}
+
 		var uploaded whatsmeow.UploadResponse
 		var filedata []byte
+		detectedMime := ""
 
-		if t.Document[0:29] == "data:application/octet-stream" {
+		if upload != nil {
+			// Stream from the temp file, large documents never sit in memory
+			if !s.useMediaQuota(w, r, txtid, upload.Size) {
+				return
+			}
+			reader, err := upload.Reader()
+			if err == nil {
+				uploaded, err = tracedUploadReader(context.WithoutCancel(r.Context()), clientManager.GetWhatsmeowClient(txtid), reader, nil, whatsmeow.MediaDocument)
+			}
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("failed to upload file: %v", err)))
+				return
+			}
+			detectedMime = upload.MimeType
+		} else if len(t.Document) >= 29 && t.Document[0:29] == "data:application/octet-stream" {
 			var dataURL, err = dataurl.DecodeString(t.Document)
 			if err != nil {
 				s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode base64 encoded data from payload"))
 				return
 			} else {
 				filedata = dataURL.Data
-				uploaded, err = clientManager.GetWhatsmeowClient(txtid).Upload(context.Background(), filedata, whatsmeow.MediaDocument)
+				detectedMime = http.DetectContentType(filedata)
+				if !s.useMediaQuota(w, r, txtid, int64(len(filedata))) {
+					return
+				}
+				uploaded, err = tracedUpload(context.WithoutCancel(r.Context()), clientManager.GetWhatsmeowClient(txtid), filedata, whatsmeow.MediaDocument)
 				if err != nil {
 					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("failed to upload file: %v", err)))
 					return
@@ -897,11 +962,11 @@ func (s *server) SendDocument() http.HandlerFunc {
 				if t.MimeType != "" {
 					return t.MimeType
 				}
-				return http.DetectContentType(filedata)
+				return detectedMime
 			}()),
 			FileEncSHA256: uploaded.FileEncSHA256,
 			FileSHA256:    uploaded.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(filedata))),
+			FileLength:    proto.Uint64(uploaded.FileLength),
 			Caption:       proto.String(t.Caption),
 		}}
 
@@ -926,7 +991,7 @@ func (s *server) SendDocument() http.HandlerFunc {
 			msg.DocumentMessage.ContextInfo.IsForwarded = proto.Bool(true)
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		resp, err = tracedSendMessage(context.WithoutCancel(r.Context()), clientManager.GetWhatsmeowClient(txtid), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
 			return
@@ -934,7 +999,12 @@ func (s *server) SendDocument() http.HandlerFunc {
 
 		historyStr := r.Context().Value("userinfo").(Values).Get("History")
 		historyLimit, _ := strconv.Atoi(historyStr)
-		s.saveOutgoingMessageToHistory(txtid, recipient.String(), msgid, "document", t.Caption, "", historyLimit)
+		opener := bytesMediaOpener(filedata)
+		if upload != nil {
+			opener = fileMediaOpener(upload.File.Name())
+		}
+		mediaLink := s.archiveOutgoingMedia(txtid, recipient, msgid, msg.DocumentMessage.GetMimetype(), opener)
+		s.saveOutgoingMessageToHistory(txtid, recipient.String(), msgid, "document", t.Caption, mediaLink, historyLimit)
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp.Unix(), "Id": msgid}
@@ -958,6 +1028,7 @@ func (s *server) SendAudio() http.HandlerFunc {
 		Id          string
 		PTT         *bool  `json:"ptt,omitempty"`
 		MimeType    string `json:"mimetype,omitempty"`
+		MediaId     string `json:"media_id,omitempty"`
 		Seconds     uint32
 		Waveform    []byte
 		ContextInfo waE2E.ContextInfo
@@ -974,12 +1045,23 @@ func (s *server) SendAudio() http.HandlerFunc {
 			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
 		var t audioStruct
-		err := decoder.Decode(&t)
-		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
-			return
+		var err error
+		var upload *multipartMedia
+		if isMultipartRequest(r) {
+			upload, err = readMultipartMedia(r, "Audio", uploadLimitBytes("audio"), &t)
+			if err != nil {
+				s.respondMultipartError(w, r, err, uploadLimitBytes("audio"))
+				return
+			}
+			defer upload.Close()
+		} else {
+			decoder := json.NewDecoder(r.Body)
+			err = decoder.Decode(&t)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+				return
+			}
 		}
 
 		if t.Phone == "" {
@@ -987,7 +1069,7 @@ func (s *server) SendAudio() http.HandlerFunc {
 			return
 		}
 
-		if t.Audio == "" {
+		if t.Audio == "" && upload == nil && t.MediaId == "" {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Audio in Payload"))
 			return
 		}
@@ -1005,43 +1087,82 @@ func (s *server) SendAudio() http.HandlerFunc {
 			msgid = t.Id
 		}
 
+		if t.MediaId != "" {
+			s.sendLibraryMedia(w, r, t.MediaId, "audio", recipient, msgid, "", t.PTT == nil || *t.PTT, &t.ContextInfo)
+			return
+		}
+
 		var uploaded whatsmeow.UploadResponse
 		var filedata []byte
 
-		if strings.HasPrefix(t.Audio, "data:audio/") {
+		// Configure PTT (Push to Talk) - default is true, setting it to false is a breaking change
+		ptt := true
+		if t.PTT != nil {
+			ptt = *t.PTT
+		}
+		transcoded := false
+
+		if upload != nil {
+			filedata, err = upload.Bytes()
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("could not read uploaded file"))
+				return
+			}
+		} else if strings.HasPrefix(t.Audio, "data:audio/") {
 			var dataURL, err = dataurl.DecodeString(t.Audio)
 			if err != nil {
 				s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode base64 encoded data from payload"))
 				return
-			} else {
-				filedata = dataURL.Data
-				uploaded, err = clientManager.GetWhatsmeowClient(txtid).Upload(context.Background(), filedata, whatsmeow.MediaAudio)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("failed to upload file: %v", err)))
-					return
-				}
 			}
+			filedata = dataURL.Data
 		} else {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("audio data should start with \"data:audio/\""))
 			return
 		}
 
-		// Configure PTT (Push to Talk) - default is true, setting it to false is a breaking change
-		ptt := true
-		if t.PTT != nil {
-			ptt = *t.PTT
+		if ptt {
+			// Voice notes only play as mono OGG/Opus, and duration and waveform must match the audio
+			converted, seconds, waveform, err := prepareVoiceNote(filedata)
+			if errors.Is(err, errFFmpegNotAvailable) {
+				// Other formats don't play as voice notes, they are sent as regular audio
+				log.Warn().Msg("ffmpeg not found, sending audio as a regular audio message")
+				ptt = false
+			} else if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("could not convert audio to voice note: %v", err)))
+				return
+			} else {
+				filedata = converted
+				transcoded = true
+			}
+			if seconds > 0 {
+				t.Seconds = seconds
+			}
+			if waveform != nil {
+				t.Waveform = waveform
+			}
+		}
+
+		if !s.useMediaQuota(w, r, txtid, int64(len(filedata))) {
+			return
+		}
+		uploaded, err = tracedUpload(context.WithoutCancel(r.Context()), clientManager.GetWhatsmeowClient(txtid), filedata, whatsmeow.MediaAudio)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("failed to upload file: %v", err)))
+			return
 		}
 
 		// Configure MIME type
 		var mime string
-		if t.MimeType != "" {
+		if transcoded {
+			mime = "audio/ogg; codecs=opus"
+		} else if t.MimeType != "" {
 			mime = t.MimeType
 		} else {
 			// Default MIME types based on PTT setting
 			if ptt {
 				mime = "audio/ogg; codecs=opus"
 			} else {
-				mime = "audio/mpeg"
+				mime = detectAudioMimeType(filedata)
 			}
 		}
 
@@ -1079,7 +1200,7 @@ func (s *server) SendAudio() http.HandlerFunc {
 			msg.AudioMessage.ContextInfo.IsForwarded = proto.Bool(true)
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		resp, err = tracedSendMessage(context.WithoutCancel(r.Context()), clientManager.GetWhatsmeowClient(txtid), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
 			return
@@ -1087,7 +1208,8 @@ func (s *server) SendAudio() http.HandlerFunc {
 
 		historyStr := r.Context().Value("userinfo").(Values).Get("History")
 		historyLimit, _ := strconv.Atoi(historyStr)
-		s.saveOutgoingMessageToHistory(txtid, recipient.String(), msgid, "audio", "", "", historyLimit)
+		mediaLink := s.archiveOutgoingMedia(txtid, recipient, msgid, msg.AudioMessage.GetMimetype(), bytesMediaOpener(filedata))
+		s.saveOutgoingMessageToHistory(txtid, recipient.String(), msgid, "audio", "", mediaLink, historyLimit)
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp.Unix(), "Id": msgid}
@@ -1110,6 +1232,7 @@ func (s *server) SendImage() http.HandlerFunc {
 		Caption     string
 		Id          string
 		MimeType    string
+		MediaId     string `json:"media_id,omitempty"`
 		ContextInfo waE2E.ContextInfo
 	}
 
@@ -1124,12 +1247,23 @@ func (s *server) SendImage() http.HandlerFunc {
 			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
 		var t imageStruct
-		err := decoder.Decode(&t)
-		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
-			return
+		var err error
+		var upload *multipartMedia
+		if isMultipartRequest(r) {
+			upload, err = readMultipartMedia(r, "Image", uploadLimitBytes("image"), &t)
+			if err != nil {
+				s.respondMultipartError(w, r, err, uploadLimitBytes("image"))
+				return
+			}
+			defer upload.Close()
+		} else {
+			decoder := json.NewDecoder(r.Body)
+			err = decoder.Decode(&t)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+				return
+			}
 		}
 
 		if t.Phone == "" {
@@ -1137,7 +1271,7 @@ func (s *server) SendImage() http.HandlerFunc {
 			return
 		}
 
-		if t.Image == "" {
+		if t.Image == "" && upload == nil && t.MediaId == "" {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Image in Payload"))
 			return
 		}
@@ -1155,11 +1289,26 @@ func (s *server) SendImage() http.HandlerFunc {
 			msgid = t.Id
 		}
 
+		if t.MediaId != "" {
+			s.sendLibraryMedia(w, r, t.MediaId, "image", recipient, msgid, t.Caption, false, &t.ContextInfo)
+			return
+		}
+
 		var uploaded whatsmeow.UploadResponse
 		var filedata []byte
 		var thumbnailBytes []byte
 
-		if len(t.Image) >= 10 && t.Image[0:10] == "data:image" {
+		if upload != nil {
+			filedata, err = upload.Bytes()
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("could not read uploaded file"))
+				return
+			}
+			if !strings.HasPrefix(upload.MimeType, "image/") {
+				s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("uploaded file is %s, not an image", upload.MimeType)))
+				return
+			}
+		} else if len(t.Image) >= 10 && t.Image[0:10] == "data:image" {
 			var dataURL, err = dataurl.DecodeString(t.Image)
 			if err != nil {
 				s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode base64 encoded data from payload"))
@@ -1189,7 +1338,10 @@ func (s *server) SendImage() http.HandlerFunc {
 			return
 		}
 
-		uploaded, err = clientManager.GetWhatsmeowClient(txtid).Upload(context.Background(), filedata, whatsmeow.MediaImage)
+		if !s.useMediaQuota(w, r, txtid, int64(len(filedata))) {
+			return
+		}
+		uploaded, err = tracedUpload(context.WithoutCancel(r.Context()), clientManager.GetWhatsmeowClient(txtid), filedata, whatsmeow.MediaImage)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("failed to upload file: %v", err)))
 			return
@@ -1266,7 +1418,7 @@ func (s *server) SendImage() http.HandlerFunc {
 			msg.ImageMessage.ContextInfo.IsForwarded = proto.Bool(true)
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		resp, err = tracedSendMessage(context.WithoutCancel(r.Context()), clientManager.GetWhatsmeowClient(txtid), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
 			return
@@ -1274,7 +1426,8 @@ func (s *server) SendImage() http.HandlerFunc {
 
 		historyStr := r.Context().Value("userinfo").(Values).Get("History")
 		historyLimit, _ := strconv.Atoi(historyStr)
-		s.saveOutgoingMessageToHistory(txtid, recipient.String(), msgid, "image", t.Caption, "", historyLimit)
+		mediaLink := s.archiveOutgoingMedia(txtid, recipient, msgid, msg.ImageMessage.GetMimetype(), bytesMediaOpener(filedata))
+		s.saveOutgoingMessageToHistory(txtid, recipient.String(), msgid, "image", t.Caption, mediaLink, historyLimit)
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp.Unix(), "Id": msgid}
@@ -1297,6 +1450,7 @@ func (s *server) SendSticker() http.HandlerFunc {
 		Id            string
 		PngThumbnail  []byte
 		MimeType      string
+		MediaId       string `json:"media_id,omitempty"`
 		PackId        string
 		PackName      string
 		PackPublisher string
@@ -1315,12 +1469,23 @@ func (s *server) SendSticker() http.HandlerFunc {
 			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
 		var t stickerStruct
-		err := decoder.Decode(&t)
-		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
-			return
+		var err error
+		var upload *multipartMedia
+		if isMultipartRequest(r) {
+			upload, err = readMultipartMedia(r, "Sticker", uploadLimitBytes("sticker"), &t)
+			if err != nil {
+				s.respondMultipartError(w, r, err, uploadLimitBytes("sticker"))
+				return
+			}
+			defer upload.Close()
+		} else {
+			decoder := json.NewDecoder(r.Body)
+			err = decoder.Decode(&t)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+				return
+			}
 		}
 
 		if t.Phone == "" {
@@ -1328,7 +1493,7 @@ func (s *server) SendSticker() http.HandlerFunc {
 			return
 		}
 
-		if t.Sticker == "" {
+		if t.Sticker == "" && upload == nil && t.MediaId == "" {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Sticker in Payload"))
 			return
 		}
@@ -1346,14 +1511,29 @@ func (s *server) SendSticker() http.HandlerFunc {
 			msgid = t.Id
 		}
 
-		processedData, detectedMimeType, err := processStickerData(
-			t.Sticker,
-			t.MimeType,
-			t.PackId,
-			t.PackName,
-			t.PackPublisher,
-			t.Emojis,
-		)
+		if t.MediaId != "" {
+			s.sendLibraryMedia(w, r, t.MediaId, "sticker", recipient, msgid, "", false, &t.ContextInfo)
+			return
+		}
+
+		var processedData []byte
+		var detectedMimeType string
+		if upload != nil {
+			var stickerData []byte
+			stickerData, err = upload.Bytes()
+			if err == nil {
+				processedData, detectedMimeType, err = processStickerBytes(stickerData, t.MimeType, t.PackId, t.PackName, t.PackPublisher, t.Emojis)
+			}
+		} else {
+			processedData, detectedMimeType, err = processStickerData(
+				t.Sticker,
+				t.MimeType,
+				t.PackId,
+				t.PackName,
+				t.PackPublisher,
+				t.Emojis,
+			)
+		}
 		if err != nil {
 			log.Error().Err(err).Msg("Failed to process sticker data")
 			status := http.StatusBadRequest
@@ -1364,7 +1544,10 @@ func (s *server) SendSticker() http.HandlerFunc {
 			return
 		}
 
-		uploaded, err := clientManager.GetWhatsmeowClient(txtid).Upload(context.Background(), processedData, whatsmeow.MediaImage)
+		if !s.useMediaQuota(w, r, txtid, int64(len(processedData))) {
+			return
+		}
+		uploaded, err := tracedUpload(context.WithoutCancel(r.Context()), clientManager.GetWhatsmeowClient(txtid), processedData, whatsmeow.MediaImage)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
 			return
@@ -1402,7 +1585,7 @@ func (s *server) SendSticker() http.HandlerFunc {
 			msg.StickerMessage.ContextInfo.IsForwarded = proto.Bool(true)
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		resp, err = tracedSendMessage(context.WithoutCancel(r.Context()), clientManager.GetWhatsmeowClient(txtid), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
 			return
@@ -1410,7 +1593,8 @@ func (s *server) SendSticker() http.HandlerFunc {
 
 		historyStr := r.Context().Value("userinfo").(Values).Get("History")
 		historyLimit, _ := strconv.Atoi(historyStr)
-		s.saveOutgoingMessageToHistory(txtid, recipient.String(), msgid, "sticker", "", "", historyLimit)
+		mediaLink := s.archiveOutgoingMedia(txtid, recipient, msgid, msg.StickerMessage.GetMimetype(), bytesMediaOpener(processedData))
+		s.saveOutgoingMessageToHistory(txtid, recipient.String(), msgid, "sticker", "", mediaLink, historyLimit)
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp.Unix(), "Id": msgid}
@@ -1434,6 +1618,9 @@ func (s *server) SendVideo() http.HandlerFunc {
 		Id            string
 		JPEGThumbnail []byte
 		MimeType      string
+		MediaId       string `json:"media_id,omitempty"`
+		Transcode     *bool  `json:"transcode,omitempty"`
+		GifPlayback   bool   `json:"gif_playback,omitempty"`
 		ContextInfo   waE2E.ContextInfo
 	}
 
@@ -1448,12 +1635,23 @@ func (s *server) SendVideo() http.HandlerFunc {
 			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
 		var t imageStruct
-		err := decoder.Decode(&t)
-		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
-			return
+		var err error
+		var upload *multipartMedia
+		if isMultipartRequest(r) {
+			upload, err = readMultipartMedia(r, "Video", uploadLimitBytes("video"), &t)
+			if err != nil {
+				s.respondMultipartError(w, r, err, uploadLimitBytes("video"))
+				return
+			}
+			defer upload.Close()
+		} else {
+			decoder := json.NewDecoder(r.Body)
+			err = decoder.Decode(&t)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+				return
+			}
 		}
 
 		if t.Phone == "" {
@@ -1461,7 +1659,7 @@ func (s *server) SendVideo() http.HandlerFunc {
 			return
 		}
 
-		if t.Video == "" {
+		if t.Video == "" && upload == nil && t.MediaId == "" {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Video in Payload"))
 			return
 		}
@@ -1479,10 +1677,21 @@ func (s *server) SendVideo() http.HandlerFunc {
 			msgid = t.Id
 		}
 
+		if t.MediaId != "" {
+			s.sendLibraryMedia(w, r, t.MediaId, "video", recipient, msgid, t.Caption, false, &t.ContextInfo)
+			return
+		}
+
 		var uploaded whatsmeow.UploadResponse
 		var filedata []byte
 
-		if t.Video[0:4] == "data" {
+		if upload != nil {
+			filedata, err = upload.Bytes()
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("could not read uploaded file"))
+				return
+			}
+		} else if strings.HasPrefix(t.Video, "data") {
 			var dataURL, err = dataurl.DecodeString(t.Video)
 			if err != nil {
 				s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode base64 encoded data from payload"))
@@ -1514,18 +1723,49 @@ func (s *server) SendVideo() http.HandlerFunc {
 			return
 		}
 
-		uploaded, err = clientManager.GetWhatsmeowClient(txtid).Upload(context.Background(), filedata, whatsmeow.MediaVideo)
+		// Optional server side pipeline: H.264/AAC transcoding, size limit, thumbnail and duration
+		transcode := *videoTranscode
+		if t.Transcode != nil {
+			transcode = *t.Transcode
+		}
+		video, err := prepareVideo(filedata, transcode, t.GifPlayback, len(t.JPEGThumbnail) == 0, *videoMaxMB*1024*1024)
+		if errors.Is(err, errFFmpegNotAvailable) {
+			if video.GifPlayback && video.MimeType != "video/mp4" {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("ffmpeg is required to send GIF/WebM as gif playback"))
+				return
+			}
+			if transcode {
+				log.Warn().Msg("ffmpeg not found, sending video without transcoding")
+			}
+		} else if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("could not process video: %v", err)))
+			return
+		}
+		filedata = video.Data
+
+		if !s.useMediaQuota(w, r, txtid, int64(len(filedata))) {
+			return
+		}
+		uploaded, err = tracedUpload(context.WithoutCancel(r.Context()), clientManager.GetWhatsmeowClient(txtid), filedata, whatsmeow.MediaVideo)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("failed to upload file: %v", err)))
 			return
 		}
 
+		thumbnail := t.JPEGThumbnail
+		if len(thumbnail) == 0 {
+			thumbnail = video.Thumbnail
+		}
+
 		msg := &waE2E.Message{VideoMessage: &waE2E.VideoMessage{
 			Caption:    proto.String(t.Caption),
 			URL:        proto.String(uploaded.URL),
 			DirectPath: proto.String(uploaded.DirectPath),
 			MediaKey:   uploaded.MediaKey,
 			Mimetype: proto.String(func() string {
+				if video.Transcoded {
+					return "video/mp4"
+				}
 				if t.MimeType != "" {
 					return t.MimeType
 				}
@@ -1534,8 +1774,12 @@ func (s *server) SendVideo() http.HandlerFunc {
 			FileEncSHA256: uploaded.FileEncSHA256,
 			FileSHA256:    uploaded.FileSHA256,
 			FileLength:    proto.Uint64(uint64(len(filedata))),
-			JPEGThumbnail: t.JPEGThumbnail,
+			JPEGThumbnail: thumbnail,
+			GifPlayback:   proto.Bool(video.GifPlayback),
 		}}
+		if video.Seconds > 0 {
+			msg.VideoMessage.Seconds = proto.Uint32(video.Seconds)
+		}
 
 		if t.ContextInfo.StanzaID != nil {
 			msg.VideoMessage.ContextInfo = &waE2E.ContextInfo{
@@ -1558,7 +1802,7 @@ func (s *server) SendVideo() http.HandlerFunc {
 			msg.VideoMessage.ContextInfo.IsForwarded = proto.Bool(true)
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		resp, err = tracedSendMessage(context.WithoutCancel(r.Context()), clientManager.GetWhatsmeowClient(txtid), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("error sending message: %v", err)))
 			return
@@ -1566,7 +1810,8 @@ func (s *server) SendVideo() http.HandlerFunc {
 
 		historyStr := r.Context().Value("userinfo").(Values).Get("History")
 		historyLimit, _ := strconv.Atoi(historyStr)
-		s.saveOutgoingMessageToHistory(txtid, recipient.String(), msgid, "video", t.Caption, "", historyLimit)
+		mediaLink := s.archiveOutgoingMedia(txtid, recipient, msgid, msg.VideoMessage.GetMimetype(), bytesMediaOpener(filedata))
+		s.saveOutgoingMessageToHistory(txtid, recipient.String(), msgid, "video", t.Caption, mediaLink, historyLimit)
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp.Unix(), "Id": msgid}
@@ -1662,7 +1907,7 @@ func (s *server) SendContact() http.HandlerFunc {
 			msg.ContactMessage.ContextInfo.IsForwarded = proto.Bool(true)
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		resp, err = tracedSendMessage(context.WithoutCancel(r.Context()), clientManager.GetWhatsmeowClient(txtid), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("error sending message: %v", err)))
 			return
@@ -1768,7 +2013,7 @@ func (s *server) SendLocation() http.HandlerFunc {
 			msg.LocationMessage.ContextInfo.IsForwarded = proto.Bool(true)
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		resp, err = tracedSendMessage(context.WithoutCancel(r.Context()), clientManager.GetWhatsmeowClient(txtid), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("error sending message: %v", err)))
 			return
@@ -1872,7 +2117,7 @@ func (s *server) SendButtons() http.HandlerFunc {
 			Buttons:     buttons,
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, &waE2E.Message{ViewOnceMessage: &waE2E.FutureProofMessage{
+		resp, err = tracedSendMessage(context.WithoutCancel(r.Context()), clientManager.GetWhatsmeowClient(txtid), recipient, &waE2E.Message{ViewOnceMessage: &waE2E.FutureProofMessage{
 			Message: &waE2E.Message{
 				ButtonsMessage: msg2,
 			},
@@ -2019,8 +2264,9 @@ func (s *server) SendList() http.HandlerFunc {
 			},
 		}
 
-		resp, err := clientManager.GetWhatsmeowClient(txtid).SendMessage(
-			context.Background(),
+		resp, err := tracedSendMessage(
+			context.WithoutCancel(r.Context()),
+			clientManager.GetWhatsmeowClient(txtid),
 			recipient,
 			msg,
 			whatsmeow.SendRequestExtra{ID: msgid},
@@ -2206,7 +2452,7 @@ func (s *server) SendMessage() http.HandlerFunc {
 			msg.ExtendedTextMessage.ContextInfo.IsForwarded = proto.Bool(true)
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		resp, err = tracedSendMessage(context.WithoutCancel(r.Context()), clientManager.GetWhatsmeowClient(txtid), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("error sending message: %v", err)))
 			return
@@ -2284,7 +2530,7 @@ func (s *server) SendPoll() http.HandlerFunc {
 		}
 
 		pollMessage := clientManager.GetWhatsmeowClient(txtid).BuildPollCreation(req.Header, req.Options, 1)
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, pollMessage, whatsmeow.SendRequestExtra{ID: msgid})
+		resp, err = tracedSendMessage(context.WithoutCancel(r.Context()), clientManager.GetWhatsmeowClient(txtid), recipient, pollMessage, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("failed to send poll: %v", err)))
 			return
@@ -2348,7 +2594,7 @@ func (s *server) DeleteMessage() http.HandlerFunc {
 			return
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, clientManager.GetWhatsmeowClient(txtid).BuildRevoke(recipient, types.EmptyJID, msgid))
+		resp, err = tracedSendMessage(context.WithoutCancel(r.Context()), clientManager.GetWhatsmeowClient(txtid), recipient, clientManager.GetWhatsmeowClient(txtid).BuildRevoke(recipient, types.EmptyJID, msgid))
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("error sending message: %v", err)))
 			return
@@ -2441,7 +2687,7 @@ func (s *server) SendEditMessage() http.HandlerFunc {
 			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, clientManager.GetWhatsmeowClient(txtid).BuildEdit(recipient, msgid, msg))
+		resp, err = tracedSendMessage(context.WithoutCancel(r.Context()), clientManager.GetWhatsmeowClient(txtid), recipient, clientManager.GetWhatsmeowClient(txtid).BuildEdit(recipient, msgid, msg))
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("error sending edit message: %v", err)))
 			return
@@ -2534,7 +2780,7 @@ func (s *server) RequestHistorySync() http.HandlerFunc {
 			Time("oldest_msg_timestamp", info.Timestamp).
 			Msg("Preparing to send history sync request")
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), clientManager.GetMyClient(txtid).WAClient.Store.ID.ToNonAD(), historyMsg, whatsmeow.SendRequestExtra{Peer: true})
+		resp, err = tracedSendMessage(context.WithoutCancel(r.Context()), clientManager.GetWhatsmeowClient(txtid), clientManager.GetMyClient(txtid).WAClient.Store.ID.ToNonAD(), historyMsg, whatsmeow.SendRequestExtra{Peer: true})
 		if err != nil {
 			log.Error().
 				Str("userID", txtid).
@@ -2714,7 +2960,7 @@ func (s *server) SendTemplate() http.HandlerFunc {
 		},
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(userid).SendMessage(context.Background(),recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		resp, err = tracedSendMessage(context.WithoutCancel(r.Context()), clientManager.GetWhatsmeowClient(userid), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
 			return
@@ -3482,7 +3728,7 @@ func (s *server) React() http.HandlerFunc {
 			},
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg)
+		resp, err = tracedSendMessage(context.WithoutCancel(r.Context()), clientManager.GetWhatsmeowClient(txtid), recipient, msg)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("error sending message: %v", err)))
 			return
@@ -4531,7 +4777,6 @@ func (s *server) ListUsers() http.HandlerFunc {
 	type usersStruct struct {
 		Id         string         `db:"id"`
 		Name       string         `db:"name"`
-		Token      string         `db:"token"`
 		Webhook    string         `db:"webhook"`
 		Jid        string         `db:"jid"`
 		Qrcode     string         `db:"qrcode"`
@@ -4540,6 +4785,7 @@ func (s *server) ListUsers() http.HandlerFunc {
 		ProxyURL   sql.NullString `db:"proxy_url"`
 		Events     string         `db:"events"`
 		History    sql.NullInt64  `db:"history"`
+		UserQuotas
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
@@ -4550,11 +4796,11 @@ func (s *server) ListUsers() http.HandlerFunc {
 
 		if hasID {
 			// Fetch a single user
-			query = "SELECT id, name, token, webhook, jid, qrcode, connected, expiration, proxy_url, events, history FROM users WHERE id = $1"
+			query = "SELECT id, name, webhook, jid, qrcode, connected, expiration, proxy_url, events, history, quota_messages, quota_media_bytes, quota_history_rows FROM users WHERE id = $1"
 			args = append(args, userID)
 		} else {
 			// Fetch all users
-			query = "SELECT id, name, token, webhook, jid, qrcode, connected, expiration, proxy_url, events, history FROM users"
+			query = "SELECT id, name, webhook, jid, qrcode, connected, expiration, proxy_url, events, history, quota_messages, quota_media_bytes, quota_history_rows FROM users"
 		}
 
 		rows, err := s.db.Queryx(query, args...)
@@ -4587,7 +4833,6 @@ func (s *server) ListUsers() http.HandlerFunc {
 			userMap := map[string]interface{}{
 				"id":         user.Id,
 				"name":       user.Name,
-				"token":      user.Token,
 				"webhook":    user.Webhook,
 				"jid":        user.Jid,
 				"qrcode":     user.Qrcode,
@@ -4596,6 +4841,7 @@ func (s *server) ListUsers() http.HandlerFunc {
 				"expiration": user.Expiration.Int64,
 				"proxy_url":  user.ProxyURL.String,
 				"events":     user.Events,
+				"quotas":     user.UserQuotas,
 			}
 			// Add proxy_config
 			proxyURL := user.ProxyURL.String
@@ -4678,6 +4924,7 @@ func (s *server) AddUser() http.HandlerFunc {
 			S3Config    *S3Config    `json:"s3Config,omitempty"`
 			HmacKey     string       `json:"hmacKey,omitempty"`
 			History     int          `json:"history,omitempty"`
+			Quotas      *UserQuotas  `json:"quotas,omitempty"`
 		}
 
 		if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
@@ -4703,9 +4950,28 @@ func (s *server) AddUser() http.HandlerFunc {
 		if user.S3Config == nil {
 			user.S3Config = &S3Config{}
 		}
+		if user.Quotas == nil {
+			user.Quotas = &UserQuotas{}
+		}
 		if user.Webhook == "" {
 			user.Webhook = ""
 		}
+		if err := user.Quotas.validate(); err != nil {
+			s.respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"code":    http.StatusBadRequest,
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if user.Token == "" {
+			s.respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"code":    http.StatusBadRequest,
+				"error":   "missing token",
+				"success": false,
+			})
+			return
+		}
 
 		// Encrypt HMAC key if provided
 		var encryptedHmacKey []byte
@@ -4734,8 +5000,8 @@ func (s *server) AddUser() http.HandlerFunc {
 		}
 
 		// Check for existing user
-		var count int
-		if err := s.db.Get(&count, "SELECT COUNT(*) FROM users WHERE token = $1", user.Token); err != nil {
+		inUse, err := tokenInUse(s.db, user.Token, "")
+		if err != nil {
 			s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
 				"code":    http.StatusInternalServerError,
 				"error":   "database error",
@@ -4743,7 +5009,7 @@ func (s *server) AddUser() http.HandlerFunc {
 			})
 			return
 		}
-		if count > 0 {
+		if inUse {
 			s.respondWithJSON(w, http.StatusConflict, map[string]interface{}{
 				"code":    http.StatusConflict,
 				"error":   "user with this token already exists",
@@ -4782,11 +5048,23 @@ func (s *server) AddUser() http.HandlerFunc {
 			return
 		}
 
+		// Only the salted hash of the token is stored
+		tokenLookup, tokenHash, tokenSalt, err := newTokenColumns(user.Token)
+		if err != nil {
+			s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"code":    http.StatusInternalServerError,
+				"error":   "failed to hash token",
+				"success": false,
+			})
+			return
+		}
+
 		// Insert user with all proxy, S3 and HMAC fields
 		if _, err = s.db.Exec(
-			"INSERT INTO users (id, name, token, webhook, expiration, events, jid, qrcode, proxy_url, s3_enabled, s3_endpoint, s3_region, s3_bucket, s3_access_key, s3_secret_key, s3_path_style, s3_public_url, media_delivery, s3_retention_days, hmac_key, history) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21)",
-			id, user.Name, user.Token, user.Webhook, user.Expiration, user.Events, "", "", user.ProxyConfig.ProxyURL,
+			"INSERT INTO users (id, name, token, token_lookup, token_hash, token_salt, webhook, expiration, events, jid, qrcode, proxy_url, s3_enabled, s3_endpoint, s3_region, s3_bucket, s3_access_key, s3_secret_key, s3_path_style, s3_public_url, media_delivery, s3_retention_days, hmac_key, history, quota_messages, quota_media_bytes, quota_history_rows) VALUES ($1, $2, '', $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26)",
+			id, user.Name, tokenLookup, tokenHash, tokenSalt, user.Webhook, user.Expiration, user.Events, "", "", user.ProxyConfig.ProxyURL,
 			user.S3Config.Enabled, user.S3Config.Endpoint, user.S3Config.Region, user.S3Config.Bucket, user.S3Config.AccessKey, user.S3Config.SecretKey, user.S3Config.PathStyle, user.S3Config.PublicURL, user.S3Config.MediaDelivery, user.S3Config.RetentionDays, encryptedHmacKey, user.History,
+			user.Quotas.MessagesPerMonth, user.Quotas.MaxMediaBytes, user.Quotas.MaxHistoryRows,
 		); err != nil {
 			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("admin DB error")
 			s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
@@ -4840,6 +5118,7 @@ func (s *server) AddUser() http.HandlerFunc {
 			"proxy_config": proxyConfig,
 			"s3_config":    s3Config,
 			"hmac_key":     user.HmacKey != "",
+			"quotas":       user.Quotas,
 		}
 		s.respondWithJSON(w, http.StatusCreated, map[string]interface{}{
 			"code":    http.StatusCreated,
@@ -4873,6 +5152,7 @@ func (s *server) EditUser() http.HandlerFunc {
 			ProxyConfig *ProxyConfig `json:"proxyConfig,omitempty"`
 			S3Config    *S3Config    `json:"s3Config,omitempty"`
 			History     int          `json:"history,omitempty"`
+			Quotas      *UserQuotas  `json:"quotas,omitempty"`
 		}
 
 		if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
@@ -4907,6 +5187,17 @@ func (s *server) EditUser() http.HandlerFunc {
 			return
 		}
 
+		if user.Quotas != nil {
+			if err := user.Quotas.validate(); err != nil {
+				s.respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+					"code":    http.StatusBadRequest,
+					"error":   err.Error(),
+					"success": false,
+				})
+				return
+			}
+		}
+
 		// Validate events if provided
 		if user.Events != "" {
 			eventList := strings.Split(user.Events, ",")
@@ -4946,9 +5237,9 @@ func (s *server) EditUser() http.HandlerFunc {
 
 		// Add fields to update
 		addField("name", user.Name, user.Name != "")
-		addField("token", user.Token, user.Token != "")
 		addField("webhook", user.Webhook, user.Webhook != "")
-		addField("expiration", user.Expiration, user.Expiration != 0)
+		// A negative expiration removes it
+		addField("expiration", max(user.Expiration, 0), user.Expiration != 0)
 		addField("events", user.Events, user.Events != "")
 		addField("history", user.History, user.History != 0)
 
@@ -4973,10 +5264,18 @@ func (s *server) EditUser() http.HandlerFunc {
 			addField("s3_public_url", user.S3Config.PublicURL, true)
 			addField("media_delivery", user.S3Config.MediaDelivery, true)
 			addField("s3_retention_days", user.S3Config.RetentionDays, true)
+			addField("s3_url_mode", user.S3Config.URLMode, user.S3Config.URLMode != "")
+			addField("s3_presign_ttl", user.S3Config.PresignTTL, user.S3Config.PresignTTL > 0)
+		}
+
+		if user.Quotas != nil {
+			addField("quota_messages", user.Quotas.MessagesPerMonth, true)
+			addField("quota_media_bytes", user.Quotas.MaxMediaBytes, true)
+			addField("quota_history_rows", user.Quotas.MaxHistoryRows, true)
 		}
 
 		// If no fields to update, return early
-		if argIndex == 1 {
+		if argIndex == 1 && user.Token == "" {
 			s.respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
 				"code":    http.StatusBadRequest,
 				"error":   "no fields to update",
@@ -4985,19 +5284,43 @@ func (s *server) EditUser() http.HandlerFunc {
 			return
 		}
 
-		// Add WHERE clause
-		query += " WHERE id = $" + strconv.Itoa(argIndex)
-		args = append(args, userID)
+		// The token is stored hashed, setting it here also ends the grace period of a rotated token
+		if user.Token != "" {
+			if inUse, err := tokenInUse(s.db, user.Token, userID); err != nil || inUse {
+				s.respondWithJSON(w, http.StatusConflict, map[string]interface{}{
+					"code":    http.StatusConflict,
+					"error":   "user with this token already exists",
+					"success": false,
+				})
+				return
+			}
+			if err := setUserToken(s.db, userID, user.Token, 0); err != nil {
+				log.Error().Err(err).Str("userID", userID).Msg("Failed to set user token")
+				s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
+					"code":    http.StatusInternalServerError,
+					"error":   "database error",
+					"success": false,
+				})
+				return
+			}
+		}
 
-		// Execute the update
-		if _, err := s.db.Exec(query, args...); err != nil {
-			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("admin DB error")
-			s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
-				"code":    http.StatusInternalServerError,
-				"error":   "database error",
-				"success": false,
-			})
-			return
+		if argIndex > 1 {
+			// Add WHERE clause
+			query += " WHERE id = $" + strconv.Itoa(argIndex)
+			args = append(args, userID)
+
+			// Execute the update
+			if _, err := s.db.Exec(query, args...); err != nil {
+				log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("admin DB error")
+				s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
+					"code":    http.StatusInternalServerError,
+					"error":   "database error",
+					"success": false,
+				})
+				return
+			}
+			forgetUserLimits(userID)
 		}
 
 		// Update S3Manager if S3 config was modified
@@ -5015,7 +5338,11 @@ func (s *server) EditUser() http.HandlerFunc {
 					MediaDelivery: user.S3Config.MediaDelivery,
 					RetentionDays: user.S3Config.RetentionDays,
 				}
-				_ = GetS3Manager().InitializeS3Client(userID, s3Config)
+				// The URL mode and key template may not be part of this edit, the stored values are authoritative
+				_ = s.db.QueryRow("SELECT COALESCE(s3_url_mode, 'public'), COALESCE(s3_presign_ttl, 3600), COALESCE(s3_key_template, '') FROM users WHERE id = $1", userID).Scan(&s3Config.URLMode, &s3Config.PresignTTL, &s3Config.KeyTemplate)
+				if err := GetS3Manager().InitializeS3Client(userID, s3Config); err == nil {
+					go GetS3Manager().ApplyRetention(context.Background(), userID)
+				}
 			} else {
 				// Remove S3 client if disabled
 				GetS3Manager().RemoveClient(userID)
@@ -5023,48 +5350,33 @@ func (s *server) EditUser() http.HandlerFunc {
 		}
 
 		// Update userinfo cache for any modified fields
-		// First, get the current user token to find the cache entry
-		var currentToken string
-		err := s.db.Get(&currentToken, "SELECT token FROM users WHERE id = $1", userID)
-		if err != nil {
-			log.Error().Err(err).Str("userID", userID).Msg("Failed to get user token for cache update")
-		} else {
-			// Get current cached userinfo if it exists
-			if cachedUserInfo, found := userinfocache.Get(currentToken); found {
-				updatedUserInfo := cachedUserInfo.(Values)
+		if cachedUserInfo, found := userinfocache.Get(userID); found {
+			updatedUserInfo := cachedUserInfo.(Values)
 
-				// Update cache fields that were modified
-				if user.Name != "" {
-					updatedUserInfo = updateUserInfo(updatedUserInfo, "Name", user.Name).(Values)
-				}
-				if user.Token != "" {
-					// If token changed, we need to update the cache key
-					updatedUserInfo = updateUserInfo(updatedUserInfo, "Token", user.Token).(Values)
-					// Remove old cache entry and add new one with new token
-					userinfocache.Delete(currentToken)
-					currentToken = user.Token
-				}
-				if user.Webhook != "" {
-					updatedUserInfo = updateUserInfo(updatedUserInfo, "Webhook", user.Webhook).(Values)
-				}
-				if user.Events != "" {
-					updatedUserInfo = updateUserInfo(updatedUserInfo, "Events", user.Events).(Values)
-				}
-				if user.History != 0 {
-					updatedUserInfo = updateUserInfo(updatedUserInfo, "History", strconv.Itoa(user.History)).(Values)
-				}
-				if user.ProxyConfig != nil {
-					if user.ProxyConfig.Enabled {
-						updatedUserInfo = updateUserInfo(updatedUserInfo, "Proxy", user.ProxyConfig.ProxyURL).(Values)
-					} else {
-						updatedUserInfo = updateUserInfo(updatedUserInfo, "Proxy", "").(Values)
-					}
+			// Update cache fields that were modified
+			if user.Name != "" {
+				updatedUserInfo = updateUserInfo(updatedUserInfo, "Name", user.Name).(Values)
+			}
+			if user.Webhook != "" {
+				updatedUserInfo = updateUserInfo(updatedUserInfo, "Webhook", user.Webhook).(Values)
+			}
+			if user.Events != "" {
+				updatedUserInfo = updateUserInfo(updatedUserInfo, "Events", user.Events).(Values)
+			}
+			if user.History != 0 {
+				updatedUserInfo = updateUserInfo(updatedUserInfo, "History", strconv.Itoa(user.History)).(Values)
+			}
+			if user.ProxyConfig != nil {
+				if user.ProxyConfig.Enabled {
+					updatedUserInfo = updateUserInfo(updatedUserInfo, "Proxy", user.ProxyConfig.ProxyURL).(Values)
+				} else {
+					updatedUserInfo = updateUserInfo(updatedUserInfo, "Proxy", "").(Values)
 				}
-
-				// Update the cache
-				userinfocache.Set(currentToken, updatedUserInfo, cache.NoExpiration)
-				log.Info().Str("userID", userID).Msg("User info cache updated after edit")
 			}
+
+			// Update the cache
+			userinfocache.Set(userID, updatedUserInfo, cache.NoExpiration)
+			log.Info().Str("userID", userID).Msg("User info cache updated after edit")
 		}
 
 		s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
@@ -5113,6 +5425,9 @@ func (s *server) DeleteUser() http.HandlerFunc {
 			})
 			return
 		}
+		forgetUserLimits(userID)
+		forgetSessionDiagnostics(userID)
+		forgetUserMetrics(userID)
 		s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
 			"code":    http.StatusOK,
 			"data":    map[string]string{"id": userID},
@@ -5163,8 +5478,8 @@ func (s *server) DeleteUserComplete() http.HandlerFunc {
 		}
 
 		// Get user info before deletion
-		var uname, jid, token string
-		err = s.db.QueryRow("SELECT name, jid, token FROM users WHERE id = $1", id).Scan(&uname, &jid, &token)
+		var uname, jid string
+		err = s.db.QueryRow("SELECT name, jid FROM users WHERE id = $1", id).Scan(&uname, &jid)
 		if err != nil {
 			log.Error().Err(err).Str("id", id).Msg("problem retrieving user information")
 			// Continue anyway since we have the ID
@@ -5192,11 +5507,32 @@ func (s *server) DeleteUserComplete() http.HandlerFunc {
 			return
 		}
 
+		if _, err := s.db.Exec("DELETE FROM helpdesk_connectors WHERE user_id = $1", id); err != nil {
+			log.Error().Err(err).Str("id", id).Msg("problem removing helpdesk connectors")
+		}
+		if _, err := s.db.Exec("DELETE FROM flows WHERE user_id = $1", id); err != nil {
+			log.Error().Err(err).Str("id", id).Msg("problem removing flows")
+		}
+		if _, err := s.db.Exec("DELETE FROM flow_sessions WHERE user_id = $1", id); err != nil {
+			log.Error().Err(err).Str("id", id).Msg("problem removing flow sessions")
+		}
+		for _, table := range []string{"autoreply_rules", "autoreply_settings", "autoreply_contacts", "ai_agents", "ai_handoffs", "media_library", "api_keys", "user_usage", "usage_daily"} {
+			if _, err := s.db.Exec("DELETE FROM "+table+" WHERE user_id = $1", id); err != nil {
+				log.Error().Err(err).Str("id", id).Str("table", table).Msg("problem removing user data")
+			}
+		}
+
 		// 3. Cleanup from memory
+		connectorCache.Delete(id)
+		aiAgentCache.Delete(id)
 		clientManager.DeleteWhatsmeowClient(id)
 		clientManager.DeleteMyClient(id)
 		clientManager.DeleteHTTPClient(id)
-		userinfocache.Delete(token)
+		userinfocache.Delete(id)
+		forgetUserLimits(id)
+		forgetSessionDiagnostics(id)
+		forgetUserMetrics(id)
+		forgetUserTokens(id)
 
 		// 4. Remove media files
 		userDirectory := filepath.Join(s.exPath, "files", id)
@@ -5207,6 +5543,13 @@ func (s *server) DeleteUserComplete() http.HandlerFunc {
 				log.Error().Err(err).Str("dir", userDirectory).Msg("error removing media directory")
 			}
 		}
+		if err := os.RemoveAll(s.mediaLibraryDir(id)); err != nil {
+			log.Error().Err(err).Str("id", id).Msg("error removing media library files")
+		}
+
+		if err := localMediaStore.DeleteAll(context.Background(), id); err != nil {
+			log.Error().Err(err).Str("id", id).Msg("error removing locally stored media")
+		}
 
 		// 5. Remove files from S3 (if enabled)
 		var s3Enabled bool
@@ -5329,12 +5672,11 @@ func (s *server) SetHistory() http.HandlerFunc {
 			return
 		}
 
-		token := r.Context().Value("userinfo").(Values).Get("Token")
-		if cachedUserInfo, found := userinfocache.Get(token); found {
+		if cachedUserInfo, found := userinfocache.Get(txtid); found {
 			updatedUserInfo := cachedUserInfo.(Values)
 			// Update history in cache
 			updatedUserInfo = updateUserInfo(updatedUserInfo, "History", strconv.Itoa(t.History)).(Values)
-			userinfocache.Set(token, updatedUserInfo, cache.NoExpiration)
+			userinfocache.Set(txtid, updatedUserInfo, cache.NoExpiration)
 			log.Info().Str("userID", txtid).Msg("User info cache updated with History configuration")
 		}
 
@@ -5384,12 +5726,11 @@ func (s *server) SetProxy() http.HandlerFunc {
 				return
 			}
 
-			token := r.Context().Value("userinfo").(Values).Get("Token")
-			if cachedUserInfo, found := userinfocache.Get(token); found {
+			if cachedUserInfo, found := userinfocache.Get(txtid); found {
 				updatedUserInfo := cachedUserInfo.(Values)
 				// Update proxy in cache
 				updatedUserInfo = updateUserInfo(updatedUserInfo, "Proxy", "").(Values)
-				userinfocache.Set(token, updatedUserInfo, cache.NoExpiration)
+				userinfocache.Set(txtid, updatedUserInfo, cache.NoExpiration)
 				log.Info().Str("userID", txtid).Msg("User info cache updated with Proxy configuration")
 			}
 
@@ -5428,12 +5769,11 @@ func (s *server) SetProxy() http.HandlerFunc {
 			return
 		}
 
-		token := r.Context().Value("userinfo").(Values).Get("Token")
-		if cachedUserInfo, found := userinfocache.Get(token); found {
+		if cachedUserInfo, found := userinfocache.Get(txtid); found {
 			updatedUserInfo := cachedUserInfo.(Values)
 			// Update proxy in cache
 			updatedUserInfo = updateUserInfo(updatedUserInfo, "Proxy", t.ProxyURL).(Values)
-			userinfocache.Set(token, updatedUserInfo, cache.NoExpiration)
+			userinfocache.Set(txtid, updatedUserInfo, cache.NoExpiration)
 			log.Info().Str("userID", txtid).Msg("User info cache updated with Proxy configuration")
 		}
 
@@ -5463,6 +5803,9 @@ func (s *server) ConfigureS3() http.HandlerFunc {
 		PublicURL     string `json:"public_url"`
 		MediaDelivery string `json:"media_delivery"`
 		RetentionDays int    `json:"retention_days"`
+		URLMode       string `json:"url_mode"`
+		PresignTTL    int    `json:"presign_ttl"`
+		KeyTemplate   string `json:"key_template"`
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -5477,8 +5820,8 @@ func (s *server) ConfigureS3() http.HandlerFunc {
 		}
 
 		// Validate media_delivery
-		if t.MediaDelivery != "" && t.MediaDelivery != "base64" && t.MediaDelivery != "s3" && t.MediaDelivery != "both" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("media_delivery must be 'base64', 's3', or 'both'"))
+		if t.MediaDelivery != "" && t.MediaDelivery != "base64" && t.MediaDelivery != "s3" && t.MediaDelivery != "both" && t.MediaDelivery != "local" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("media_delivery must be 'base64', 's3', 'both' or 'local'"))
 			return
 		}
 
@@ -5486,6 +5829,28 @@ func (s *server) ConfigureS3() http.HandlerFunc {
 			t.MediaDelivery = "base64"
 		}
 
+		if t.URLMode == "" {
+			t.URLMode = "public"
+		}
+		if t.URLMode != "public" && t.URLMode != "presigned" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("url_mode must be 'public' or 'presigned'"))
+			return
+		}
+		if t.PresignTTL <= 0 {
+			t.PresignTTL = defaultS3PresignTTL
+		}
+		// SigV4 presigned URLs can't live longer than a week
+		if t.PresignTTL > 7*24*3600 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("presign_ttl can't exceed 604800 seconds (7 days)"))
+			return
+		}
+		if t.KeyTemplate != "" {
+			if err := validateS3KeyTemplate(t.KeyTemplate); err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+
 		// Update database
 		_, err = s.db.Exec(`
 			UPDATE users SET 
@@ -5498,10 +5863,13 @@ func (s *server) ConfigureS3() http.HandlerFunc {
 				s3_path_style = $7,
 				s3_public_url = $8,
 				media_delivery = $9,
-				s3_retention_days = $10
-			WHERE id = $11`,
+				s3_retention_days = $10,
+				s3_url_mode = $11,
+				s3_presign_ttl = $12,
+				s3_key_template = $13
+			WHERE id = $14`,
 			t.Enabled, t.Endpoint, t.Region, t.Bucket, t.AccessKey, t.SecretKey,
-			t.PathStyle, t.PublicURL, t.MediaDelivery, t.RetentionDays, txtid)
+			t.PathStyle, t.PublicURL, t.MediaDelivery, t.RetentionDays, t.URLMode, t.PresignTTL, t.KeyTemplate, txtid)
 
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to save S3 configuration"))
@@ -5509,6 +5877,7 @@ func (s *server) ConfigureS3() http.HandlerFunc {
 		}
 
 		// Initialize S3 client if enabled
+		retention := retentionModeDisabled
 		if t.Enabled {
 			s3Config := &S3Config{
 				Enabled:       t.Enabled,
@@ -5520,6 +5889,9 @@ func (s *server) ConfigureS3() http.HandlerFunc {
 				PathStyle:     t.PathStyle,
 				PublicURL:     t.PublicURL,
 				RetentionDays: t.RetentionDays,
+				URLMode:       t.URLMode,
+				PresignTTL:    t.PresignTTL,
+				KeyTemplate:   t.KeyTemplate,
 			}
 
 			err = GetS3Manager().InitializeS3Client(txtid, s3Config)
@@ -5527,13 +5899,16 @@ func (s *server) ConfigureS3() http.HandlerFunc {
 				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("failed to initialize S3 client: %v", err)))
 				return
 			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+			retention = GetS3Manager().ApplyRetention(ctx, txtid).Mode
+			cancel()
 		} else {
 			GetS3Manager().RemoveClient(txtid)
 		}
 
 		// Update userinfocache with S3 configuration
-		token := r.Context().Value("userinfo").(Values).Get("Token")
-		if cachedUserInfo, found := userinfocache.Get(token); found {
+		if cachedUserInfo, found := userinfocache.Get(txtid); found {
 			updatedUserInfo := cachedUserInfo.(Values)
 
 			// Update S3-related fields in cache
@@ -5548,13 +5923,14 @@ func (s *server) ConfigureS3() http.HandlerFunc {
 			updatedUserInfo = updateUserInfo(updatedUserInfo, "MediaDelivery", t.MediaDelivery).(Values)
 			updatedUserInfo = updateUserInfo(updatedUserInfo, "S3RetentionDays", strconv.Itoa(t.RetentionDays)).(Values)
 
-			userinfocache.Set(token, updatedUserInfo, cache.NoExpiration)
+			userinfocache.Set(txtid, updatedUserInfo, cache.NoExpiration)
 			log.Info().Str("userID", txtid).Msg("User info cache updated with S3 configuration")
 		}
 
 		response := map[string]interface{}{
-			"Details": "S3 configuration saved successfully",
-			"Enabled": t.Enabled,
+			"Details":   "S3 configuration saved successfully",
+			"Enabled":   t.Enabled,
+			"Retention": retention,
 		}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
@@ -5580,6 +5956,9 @@ func (s *server) GetS3Config() http.HandlerFunc {
 			PublicURL     string `json:"public_url" db:"public_url"`
 			MediaDelivery string `json:"media_delivery" db:"media_delivery"`
 			RetentionDays int    `json:"retention_days" db:"retention_days"`
+			URLMode       string `json:"url_mode" db:"url_mode"`
+			PresignTTL    int    `json:"presign_ttl" db:"presign_ttl"`
+			KeyTemplate   string `json:"key_template" db:"key_template"`
 		}
 
 		err := s.db.Get(&config, `
@@ -5592,7 +5971,10 @@ func (s *server) GetS3Config() http.HandlerFunc {
 				s3_path_style as path_style,
 				s3_public_url as public_url,
 				media_delivery,
-				s3_retention_days as retention_days
+				s3_retention_days as retention_days,
+				COALESCE(s3_url_mode, 'public') as url_mode,
+				COALESCE(s3_presign_ttl, 3600) as presign_ttl,
+				COALESCE(s3_key_template, '') as key_template
 			FROM users WHERE id = $1`, txtid)
 
 		if err != nil {
@@ -5631,6 +6013,9 @@ func (s *server) TestS3Connection() http.HandlerFunc {
 			PathStyle     bool   `db:"path_style"`
 			PublicURL     string `db:"public_url"`
 			RetentionDays int    `db:"retention_days"`
+			URLMode       string `db:"url_mode"`
+			PresignTTL    int    `db:"presign_ttl"`
+			KeyTemplate   string `db:"key_template"`
 		}
 
 		err := s.db.Get(&config, `
@@ -5643,7 +6028,10 @@ func (s *server) TestS3Connection() http.HandlerFunc {
 				s3_secret_key as secret_key,
 				s3_path_style as path_style,
 				s3_public_url as public_url,
-				s3_retention_days as retention_days
+				s3_retention_days as retention_days,
+				COALESCE(s3_url_mode, 'public') as url_mode,
+				COALESCE(s3_presign_ttl, 3600) as presign_ttl,
+				COALESCE(s3_key_template, '') as key_template
 			FROM users WHERE id = $1`, txtid)
 
 		if err != nil {
@@ -5670,6 +6058,9 @@ func (s *server) TestS3Connection() http.HandlerFunc {
 			PathStyle:     config.PathStyle,
 			PublicURL:     config.PublicURL,
 			RetentionDays: config.RetentionDays,
+			URLMode:       config.URLMode,
+			PresignTTL:    config.PresignTTL,
+			KeyTemplate:   config.KeyTemplate,
 		}
 
 		err = GetS3Manager().InitializeS3Client(txtid, s3Config)
@@ -5752,9 +6143,8 @@ func (s *server) GetHistory() http.HandlerFunc {
 
 		if historyLimit == 0 {
 			// Before returning error, try refreshing the cache in case the DB was updated
-			token := r.Context().Value("userinfo").(Values).Get("Token")
-			log.Info().Str("userId", txtid).Str("token", token).Msg("History is 0, invalidating cache and trying fresh DB lookup")
-			userinfocache.Delete(token)
+			log.Info().Str("userId", txtid).Msg("History is 0, invalidating cache and trying fresh DB lookup")
+			userinfocache.Delete(txtid)
 
 			// Re-fetch from database
 			var newHistoryValue sql.NullInt64
@@ -6018,7 +6408,6 @@ func (s *server) ConfigureHmac() http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		token := r.Context().Value("userinfo").(Values).Get("Token")
 
 		decoder := json.NewDecoder(r.Body)
 		var t hmacConfigStruct
@@ -6052,12 +6441,12 @@ func (s *server) ConfigureHmac() http.HandlerFunc {
 			return
 		}
 
-		if cachedUserInfo, found := userinfocache.Get(token); found {
+		if cachedUserInfo, found := userinfocache.Get(txtid); found {
 			updatedUserInfo := cachedUserInfo.(Values)
 			updatedUserInfo = updateUserInfo(updatedUserInfo, "HasHmac", "true").(Values)
 			hmacKeyEncrypted := base64.StdEncoding.EncodeToString(encryptedHmacKey)
 			updatedUserInfo = updateUserInfo(updatedUserInfo, "HmacKeyEncrypted", hmacKeyEncrypted).(Values)
-			userinfocache.Set(token, updatedUserInfo, cache.NoExpiration)
+			userinfocache.Set(txtid, updatedUserInfo, cache.NoExpiration)
 			log.Info().Str("userID", txtid).Msg("User info cache updated with HMAC configuration")
 		}
 
@@ -6109,7 +6498,6 @@ func (s *server) GetHmacConfig() http.HandlerFunc {
 func (s *server) DeleteHmacConfig() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		token := r.Context().Value("userinfo").(Values).Get("Token") // ← Pegar o token
 
 		// Clear HMAC key
 		_, err := s.db.Exec(`UPDATE users SET hmac_key = NULL WHERE id = $1`, txtid)
@@ -6121,11 +6509,11 @@ func (s *server) DeleteHmacConfig() http.HandlerFunc {
 			return
 		}
 
-		if cachedUserInfo, found := userinfocache.Get(token); found {
+		if cachedUserInfo, found := userinfocache.Get(txtid); found {
 			updatedUserInfo := cachedUserInfo.(Values)
 			updatedUserInfo = updateUserInfo(updatedUserInfo, "HasHmac", "false").(Values)
 			updatedUserInfo = updateUserInfo(updatedUserInfo, "HmacKeyEncrypted", "").(Values)
-			userinfocache.Set(token, updatedUserInfo, cache.NoExpiration)
+			userinfocache.Set(txtid, updatedUserInfo, cache.NoExpiration)
 			log.Info().Str("userID", txtid).Msg("User info cache updated - HMAC configuration removed")
 		}
 
@@ -11,18 +11,21 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
 	_ "image/gif"
 	"image/jpeg"
 	_ "image/png"
 	"io"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"regexp"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -40,6 +43,9 @@ import (
 	"github.com/nfnt/resize"
 	"github.com/rs/zerolog/log"
 	"github.com/vincent-petithory/dataurl"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"google.golang.org/protobuf/proto"
 )
 
 const (
@@ -106,6 +112,50 @@ func (usm *UserSemaphoreManager) ForUser(userID string) chan struct{} {
 	return pool.(chan struct{})
 }
 
+// Mutexes by key that are dropped once nobody holds or waits for them
+type KeyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedMutexEntry
+}
+
+type keyedMutexEntry struct {
+	sync.Mutex
+	refs int
+}
+
+func NewKeyedMutex() *KeyedMutex {
+	return &KeyedMutex{locks: make(map[string]*keyedMutexEntry)}
+}
+
+// Locks the key and returns the function that unlocks it
+func (km *KeyedMutex) Lock(key string) func() {
+	km.mu.Lock()
+	entry, ok := km.locks[key]
+	if !ok {
+		entry = &keyedMutexEntry{}
+		km.locks[key] = entry
+	}
+	entry.refs++
+	km.mu.Unlock()
+
+	entry.Lock()
+	return func() {
+		entry.Unlock()
+		km.mu.Lock()
+		entry.refs--
+		if entry.refs == 0 {
+			delete(km.locks, key)
+		}
+		km.mu.Unlock()
+	}
+}
+
+func (km *KeyedMutex) size() int {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	return len(km.locks)
+}
+
 var (
 	urlRegex = regexp.MustCompile(`https?://[^\s"']*[^\"'\s\.,!?()[\]{}]`)
 
@@ -255,6 +305,13 @@ func callHookWithHmac(myurl string, payload map[string]string, userID string, en
 
 	var body interface{} = payload
 
+	ctx, delivery := startWebhookSpan(myurl, userID)
+	defer delivery.End()
+
+	backlog := &sessionDiagnosticsFor(userID).pendingWebhooks
+	backlog.Add(1)
+	defer backlog.Add(-1)
+
 	// Starts the retry loop.
 	for attempt := 0; attempt < maxRetries; attempt++ {
 		if attempt > 0 {
@@ -332,7 +389,11 @@ func callHookWithHmac(myurl string, payload map[string]string, userID string, en
 			req.SetHeader("x-hmac-signature", hmacSignature)
 		}
 
+		attemptSpan := startWebhookAttemptSpan(ctx, req, attempt)
+		started := time.Now()
 		resp, postErr := req.Post(myurl)
+		observeSince(metricWebhookDuration, started)
+		endWebhookAttemptSpan(attemptSpan, resp, postErr)
 
 		lastError = postErr
 
@@ -356,11 +417,16 @@ func callHookWithHmac(myurl string, payload map[string]string, userID string, en
 		}
 
 		log.Info().Int("status", resp.StatusCode()).Str("url", myurl).Msg("Webhook call successful")
+		meterUsage(userID, metricWebhookDelivered, 1)
+		metricWebhooksTotal.WithLabelValues("success").Inc()
 		return
 	}
 
 	if lastError != nil {
 		log.Error().Str("url", myurl).Msg("Webhook permanently failed after all retries. Sending to error queue...")
+		delivery.SetError(lastError)
+		meterUsage(userID, metricWebhookFailed, 1)
+		metricWebhooksTotal.WithLabelValues("failure").Inc()
 
 		errorPayloadMap := make(map[string]interface{})
 		if p, ok := body.(map[string]string); ok {
@@ -404,6 +470,13 @@ func callHookFileWithHmac(myurl string, payload map[string]string, userID string
 
 	var lastError error
 
+	ctx, delivery := startWebhookSpan(myurl, userID)
+	defer delivery.End()
+
+	backlog := &sessionDiagnosticsFor(userID).pendingWebhooks
+	backlog.Add(1)
+	defer backlog.Add(-1)
+
 	finalPayload := make(map[string]string)
 	for k, v := range payload {
 		finalPayload[k] = v
@@ -452,7 +525,11 @@ func callHookFileWithHmac(myurl string, payload map[string]string, userID string
 			req.SetHeader("x-hmac-signature", hmacSignature)
 		}
 
+		attemptSpan := startWebhookAttemptSpan(ctx, req, attempt)
+		started := time.Now()
 		resp, postErr := req.Post(myurl)
+		observeSince(metricWebhookDuration, started)
+		endWebhookAttemptSpan(attemptSpan, resp, postErr)
 
 		lastError = postErr
 
@@ -476,11 +553,16 @@ func callHookFileWithHmac(myurl string, payload map[string]string, userID string
 		}
 
 		log.Info().Int("status", resp.StatusCode()).Str("url", myurl).Msg("File webhook call successful")
+		meterUsage(userID, metricWebhookDelivered, 1)
+		metricWebhooksTotal.WithLabelValues("success").Inc()
 		return nil
 	}
 
 	if lastError != nil {
 		log.Error().Str("url", myurl).Msg("File webhook permanently failed after all retries. Sending to error queue...")
+		delivery.SetError(lastError)
+		meterUsage(userID, metricWebhookFailed, 1)
+		metricWebhooksTotal.WithLabelValues("failure").Inc()
 
 		errorPayloadMap := make(map[string]interface{})
 		for k, v := range finalPayload {
@@ -522,25 +604,29 @@ func (s *server) respondWithJSON(w http.ResponseWriter, statusCode int, payload
 	}
 }
 
-// ProcessOutgoingMedia handles media processing for outgoing messages with S3 support
-func ProcessOutgoingMedia(userID string, contactJID string, messageID string, data []byte, mimeType string, fileName string, db *sqlx.DB) (map[string]interface{}, error) {
+// outgoingMediaStorage returns where the user's sent media is archived, nil for base64 only delivery
+func outgoingMediaStorage(userID string, db *sqlx.DB) MediaStorage {
 	// Check if S3 is enabled for this user
 	var s3Config struct {
 		Enabled       bool   `db:"s3_enabled"`
 		MediaDelivery string `db:"media_delivery"`
 	}
-	err := db.Get(&s3Config, "SELECT s3_enabled, media_delivery FROM users WHERE id = $1", userID)
+	err := db.Get(&s3Config, "SELECT COALESCE(s3_enabled, false) AS s3_enabled, COALESCE(media_delivery, 'base64') AS media_delivery FROM users WHERE id = $1", userID)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to get S3 config")
-		s3Config.Enabled = false
-		s3Config.MediaDelivery = "base64"
+		return nil
 	}
+	return mediaStorageFor(userID, s3Config.MediaDelivery, s3Config.Enabled)
+}
 
-	// Process S3 upload if enabled
-	if s3Config.Enabled && (s3Config.MediaDelivery == "s3" || s3Config.MediaDelivery == "both") {
-		// Process S3 upload (outgoing messages are always in outbox)
-		s3Data, err := GetS3Manager().ProcessMediaForS3(
+// ProcessOutgoingMedia handles media processing for outgoing messages with S3 or local storage
+func ProcessOutgoingMedia(userID string, contactJID string, messageID string, data []byte, mimeType string, fileName string, db *sqlx.DB) (map[string]interface{}, error) {
+	// Store the media if it is delivered as a link
+	if storage := outgoingMediaStorage(userID, db); storage != nil {
+		// Outgoing messages are always in outbox
+		mediaData, err := storeMediaForDelivery(
 			context.Background(),
+			storage,
 			userID,
 			contactJID,
 			messageID,
@@ -550,10 +636,10 @@ func ProcessOutgoingMedia(userID string, contactJID string, messageID string, da
 			false, // isIncoming = false for sent messages
 		)
 		if err != nil {
-			log.Error().Err(err).Msg("Failed to upload media to S3")
-			// Continue even if S3 upload fails
+			log.Error().Err(err).Msg("Failed to store outgoing media")
+			// Continue even if the upload fails
 		} else {
-			return s3Data, nil
+			return mediaData, nil
 		}
 	}
 
@@ -642,9 +728,14 @@ func extractFirstURL(text string) string {
 	return match
 }
 func fetchOpenGraphData(ctx context.Context, urlStr string) (string, string, []byte) {
+	ctx, sp := startSpan(ctx, "opengraph.fetch", spanKindClient)
+	sp.SetAttr("url.full", urlStr)
+	defer sp.End()
+
 	pageData, _, err := fetchURLBytes(ctx, urlStr, openGraphPageMaxBytes)
 	if err != nil {
 		log.Warn().Err(err).Str("url", urlStr).Msg("Failed to fetch URL for Open Graph data")
+		sp.SetError(err)
 		return "", "", nil
 	}
 
@@ -803,6 +894,338 @@ func convertImageToWebP(input []byte) ([]byte, error) {
 	}, "ffmpeg failed converting image sticker")
 }
 
+// Number of bars in a WhatsApp voice note waveform, each in the 0-100 range
+const voiceNoteWaveformSamples = 64
+
+// Voice notes must be mono OGG/Opus, anything else plays broken or not at all
+func convertAudioToOpus(input []byte) ([]byte, error) {
+	return runFFmpegConversion(input, ".audio", func(inPath, outPath string) []string {
+		return []string{
+			"-y",
+			"-i", inPath,
+			"-vn",
+			"-ac", "1",
+			"-ar", "48000",
+			"-c:a", "libopus",
+			"-b:a", "32k",
+			"-application", "voip",
+			"-f", "ogg",
+			outPath,
+		}
+	}, "ffmpeg failed converting audio to opus")
+}
+
+// Decodes the audio to 8kHz mono PCM and reduces it to the voice note waveform
+func generateAudioWaveform(input []byte) ([]byte, error) {
+	pcm, err := runFFmpegConversion(input, ".ogg", func(inPath, outPath string) []string {
+		return []string{
+			"-y",
+			"-i", inPath,
+			"-ac", "1",
+			"-ar", "8000",
+			"-f", "s16le",
+			outPath,
+		}
+	}, "ffmpeg failed decoding audio for waveform")
+	if err != nil {
+		return nil, err
+	}
+	return waveformFromPCM(pcm), nil
+}
+
+func waveformFromPCM(pcm []byte) []byte {
+	samples := len(pcm) / 2
+	waveform := make([]byte, voiceNoteWaveformSamples)
+	if samples == 0 {
+		return waveform
+	}
+
+	levels := make([]float64, voiceNoteWaveformSamples)
+	maxLevel := 0.0
+	for i := range levels {
+		start := i * samples / voiceNoteWaveformSamples
+		end := (i + 1) * samples / voiceNoteWaveformSamples
+		if end <= start {
+			end = start + 1
+		}
+		sum := 0.0
+		for j := start; j < end && j < samples; j++ {
+			v := float64(int16(binary.LittleEndian.Uint16(pcm[j*2:]))) / 32768
+			sum += v * v
+		}
+		levels[i] = math.Sqrt(sum / float64(end-start))
+		maxLevel = math.Max(maxLevel, levels[i])
+	}
+	if maxLevel == 0 {
+		return waveform
+	}
+	for i, level := range levels {
+		waveform[i] = byte(math.Round(level / maxLevel * 100))
+	}
+	return waveform
+}
+
+func isOggOpus(data []byte) bool {
+	return len(data) > 36 && bytes.HasPrefix(data, []byte("OggS")) && bytes.Contains(data[:min(len(data), 512)], []byte("OpusHead"))
+}
+
+// Duration of an OGG/Opus stream in seconds, read from the granule position of the last page.
+// Opus granules always count 48kHz samples, minus the pre-skip declared in OpusHead.
+func oggOpusDuration(data []byte) uint32 {
+	if !isOggOpus(data) {
+		return 0
+	}
+	var preSkip uint64
+	if head := bytes.Index(data, []byte("OpusHead")); head >= 0 && head+12 <= len(data) {
+		preSkip = uint64(binary.LittleEndian.Uint16(data[head+10:]))
+	}
+
+	var granule uint64
+	for offset := 0; offset+27 <= len(data); {
+		if !bytes.Equal(data[offset:offset+4], []byte("OggS")) {
+			next := bytes.Index(data[offset+1:], []byte("OggS"))
+			if next < 0 {
+				break
+			}
+			offset += next + 1
+			continue
+		}
+		if pos := binary.LittleEndian.Uint64(data[offset+6:]); pos != math.MaxUint64 {
+			granule = pos
+		}
+		segments := int(data[offset+26])
+		if offset+27+segments > len(data) {
+			break
+		}
+		pageSize := 27 + segments
+		for _, lacing := range data[offset+27 : offset+27+segments] {
+			pageSize += int(lacing)
+		}
+		offset += pageSize
+	}
+	if granule <= preSkip {
+		return 0
+	}
+	return uint32(math.Ceil(float64(granule-preSkip) / 48000))
+}
+
+var errFFmpegNotAvailable = errors.New("ffmpeg not available")
+
+// Mimetype of audio sent as is, MP3 when it can't be told
+func detectAudioMimeType(data []byte) string {
+	mimeType := http.DetectContentType(data)
+	if !strings.HasPrefix(mimeType, "audio/") && mimeType != "application/ogg" {
+		return "audio/mpeg"
+	}
+	return mimeType
+}
+
+// Turns any audio into a playable voice note, returning the OGG/Opus data with its real
+// duration and waveform. Without ffmpeg, OGG/Opus input is still measured and other
+// formats are returned untouched.
+func prepareVoiceNote(input []byte) ([]byte, uint32, []byte, error) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		if !isOggOpus(input) {
+			return input, 0, nil, errFFmpegNotAvailable
+		}
+		return input, oggOpusDuration(input), nil, nil
+	}
+
+	converted, err := convertAudioToOpus(input)
+	if err != nil {
+		return input, 0, nil, fmt.Errorf("failed to convert audio to opus: %w", err)
+	}
+	waveform, err := generateAudioWaveform(converted)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to generate voice note waveform")
+		waveform = nil
+	}
+	return converted, oggOpusDuration(converted), waveform, nil
+}
+
+type preparedVideo struct {
+	Data        []byte
+	MimeType    string
+	Thumbnail   []byte
+	Seconds     uint32
+	GifPlayback bool
+	Transcoded  bool
+}
+
+// Converts a video to the H.264/AAC MP4 every WhatsApp client plays, with the moov atom
+// first so playback starts before the download ends. GIF playback drops the audio track.
+func transcodeVideoToMP4(input []byte, gifPlayback bool, maxHeight int, videoBitrate int) ([]byte, error) {
+	return runFFmpegConversion(input, ".video", func(inPath, outPath string) []string {
+		args := []string{
+			"-y",
+			"-i", inPath,
+			// H.264 needs even dimensions, GIFs often have odd ones
+			"-vf", fmt.Sprintf("scale=-2:'min(%d,trunc(ih/2)*2)'", maxHeight),
+			"-c:v", "libx264",
+			"-profile:v", "main",
+			"-pix_fmt", "yuv420p",
+			"-preset", "veryfast",
+		}
+		if videoBitrate > 0 {
+			args = append(args, "-b:v", strconv.Itoa(videoBitrate), "-maxrate", strconv.Itoa(videoBitrate), "-bufsize", strconv.Itoa(videoBitrate*2))
+		} else {
+			args = append(args, "-crf", "28")
+		}
+		if gifPlayback {
+			args = append(args, "-an")
+		} else {
+			args = append(args, "-c:a", "aac", "-b:a", "128k", "-ac", "2")
+		}
+		return append(args, "-movflags", "+faststart", "-f", "mp4", outPath)
+	}, "ffmpeg failed transcoding video")
+}
+
+// Picks a representative frame among the first ones and scales it down for the preview
+func extractVideoThumbnail(input []byte) ([]byte, error) {
+	return runFFmpegConversion(input, ".mp4", func(inPath, outPath string) []string {
+		return []string{
+			"-y",
+			"-i", inPath,
+			"-vf", "thumbnail,scale=320:-2",
+			"-frames:v", "1",
+			"-c:v", "mjpeg",
+			"-q:v", "5",
+			"-f", "image2",
+			outPath,
+		}
+	}, "ffmpeg failed extracting video thumbnail")
+}
+
+// Duration in seconds from the mvhd box of an MP4/MOV file
+func mp4Duration(data []byte) uint32 {
+	moov := findMP4Box(data, "moov")
+	if moov == nil {
+		return 0
+	}
+	mvhd := findMP4Box(moov, "mvhd")
+	if len(mvhd) < 4 {
+		return 0
+	}
+	var timescale uint32
+	var duration uint64
+	if mvhd[0] == 1 {
+		if len(mvhd) < 32 {
+			return 0
+		}
+		timescale = binary.BigEndian.Uint32(mvhd[20:])
+		duration = binary.BigEndian.Uint64(mvhd[24:])
+	} else {
+		if len(mvhd) < 20 {
+			return 0
+		}
+		timescale = binary.BigEndian.Uint32(mvhd[12:])
+		duration = uint64(binary.BigEndian.Uint32(mvhd[16:]))
+	}
+	if timescale == 0 {
+		return 0
+	}
+	return uint32(math.Ceil(float64(duration) / float64(timescale)))
+}
+
+// Returns the payload of the first top level box with the given type
+func findMP4Box(data []byte, boxType string) []byte {
+	for offset := 0; offset+8 <= len(data); {
+		size := uint64(binary.BigEndian.Uint32(data[offset:]))
+		header := uint64(8)
+		if size == 1 {
+			if offset+16 > len(data) {
+				return nil
+			}
+			size = binary.BigEndian.Uint64(data[offset+8:])
+			header = 16
+		} else if size == 0 {
+			size = uint64(len(data) - offset)
+		}
+		if size < header || uint64(offset)+size > uint64(len(data)) {
+			return nil
+		}
+		if string(data[offset+4:offset+8]) == boxType {
+			return data[uint64(offset)+header : uint64(offset)+size]
+		}
+		offset += int(size)
+	}
+	return nil
+}
+
+// Runs the video pipeline: transcoding (forced for GIF input and GIF playback from WebM),
+// size limit enforcement and, when asked, the thumbnail. Without transcoding the input is
+// kept, its duration is read and ffmpeg only extracts the thumbnail when it is installed.
+// Without ffmpeg a video that needs transcoding is returned together with errFFmpegNotAvailable.
+func prepareVideo(input []byte, transcode bool, gifPlayback bool, thumbnail bool, maxBytes int) (*preparedVideo, error) {
+	detected := http.DetectContentType(input)
+	if detected == "image/gif" {
+		gifPlayback = true
+	}
+	if gifPlayback && detected != "video/mp4" {
+		transcode = true
+	}
+
+	result := &preparedVideo{Data: input, MimeType: detected, GifPlayback: gifPlayback, Seconds: mp4Duration(input)}
+	if !transcode {
+		if _, err := exec.LookPath("ffmpeg"); err == nil && thumbnail {
+			result.Thumbnail = videoThumbnail(input)
+		}
+		return result, nil
+	}
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return result, errFFmpegNotAvailable
+	}
+
+	converted, err := transcodeVideoToMP4(input, gifPlayback, 1280, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to transcode video: %w", err)
+	}
+	// Too big: aim at a bitrate that fits the limit, lowering the resolution on each try
+	for _, height := range []int{720, 480} {
+		if maxBytes <= 0 || len(converted) <= maxBytes {
+			break
+		}
+		seconds := mp4Duration(converted)
+		if seconds == 0 {
+			break
+		}
+		audioBitrate := 128000
+		if gifPlayback {
+			audioBitrate = 0
+		}
+		bitrate := int(float64(maxBytes)*8*0.9/float64(seconds)) - audioBitrate
+		if bitrate < 100000 {
+			return nil, fmt.Errorf("video is too long to fit in %d bytes", maxBytes)
+		}
+		converted, err = transcodeVideoToMP4(input, gifPlayback, height, bitrate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to transcode video: %w", err)
+		}
+	}
+	if maxBytes > 0 && len(converted) > maxBytes {
+		return nil, fmt.Errorf("video is %d bytes after transcoding, above the %d bytes limit", len(converted), maxBytes)
+	}
+	result.Data = converted
+	result.MimeType = "video/mp4"
+	result.Transcoded = true
+	result.Seconds = mp4Duration(converted)
+
+	if thumbnail {
+		result.Thumbnail = videoThumbnail(converted)
+	}
+	return result, nil
+}
+
+// Thumbnail of the video, nil when it can't be extracted
+func videoThumbnail(video []byte) []byte {
+	jpeg, err := extractVideoThumbnail(video)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to generate video thumbnail")
+		return nil
+	}
+	return jpeg
+}
+
 func processStickerData(stickerData string, mimeOverride string, packID, packName, packPublisher string, emojis []string) ([]byte, string, error) {
 	if !strings.HasPrefix(stickerData, "data") {
 		return nil, "", fmt.Errorf("data should start with \"data:mime/type;base64,\"")
@@ -813,7 +1236,11 @@ func processStickerData(stickerData string, mimeOverride string, packID, packNam
 		return nil, "", fmt.Errorf("could not decode base64 encoded data from payload")
 	}
 
-	filedata, mimeType, err := convertToWebPSticker(dataURL.Data, mimeOverride)
+	return processStickerBytes(dataURL.Data, mimeOverride, packID, packName, packPublisher, emojis)
+}
+
+func processStickerBytes(data []byte, mimeOverride string, packID, packName, packPublisher string, emojis []string) ([]byte, string, error) {
+	filedata, mimeType, err := convertToWebPSticker(data, mimeOverride)
 	if err != nil {
 		return nil, "", err
 	}
@@ -1019,3 +1446,90 @@ func writeChunk(buf *bytes.Buffer, tag string, data []byte) {
 		buf.WriteByte(0)
 	}
 }
+
+// Uploads media to WhatsApp and builds the message for it. mediaType is
+// image, audio, video or document; anything else is sent as a document.
+func uploadMediaMessage(ctx context.Context, client *whatsmeow.Client, data []byte, mediaType string, caption string, fileName string) (*waE2E.Message, error) {
+	mimeType := http.DetectContentType(data)
+
+	switch mediaType {
+	case "image":
+		uploaded, err := tracedUpload(ctx, client, data, whatsmeow.MediaImage)
+		if err != nil {
+			return nil, err
+		}
+		return &waE2E.Message{ImageMessage: &waE2E.ImageMessage{
+			Caption:       proto.String(caption),
+			URL:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(mimeType),
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uint64(len(data))),
+		}}, nil
+	case "audio":
+		// Sent as a voice note, or as regular audio when ffmpeg can't convert it
+		voiceNote, seconds, waveform, err := prepareVoiceNote(data)
+		ptt := true
+		audioMimeType := "audio/ogg; codecs=opus"
+		if errors.Is(err, errFFmpegNotAvailable) {
+			ptt = false
+			audioMimeType = detectAudioMimeType(data)
+		} else if err != nil {
+			return nil, err
+		} else {
+			data = voiceNote
+		}
+		uploaded, err := tracedUpload(ctx, client, data, whatsmeow.MediaAudio)
+		if err != nil {
+			return nil, err
+		}
+		return &waE2E.Message{AudioMessage: &waE2E.AudioMessage{
+			URL:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(audioMimeType),
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uint64(len(data))),
+			PTT:           proto.Bool(ptt),
+			Seconds:       proto.Uint32(seconds),
+			Waveform:      waveform,
+		}}, nil
+	case "video":
+		uploaded, err := tracedUpload(ctx, client, data, whatsmeow.MediaVideo)
+		if err != nil {
+			return nil, err
+		}
+		return &waE2E.Message{VideoMessage: &waE2E.VideoMessage{
+			Caption:       proto.String(caption),
+			URL:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(mimeType),
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uint64(len(data))),
+		}}, nil
+	default:
+		uploaded, err := tracedUpload(ctx, client, data, whatsmeow.MediaDocument)
+		if err != nil {
+			return nil, err
+		}
+		if fileName == "" {
+			fileName = "file"
+		}
+		return &waE2E.Message{DocumentMessage: &waE2E.DocumentMessage{
+			Caption:       proto.String(caption),
+			URL:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(mimeType),
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uint64(len(data))),
+			FileName:      proto.String(fileName),
+		}}, nil
+	}
+}
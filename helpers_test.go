@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"testing"
+)
+
+// Builds a minimal OGG page carrying a single packet
+func oggPage(granule uint64, packet []byte) []byte {
+	var page bytes.Buffer
+	page.WriteString("OggS")
+	page.WriteByte(0)
+	page.WriteByte(0)
+	binary.Write(&page, binary.LittleEndian, granule)
+	page.Write(make([]byte, 12)) // serial, sequence and checksum
+	lacing := []byte{}
+	remaining := len(packet)
+	for remaining >= 255 {
+		lacing = append(lacing, 255)
+		remaining -= 255
+	}
+	lacing = append(lacing, byte(remaining))
+	page.WriteByte(byte(len(lacing)))
+	page.Write(lacing)
+	page.Write(packet)
+	return page.Bytes()
+}
+
+func TestOggOpusDuration(t *testing.T) {
+	head := append([]byte("OpusHead"), 1, 1, 0x38, 0x01, 0x80, 0xBB, 0, 0, 0, 0, 0) // pre-skip 312
+	var stream []byte
+	stream = append(stream, oggPage(0, head)...)
+	stream = append(stream, oggPage(0, []byte("OpusTags"))...)
+	stream = append(stream, oggPage(48000+312, make([]byte, 300))...)
+	stream = append(stream, oggPage(5*48000+24000+312, make([]byte, 40))...)
+
+	if !isOggOpus(stream) {
+		t.Fatal("Expected stream to be detected as OGG/Opus")
+	}
+	if got := oggOpusDuration(stream); got != 6 {
+		t.Errorf("Expected 6 seconds, got %d", got)
+	}
+	if got := oggOpusDuration([]byte("ID3 not an ogg file at all, just some mp3 bytes")); got != 0 {
+		t.Errorf("Expected 0 for non-ogg data, got %d", got)
+	}
+}
+
+func TestDetectAudioMimeType(t *testing.T) {
+	for name, want := range map[string]string{
+		"ID3\x03\x00\x00\x00\x00\x00\x00": "audio/mpeg",
+		"RIFF\x24\x00\x00\x00WAVEfmt ":    "audio/wave",
+		"not audio at all":                "audio/mpeg",
+	} {
+		if got := detectAudioMimeType([]byte(name)); got != want {
+			t.Errorf("%q: expected %s, got %s", name, want, got)
+		}
+	}
+}
+
+func TestWaveformFromPCM(t *testing.T) {
+	pcm := make([]byte, 8000*2)
+	for i := 0; i < 8000; i++ {
+		// Silence in the first half, full scale in the second
+		if i >= 4000 {
+			binary.LittleEndian.PutUint16(pcm[i*2:], 0x8000) // -32768
+		}
+	}
+	waveform := waveformFromPCM(pcm)
+	if len(waveform) != voiceNoteWaveformSamples {
+		t.Fatalf("Expected %d samples, got %d", voiceNoteWaveformSamples, len(waveform))
+	}
+	if waveform[0] != 0 || waveform[voiceNoteWaveformSamples-1] != 100 {
+		t.Errorf("Unexpected waveform %v", waveform)
+	}
+	if w := waveformFromPCM(nil); len(w) != voiceNoteWaveformSamples || w[0] != 0 {
+		t.Errorf("Expected empty waveform for empty input, got %v", w)
+	}
+}
+
+func mp4Box(boxType string, payload []byte) []byte {
+	box := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(box, uint32(8+len(payload)))
+	copy(box[4:], boxType)
+	return append(box, payload...)
+}
+
+func TestMP4Duration(t *testing.T) {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)  // timescale
+	binary.BigEndian.PutUint32(mvhd[16:], 12500) // duration
+	file := append(mp4Box("ftyp", []byte("isom\x00\x00\x02\x00")), mp4Box("moov", mp4Box("mvhd", mvhd))...)
+	file = append(file, mp4Box("mdat", make([]byte, 64))...)
+
+	if got := mp4Duration(file); got != 13 {
+		t.Errorf("Expected 13 seconds, got %d", got)
+	}
+
+	mvhd = make([]byte, 112)
+	mvhd[0] = 1
+	binary.BigEndian.PutUint32(mvhd[20:], 90000)
+	binary.BigEndian.PutUint64(mvhd[24:], 90000*42)
+	if got := mp4Duration(mp4Box("moov", mp4Box("mvhd", mvhd))); got != 42 {
+		t.Errorf("Expected 42 seconds from version 1 mvhd, got %d", got)
+	}
+
+	if got := mp4Duration([]byte("not a video")); got != 0 {
+		t.Errorf("Expected 0 for invalid data, got %d", got)
+	}
+}
+
+func TestKeyedMutex(t *testing.T) {
+	km := NewKeyedMutex()
+	var wg sync.WaitGroup
+	counter := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := km.Lock("key")
+			counter++
+			unlock()
+		}()
+	}
+	wg.Wait()
+	if counter != 50 {
+		t.Errorf("Expected 50 increments, got %d", counter)
+	}
+	if km.size() != 0 {
+		t.Errorf("Expected unused locks to be dropped, %d left", km.size())
+	}
+}
+
+func TestPrepareVideoWithoutTranscoding(t *testing.T) {
+	input := []byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom")
+	video, err := prepareVideo(input, false, false, true, 0)
+	if err != nil {
+		t.Fatalf("Expected the video to be kept without transcoding, got %v", err)
+	}
+	if !bytes.Equal(video.Data, input) || video.Transcoded || video.Thumbnail != nil {
+		t.Errorf("Expected the video to be left untouched, got %+v", video)
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Tolerated clock difference with the identity provider
+const jwtLeeway = time.Minute
+
+// Set up in main when a JWKS is configured, nil disables JWT authentication
+var jwtAuth *jwtVerifier
+
+type jwtAlgorithm struct {
+	hash crypto.Hash
+	ec   bool
+	size int // Bytes of each of r and s in an ECDSA signature
+}
+
+var jwtAlgorithms = map[string]jwtAlgorithm{
+	"RS256": {hash: crypto.SHA256},
+	"RS384": {hash: crypto.SHA384},
+	"RS512": {hash: crypto.SHA512},
+	"ES256": {hash: crypto.SHA256, ec: true, size: 32},
+	"ES384": {hash: crypto.SHA384, ec: true, size: 48},
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// Parses the signing keys of a JWKS document, keys of other types are skipped
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		switch jwk.Kty {
+		case "RSA":
+			n, err := decodeBigInt(jwk.N)
+			if err != nil {
+				return nil, fmt.Errorf("invalid RSA key %q: %w", jwk.Kid, err)
+			}
+			e, err := decodeBigInt(jwk.E)
+			if err != nil || !e.IsInt64() {
+				return nil, fmt.Errorf("invalid RSA exponent in key %q", jwk.Kid)
+			}
+			keys[jwk.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch jwk.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			default:
+				continue
+			}
+			x, err := decodeBigInt(jwk.X)
+			if err != nil {
+				return nil, fmt.Errorf("invalid EC key %q: %w", jwk.Kid, err)
+			}
+			y, err := decodeBigInt(jwk.Y)
+			if err != nil {
+				return nil, fmt.Errorf("invalid EC key %q: %w", jwk.Kid, err)
+			}
+			keys[jwk.Kid] = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no usable signing keys")
+	}
+	return keys, nil
+}
+
+// Keys from a JWKS file or URL, reloaded periodically and when a token names an unknown key
+type jwksKeySet struct {
+	source  string
+	refresh time.Duration
+	client  *http.Client
+
+	mu         sync.Mutex
+	keys       map[string]crypto.PublicKey
+	loadedAt   time.Time
+	lastReload time.Time
+}
+
+func (ks *jwksKeySet) fetch() ([]byte, error) {
+	if !strings.HasPrefix(ks.source, "http://") && !strings.HasPrefix(ks.source, "https://") {
+		return os.ReadFile(ks.source)
+	}
+	resp, err := ks.client.Get(ks.source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS request failed with status %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// Must be called with mu held
+func (ks *jwksKeySet) reload() error {
+	ks.lastReload = time.Now()
+	data, err := ks.fetch()
+	if err != nil {
+		return fmt.Errorf("failed to load JWKS: %w", err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+	ks.keys, ks.loadedAt = keys, time.Now()
+	return nil
+}
+
+func (ks *jwksKeySet) key(kid string) (crypto.PublicKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	_, known := ks.keys[kid]
+	stale := time.Since(ks.loadedAt) > ks.refresh
+	// Unknown key ids trigger a reload at most once a minute, so forged tokens can't hammer the provider
+	if stale || (!known && kid != "" && time.Since(ks.lastReload) > time.Minute) {
+		if err := ks.reload(); err != nil {
+			log.Warn().Err(err).Str("source", ks.source).Msg("JWKS reload failed")
+			if ks.keys == nil {
+				return nil, err
+			}
+		}
+	}
+
+	if key, ok := ks.keys[kid]; ok {
+		return key, nil
+	}
+	// Tokens without a key id are accepted when the set has a single key
+	if kid == "" && len(ks.keys) == 1 {
+		for _, key := range ks.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+type jwtVerifier struct {
+	keys      *jwksKeySet
+	issuer    string
+	audience  string
+	userClaim string
+	roleClaim string
+}
+
+func newJWTVerifier(source, issuer, audience, userClaim, roleClaim string, refresh time.Duration) (*jwtVerifier, error) {
+	v := &jwtVerifier{
+		keys:      &jwksKeySet{source: source, refresh: refresh, client: &http.Client{Timeout: 10 * time.Second}},
+		issuer:    issuer,
+		audience:  audience,
+		userClaim: userClaim,
+		roleClaim: roleClaim,
+	}
+	v.keys.mu.Lock()
+	defer v.keys.mu.Unlock()
+	if err := v.keys.reload(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+type jwtClaims map[string]interface{}
+
+// Claim by name, nested claims are reached with dots (realm_access.roles)
+func (c jwtClaims) lookup(name string) interface{} {
+	var value interface{} = map[string]interface{}(c)
+	for _, part := range strings.Split(name, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[part]
+	}
+	return value
+}
+
+// Values of a claim that may be a string or a list of strings
+func (c jwtClaims) strings(name string) []string {
+	switch value := c.lookup(name).(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var values []string
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func (c jwtClaims) time(name string) (time.Time, bool) {
+	value, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(value), 0), true
+}
+
+// Verifies the signature and the registered claims of a compact JWS
+func (v *jwtVerifier) Verify(token string) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerJSON, &header) != nil {
+		return nil, errors.New("malformed token header")
+	}
+	alg, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+
+	key, err := v.keys.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	hasher := alg.hash.New()
+	hasher.Write([]byte(parts[0] + "." + parts[1]))
+	digest := hasher.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if alg.ec || rsa.VerifyPKCS1v15(pub, alg.hash, digest, signature) != nil {
+			return nil, errors.New("invalid token signature")
+		}
+	case *ecdsa.PublicKey:
+		if !alg.ec || len(signature) != 2*alg.size || (pub.Curve.Params().BitSize+7)/8 != alg.size {
+			return nil, errors.New("invalid token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:alg.size])
+		s := new(big.Int).SetBytes(signature[alg.size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return nil, errors.New("invalid token signature")
+		}
+	default:
+		return nil, errors.New("invalid token signature")
+	}
+
+	var claims jwtClaims
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &claims) != nil {
+		return nil, errors.New("malformed token payload")
+	}
+
+	now := time.Now()
+	exp, ok := claims.time("exp")
+	if !ok {
+		return nil, errors.New("token has no expiry")
+	}
+	if now.After(exp.Add(jwtLeeway)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims.time("nbf"); ok && now.Add(jwtLeeway).Before(nbf) {
+		return nil, errors.New("token not valid yet")
+	}
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return nil, errors.New("unexpected token issuer")
+	}
+	if v.audience != "" && !Find(claims.strings("aud"), v.audience) {
+		return nil, errors.New("unexpected token audience")
+	}
+	return claims, nil
+}
+
+// Bearer token of the request, if any
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// Maps a token to an admin, using the most privileged role listed in the role claim
+func (v *jwtVerifier) Admin(token string) (*AdminPrincipal, error) {
+	claims, err := v.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	roles := claims.strings(v.roleClaim)
+	role := ""
+	for _, candidate := range []string{adminRoleSuperadmin, adminRoleOperator, adminRoleReadOnly} {
+		if Find(roles, candidate) {
+			role = candidate
+			break
+		}
+	}
+	if role == "" {
+		return nil, errors.New("token grants no admin role")
+	}
+
+	subject, _ := claims["sub"].(string)
+	name := subject
+	for _, claim := range []string{"preferred_username", "email", "name"} {
+		if value, ok := claims[claim].(string); ok && value != "" {
+			name = value
+			break
+		}
+	}
+	return &AdminPrincipal{ID: "jwt:" + subject, Name: name, Role: role}, nil
+}
+
+// Maps a token to the WuzAPI user id held in the user claim
+func (v *jwtVerifier) UserID(token string) (string, error) {
+	claims, err := v.Verify(token)
+	if err != nil {
+		return "", err
+	}
+	userIDs := claims.strings(v.userClaim)
+	if len(userIDs) != 1 || userIDs[0] == "" {
+		return "", errors.New("token is not bound to a user")
+	}
+	return userIDs[0], nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signTestJWT(t *testing.T, key crypto.Signer, alg, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = sig
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signingInput + "." + b64(signature)
+}
+
+func newTestVerifier(t *testing.T) (*jwtVerifier, *rsa.PrivateKey, *ecdsa.PrivateKey) {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa1", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+	}})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := newJWTVerifier(path, "https://sso.example.com", "wuzapi", "wuzapi_user", "groups", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v, rsaKey, ecKey
+}
+
+func TestJWTVerify(t *testing.T) {
+	v, rsaKey, ecKey := newTestVerifier(t)
+	now := time.Now().Unix()
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"iss": "https://sso.example.com", "aud": []string{"wuzapi"}, "sub": "u-1", "exp": now + 300}
+		for k, val := range extra {
+			c[k] = val
+		}
+		return c
+	}
+
+	if _, err := v.Verify(signTestJWT(t, rsaKey, "RS256", "rsa1", claims(nil))); err != nil {
+		t.Errorf("RS256 token rejected: %v", err)
+	}
+	if _, err := v.Verify(signTestJWT(t, ecKey, "ES256", "ec1", claims(nil))); err != nil {
+		t.Errorf("ES256 token rejected: %v", err)
+	}
+
+	bad := map[string]string{
+		"expired":        signTestJWT(t, rsaKey, "RS256", "rsa1", claims(map[string]interface{}{"exp": now - 3600})),
+		"wrong issuer":   signTestJWT(t, rsaKey, "RS256", "rsa1", claims(map[string]interface{}{"iss": "https://evil.example.com"})),
+		"wrong audience": signTestJWT(t, rsaKey, "RS256", "rsa1", claims(map[string]interface{}{"aud": "other"})),
+		"no expiry":      signTestJWT(t, rsaKey, "RS256", "rsa1", claims(map[string]interface{}{"exp": nil})),
+		"key mismatch":   signTestJWT(t, ecKey, "ES256", "rsa1", claims(nil)),
+		"unknown key":    signTestJWT(t, rsaKey, "RS256", "rsa2", claims(nil)),
+		"alg none":       b64([]byte(`{"alg":"none"}`)) + "." + b64([]byte(`{"exp":9999999999}`)) + ".",
+		"not a jwt":      "1234ABCD",
+	}
+	valid := strings.Split(signTestJWT(t, rsaKey, "RS256", "rsa1", claims(nil)), ".")
+	forged, _ := json.Marshal(claims(map[string]interface{}{"sub": "u-2"}))
+	bad["tampered claims"] = valid[0] + "." + b64(forged) + "." + valid[2]
+
+	for name, token := range bad {
+		if _, err := v.Verify(token); err == nil {
+			t.Errorf("%s: token accepted", name)
+		}
+	}
+}
+
+func TestJWTClaimMapping(t *testing.T) {
+	v, rsaKey, _ := newTestVerifier(t)
+	exp := time.Now().Add(time.Hour).Unix()
+	base := map[string]interface{}{"iss": "https://sso.example.com", "aud": "wuzapi", "sub": "u-1", "exp": exp}
+
+	withClaims := func(extra map[string]interface{}) string {
+		c := map[string]interface{}{}
+		for k, val := range base {
+			c[k] = val
+		}
+		for k, val := range extra {
+			c[k] = val
+		}
+		return signTestJWT(t, rsaKey, "RS256", "rsa1", c)
+	}
+
+	admin, err := v.Admin(withClaims(map[string]interface{}{"groups": []string{"staff", "readonly", "operator"}, "email": "ops@example.com"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if admin.Role != adminRoleOperator || admin.Name != "ops@example.com" || admin.ID != "jwt:u-1" {
+		t.Errorf("unexpected admin %+v", admin)
+	}
+	if _, err := v.Admin(withClaims(map[string]interface{}{"groups": []string{"staff"}})); err == nil {
+		t.Errorf("token without an admin role accepted as admin")
+	}
+
+	userID, err := v.UserID(withClaims(map[string]interface{}{"wuzapi_user": "abc123"}))
+	if err != nil || userID != "abc123" {
+		t.Errorf("user id: got %q, %v", userID, err)
+	}
+	if _, err := v.UserID(withClaims(nil)); err == nil {
+		t.Errorf("token without a user accepted")
+	}
+}
+
+func TestJWTClaimLookup(t *testing.T) {
+	claims := jwtClaims{"realm_access": map[string]interface{}{"roles": []interface{}{"superadmin"}}}
+	if got := claims.strings("realm_access.roles"); len(got) != 1 || got[0] != "superadmin" {
+		t.Errorf("nested claim: got %v", got)
+	}
+	if got := claims.strings("missing.claim"); got != nil {
+		t.Errorf("missing claim: got %v", got)
+	}
+}
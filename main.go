@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"net/http"
@@ -61,6 +62,27 @@ var (
 	versionFlag         = flag.Bool("version", false, "Display version information and exit")
 	mode                = flag.String("mode", "http", "Server mode: http or stdio")
 	dataDir             = flag.String("datadir", "", "Data directory for database and session files (defaults to executable directory)")
+	videoTranscode      = flag.Bool("videotranscode", false, "Transcode videos to H.264/AAC MP4 with ffmpeg before sending")
+	videoMaxMB          = flag.Int("videomaxmb", 16, "Maximum size in MB of transcoded videos")
+	uploadMaxImageMB    = flag.Int("uploadmaximagemb", 16, "Maximum size in MB of multipart image uploads")
+	uploadMaxAudioMB    = flag.Int("uploadmaxaudiomb", 16, "Maximum size in MB of multipart audio uploads")
+	uploadMaxVideoMB    = flag.Int("uploadmaxvideomb", 100, "Maximum size in MB of multipart video uploads")
+	uploadMaxDocumentMB = flag.Int("uploadmaxdocumentmb", 100, "Maximum size in MB of multipart document uploads")
+	uploadMaxStickerMB  = flag.Int("uploadmaxstickermb", 10, "Maximum size in MB of multipart sticker uploads")
+	publicURL           = flag.String("publicurl", "", "Public base URL of this server, used in links to locally stored media")
+	mediaURLSecret      = flag.String("mediaurlsecret", "", "Secret used to sign links to locally stored media (defaults to the encryption key)")
+	localMediaTTLHours  = flag.Int("localmediattl", 24, "Hours a link to locally stored media stays valid")
+	s3SweepInterval     = flag.Int("s3sweepinterval", 60, "Minutes between S3 retention sweeps for buckets without lifecycle rules (0 disables)")
+	jwksSource          = flag.String("jwks", "", "JWKS file or URL used to verify JWT bearer tokens (empty disables JWT authentication)")
+	jwtIssuer           = flag.String("jwtissuer", "", "Required iss claim of JWT bearer tokens")
+	jwtAudience         = flag.String("jwtaudience", "", "Required aud claim of JWT bearer tokens")
+	jwtUserClaim        = flag.String("jwtuserclaim", "wuzapi_user", "JWT claim holding the WuzAPI user id")
+	jwtRoleClaim        = flag.String("jwtroleclaim", "wuzapi_role", "JWT claim holding the admin role")
+	jwksRefresh         = flag.Int("jwksrefresh", 60, "Minutes between JWKS reloads")
+	metricsToken        = flag.String("metricstoken", "", "Bearer token required to read /metrics (empty leaves it open)")
+	traceExporter       = flag.String("tracing", "", "Trace exporter: otlp or stdout (empty or none disables tracing)")
+	otlpEndpoint        = flag.String("otlpendpoint", "", "OTLP endpoint URL traces are sent to (overrides OTEL_EXPORTER_OTLP_TRACES_ENDPOINT)")
+	traceSampleRatio    = flag.Float64("tracesample", 1, "Fraction of new traces that are sampled, from 0 to 1")
 
 	globalHMACKeyEncrypted []byte
 
@@ -72,6 +94,7 @@ var (
 	container        *sqlstore.Container
 	clientManager    = NewClientManager()
 	killchannel      = make(map[string](chan bool))
+	killchannelMu    sync.Mutex
 	userinfocache    = cache.New(5*time.Minute, 10*time.Minute)
 	lastMessageCache = cache.New(24*time.Hour, 24*time.Hour)
 	globalHTTPClient = newSafeHTTPClient()
@@ -220,6 +243,82 @@ func main() {
 		Str("queue", *webhookErrorQueueName).
 		Msg("Webhook Retry Configured")
 
+	if v := os.Getenv("WUZAPI_VIDEO_TRANSCODE"); v != "" {
+		*videoTranscode = strings.ToLower(v) == "true" || v == "1"
+	}
+	if v := os.Getenv("WUZAPI_VIDEO_MAX_MB"); v != "" {
+		if size, err := strconv.Atoi(v); err == nil {
+			*videoMaxMB = size
+		}
+	}
+
+	for env, limit := range map[string]*int{
+		"WUZAPI_UPLOAD_MAX_IMAGE_MB":    uploadMaxImageMB,
+		"WUZAPI_UPLOAD_MAX_AUDIO_MB":    uploadMaxAudioMB,
+		"WUZAPI_UPLOAD_MAX_VIDEO_MB":    uploadMaxVideoMB,
+		"WUZAPI_UPLOAD_MAX_DOCUMENT_MB": uploadMaxDocumentMB,
+		"WUZAPI_UPLOAD_MAX_STICKER_MB":  uploadMaxStickerMB,
+	} {
+		if v := os.Getenv(env); v != "" {
+			if size, err := strconv.Atoi(v); err == nil {
+				*limit = size
+			}
+		}
+	}
+
+	if v := os.Getenv("WUZAPI_PUBLIC_URL"); v != "" {
+		*publicURL = v
+	}
+	if v := os.Getenv("WUZAPI_MEDIA_URL_SECRET"); v != "" {
+		*mediaURLSecret = v
+	}
+	if v := os.Getenv("WUZAPI_LOCAL_MEDIA_TTL_HOURS"); v != "" {
+		if hours, err := strconv.Atoi(v); err == nil {
+			*localMediaTTLHours = hours
+		}
+	}
+
+	if v := os.Getenv("WUZAPI_S3_SWEEP_INTERVAL"); v != "" {
+		if minutes, err := strconv.Atoi(v); err == nil {
+			*s3SweepInterval = minutes
+		}
+	}
+
+	if v := os.Getenv("WUZAPI_JWKS"); v != "" {
+		*jwksSource = v
+	}
+	if v := os.Getenv("WUZAPI_JWT_ISSUER"); v != "" {
+		*jwtIssuer = v
+	}
+	if v := os.Getenv("WUZAPI_JWT_AUDIENCE"); v != "" {
+		*jwtAudience = v
+	}
+	if v := os.Getenv("WUZAPI_JWT_USER_CLAIM"); v != "" {
+		*jwtUserClaim = v
+	}
+	if v := os.Getenv("WUZAPI_JWT_ROLE_CLAIM"); v != "" {
+		*jwtRoleClaim = v
+	}
+	if v := os.Getenv("WUZAPI_JWKS_REFRESH"); v != "" {
+		if minutes, err := strconv.Atoi(v); err == nil {
+			*jwksRefresh = minutes
+		}
+	}
+	if v := os.Getenv("WUZAPI_METRICS_TOKEN"); v != "" {
+		*metricsToken = v
+	}
+	if v := os.Getenv("WUZAPI_TRACING"); v != "" {
+		*traceExporter = v
+	}
+	if *traceExporter == "" {
+		*traceExporter = os.Getenv("OTEL_TRACES_EXPORTER")
+	}
+	if v := os.Getenv("WUZAPI_TRACE_SAMPLE"); v != "" {
+		if ratio, err := strconv.ParseFloat(v, 64); err == nil {
+			*traceSampleRatio = ratio
+		}
+	}
+
 	// Novo bloco para sobrescrever o osName pelo ENV, se existir
 	if v := os.Getenv("SESSION_DEVICE_NAME"); v != "" {
 		*osName = v
@@ -364,6 +463,27 @@ func main() {
 		panic(err)
 	}
 	exPath := filepath.Dir(ex)
+	localMediaStore = newLocalMediaStorage(filepath.Join(exPath, "files", "media"))
+
+	if *jwksSource != "" {
+		jwtAuth, err = newJWTVerifier(*jwksSource, *jwtIssuer, *jwtAudience, *jwtUserClaim, *jwtRoleClaim, time.Duration(*jwksRefresh)*time.Minute)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to set up JWT authentication")
+		}
+		log.Info().Str("jwks", *jwksSource).Msg("JWT bearer authentication enabled")
+	}
+
+	if *traceExporter != "" && *traceExporter != "none" {
+		// Stdout carries the JSON-RPC protocol in stdio mode
+		traceOut := io.Writer(os.Stdout)
+		if *mode == "stdio" {
+			traceOut = os.Stderr
+		}
+		if err := setupTracing(*traceExporter, *otlpEndpoint, *traceSampleRatio, traceOut); err != nil {
+			log.Fatal().Err(err).Msg("Failed to set up tracing")
+		}
+		log.Info().Str("exporter", *traceExporter).Msg("Tracing enabled")
+	}
 
 	db, err := InitializeDatabase(exPath, *dataDir)
 	if err != nil {
@@ -425,6 +545,9 @@ func main() {
 	s.routes()
 
 	s.connectOnStartup()
+	s.StartExpiryWatcher()
+	s.StartUsageMeter()
+	GetS3Manager().StartRetentionSweeper(time.Duration(*s3SweepInterval) * time.Minute)
 
 	if serverMode == Stdio {
 		startStdioMode(s)
@@ -463,6 +586,12 @@ func startHTTPMode(s *server) {
 					log.Error().Err(err).Msg("Failed to stop server")
 					os.Exit(1)
 				}
+				if err := s.flushUsage(); err != nil {
+					log.Error().Err(err).Msg("Failed to store usage counters")
+				}
+				if err := shutdownTracing(ctx); err != nil {
+					log.Error().Err(err).Msg("Failed to export remaining spans")
+				}
 
 				log.Info().Msg("Server Exited Properly")
 				os.Exit(0)
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nfnt/resize"
+	"github.com/rs/zerolog/log"
+	"github.com/vincent-petithory/dataurl"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// WhatsApp drops media from its CDN after a while, re-upload before that happens
+const mediaLibraryReuploadAfter = 14 * 24 * time.Hour
+
+// Serializes re-uploads of the same library item
+var mediaLibraryLocks = NewKeyedMutex()
+
+var mediaLibraryTypes = map[string]whatsmeow.MediaType{
+	"image":    whatsmeow.MediaImage,
+	"video":    whatsmeow.MediaVideo,
+	"audio":    whatsmeow.MediaAudio,
+	"document": whatsmeow.MediaDocument,
+	"sticker":  whatsmeow.MediaImage,
+}
+
+type LibraryMedia struct {
+	ID            string    `json:"id" db:"id"`
+	UserID        string    `json:"-" db:"user_id"`
+	MediaType     string    `json:"media_type" db:"media_type"`
+	MimeType      string    `json:"mime_type" db:"mime_type"`
+	FileName      string    `json:"file_name" db:"file_name"`
+	FileLength    int64     `json:"file_length" db:"file_length"`
+	Seconds       int       `json:"seconds,omitempty" db:"seconds"`
+	URL           string    `json:"-" db:"url"`
+	DirectPath    string    `json:"-" db:"direct_path"`
+	MediaKey      string    `json:"-" db:"media_key"`
+	FileEncSHA256 string    `json:"-" db:"file_enc_sha256"`
+	FileSHA256    string    `json:"-" db:"file_sha256"`
+	Thumbnail     string    `json:"-" db:"thumbnail"`
+	FilePath      string    `json:"-" db:"file_path"`
+	UploadedAt    time.Time `json:"uploaded_at" db:"uploaded_at"`
+	ExpiresAt     time.Time `json:"expires_at" db:"expires_at"`
+	CreatedAt     time.Time `json:"created_at" db:"created_at"`
+}
+
+const libraryMediaColumns = "id, user_id, media_type, mime_type, file_name, file_length, seconds, url, direct_path, media_key, file_enc_sha256, file_sha256, thumbnail, file_path, uploaded_at, expires_at, created_at"
+
+func (item *LibraryMedia) setUpload(uploaded whatsmeow.UploadResponse) {
+	item.URL = uploaded.URL
+	item.DirectPath = uploaded.DirectPath
+	item.MediaKey = base64.StdEncoding.EncodeToString(uploaded.MediaKey)
+	item.FileEncSHA256 = base64.StdEncoding.EncodeToString(uploaded.FileEncSHA256)
+	item.FileSHA256 = base64.StdEncoding.EncodeToString(uploaded.FileSHA256)
+	item.FileLength = int64(uploaded.FileLength)
+	item.UploadedAt = time.Now()
+	item.ExpiresAt = item.UploadedAt.Add(mediaLibraryReuploadAfter)
+}
+
+// Builds the message for a library item, the same way the send endpoints do for fresh uploads
+func (item *LibraryMedia) message(caption string, ptt bool) *waE2E.Message {
+	mediaKey, _ := base64.StdEncoding.DecodeString(item.MediaKey)
+	encSHA, _ := base64.StdEncoding.DecodeString(item.FileEncSHA256)
+	fileSHA, _ := base64.StdEncoding.DecodeString(item.FileSHA256)
+	thumbnail, _ := base64.StdEncoding.DecodeString(item.Thumbnail)
+	if len(thumbnail) == 0 {
+		thumbnail = nil
+	}
+	length := proto.Uint64(uint64(item.FileLength))
+
+	switch item.MediaType {
+	case "image":
+		return &waE2E.Message{ImageMessage: &waE2E.ImageMessage{
+			Caption: proto.String(caption), URL: proto.String(item.URL), DirectPath: proto.String(item.DirectPath),
+			MediaKey: mediaKey, Mimetype: proto.String(item.MimeType), FileEncSHA256: encSHA, FileSHA256: fileSHA,
+			FileLength: length, JPEGThumbnail: thumbnail,
+		}}
+	case "video":
+		msg := &waE2E.Message{VideoMessage: &waE2E.VideoMessage{
+			Caption: proto.String(caption), URL: proto.String(item.URL), DirectPath: proto.String(item.DirectPath),
+			MediaKey: mediaKey, Mimetype: proto.String(item.MimeType), FileEncSHA256: encSHA, FileSHA256: fileSHA,
+			FileLength: length, JPEGThumbnail: thumbnail,
+		}}
+		if item.Seconds > 0 {
+			msg.VideoMessage.Seconds = proto.Uint32(uint32(item.Seconds))
+		}
+		return msg
+	case "audio":
+		msg := &waE2E.Message{AudioMessage: &waE2E.AudioMessage{
+			URL: proto.String(item.URL), DirectPath: proto.String(item.DirectPath), MediaKey: mediaKey,
+			Mimetype: proto.String(item.MimeType), FileEncSHA256: encSHA, FileSHA256: fileSHA,
+			FileLength: length, PTT: proto.Bool(ptt),
+		}}
+		if item.Seconds > 0 {
+			msg.AudioMessage.Seconds = proto.Uint32(uint32(item.Seconds))
+		}
+		return msg
+	case "sticker":
+		return &waE2E.Message{StickerMessage: &waE2E.StickerMessage{
+			URL: proto.String(item.URL), DirectPath: proto.String(item.DirectPath), MediaKey: mediaKey,
+			Mimetype: proto.String(item.MimeType), FileEncSHA256: encSHA, FileSHA256: fileSHA,
+			FileLength: length,
+		}}
+	default:
+		return &waE2E.Message{DocumentMessage: &waE2E.DocumentMessage{
+			Caption: proto.String(caption), URL: proto.String(item.URL), DirectPath: proto.String(item.DirectPath),
+			MediaKey: mediaKey, Mimetype: proto.String(item.MimeType), FileEncSHA256: encSHA, FileSHA256: fileSHA,
+			FileLength: length, FileName: proto.String(item.FileName),
+		}}
+	}
+}
+
+func (s *server) mediaLibraryDir(userID string) string {
+	return filepath.Join(s.exPath, "files", "user_"+userID, "library")
+}
+
+func (s *server) saveLibraryMedia(item *LibraryMedia) error {
+	_, err := s.db.Exec(`
+		INSERT INTO media_library (id, user_id, media_type, mime_type, file_name, file_length, seconds, url, direct_path,
+			media_key, file_enc_sha256, file_sha256, thumbnail, file_path, uploaded_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+		ON CONFLICT (id) DO UPDATE SET
+			url = excluded.url,
+			direct_path = excluded.direct_path,
+			media_key = excluded.media_key,
+			file_enc_sha256 = excluded.file_enc_sha256,
+			file_sha256 = excluded.file_sha256,
+			file_length = excluded.file_length,
+			uploaded_at = excluded.uploaded_at,
+			expires_at = excluded.expires_at`,
+		item.ID, item.UserID, item.MediaType, item.MimeType, item.FileName, item.FileLength, item.Seconds, item.URL, item.DirectPath,
+		item.MediaKey, item.FileEncSHA256, item.FileSHA256, item.Thumbnail, item.FilePath, item.UploadedAt, item.ExpiresAt)
+	return err
+}
+
+// Returns a library item ready to be sent, uploading it again when the CDN reference is too old
+func (s *server) getLibraryMediaForSend(ctx context.Context, client *whatsmeow.Client, userID string, mediaID string, mediaType string) (*LibraryMedia, error) {
+	unlock := mediaLibraryLocks.Lock(mediaID)
+	defer unlock()
+
+	var item LibraryMedia
+	err := s.db.Get(&item, "SELECT "+libraryMediaColumns+" FROM media_library WHERE user_id = $1 AND id = $2", userID, mediaID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errLibraryMediaNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if mediaType != "" && item.MediaType != mediaType {
+		return nil, fmt.Errorf("media %s is a %s, not a %s", mediaID, item.MediaType, mediaType)
+	}
+
+	if time.Now().Before(item.ExpiresAt) {
+		return &item, nil
+	}
+
+	file, err := os.Open(item.FilePath)
+	if err != nil {
+		return nil, fmt.Errorf("media reference expired and the stored file is missing: %w", err)
+	}
+	defer file.Close()
+	uploaded, err := tracedUploadReader(ctx, client, file, nil, mediaLibraryTypes[item.MediaType])
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload media again: %w", err)
+	}
+	item.setUpload(uploaded)
+	if err := s.saveLibraryMedia(&item); err != nil {
+		log.Error().Err(err).Str("media", item.ID).Msg("Failed to store new media reference")
+	}
+	log.Info().Str("userID", userID).Str("media", item.ID).Msg("Media library item uploaded again after expiry")
+	return &item, nil
+}
+
+var errLibraryMediaNotFound = errors.New("media not found")
+
+// Sends a library item from one of the /chat/send endpoints and writes the usual response
+func (s *server) sendLibraryMedia(w http.ResponseWriter, r *http.Request, mediaID string, mediaType string, recipient types.JID, msgid string, caption string, ptt bool, contextInfo *waE2E.ContextInfo) {
+	txtid := r.Context().Value("userinfo").(Values).Get("Id")
+	client := clientManager.GetWhatsmeowClient(txtid)
+
+	item, err := s.getLibraryMediaForSend(r.Context(), client, txtid, mediaID, mediaType)
+	if errors.Is(err, errLibraryMediaNotFound) {
+		s.Respond(w, r, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		s.Respond(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	msg := item.message(caption, ptt)
+	if contextInfo != nil && (contextInfo.StanzaID != nil || contextInfo.MentionedJID != nil || contextInfo.IsForwarded != nil) {
+		ci := &waE2E.ContextInfo{}
+		if contextInfo.StanzaID != nil {
+			ci.StanzaID = proto.String(*contextInfo.StanzaID)
+			ci.Participant = contextInfo.Participant
+			ci.QuotedMessage = &waE2E.Message{Conversation: proto.String("")}
+		}
+		ci.MentionedJID = contextInfo.MentionedJID
+		if contextInfo.IsForwarded != nil && *contextInfo.IsForwarded {
+			ci.IsForwarded = proto.Bool(true)
+		}
+		switch {
+		case msg.ImageMessage != nil:
+			msg.ImageMessage.ContextInfo = ci
+		case msg.VideoMessage != nil:
+			msg.VideoMessage.ContextInfo = ci
+		case msg.AudioMessage != nil:
+			msg.AudioMessage.ContextInfo = ci
+		case msg.StickerMessage != nil:
+			msg.StickerMessage.ContextInfo = ci
+		case msg.DocumentMessage != nil:
+			msg.DocumentMessage.ContextInfo = ci
+		}
+	}
+
+	resp, err := tracedSendMessage(context.WithoutCancel(r.Context()), client, recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+	if err != nil {
+		s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("error sending message: %v", err)))
+		return
+	}
+
+	historyStr := r.Context().Value("userinfo").(Values).Get("History")
+	historyLimit, _ := strconv.Atoi(historyStr)
+	mediaLink := s.archiveOutgoingMedia(txtid, recipient, msgid, item.MimeType, fileMediaOpener(item.FilePath))
+	s.saveOutgoingMessageToHistory(txtid, recipient.String(), msgid, item.MediaType, caption, mediaLink, historyLimit)
+
+	log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Str("media", item.ID).Msg("Message sent")
+	response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp.Unix(), "Id": msgid}
+	responseJson, err := json.Marshal(response)
+	if err != nil {
+		s.Respond(w, r, http.StatusInternalServerError, err)
+	} else {
+		s.Respond(w, r, http.StatusOK, string(responseJson))
+	}
+}
+
+// Temp files usually live on another filesystem, fall back to copying when rename fails
+func moveUploadedFile(media *multipartMedia, path string) error {
+	if err := os.Rename(media.File.Name(), path); err == nil {
+		return nil
+	}
+	reader, err := media.Reader()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, reader); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func imageThumbnail(data []byte) []byte {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, resize.Thumbnail(72, 72, img, resize.Lanczos3), nil); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// Upload a file once to reference it later by media_id
+func (s *server) UploadLibraryMedia() http.HandlerFunc {
+	type mediaStruct struct {
+		MediaType string `json:"media_type"`
+		Data      string `json:"data"`
+		FileName  string `json:"file_name"`
+		MimeType  string `json:"mime_type"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		client := clientManager.GetWhatsmeowClient(txtid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
+			return
+		}
+
+		id, err := GenerateRandomID()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		dir := s.mediaLibraryDir(txtid)
+		if err := os.MkdirAll(dir, 0751); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("could not create user directory (%s)", dir)))
+			return
+		}
+		item := &LibraryMedia{ID: id, UserID: txtid, FilePath: filepath.Join(dir, id)}
+
+		var t mediaStruct
+		if isMultipartRequest(r) {
+			media, err := readMultipartMedia(r, "file", uploadLimitBytes("document"), &t)
+			if err != nil {
+				s.respondMultipartError(w, r, err, uploadLimitBytes("document"))
+				return
+			}
+			err = moveUploadedFile(media, item.FilePath)
+			media.Close()
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("could not store media"))
+				return
+			}
+			item.MimeType = media.MimeType
+			if t.FileName == "" {
+				t.FileName = media.FileName
+			}
+		} else {
+			if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+				return
+			}
+			var data []byte
+			if strings.HasPrefix(t.Data, "data:") {
+				dataURL, err := dataurl.DecodeString(t.Data)
+				if err != nil {
+					s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode base64 encoded data from payload"))
+					return
+				}
+				data = dataURL.Data
+			} else if isHTTPURL(t.Data) {
+				data, _, err = fetchURLBytes(r.Context(), t.Data, uploadLimitBytes("document"))
+				if err != nil {
+					s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("failed to fetch media from url: %v", err)))
+					return
+				}
+			} else {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("data should be a data URL or an http(s) url"))
+				return
+			}
+			if err := os.WriteFile(item.FilePath, data, 0640); err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("could not store media"))
+				return
+			}
+			item.MimeType = http.DetectContentType(data)
+		}
+
+		stored := false
+		defer func() {
+			if !stored {
+				os.Remove(item.FilePath)
+			}
+		}()
+
+		waType, ok := mediaLibraryTypes[t.MediaType]
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("media_type must be image, video, audio, document or sticker"))
+			return
+		}
+		item.MediaType = t.MediaType
+		item.FileName = t.FileName
+		if t.MimeType != "" {
+			item.MimeType = t.MimeType
+		}
+		if item.MediaType == "document" && item.FileName == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing file_name for document"))
+			return
+		}
+
+		// Previews are computed once here, documents are streamed without loading them
+		if item.MediaType != "document" {
+			data, err := os.ReadFile(item.FilePath)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("could not read media"))
+				return
+			}
+			switch item.MediaType {
+			case "image":
+				item.Thumbnail = base64.StdEncoding.EncodeToString(imageThumbnail(data))
+			case "video":
+				item.Seconds = int(mp4Duration(data))
+				if thumbnail, err := extractVideoThumbnail(data); err == nil {
+					item.Thumbnail = base64.StdEncoding.EncodeToString(thumbnail)
+				}
+			case "audio":
+				item.Seconds = int(oggOpusDuration(data))
+			}
+		}
+
+		info, err := os.Stat(item.FilePath)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("could not read media"))
+			return
+		}
+		if !s.useMediaQuota(w, r, txtid, info.Size()) {
+			return
+		}
+		file, err := os.Open(item.FilePath)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("could not read media"))
+			return
+		}
+		uploaded, err := tracedUploadReader(r.Context(), client, file, nil, waType)
+		file.Close()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("failed to upload file: %v", err)))
+			return
+		}
+		item.setUpload(uploaded)
+
+		if err := s.saveLibraryMedia(item); err != nil {
+			log.Error().Err(err).Str("userID", txtid).Msg("Failed to save media library item")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to save media"))
+			return
+		}
+		stored = true
+
+		responseJson, err := json.Marshal(item)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// List media library items
+func (s *server) ListLibraryMedia() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		items := []LibraryMedia{}
+		err := s.db.Select(&items, "SELECT "+libraryMediaColumns+" FROM media_library WHERE user_id = $1 ORDER BY created_at DESC", txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to list media"))
+			return
+		}
+
+		responseJson, err := json.Marshal(items)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Get a media library item
+func (s *server) GetLibraryMedia() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		var item LibraryMedia
+		err := s.db.Get(&item, "SELECT "+libraryMediaColumns+" FROM media_library WHERE user_id = $1 AND id = $2", txtid, mux.Vars(r)["id"])
+		if errors.Is(err, sql.ErrNoRows) {
+			s.Respond(w, r, http.StatusNotFound, errLibraryMediaNotFound)
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to load media"))
+			return
+		}
+
+		responseJson, err := json.Marshal(item)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Delete a media library item and its stored file
+func (s *server) DeleteLibraryMedia() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		mediaID := mux.Vars(r)["id"]
+
+		var filePath string
+		err := s.db.Get(&filePath, "SELECT file_path FROM media_library WHERE user_id = $1 AND id = $2", txtid, mediaID)
+		if errors.Is(err, sql.ErrNoRows) {
+			s.Respond(w, r, http.StatusNotFound, errLibraryMediaNotFound)
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to load media"))
+			return
+		}
+
+		if _, err := s.db.Exec("DELETE FROM media_library WHERE user_id = $1 AND id = $2", txtid, mediaID); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to delete media"))
+			return
+		}
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			log.Warn().Err(err).Str("path", filePath).Msg("Failed to remove media library file")
+		}
+
+		response := map[string]interface{}{"Details": "Media deleted", "Id": mediaID}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
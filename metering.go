@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+)
+
+// Counters are kept in memory and added to usage_daily this often
+const usageFlushInterval = time.Minute
+
+// Metrics recorded per user and day, message counters are suffixed with the message type
+const (
+	metricMessagesSent     = "messages_sent."
+	metricMessagesReceived = "messages_received."
+	metricMediaBytesIn     = "media_bytes_in"
+	metricMediaBytesOut    = "media_bytes_out"
+	metricWebhookDelivered = "webhook_deliveries"
+	metricWebhookFailed    = "webhook_failures"
+	metricAPICalls         = "api_calls"
+)
+
+type usageKey struct {
+	userID string
+	day    string
+	metric string
+}
+
+var (
+	usageMu      sync.Mutex
+	usagePending = map[usageKey]int64{}
+)
+
+// Adds to a usage counter of the user for today (UTC)
+func meterUsage(userID, metric string, value int64) {
+	if userID == "" || value == 0 {
+		return
+	}
+	key := usageKey{userID: userID, day: time.Now().UTC().Format("2006-01-02"), metric: metric}
+	usageMu.Lock()
+	usagePending[key] += value
+	usageMu.Unlock()
+
+	// Message counters are also exported to Prometheus and dated in the session diagnostics
+	if messageType, ok := strings.CutPrefix(metric, metricMessagesSent); ok {
+		metricMessagesSentTotal.WithLabelValues(userID, messageType).Add(float64(value))
+		sessionDiagnosticsFor(userID).recordMessage(true)
+	} else if messageType, ok := strings.CutPrefix(metric, metricMessagesReceived); ok {
+		metricMessagesRecvTotal.WithLabelValues(userID, messageType).Add(float64(value))
+		sessionDiagnosticsFor(userID).recordMessage(false)
+	}
+}
+
+// Type of a message for the usage counters and the size of its media, if any
+func usageMessageType(msg *waE2E.Message) (string, int64) {
+	switch {
+	case msg.GetImageMessage() != nil:
+		return "image", int64(msg.GetImageMessage().GetFileLength())
+	case msg.GetVideoMessage() != nil:
+		return "video", int64(msg.GetVideoMessage().GetFileLength())
+	case msg.GetAudioMessage() != nil:
+		return "audio", int64(msg.GetAudioMessage().GetFileLength())
+	case msg.GetDocumentMessage() != nil:
+		return "document", int64(msg.GetDocumentMessage().GetFileLength())
+	case msg.GetStickerMessage() != nil:
+		return "sticker", int64(msg.GetStickerMessage().GetFileLength())
+	case msg.GetConversation() != "" || msg.GetExtendedTextMessage() != nil:
+		return "text", 0
+	case msg.GetReactionMessage() != nil:
+		return "reaction", 0
+	case msg.GetContactMessage() != nil || msg.GetContactsArrayMessage() != nil:
+		return "contact", 0
+	case msg.GetLocationMessage() != nil || msg.GetLiveLocationMessage() != nil:
+		return "location", 0
+	case msg.GetPollCreationMessage() != nil || msg.GetPollCreationMessageV3() != nil:
+		return "poll", 0
+	}
+	return "other", 0
+}
+
+// Adds the pending counters to usage_daily, they are kept for the next flush if that fails
+func (s *server) flushUsage() error {
+	usageMu.Lock()
+	pending := usagePending
+	usagePending = map[usageKey]int64{}
+	usageMu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	err := func() error {
+		tx, err := s.db.Beginx()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		for key, value := range pending {
+			_, err := tx.Exec(`INSERT INTO usage_daily (user_id, day, metric, value) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (user_id, day, metric) DO UPDATE SET value = usage_daily.value + excluded.value`,
+				key.userID, key.day, key.metric, value)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		usageMu.Lock()
+		for key, value := range pending {
+			usagePending[key] += value
+		}
+		usageMu.Unlock()
+	}
+	return err
+}
+
+func (s *server) StartUsageMeter() {
+	go func() {
+		ticker := time.NewTicker(usageFlushInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := s.flushUsage(); err != nil {
+				log.Error().Err(err).Msg("Failed to store usage counters")
+			}
+		}
+	}()
+}
+
+// Counts API calls and, for the send endpoints, the messages sent by type
+func (s *server) meterapi(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		meterUsage(txtid, metricAPICalls, 1)
+
+		template := routeTemplate(r)
+		if r.Method != http.MethodPost || !strings.HasPrefix(template, "/chat/send/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		recorder := &auditResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		if recorder.status < http.StatusMultipleChoices {
+			meterUsage(txtid, metricMessagesSent+strings.TrimPrefix(template, "/chat/send/"), 1)
+		}
+	})
+}
+
+type usageRecord struct {
+	UserID string `json:"user_id" db:"user_id"`
+	Day    string `json:"day" db:"day"`
+	Metric string `json:"metric" db:"metric"`
+	Value  int64  `json:"value" db:"value"`
+}
+
+// Admin: daily usage counters between from and to (YYYY-MM-DD, inclusive) as JSON or CSV
+func (s *server) ExportUsage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		today := time.Now().UTC()
+		from := query.Get("from")
+		if from == "" {
+			from = today.Format("2006-01") + "-01"
+		}
+		to := query.Get("to")
+		if to == "" {
+			to = today.Format("2006-01-02")
+		}
+		fromDay, errFrom := time.Parse("2006-01-02", from)
+		toDay, errTo := time.Parse("2006-01-02", to)
+		if errFrom != nil || errTo != nil {
+			s.adminError(w, http.StatusBadRequest, "from and to must be YYYY-MM-DD")
+			return
+		}
+		if toDay.Before(fromDay) {
+			s.adminError(w, http.StatusBadRequest, "to is before from")
+			return
+		}
+
+		// Counters of the last minute are still in memory
+		if err := s.flushUsage(); err != nil {
+			log.Error().Err(err).Msg("Failed to store usage counters")
+		}
+
+		sqlQuery := "SELECT user_id, day, metric, value FROM usage_daily WHERE day >= $1 AND day <= $2"
+		args := []interface{}{from, to}
+		if userID := query.Get("user_id"); userID != "" {
+			sqlQuery += " AND user_id = $3"
+			args = append(args, userID)
+		}
+		sqlQuery += " ORDER BY day, user_id, metric"
+
+		records := []usageRecord{}
+		if err := s.db.Select(&records, sqlQuery, args...); err != nil {
+			log.Error().Err(err).Msg("Failed to export usage")
+			s.adminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		if query.Get("format") != "csv" && !strings.Contains(r.Header.Get("Accept"), "text/csv") {
+			s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+				"code":    http.StatusOK,
+				"data":    map[string]interface{}{"from": from, "to": to, "usage": records},
+				"success": true,
+			})
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=usage-"+from+"-"+to+".csv")
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"user_id", "day", "metric", "value"})
+		for _, record := range records {
+			writer.Write([]string{record.UserID, record.Day, record.Metric, strconv.FormatInt(record.Value, 10)})
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			log.Error().Err(err).Msg("Failed to write usage CSV")
+		}
+	}
+}
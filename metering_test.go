@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestUsageMessageType(t *testing.T) {
+	tests := []struct {
+		msg       *waE2E.Message
+		wantType  string
+		wantBytes int64
+	}{
+		{&waE2E.Message{Conversation: proto.String("hi")}, "text", 0},
+		{&waE2E.Message{ExtendedTextMessage: &waE2E.ExtendedTextMessage{Text: proto.String("hi")}}, "text", 0},
+		{&waE2E.Message{ImageMessage: &waE2E.ImageMessage{FileLength: proto.Uint64(2048)}}, "image", 2048},
+		{&waE2E.Message{DocumentMessage: &waE2E.DocumentMessage{FileLength: proto.Uint64(10)}}, "document", 10},
+		{&waE2E.Message{ReactionMessage: &waE2E.ReactionMessage{Text: proto.String("👍")}}, "reaction", 0},
+		{&waE2E.Message{}, "other", 0},
+	}
+	for _, tt := range tests {
+		gotType, gotBytes := usageMessageType(tt.msg)
+		if gotType != tt.wantType || gotBytes != tt.wantBytes {
+			t.Errorf("got %s/%d, want %s/%d", gotType, gotBytes, tt.wantType, tt.wantBytes)
+		}
+	}
+}
+
+func TestMeterUsage(t *testing.T) {
+	usageMu.Lock()
+	usagePending = map[usageKey]int64{}
+	usageMu.Unlock()
+
+	meterUsage("u1", metricAPICalls, 1)
+	meterUsage("u1", metricAPICalls, 2)
+	meterUsage("u1", metricMediaBytesIn, 0)
+	meterUsage("", metricAPICalls, 1)
+
+	key := usageKey{userID: "u1", day: time.Now().UTC().Format("2006-01-02"), metric: metricAPICalls}
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	if usagePending[key] != 3 || len(usagePending) != 1 {
+		t.Errorf("unexpected pending counters %v", usagePending)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics served at /metrics, along with the Go runtime and process collectors
+var metricsRegistry = prometheus.NewRegistry()
+
+var metricsFactory = promauto.With(metricsRegistry)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Latency buckets in seconds shared by the HTTP client histograms
+var latencyBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+var (
+	metricSessions = metricsFactory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "wuzapi_sessions",
+		Help: "WhatsApp sessions by state (total, connected, logged_in).",
+	}, []string{"state"})
+	metricUsers = metricsFactory.NewGauge(prometheus.GaugeOpts{
+		Name: "wuzapi_users",
+		Help: "Registered users.",
+	})
+	metricMessagesSentTotal = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "wuzapi_messages_sent_total",
+		Help: "Messages sent by user and type.",
+	}, []string{"user_id", "type"})
+	metricMessagesRecvTotal = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "wuzapi_messages_received_total",
+		Help: "Messages received by user and type.",
+	}, []string{"user_id", "type"})
+	metricWebhooksTotal = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "wuzapi_webhook_deliveries_total",
+		Help: "Webhook deliveries by result (success, failure), after retries.",
+	}, []string{"result"})
+	metricWebhookDuration = metricsFactory.NewHistogram(prometheus.HistogramOpts{
+		Name:    "wuzapi_webhook_request_duration_seconds",
+		Help:    "Duration of webhook requests, including failed attempts.",
+		Buckets: latencyBuckets,
+	})
+	metricRabbitErrors = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "wuzapi_rabbitmq_publish_errors_total",
+		Help: "Failed RabbitMQ publishes.",
+	})
+	metricS3UploadDuration = metricsFactory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "wuzapi_s3_upload_duration_seconds",
+		Help:    "Duration of S3 uploads.",
+		Buckets: latencyBuckets,
+	}, []string{"result"})
+	metricS3UploadBytes = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "wuzapi_s3_upload_bytes_total",
+		Help: "Bytes uploaded to S3.",
+	})
+	metricConnectionEvents = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "wuzapi_connection_events_total",
+		Help: "WhatsApp connection events (Disconnected, KeepAliveTimeout) by user.",
+	}, []string{"user_id", "event"})
+)
+
+// Metrics with a user_id label, their series are dropped with the user
+var userMetrics = []*prometheus.CounterVec{metricMessagesSentTotal, metricMessagesRecvTotal, metricConnectionEvents}
+
+func observeSince(observer prometheus.Observer, start time.Time) {
+	observer.Observe(time.Since(start).Seconds())
+}
+
+func forgetUserMetrics(userID string) {
+	for _, metric := range userMetrics {
+		metric.DeletePartialMatch(prometheus.Labels{"user_id": userID})
+	}
+}
+
+// Serves the metrics, with a token configured it must be sent as a bearer token
+func (s *server) GetMetrics() http.HandlerFunc {
+	handler := promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if *metricsToken != "" && subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(*metricsToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		total, connected, loggedIn := clientManager.sessionCounts()
+		metricSessions.WithLabelValues("total").Set(float64(total))
+		metricSessions.WithLabelValues("connected").Set(float64(connected))
+		metricSessions.WithLabelValues("logged_in").Set(float64(loggedIn))
+		var users int
+		if err := s.db.Get(&users, "SELECT COUNT(*) FROM users"); err == nil {
+			metricUsers.Set(float64(users))
+		}
+
+		handler.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGetMetrics(t *testing.T) {
+	s := makeTestServer(t)
+	metricMessagesSentTotal.WithLabelValues("metricsuser", "text").Add(3)
+	metricConnectionEvents.WithLabelValues("metricsuser", "Disconnected").Inc()
+	metricMessagesSentTotal.WithLabelValues("otheruser", "text").Inc()
+	defer forgetUserMetrics("otheruser")
+
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		s.GetMetrics().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected the metrics, got %d", w.Code)
+		}
+		return w.Body.String()
+	}
+
+	body := scrape()
+	for _, want := range []string{
+		`wuzapi_messages_sent_total{type="text",user_id="metricsuser"} 3`,
+		`wuzapi_connection_events_total{event="Disconnected",user_id="metricsuser"} 1`,
+		"# TYPE wuzapi_webhook_request_duration_seconds histogram",
+		`wuzapi_sessions{state="total"} 0`,
+		"go_goroutines",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %q in the metrics", want)
+		}
+	}
+
+	// Deleted users leave no series behind
+	forgetUserMetrics("metricsuser")
+	body = scrape()
+	if strings.Contains(body, `user_id="metricsuser"`) {
+		t.Error("Expected the user's series to be dropped")
+	}
+	if !strings.Contains(body, `user_id="otheruser"`) {
+		t.Error("Expected the other users' series to be kept")
+	}
+}
+
+func TestGetMetricsToken(t *testing.T) {
+	s := makeTestServer(t)
+	previous := *metricsToken
+	*metricsToken = "scrape-secret"
+	defer func() { *metricsToken = previous }()
+
+	for token, want := range map[string]int{"": http.StatusUnauthorized, "wrong": http.StatusUnauthorized, "scrape-secret": http.StatusOK} {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		s.GetMetrics().ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("token %q: expected %d, got %d", token, want, w.Code)
+		}
+	}
+}
@@ -70,6 +70,76 @@ var migrations = []Migration{
 		Name:  "add_data_json",
 		UpSQL: addDataJsonSQL,
 	},
+	{
+		ID:    9,
+		Name:  "add_helpdesk_connectors",
+		UpSQL: addHelpdeskConnectorsSQL,
+	},
+	{
+		ID:    10,
+		Name:  "add_flows",
+		UpSQL: addFlowsSQL,
+	},
+	{
+		ID:    11,
+		Name:  "add_autoreply",
+		UpSQL: addAutoReplySQL,
+	},
+	{
+		ID:    12,
+		Name:  "add_ai_agents",
+		UpSQL: addAIAgentsSQL,
+	},
+	{
+		ID:    13,
+		Name:  "add_media_library",
+		UpSQL: addMediaLibrarySQL,
+	},
+	{
+		ID:    14,
+		Name:  "add_s3_presigned_urls",
+		UpSQL: addS3PresignedURLsSQL,
+	},
+	{
+		ID:    15,
+		Name:  "add_s3_key_template",
+		UpSQL: addS3KeyTemplateSQL,
+	},
+	{
+		ID:    16,
+		Name:  "add_api_keys",
+		UpSQL: addAPIKeysSQL,
+	},
+	{
+		ID:    17,
+		Name:  "hash_user_tokens",
+		UpSQL: hashUserTokensSQL,
+	},
+	{
+		ID:    18,
+		Name:  "add_admin_principals",
+		UpSQL: addAdminPrincipalsSQL,
+	},
+	{
+		ID:    19,
+		Name:  "add_user_quotas",
+		UpSQL: addUserQuotasSQL,
+	},
+	{
+		ID:    20,
+		Name:  "add_usage_daily",
+		UpSQL: addUsageDailySQL,
+	},
+	{
+		ID:    21,
+		Name:  "add_reconnect_policy",
+		UpSQL: addReconnectPolicySQL,
+	},
+	{
+		ID:    22,
+		Name:  "shorten_token_lookups",
+		UpSQL: shortenTokenLookupsSQL,
+	},
 }
 
 const changeIDToStringSQL = `
@@ -214,6 +284,351 @@ END $$;
 -- SQLite version (handled in code)
 `
 
+const addHelpdeskConnectorsSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'helpdesk_connectors') THEN
+        CREATE TABLE helpdesk_connectors (
+            user_id TEXT NOT NULL,
+            type TEXT NOT NULL,
+            enabled BOOLEAN NOT NULL DEFAULT TRUE,
+            config TEXT NOT NULL DEFAULT '{}',
+            created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+            PRIMARY KEY (user_id, type)
+        );
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addFlowsSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'flows') THEN
+        CREATE TABLE flows (
+            id TEXT PRIMARY KEY,
+            user_id TEXT NOT NULL,
+            name TEXT NOT NULL,
+            definition TEXT NOT NULL,
+            enabled BOOLEAN NOT NULL DEFAULT TRUE,
+            priority INTEGER NOT NULL DEFAULT 0,
+            created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+        );
+        CREATE INDEX idx_flows_user_id ON flows (user_id);
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'flow_sessions') THEN
+        CREATE TABLE flow_sessions (
+            user_id TEXT NOT NULL,
+            chat_jid TEXT NOT NULL,
+            flow_id TEXT NOT NULL,
+            current_node TEXT NOT NULL DEFAULT '',
+            variables TEXT NOT NULL DEFAULT '{}',
+            expires_at TIMESTAMP,
+            updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+            PRIMARY KEY (user_id, chat_jid)
+        );
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addAutoReplySQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'autoreply_rules') THEN
+        CREATE TABLE autoreply_rules (
+            id TEXT PRIMARY KEY,
+            user_id TEXT NOT NULL,
+            name TEXT NOT NULL DEFAULT '',
+            match_type TEXT NOT NULL,
+            pattern TEXT NOT NULL DEFAULT '',
+            reply_text TEXT NOT NULL DEFAULT '',
+            media_url TEXT NOT NULL DEFAULT '',
+            media_type TEXT NOT NULL DEFAULT '',
+            file_name TEXT NOT NULL DEFAULT '',
+            enabled BOOLEAN NOT NULL DEFAULT TRUE,
+            priority INTEGER NOT NULL DEFAULT 0,
+            created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+        );
+        CREATE INDEX idx_autoreply_rules_user_id ON autoreply_rules (user_id);
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'autoreply_settings') THEN
+        CREATE TABLE autoreply_settings (
+            user_id TEXT PRIMARY KEY,
+            timezone TEXT NOT NULL DEFAULT 'UTC',
+            business_hours TEXT NOT NULL DEFAULT '{}',
+            holidays TEXT NOT NULL DEFAULT '[]',
+            away_cooldown_minutes INTEGER NOT NULL DEFAULT 60,
+            updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+        );
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'autoreply_contacts') THEN
+        CREATE TABLE autoreply_contacts (
+            user_id TEXT NOT NULL,
+            chat_jid TEXT NOT NULL,
+            greeted_at TIMESTAMP,
+            away_sent_at TIMESTAMP,
+            PRIMARY KEY (user_id, chat_jid)
+        );
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addAIAgentsSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'ai_agents') THEN
+        CREATE TABLE ai_agents (
+            user_id TEXT PRIMARY KEY,
+            enabled BOOLEAN NOT NULL DEFAULT TRUE,
+            base_url TEXT NOT NULL,
+            api_key TEXT NOT NULL DEFAULT '',
+            model TEXT NOT NULL,
+            system_prompt TEXT NOT NULL DEFAULT '',
+            handoff_keyword TEXT NOT NULL DEFAULT '',
+            handoff_message TEXT NOT NULL DEFAULT '',
+            context_messages INTEGER NOT NULL DEFAULT 0,
+            temperature DOUBLE PRECISION NOT NULL DEFAULT 0,
+            max_tokens INTEGER NOT NULL DEFAULT 0,
+            timeout_seconds INTEGER NOT NULL DEFAULT 0,
+            transcription_url TEXT NOT NULL DEFAULT '',
+            transcription_model TEXT NOT NULL DEFAULT '',
+            updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+        );
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'ai_handoffs') THEN
+        CREATE TABLE ai_handoffs (
+            user_id TEXT NOT NULL,
+            chat_jid TEXT NOT NULL,
+            created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+            PRIMARY KEY (user_id, chat_jid)
+        );
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addMediaLibrarySQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'media_library') THEN
+        CREATE TABLE media_library (
+            id TEXT PRIMARY KEY,
+            user_id TEXT NOT NULL,
+            media_type TEXT NOT NULL,
+            mime_type TEXT NOT NULL DEFAULT '',
+            file_name TEXT NOT NULL DEFAULT '',
+            file_length BIGINT NOT NULL DEFAULT 0,
+            seconds INTEGER NOT NULL DEFAULT 0,
+            url TEXT NOT NULL DEFAULT '',
+            direct_path TEXT NOT NULL DEFAULT '',
+            media_key TEXT NOT NULL DEFAULT '',
+            file_enc_sha256 TEXT NOT NULL DEFAULT '',
+            file_sha256 TEXT NOT NULL DEFAULT '',
+            thumbnail TEXT NOT NULL DEFAULT '',
+            file_path TEXT NOT NULL,
+            uploaded_at TIMESTAMP NOT NULL,
+            expires_at TIMESTAMP NOT NULL,
+            created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+        );
+        CREATE INDEX idx_media_library_user_id ON media_library (user_id);
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addS3PresignedURLsSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 's3_url_mode') THEN
+        ALTER TABLE users ADD COLUMN s3_url_mode TEXT DEFAULT 'public';
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 's3_presign_ttl') THEN
+        ALTER TABLE users ADD COLUMN s3_presign_ttl INTEGER DEFAULT 3600;
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addS3KeyTemplateSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 's3_key_template') THEN
+        ALTER TABLE users ADD COLUMN s3_key_template TEXT DEFAULT '';
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addAPIKeysSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'api_keys') THEN
+        CREATE TABLE api_keys (
+            id TEXT PRIMARY KEY,
+            user_id TEXT NOT NULL,
+            name TEXT NOT NULL DEFAULT '',
+            prefix TEXT NOT NULL DEFAULT '',
+            key_hash TEXT NOT NULL UNIQUE,
+            scopes TEXT NOT NULL DEFAULT '',
+            allowed_ips TEXT NOT NULL DEFAULT '',
+            expires_at TIMESTAMP NULL,
+            last_used_at TIMESTAMP NULL,
+            created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+        );
+        CREATE INDEX idx_api_keys_user_id ON api_keys (user_id);
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const hashUserTokensSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'token_hash') THEN
+        ALTER TABLE users ADD COLUMN token_lookup TEXT;
+        ALTER TABLE users ADD COLUMN token_hash TEXT;
+        ALTER TABLE users ADD COLUMN token_salt TEXT;
+        ALTER TABLE users ADD COLUMN previous_token_lookup TEXT;
+        ALTER TABLE users ADD COLUMN previous_token_hash TEXT;
+        ALTER TABLE users ADD COLUMN previous_token_salt TEXT;
+        ALTER TABLE users ADD COLUMN previous_token_expires TIMESTAMP NULL;
+        CREATE INDEX idx_users_token_lookup ON users (token_lookup);
+        CREATE INDEX idx_users_previous_token_lookup ON users (previous_token_lookup);
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+-- Existing tokens are hashed in code for both databases
+`
+
+const addAdminPrincipalsSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'admins') THEN
+        CREATE TABLE admins (
+            id TEXT PRIMARY KEY,
+            name TEXT NOT NULL,
+            role TEXT NOT NULL,
+            token_lookup TEXT NOT NULL,
+            token_hash TEXT NOT NULL,
+            token_salt TEXT NOT NULL,
+            created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+        );
+        CREATE INDEX idx_admins_token_lookup ON admins (token_lookup);
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'admin_audit') THEN
+        CREATE TABLE admin_audit (
+            id TEXT PRIMARY KEY,
+            admin_id TEXT NOT NULL DEFAULT '',
+            admin_name TEXT NOT NULL DEFAULT '',
+            role TEXT NOT NULL DEFAULT '',
+            action TEXT NOT NULL,
+            method TEXT NOT NULL,
+            path TEXT NOT NULL,
+            target TEXT NOT NULL DEFAULT '',
+            status INTEGER NOT NULL DEFAULT 0,
+            remote_addr TEXT NOT NULL DEFAULT '',
+            created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+        );
+        CREATE INDEX idx_admin_audit_created_at ON admin_audit (created_at);
+        CREATE INDEX idx_admin_audit_admin_id ON admin_audit (admin_id);
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addUserQuotasSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'quota_messages') THEN
+        ALTER TABLE users ADD COLUMN quota_messages INTEGER NOT NULL DEFAULT 0;
+        ALTER TABLE users ADD COLUMN quota_media_bytes BIGINT NOT NULL DEFAULT 0;
+        ALTER TABLE users ADD COLUMN quota_history_rows INTEGER NOT NULL DEFAULT 0;
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'user_usage') THEN
+        CREATE TABLE user_usage (
+            user_id TEXT NOT NULL,
+            period TEXT NOT NULL,
+            messages INTEGER NOT NULL DEFAULT 0,
+            media_bytes BIGINT NOT NULL DEFAULT 0,
+            PRIMARY KEY (user_id, period)
+        );
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addUsageDailySQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'usage_daily') THEN
+        CREATE TABLE usage_daily (
+            user_id TEXT NOT NULL,
+            day TEXT NOT NULL,
+            metric TEXT NOT NULL,
+            value BIGINT NOT NULL DEFAULT 0,
+            PRIMARY KEY (user_id, day, metric)
+        );
+        CREATE INDEX idx_usage_daily_day ON usage_daily (day);
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addReconnectPolicySQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'reconnect_enabled') THEN
+        ALTER TABLE users ADD COLUMN reconnect_enabled BOOLEAN NOT NULL DEFAULT TRUE;
+        ALTER TABLE users ADD COLUMN reconnect_min_delay INTEGER NOT NULL DEFAULT 2;
+        ALTER TABLE users ADD COLUMN reconnect_max_delay INTEGER NOT NULL DEFAULT 300;
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+// Tokens without a public id are only found by a short bucket of their hash now
+const shortenTokenLookupsSQL = `
+UPDATE users SET token_lookup = substr(token_lookup, 1, 4) WHERE length(token_lookup) = 16;
+UPDATE users SET previous_token_lookup = substr(previous_token_lookup, 1, 4) WHERE length(previous_token_lookup) = 16;
+UPDATE admins SET token_lookup = substr(token_lookup, 1, 4) WHERE length(token_lookup) = 16;
+`
+
 // GenerateRandomID creates a random string ID
 func GenerateRandomID() (string, error) {
 	bytes := make([]byte, 16) // 128 bits
@@ -435,6 +850,304 @@ func applyMigration(db *sqlx.DB, migration Migration) error {
 		} else {
 			_, err = tx.Exec(migration.UpSQL)
 		}
+	} else if migration.ID == 9 {
+		if db.DriverName() == "sqlite" {
+			err = createTableIfNotExistsSQLite(tx, "helpdesk_connectors", `
+				CREATE TABLE helpdesk_connectors (
+					user_id TEXT NOT NULL,
+					type TEXT NOT NULL,
+					enabled BOOLEAN NOT NULL DEFAULT 1,
+					config TEXT NOT NULL DEFAULT '{}',
+					created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+					updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+					PRIMARY KEY (user_id, type)
+				)`)
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 10 {
+		if db.DriverName() == "sqlite" {
+			err = createTableIfNotExistsSQLite(tx, "flows", `
+				CREATE TABLE flows (
+					id TEXT PRIMARY KEY,
+					user_id TEXT NOT NULL,
+					name TEXT NOT NULL,
+					definition TEXT NOT NULL,
+					enabled BOOLEAN NOT NULL DEFAULT 1,
+					priority INTEGER NOT NULL DEFAULT 0,
+					created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+					updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+				)`)
+			if err == nil {
+				_, err = tx.Exec("CREATE INDEX IF NOT EXISTS idx_flows_user_id ON flows (user_id)")
+			}
+			if err == nil {
+				err = createTableIfNotExistsSQLite(tx, "flow_sessions", `
+					CREATE TABLE flow_sessions (
+						user_id TEXT NOT NULL,
+						chat_jid TEXT NOT NULL,
+						flow_id TEXT NOT NULL,
+						current_node TEXT NOT NULL DEFAULT '',
+						variables TEXT NOT NULL DEFAULT '{}',
+						expires_at DATETIME,
+						updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+						PRIMARY KEY (user_id, chat_jid)
+					)`)
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 11 {
+		if db.DriverName() == "sqlite" {
+			err = createTableIfNotExistsSQLite(tx, "autoreply_rules", `
+				CREATE TABLE autoreply_rules (
+					id TEXT PRIMARY KEY,
+					user_id TEXT NOT NULL,
+					name TEXT NOT NULL DEFAULT '',
+					match_type TEXT NOT NULL,
+					pattern TEXT NOT NULL DEFAULT '',
+					reply_text TEXT NOT NULL DEFAULT '',
+					media_url TEXT NOT NULL DEFAULT '',
+					media_type TEXT NOT NULL DEFAULT '',
+					file_name TEXT NOT NULL DEFAULT '',
+					enabled BOOLEAN NOT NULL DEFAULT 1,
+					priority INTEGER NOT NULL DEFAULT 0,
+					created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+					updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+				)`)
+			if err == nil {
+				_, err = tx.Exec("CREATE INDEX IF NOT EXISTS idx_autoreply_rules_user_id ON autoreply_rules (user_id)")
+			}
+			if err == nil {
+				err = createTableIfNotExistsSQLite(tx, "autoreply_settings", `
+					CREATE TABLE autoreply_settings (
+						user_id TEXT PRIMARY KEY,
+						timezone TEXT NOT NULL DEFAULT 'UTC',
+						business_hours TEXT NOT NULL DEFAULT '{}',
+						holidays TEXT NOT NULL DEFAULT '[]',
+						away_cooldown_minutes INTEGER NOT NULL DEFAULT 60,
+						updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+					)`)
+			}
+			if err == nil {
+				err = createTableIfNotExistsSQLite(tx, "autoreply_contacts", `
+					CREATE TABLE autoreply_contacts (
+						user_id TEXT NOT NULL,
+						chat_jid TEXT NOT NULL,
+						greeted_at DATETIME,
+						away_sent_at DATETIME,
+						PRIMARY KEY (user_id, chat_jid)
+					)`)
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 12 {
+		if db.DriverName() == "sqlite" {
+			err = createTableIfNotExistsSQLite(tx, "ai_agents", `
+				CREATE TABLE ai_agents (
+					user_id TEXT PRIMARY KEY,
+					enabled BOOLEAN NOT NULL DEFAULT 1,
+					base_url TEXT NOT NULL,
+					api_key TEXT NOT NULL DEFAULT '',
+					model TEXT NOT NULL,
+					system_prompt TEXT NOT NULL DEFAULT '',
+					handoff_keyword TEXT NOT NULL DEFAULT '',
+					handoff_message TEXT NOT NULL DEFAULT '',
+					context_messages INTEGER NOT NULL DEFAULT 0,
+					temperature REAL NOT NULL DEFAULT 0,
+					max_tokens INTEGER NOT NULL DEFAULT 0,
+					timeout_seconds INTEGER NOT NULL DEFAULT 0,
+					transcription_url TEXT NOT NULL DEFAULT '',
+					transcription_model TEXT NOT NULL DEFAULT '',
+					updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+				)`)
+			if err == nil {
+				err = createTableIfNotExistsSQLite(tx, "ai_handoffs", `
+					CREATE TABLE ai_handoffs (
+						user_id TEXT NOT NULL,
+						chat_jid TEXT NOT NULL,
+						created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+						PRIMARY KEY (user_id, chat_jid)
+					)`)
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 13 {
+		if db.DriverName() == "sqlite" {
+			err = createTableIfNotExistsSQLite(tx, "media_library", `
+				CREATE TABLE media_library (
+					id TEXT PRIMARY KEY,
+					user_id TEXT NOT NULL,
+					media_type TEXT NOT NULL,
+					mime_type TEXT NOT NULL DEFAULT '',
+					file_name TEXT NOT NULL DEFAULT '',
+					file_length INTEGER NOT NULL DEFAULT 0,
+					seconds INTEGER NOT NULL DEFAULT 0,
+					url TEXT NOT NULL DEFAULT '',
+					direct_path TEXT NOT NULL DEFAULT '',
+					media_key TEXT NOT NULL DEFAULT '',
+					file_enc_sha256 TEXT NOT NULL DEFAULT '',
+					file_sha256 TEXT NOT NULL DEFAULT '',
+					thumbnail TEXT NOT NULL DEFAULT '',
+					file_path TEXT NOT NULL,
+					uploaded_at DATETIME NOT NULL,
+					expires_at DATETIME NOT NULL,
+					created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+				)`)
+			if err == nil {
+				_, err = tx.Exec("CREATE INDEX IF NOT EXISTS idx_media_library_user_id ON media_library (user_id)")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 14 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "s3_url_mode", "TEXT DEFAULT 'public'")
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "users", "s3_presign_ttl", "INTEGER DEFAULT 3600")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 15 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "s3_key_template", "TEXT DEFAULT ''")
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 16 {
+		if db.DriverName() == "sqlite" {
+			err = createTableIfNotExistsSQLite(tx, "api_keys", `
+				CREATE TABLE api_keys (
+					id TEXT PRIMARY KEY,
+					user_id TEXT NOT NULL,
+					name TEXT NOT NULL DEFAULT '',
+					prefix TEXT NOT NULL DEFAULT '',
+					key_hash TEXT NOT NULL UNIQUE,
+					scopes TEXT NOT NULL DEFAULT '',
+					allowed_ips TEXT NOT NULL DEFAULT '',
+					expires_at DATETIME NULL,
+					last_used_at DATETIME NULL,
+					created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+				)`)
+			if err == nil {
+				_, err = tx.Exec("CREATE INDEX IF NOT EXISTS idx_api_keys_user_id ON api_keys (user_id)")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 17 {
+		if db.DriverName() == "sqlite" {
+			for _, column := range []string{"token_lookup", "token_hash", "token_salt", "previous_token_lookup", "previous_token_hash", "previous_token_salt"} {
+				if err = addColumnIfNotExistsSQLite(tx, "users", column, "TEXT"); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "users", "previous_token_expires", "DATETIME NULL")
+			}
+			if err == nil {
+				_, err = tx.Exec("CREATE INDEX IF NOT EXISTS idx_users_token_lookup ON users (token_lookup)")
+			}
+			if err == nil {
+				_, err = tx.Exec("CREATE INDEX IF NOT EXISTS idx_users_previous_token_lookup ON users (previous_token_lookup)")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+		if err == nil {
+			err = hashExistingTokens(tx)
+		}
+	} else if migration.ID == 18 {
+		if db.DriverName() == "sqlite" {
+			err = createTableIfNotExistsSQLite(tx, "admins", `
+				CREATE TABLE admins (
+					id TEXT PRIMARY KEY,
+					name TEXT NOT NULL,
+					role TEXT NOT NULL,
+					token_lookup TEXT NOT NULL,
+					token_hash TEXT NOT NULL,
+					token_salt TEXT NOT NULL,
+					created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+				)`)
+			if err == nil {
+				_, err = tx.Exec("CREATE INDEX IF NOT EXISTS idx_admins_token_lookup ON admins (token_lookup)")
+			}
+			if err == nil {
+				err = createTableIfNotExistsSQLite(tx, "admin_audit", `
+					CREATE TABLE admin_audit (
+						id TEXT PRIMARY KEY,
+						admin_id TEXT NOT NULL DEFAULT '',
+						admin_name TEXT NOT NULL DEFAULT '',
+						role TEXT NOT NULL DEFAULT '',
+						action TEXT NOT NULL,
+						method TEXT NOT NULL,
+						path TEXT NOT NULL,
+						target TEXT NOT NULL DEFAULT '',
+						status INTEGER NOT NULL DEFAULT 0,
+						remote_addr TEXT NOT NULL DEFAULT '',
+						created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+					)`)
+			}
+			if err == nil {
+				_, err = tx.Exec("CREATE INDEX IF NOT EXISTS idx_admin_audit_created_at ON admin_audit (created_at)")
+			}
+			if err == nil {
+				_, err = tx.Exec("CREATE INDEX IF NOT EXISTS idx_admin_audit_admin_id ON admin_audit (admin_id)")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 19 {
+		if db.DriverName() == "sqlite" {
+			for _, column := range []string{"quota_messages", "quota_media_bytes", "quota_history_rows"} {
+				if err = addColumnIfNotExistsSQLite(tx, "users", column, "INTEGER NOT NULL DEFAULT 0"); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				err = createTableIfNotExistsSQLite(tx, "user_usage", `
+					CREATE TABLE user_usage (
+						user_id TEXT NOT NULL,
+						period TEXT NOT NULL,
+						messages INTEGER NOT NULL DEFAULT 0,
+						media_bytes INTEGER NOT NULL DEFAULT 0,
+						PRIMARY KEY (user_id, period)
+					)`)
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 20 {
+		if db.DriverName() == "sqlite" {
+			err = createTableIfNotExistsSQLite(tx, "usage_daily", `
+				CREATE TABLE usage_daily (
+					user_id TEXT NOT NULL,
+					day TEXT NOT NULL,
+					metric TEXT NOT NULL,
+					value INTEGER NOT NULL DEFAULT 0,
+					PRIMARY KEY (user_id, day, metric)
+				)`)
+			if err == nil {
+				_, err = tx.Exec("CREATE INDEX IF NOT EXISTS idx_usage_daily_day ON usage_daily (day)")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 21 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "reconnect_enabled", "BOOLEAN NOT NULL DEFAULT 1")
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "users", "reconnect_min_delay", "INTEGER NOT NULL DEFAULT 2")
+			}
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "users", "reconnect_max_delay", "INTEGER NOT NULL DEFAULT 300")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
 	} else {
 		_, err = tx.Exec(migration.UpSQL)
 	}
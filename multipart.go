@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+)
+
+var errUploadTooLarge = errors.New("uploaded file exceeds the size limit")
+
+// A media file received as multipart/form-data, spooled to a temp file instead of memory
+type multipartMedia struct {
+	File     *os.File
+	Size     int64
+	MimeType string
+	FileName string
+}
+
+func (m *multipartMedia) Close() {
+	if m == nil || m.File == nil {
+		return
+	}
+	m.File.Close()
+	os.Remove(m.File.Name())
+}
+
+// Rewinds the temp file so it can be streamed to an upload
+func (m *multipartMedia) Reader() (io.Reader, error) {
+	if _, err := m.File.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return m.File, nil
+}
+
+// For pipelines that need the whole file (thumbnails, ffmpeg conversions)
+func (m *multipartMedia) Bytes() ([]byte, error) {
+	return os.ReadFile(m.File.Name())
+}
+
+// Maximum size of a multipart upload for the given media type
+func uploadLimitBytes(mediaType string) int64 {
+	limits := map[string]int{
+		"image":    *uploadMaxImageMB,
+		"audio":    *uploadMaxAudioMB,
+		"video":    *uploadMaxVideoMB,
+		"document": *uploadMaxDocumentMB,
+		"sticker":  *uploadMaxStickerMB,
+	}
+	return int64(limits[mediaType]) * 1024 * 1024
+}
+
+func isMultipartRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// Reads a multipart request: the file part (named after fileField, or "file") is streamed
+// to disk up to maxBytes, and the other parts fill the matching fields of dst. Values are
+// matched to field names case-insensitively, non string fields take JSON values
+// (ptt=false, Seconds=12, ContextInfo={...}).
+func readMultipartMedia(r *http.Request, fileField string, maxBytes int64, dst interface{}) (*multipartMedia, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]string{}
+	var media *multipartMedia
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			media.Close()
+			return nil, fmt.Errorf("could not read multipart body: %w", err)
+		}
+
+		name := part.FormName()
+		if part.FileName() == "" && !strings.EqualFold(name, fileField) && name != "file" {
+			value, err := io.ReadAll(io.LimitReader(part, 1024*1024))
+			part.Close()
+			if err != nil {
+				media.Close()
+				return nil, err
+			}
+			fields[name] = string(value)
+			continue
+		}
+		if media != nil {
+			part.Close()
+			media.Close()
+			return nil, errors.New("only one file can be uploaded")
+		}
+
+		media, err = spoolMultipartFile(part, maxBytes)
+		part.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if media == nil {
+		return nil, fmt.Errorf("missing %s file in multipart body", fileField)
+	}
+	if err := applyMultipartFields(fields, dst); err != nil {
+		media.Close()
+		return nil, err
+	}
+	return media, nil
+}
+
+func spoolMultipartFile(part *multipart.Part, maxBytes int64) (*multipartMedia, error) {
+	file, err := os.CreateTemp("", "wuzapi-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	media := &multipartMedia{File: file, FileName: part.FileName()}
+
+	media.Size, err = io.Copy(file, io.LimitReader(part, maxBytes+1))
+	if err != nil {
+		media.Close()
+		return nil, fmt.Errorf("could not store upload: %w", err)
+	}
+	if media.Size > maxBytes {
+		media.Close()
+		return nil, errUploadTooLarge
+	}
+
+	// The MIME type comes from the content, the part header is up to the client
+	head := make([]byte, 512)
+	n, _ := file.ReadAt(head, 0)
+	media.MimeType = http.DetectContentType(head[:n])
+	return media, nil
+}
+
+func applyMultipartFields(fields map[string]string, dst interface{}) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	target := reflect.TypeOf(dst).Elem()
+	payload := map[string]json.RawMessage{}
+	for name, value := range fields {
+		for i := 0; i < target.NumField(); i++ {
+			field := target.Field(i)
+			key := strings.Split(field.Tag.Get("json"), ",")[0]
+			if key == "-" {
+				continue
+			}
+			if key == "" {
+				key = field.Name
+			}
+			if !strings.EqualFold(field.Name, name) && !strings.EqualFold(key, name) {
+				continue
+			}
+			// Strings and base64 []byte fields take the raw form value
+			if field.Type.Kind() == reflect.String || field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() == reflect.Uint8 {
+				encoded, _ := json.Marshal(value)
+				payload[key] = encoded
+			} else {
+				payload[key] = json.RawMessage(value)
+			}
+			break
+		}
+	}
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("invalid form field: %w", err)
+	}
+	if err := json.Unmarshal(encoded, dst); err != nil {
+		return fmt.Errorf("invalid form field: %w", err)
+	}
+	return nil
+}
+
+// Responds to a failed multipart read with 413 when the file is too big
+func (s *server) respondMultipartError(w http.ResponseWriter, r *http.Request, err error, maxBytes int64) {
+	if errors.Is(err, errUploadTooLarge) {
+		s.Respond(w, r, http.StatusRequestEntityTooLarge, fmt.Errorf("file exceeds the %d MB limit", maxBytes/(1024*1024)))
+		return
+	}
+	s.Respond(w, r, http.StatusBadRequest, err)
+}
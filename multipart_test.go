@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"mime/multipart"
+	"net/http/httptest"
+	"testing"
+)
+
+func newMultipartRequestBody(t *testing.T, fields map[string]string, fileField string, fileName string, content []byte) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for name, value := range fields {
+		if err := writer.WriteField(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	part, err := writer.CreateFormFile(fileField, fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(content)
+	writer.Close()
+	return &body, writer.FormDataContentType()
+}
+
+func TestReadMultipartMedia(t *testing.T) {
+	type audioPayload struct {
+		Phone    string
+		Caption  string
+		PTT      *bool `json:"ptt,omitempty"`
+		Seconds  uint32
+		Waveform []byte
+	}
+
+	pdf := append([]byte("%PDF-1.7\n"), bytes.Repeat([]byte("x"), 2048)...)
+	body, contentType := newMultipartRequestBody(t, map[string]string{
+		"Phone":   "5491155554444",
+		"caption": "report",
+		"ptt":     "false",
+		"Seconds": "12",
+	}, "Audio", "report.pdf", pdf)
+	r := httptest.NewRequest("POST", "/chat/send/audio", body)
+	r.Header.Set("Content-Type", contentType)
+
+	if !isMultipartRequest(r) {
+		t.Fatal("Expected multipart request to be detected")
+	}
+
+	var payload audioPayload
+	media, err := readMultipartMedia(r, "Audio", 1024*1024, &payload)
+	if err != nil {
+		t.Fatalf("readMultipartMedia failed: %v", err)
+	}
+	defer media.Close()
+
+	if payload.Phone != "5491155554444" || payload.Caption != "report" || payload.Seconds != 12 || payload.PTT == nil || *payload.PTT {
+		t.Errorf("Unexpected payload %+v", payload)
+	}
+	if media.Size != int64(len(pdf)) || media.FileName != "report.pdf" || media.MimeType != "application/pdf" {
+		t.Errorf("Unexpected media size=%d name=%q mime=%q", media.Size, media.FileName, media.MimeType)
+	}
+	data, err := media.Bytes()
+	if err != nil || !bytes.Equal(data, pdf) {
+		t.Errorf("Stored file does not match the upload")
+	}
+}
+
+func TestReadMultipartMediaLimit(t *testing.T) {
+	body, contentType := newMultipartRequestBody(t, map[string]string{"Phone": "5491155554444"}, "file", "big.bin", make([]byte, 4096))
+	r := httptest.NewRequest("POST", "/chat/send/document", body)
+	r.Header.Set("Content-Type", contentType)
+
+	var payload struct{ Phone string }
+	_, err := readMultipartMedia(r, "Document", 1024, &payload)
+	if !errors.Is(err, errUploadTooLarge) {
+		t.Errorf("Expected errUploadTooLarge, got %v", err)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+)
+
+// How often expired accounts are looked for and disconnected
+const expiryCheckInterval = time.Minute
+
+var (
+	errAccountExpired   = errors.New("account expired")
+	errMessageQuota     = errors.New("monthly message quota exceeded")
+	errMediaQuota       = errors.New("monthly media quota exceeded")
+	limitscache         = cache.New(5*time.Minute, 10*time.Minute)
+	usagePeriodPattern  = regexp.MustCompile(`^\d{4}-(0[1-9]|1[0-2])$`)
+	quotaMessageRoutes  = []string{"/chat/send/"}
+	quotaExcludedRoutes = []string{"/chat/send/edit"}
+)
+
+// UserQuotas are the limits of a user, 0 means unlimited
+type UserQuotas struct {
+	MessagesPerMonth int64 `json:"messages_per_month" db:"quota_messages"`
+	MaxMediaBytes    int64 `json:"max_media_bytes" db:"quota_media_bytes"`
+	MaxHistoryRows   int64 `json:"max_history_rows" db:"quota_history_rows"`
+}
+
+func (q *UserQuotas) validate() error {
+	if q.MessagesPerMonth < 0 || q.MaxMediaBytes < 0 || q.MaxHistoryRows < 0 {
+		return errors.New("quotas can't be negative")
+	}
+	return nil
+}
+
+// Expiration (unix seconds, 0 for none) and quotas of a user
+type userLimits struct {
+	Expiration int64 `db:"expiration"`
+	UserQuotas
+}
+
+func (l *userLimits) expired(now time.Time) bool {
+	return l.Expiration > 0 && now.Unix() >= l.Expiration
+}
+
+// UserUsage is what a user consumed in a calendar month (UTC)
+type UserUsage struct {
+	Messages   int64 `json:"messages" db:"messages"`
+	MediaBytes int64 `json:"media_bytes" db:"media_bytes"`
+}
+
+func usagePeriod(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+func (s *server) userLimits(userID string) (*userLimits, error) {
+	if cached, found := limitscache.Get(userID); found {
+		return cached.(*userLimits), nil
+	}
+	var limits userLimits
+	err := s.db.Get(&limits, "SELECT COALESCE(expiration, 0) AS expiration, quota_messages, quota_media_bytes, quota_history_rows FROM users WHERE id = $1", userID)
+	if err != nil {
+		return nil, err
+	}
+	limitscache.Set(userID, &limits, cache.DefaultExpiration)
+	return &limits, nil
+}
+
+func forgetUserLimits(userID string) {
+	limitscache.Delete(userID)
+}
+
+func (s *server) monthlyUsage(userID, period string) (UserUsage, error) {
+	var usage UserUsage
+	err := s.db.Get(&usage, "SELECT messages, media_bytes FROM user_usage WHERE user_id = $1 AND period = $2", userID, period)
+	if errors.Is(err, sql.ErrNoRows) {
+		return usage, nil
+	}
+	return usage, err
+}
+
+// Adds to the usage of the current month only if it stays within the quotas, the check and
+// the update are one statement so concurrent requests can't overshoot
+func (s *server) consumeUsage(userID string, messages, mediaBytes int64) error {
+	limits, err := s.userLimits(userID)
+	if err != nil {
+		return err
+	}
+	period := usagePeriod(time.Now())
+	if _, err := s.db.Exec("INSERT INTO user_usage (user_id, period) VALUES ($1, $2) ON CONFLICT (user_id, period) DO NOTHING", userID, period); err != nil {
+		return err
+	}
+	result, err := s.db.Exec(`UPDATE user_usage SET messages = messages + $1, media_bytes = media_bytes + $2
+		WHERE user_id = $3 AND period = $4 AND ($5 = 0 OR messages + $1 <= $5) AND ($6 = 0 OR media_bytes + $2 <= $6)`,
+		messages, mediaBytes, userID, period, limits.MessagesPerMonth, limits.MaxMediaBytes)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		if messages > 0 {
+			return errMessageQuota
+		}
+		return errMediaQuota
+	}
+	return nil
+}
+
+// Gives back usage of the current month, for sends that failed after consumeUsage
+func (s *server) refundUsage(userID string, messages, mediaBytes int64) {
+	_, err := s.db.Exec("UPDATE user_usage SET messages = messages - $1, media_bytes = media_bytes - $2 WHERE user_id = $3 AND period = $4",
+		messages, mediaBytes, userID, usagePeriod(time.Now()))
+	if err != nil {
+		log.Error().Err(err).Str("userID", userID).Msg("Failed to refund usage")
+	}
+}
+
+// Counts media about to be uploaded for a user and writes the error response when over quota
+func (s *server) useMediaQuota(w http.ResponseWriter, r *http.Request, userID string, size int64) bool {
+	err := s.consumeUsage(userID, 0, size)
+	if errors.Is(err, errMediaQuota) {
+		s.Respond(w, r, http.StatusTooManyRequests, err)
+		return false
+	}
+	if err != nil {
+		log.Error().Err(err).Str("userID", userID).Msg("Failed to record media usage")
+		s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to check quota"))
+		return false
+	}
+	if charge, ok := r.Context().Value("quotacharge").(*quotaCharge); ok {
+		charge.mediaBytes += size
+	}
+	meterUsage(userID, metricMediaBytesOut, size)
+	return true
+}
+
+// Usage counted while serving a request, given back by authquota when the request fails
+type quotaCharge struct {
+	messages   int64
+	mediaBytes int64
+}
+
+func isQuotaMessageRoute(pathTemplate string) bool {
+	for _, prefix := range quotaExcludedRoutes {
+		if strings.HasPrefix(pathTemplate, prefix) {
+			return false
+		}
+	}
+	for _, prefix := range quotaMessageRoutes {
+		if strings.HasPrefix(pathTemplate, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Counts sent messages against the monthly quota. Messages and media counted by the handler
+// are given back when the request fails.
+func (s *server) authquota(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		charge := &quotaCharge{}
+		if isQuotaMessageRoute(routeTemplate(r)) {
+			err := s.consumeUsage(txtid, 1, 0)
+			if errors.Is(err, errMessageQuota) {
+				s.Respond(w, r, http.StatusTooManyRequests, err)
+				return
+			}
+			if err != nil {
+				log.Error().Err(err).Str("userID", txtid).Msg("Failed to record message usage")
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to check quota"))
+				return
+			}
+			charge.messages = 1
+		}
+
+		recorder := &auditResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), "quotacharge", charge)))
+		if recorder.status >= http.StatusMultipleChoices && (charge.messages > 0 || charge.mediaBytes > 0) {
+			s.refundUsage(txtid, charge.messages, charge.mediaBytes)
+		}
+	})
+}
+
+// History rows saved per user since its last trim
+var historyQuotaInserts = struct {
+	sync.Mutex
+	counts map[string]int
+}{counts: make(map[string]int)}
+
+// Rows saved between two trims: a tenth of the quota, at most 100. The history can go
+// over the quota by that much until the next trim.
+func historyQuotaTrimBatch(maxRows int) int {
+	batch := maxRows / 10
+	if batch < 1 {
+		return 1
+	}
+	if batch > 100 {
+		return 100
+	}
+	return batch
+}
+
+// Drops the oldest history rows of a user beyond its history quota, once per batch of saved rows
+func (s *server) enforceHistoryQuota(userID string) error {
+	limits, err := s.userLimits(userID)
+	if err != nil || limits.MaxHistoryRows == 0 {
+		return err
+	}
+
+	historyQuotaInserts.Lock()
+	historyQuotaInserts.counts[userID]++
+	due := historyQuotaInserts.counts[userID] >= historyQuotaTrimBatch(int(limits.MaxHistoryRows))
+	if due {
+		delete(historyQuotaInserts.counts, userID)
+	}
+	historyQuotaInserts.Unlock()
+	if !due {
+		return nil
+	}
+
+	query := `DELETE FROM message_history WHERE id IN (
+		SELECT id FROM message_history WHERE user_id = $1 ORDER BY timestamp DESC, id DESC OFFSET $2)`
+	if s.db.DriverName() == "sqlite" {
+		query = `DELETE FROM message_history WHERE id IN (
+			SELECT id FROM message_history WHERE user_id = $1 ORDER BY timestamp DESC, id DESC LIMIT -1 OFFSET $2)`
+	}
+	_, err = s.db.Exec(query, userID, limits.MaxHistoryRows)
+	return err
+}
+
+// Sends AccountExpired to the user's webhook and ends its session
+func (s *server) expireSession(userID string, expiration int64) {
+	log.Info().Str("userID", userID).Int64("expiration", expiration).Msg("Account expired, disconnecting")
+	postmap := map[string]interface{}{
+		"type":  "AccountExpired",
+		"event": map[string]interface{}{"expiration": expiration},
+	}
+	sendEventWithWebHook(&MyClient{userID: userID, db: s.db, s: s}, postmap, "")
+
+	if signalKill(userID) {
+		return
+	}
+	if _, err := s.db.Exec("UPDATE users SET connected=0 WHERE id=$1", userID); err != nil {
+		log.Error().Err(err).Str("userID", userID).Msg("Failed to mark expired user as disconnected")
+	}
+}
+
+func (s *server) expireAccounts() {
+	var expired []struct {
+		ID         string `db:"id"`
+		Expiration int64  `db:"expiration"`
+	}
+	err := s.db.Select(&expired, "SELECT id, expiration FROM users WHERE connected = 1 AND expiration > 0 AND expiration <= $1", time.Now().Unix())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to look for expired accounts")
+		return
+	}
+	for _, user := range expired {
+		s.expireSession(user.ID, user.Expiration)
+	}
+}
+
+func (s *server) StartExpiryWatcher() {
+	go func() {
+		ticker := time.NewTicker(expiryCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.expireAccounts()
+		}
+	}()
+}
+
+// Admin: expiration, quotas and usage of a user for a month (?period=YYYY-MM, defaults to the current one)
+func (s *server) GetUserUsage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := mux.Vars(r)["id"]
+		period := r.URL.Query().Get("period")
+		if period == "" {
+			period = usagePeriod(time.Now())
+		} else if !usagePeriodPattern.MatchString(period) {
+			s.adminError(w, http.StatusBadRequest, "period must be YYYY-MM")
+			return
+		}
+
+		limits, err := s.userLimits(userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			s.adminError(w, http.StatusNotFound, "user not found")
+			return
+		} else if err != nil {
+			log.Error().Err(err).Str("userID", userID).Msg("Failed to load user limits")
+			s.adminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		usage, err := s.monthlyUsage(userID, period)
+		if err != nil {
+			log.Error().Err(err).Str("userID", userID).Msg("Failed to load user usage")
+			s.adminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		var historyRows int64
+		if err := s.db.Get(&historyRows, "SELECT COUNT(*) FROM message_history WHERE user_id = $1", userID); err != nil {
+			log.Error().Err(err).Str("userID", userID).Msg("Failed to count history rows")
+			s.adminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"code": http.StatusOK,
+			"data": map[string]interface{}{
+				"user_id":    userID,
+				"period":     period,
+				"expiration": limits.Expiration,
+				"expired":    limits.expired(time.Now()),
+				"quotas":     limits.UserQuotas,
+				"usage": map[string]interface{}{
+					"messages":     usage.Messages,
+					"media_bytes":  usage.MediaBytes,
+					"history_rows": historyRows,
+				},
+			},
+			"success": true,
+		})
+	}
+}
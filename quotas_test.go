@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestUserLimitsExpired(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		expiration int64
+		want       bool
+	}{
+		{0, false},
+		{now.Add(time.Hour).Unix(), false},
+		{now.Unix(), true},
+		{now.Add(-time.Hour).Unix(), true},
+	}
+	for _, tt := range tests {
+		limits := &userLimits{Expiration: tt.expiration}
+		if got := limits.expired(now); got != tt.want {
+			t.Errorf("expiration %d: got %v, want %v", tt.expiration, got, tt.want)
+		}
+	}
+}
+
+func TestIsQuotaMessageRoute(t *testing.T) {
+	tests := map[string]bool{
+		"/chat/send/text":  true,
+		"/chat/send/image": true,
+		"/chat/send/edit":  false,
+		"/chat/delete":     false,
+		"/session/status":  false,
+	}
+	for path, want := range tests {
+		if got := isQuotaMessageRoute(path); got != want {
+			t.Errorf("%s: got %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestUsagePeriod(t *testing.T) {
+	at := time.Date(2026, 3, 31, 23, 30, 0, 0, time.FixedZone("BRT", -3*3600))
+	if got := usagePeriod(at); got != "2026-04" {
+		t.Errorf("got %q, want 2026-04", got)
+	}
+	if !usagePeriodPattern.MatchString("2026-04") || usagePeriodPattern.MatchString("2026-13") {
+		t.Errorf("period pattern mismatch")
+	}
+	if err := (&UserQuotas{MessagesPerMonth: -1}).validate(); err == nil {
+		t.Errorf("negative quota accepted")
+	}
+}
+
+func TestEnforceHistoryQuotaBatches(t *testing.T) {
+	s := makeTestServer(t)
+	userID := "historyquotauser"
+	t.Cleanup(func() { forgetUserLimits(userID) })
+	if _, err := s.db.Exec("INSERT INTO users (id, name, token, quota_history_rows) VALUES ($1, $2, $3, $4)", userID, "u", "", 20); err != nil {
+		t.Fatal(err)
+	}
+
+	// A quota of 20 rows is trimmed every 2 saved rows
+	for i := 0; i < 25; i++ {
+		if err := s.saveMessageToHistory(userID, "chat@s.whatsapp.net", "chat@s.whatsapp.net", fmt.Sprintf("m%d", i), "text", "hi", "", "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var rows int
+	if err := s.db.Get(&rows, "SELECT COUNT(*) FROM message_history WHERE user_id = $1", userID); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 21 {
+		t.Errorf("Expected 20 rows after the last trim plus one, got %d", rows)
+	}
+	var oldest string
+	if err := s.db.Get(&oldest, "SELECT message_id FROM message_history WHERE user_id = $1 ORDER BY id LIMIT 1", userID); err != nil || oldest != "m4" {
+		t.Errorf("Expected the oldest rows to be dropped, first left is %q (%v)", oldest, err)
+	}
+}
+
+func TestAuthQuotaRefunds(t *testing.T) {
+	s := makeTestServer(t)
+	userID := "refundquotauser"
+	t.Cleanup(func() { forgetUserLimits(userID) })
+	if _, err := s.db.Exec("INSERT INTO users (id, name, token, quota_messages, quota_media_bytes) VALUES ($1, $2, $3, $4, $5)", userID, "u", "", 10, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	call := func(path string, status int) {
+		handler := s.authquota(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !s.useMediaQuota(w, r, userID, 600) {
+				return
+			}
+			w.WriteHeader(status)
+		}))
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		r = r.WithContext(context.WithValue(r.Context(), "userinfo", Values{map[string]string{"Id": userID}}))
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	usage := func() UserUsage {
+		usage, err := s.monthlyUsage(userID, usagePeriod(time.Now()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return usage
+	}
+
+	call("/chat/send/image", http.StatusInternalServerError)
+	if got := usage(); got.Messages != 0 || got.MediaBytes != 0 {
+		t.Errorf("Expected a failed send to be given back, got %+v", got)
+	}
+	call("/media", http.StatusOK)
+	if got := usage(); got.Messages != 0 || got.MediaBytes != 600 {
+		t.Errorf("Expected a library upload to count its media, got %+v", got)
+	}
+	call("/chat/send/image", http.StatusOK)
+	if got := usage(); got.Messages != 0 || got.MediaBytes != 600 {
+		t.Errorf("Expected a send over the media quota to be given back, got %+v", got)
+	}
+}
+
+func TestSendAutomatedMessageQuota(t *testing.T) {
+	s := makeTestServer(t)
+	userID := "automatedquotauser"
+	t.Cleanup(func() { forgetUserLimits(userID) })
+	if _, err := s.db.Exec("INSERT INTO users (id, name, token, quota_messages) VALUES ($1, $2, $3, $4)", userID, "u", "", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.consumeUsage(userID, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Refused before reaching the (missing) WhatsApp client
+	mycli := &MyClient{userID: userID, s: s, db: s.db}
+	chat := types.NewJID("5511999999999", types.DefaultUserServer)
+	if _, err := mycli.sendAutomatedMessage(chat, &waE2E.Message{Conversation: proto.String("hi")}, "text", "hi"); !errors.Is(err, errMessageQuota) {
+		t.Errorf("Expected automated messages to count against the quota, got %v", err)
+	}
+}
+
+func TestKillChannelConcurrentSignals(t *testing.T) {
+	const userID = "killuser"
+	kill := openKillChannel(userID)
+	t.Cleanup(func() { closeKillChannel(userID, kill) })
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if !signalKill(userID) {
+				t.Error("Expected the running session to be signalled")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			closeKillChannel(userID, make(chan bool))
+		}()
+	}
+	wg.Wait()
+	if len(kill) != 1 {
+		t.Errorf("Expected one pending kill signal, got %d", len(kill))
+	}
+
+	closeKillChannel(userID, kill)
+	if signalKill(userID) {
+		t.Error("Expected no session after its channel was closed")
+	}
+}
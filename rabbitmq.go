@@ -186,6 +186,7 @@ func PublishToRabbit(data []byte, queueOverride ...string) error {
 	)
 	if err != nil {
 		log.Error().Err(err).Str("queue", queueName).Msg("Could not declare RabbitMQ queue")
+		metricRabbitErrors.Inc()
 		return err
 	}
 	err = rabbitChannel.Publish(
@@ -201,13 +202,14 @@ func PublishToRabbit(data []byte, queueOverride ...string) error {
 	)
 	if err != nil {
 		log.Error().Err(err).Str("queue", queueName).Msg("Could not publish to RabbitMQ")
+		metricRabbitErrors.Inc()
 	} else {
 		log.Debug().Str("queue", queueName).Msg("Published message to RabbitMQ")
 	}
 	return err
 }
 
-func sendToGlobalRabbit(jsonData []byte, token string, userID string, queueName ...string) {
+func sendToGlobalRabbit(jsonData []byte, userID string, queueName ...string) {
 	if !rabbitEnabled {
 		// Check if RabbitMQ is configured but disabled due to connection issues
 		rabbitURL := os.Getenv("RABBITMQ_URL")
@@ -234,7 +236,7 @@ func sendToGlobalRabbit(jsonData []byte, token string, userID string, queueName
 
 	// Extract instance information
 	instance_name := ""
-	userinfo, found := userinfocache.Get(token)
+	userinfo, found := userinfocache.Get(userID)
 	if found {
 		instance_name = userinfo.(Values).Get("Name")
 	}
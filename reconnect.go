@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Logged in sessions are kept connected by a supervisor: it reconnects with exponential backoff
+// and jitter, without a limit on attempts, and waits out temporary bans
+
+// How often the supervisor checks the connection when no event woke it up
+const supervisorCheckInterval = 30 * time.Second
+
+// ReconnectPolicy is how a user's session is reconnected, delays are in seconds
+type ReconnectPolicy struct {
+	Enabled  bool `json:"enabled" db:"reconnect_enabled"`
+	MinDelay int  `json:"min_delay_seconds" db:"reconnect_min_delay"`
+	MaxDelay int  `json:"max_delay_seconds" db:"reconnect_max_delay"`
+}
+
+var defaultReconnectPolicy = ReconnectPolicy{Enabled: true, MinDelay: 2, MaxDelay: 300}
+
+func (p *ReconnectPolicy) validate() error {
+	if p.MinDelay < 1 || p.MaxDelay < p.MinDelay || p.MaxDelay > 86400 {
+		return errors.New("delays must satisfy 1 <= min_delay_seconds <= max_delay_seconds <= 86400")
+	}
+	return nil
+}
+
+// Delay before an attempt (from 1): it doubles from the minimum up to the maximum and its second
+// half is random, so sessions dropped together don't all come back at once
+func (p *ReconnectPolicy) delay(attempt int) time.Duration {
+	maxDelay := time.Duration(p.MaxDelay) * time.Second
+	d := time.Duration(p.MinDelay) * time.Second
+	for i := 1; i < attempt && d < maxDelay; i++ {
+		d *= 2
+	}
+	d = min(d, maxDelay)
+	half := d / 2
+	return half + rand.N(d-half+1)
+}
+
+func (s *server) reconnectPolicy(userID string) (ReconnectPolicy, error) {
+	var policy ReconnectPolicy
+	err := s.db.Get(&policy, "SELECT reconnect_enabled, reconnect_min_delay, reconnect_max_delay FROM users WHERE id = $1", userID)
+	return policy, err
+}
+
+type sessionSupervisor struct {
+	mycli     *MyClient
+	policy    ReconnectPolicy
+	handlerID uint32
+	wake      chan struct{}
+	stop      chan struct{}
+	stopOnce  sync.Once
+
+	mu        sync.Mutex
+	downSince time.Time // Start of the current outage, zero while connected
+	attempts  int       // Reconnection attempts in the current outage
+	banUntil  time.Time
+	finished  bool // Session replaced or logged out, there is nothing to reconnect
+}
+
+// Supervisors by user id until they are stopped, so a disconnect reaches them while the session
+// is down or waiting out a ban
+var sessionSupervisors = struct {
+	sync.Mutex
+	byUser map[string]*sessionSupervisor
+}{byUser: make(map[string]*sessionSupervisor)}
+
+// Takes over reconnection from whatsmeow for the session, connecting it first when asked to
+func startSessionSupervisor(mycli *MyClient, policy ReconnectPolicy, connect bool) *sessionSupervisor {
+	sup := &sessionSupervisor{
+		mycli:  mycli,
+		policy: policy,
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+	}
+	mycli.WAClient.EnableAutoReconnect = false
+	sup.handlerID = mycli.WAClient.AddEventHandler(sup.handleEvent)
+	sessionSupervisors.Lock()
+	sessionSupervisors.byUser[mycli.userID] = sup
+	sessionSupervisors.Unlock()
+	go sup.run(connect)
+	return sup
+}
+
+func (sup *sessionSupervisor) Stop() {
+	if sup == nil {
+		return
+	}
+	sup.stopOnce.Do(func() {
+		close(sup.stop)
+		sup.mycli.WAClient.RemoveEventHandler(sup.handlerID)
+		sessionSupervisors.Lock()
+		if sessionSupervisors.byUser[sup.mycli.userID] == sup {
+			delete(sessionSupervisors.byUser, sup.mycli.userID)
+		}
+		sessionSupervisors.Unlock()
+	})
+}
+
+// Stops the user's supervisor, returns false when none was running
+func stopSessionSupervisor(userID string) bool {
+	sessionSupervisors.Lock()
+	sup := sessionSupervisors.byUser[userID]
+	sessionSupervisors.Unlock()
+	sup.Stop()
+	return sup != nil
+}
+
+func (sup *sessionSupervisor) notify() {
+	select {
+	case sup.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (sup *sessionSupervisor) markDown() {
+	sup.mu.Lock()
+	if sup.downSince.IsZero() {
+		sup.downSince = time.Now()
+	}
+	sup.mu.Unlock()
+}
+
+func (sup *sessionSupervisor) isFinished() bool {
+	sup.mu.Lock()
+	defer sup.mu.Unlock()
+	return sup.finished
+}
+
+func (sup *sessionSupervisor) sendEvent(eventType string, event map[string]interface{}) {
+	sendEventWithWebHook(sup.mycli, map[string]interface{}{"type": eventType, "event": event}, "")
+}
+
+func (sup *sessionSupervisor) handleEvent(rawEvt interface{}) {
+	switch evt := rawEvt.(type) {
+	case *events.Connected:
+		sup.mu.Lock()
+		downSince, attempts := sup.downSince, sup.attempts
+		sup.downSince, sup.attempts = time.Time{}, 0
+		sup.mu.Unlock()
+		if !downSince.IsZero() {
+			downtime := time.Since(downSince)
+			log.Info().Str("userid", sup.mycli.userID).Int("attempts", attempts).Dur("downtime", downtime).Msg("Session reconnected")
+			sup.sendEvent("Reconnected", map[string]interface{}{
+				"attempts":         attempts,
+				"downtime_seconds": int(downtime.Seconds()),
+			})
+		}
+	case *events.Disconnected, *events.ConnectFailure:
+		sup.markDown()
+		sup.notify()
+	case *events.KeepAliveTimeout:
+		// Same threshold whatsmeow uses to force a reconnection when it handles them itself
+		if time.Since(evt.LastSuccess) > whatsmeow.KeepAliveMaxFailTime {
+			log.Warn().Str("userid", sup.mycli.userID).Msg("Keepalive failing, forcing a reconnection")
+			go func() {
+				sup.mycli.WAClient.Disconnect()
+				sup.markDown()
+				sup.notify()
+			}()
+		}
+	case *events.TemporaryBan:
+		expire := evt.Expire
+		if expire <= 0 {
+			expire = time.Duration(sup.policy.MaxDelay) * time.Second
+		}
+		sup.mu.Lock()
+		sup.banUntil = time.Now().Add(expire)
+		sup.mu.Unlock()
+		log.Warn().Str("userid", sup.mycli.userID).Dur("expire", expire).Msg("Temporary ban, reconnecting after it expires")
+		sup.markDown()
+		sup.notify()
+	case *events.StreamReplaced, *events.LoggedOut:
+		sup.mu.Lock()
+		sup.finished = true
+		sup.mu.Unlock()
+	}
+}
+
+func (sup *sessionSupervisor) run(connect bool) {
+	ticker := time.NewTicker(supervisorCheckInterval)
+	defer ticker.Stop()
+
+	if connect {
+		sup.reconnect()
+	}
+	for {
+		select {
+		case <-sup.stop:
+			return
+		case <-sup.wake:
+		case <-ticker.C:
+		}
+		client := sup.mycli.WAClient
+		if sup.isFinished() || client.Store.ID == nil {
+			return
+		}
+		if !client.IsConnected() {
+			sup.markDown()
+			sup.reconnect()
+		}
+	}
+}
+
+// Connects until a connection is established or the supervisor stops, the Connected event
+// ends the outage
+func (sup *sessionSupervisor) reconnect() {
+	client := sup.mycli.WAClient
+	for {
+		var wait time.Duration
+		sup.mu.Lock()
+		if !sup.downSince.IsZero() {
+			sup.attempts++
+			wait = sup.policy.delay(sup.attempts)
+		}
+		attempt := sup.attempts
+		bannedUntil := sup.banUntil
+		sup.mu.Unlock()
+		if ban := time.Until(bannedUntil); ban > wait {
+			wait = ban
+		}
+
+		if attempt > 0 {
+			event := map[string]interface{}{
+				"attempt":       attempt,
+				"delay_seconds": int(wait.Round(time.Second).Seconds()),
+			}
+			if time.Now().Before(bannedUntil) {
+				event["banned_until"] = bannedUntil.UTC().Format(time.RFC3339)
+			}
+			log.Info().Str("userid", sup.mycli.userID).Int("attempt", attempt).Dur("delay", wait).Msg("Reconnecting session")
+			sup.sendEvent("Reconnecting", event)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-sup.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if sup.isFinished() {
+			return
+		}
+
+		err := client.Connect()
+		if err == nil || errors.Is(err, whatsmeow.ErrAlreadyConnected) {
+			return
+		}
+		log.Warn().Err(err).Str("userid", sup.mycli.userID).Int("attempt", attempt).Msg("Failed to connect to WhatsApp")
+		sup.markDown()
+	}
+}
+
+// Reconnection policy of the session
+func (s *server) GetReconnectPolicy() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		policy, err := s.reconnectPolicy(txtid)
+		if err != nil {
+			log.Error().Err(err).Str("userID", txtid).Msg("Failed to load reconnect policy")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to load reconnect policy"))
+			return
+		}
+		responseJson, err := json.Marshal(policy)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		s.Respond(w, r, http.StatusOK, string(responseJson))
+	}
+}
+
+// Changes the reconnection policy, fields left out keep their value. It applies from the next
+// connection of the session
+func (s *server) SetReconnectPolicy() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		policy, err := s.reconnectPolicy(txtid)
+		if err != nil {
+			log.Error().Err(err).Str("userID", txtid).Msg("Failed to load reconnect policy")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to load reconnect policy"))
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode payload"))
+			return
+		}
+		if err := policy.validate(); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		_, err = s.db.Exec("UPDATE users SET reconnect_enabled = $1, reconnect_min_delay = $2, reconnect_max_delay = $3 WHERE id = $4",
+			policy.Enabled, policy.MinDelay, policy.MaxDelay, txtid)
+		if err != nil {
+			log.Error().Err(err).Str("userID", txtid).Msg("Failed to save reconnect policy")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to save reconnect policy"))
+			return
+		}
+		responseJson, err := json.Marshal(policy)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		s.Respond(w, r, http.StatusOK, string(responseJson))
+	}
+}
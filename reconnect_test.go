@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+func TestReconnectPolicyDelay(t *testing.T) {
+	policy := ReconnectPolicy{Enabled: true, MinDelay: 2, MaxDelay: 60}
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{3, 8 * time.Second},
+		{6, 60 * time.Second},
+		{1000, 60 * time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 50; i++ {
+			if d := policy.delay(tt.attempt); d < tt.max/2 || d > tt.max {
+				t.Fatalf("attempt %d: delay %v outside [%v, %v]", tt.attempt, d, tt.max/2, tt.max)
+			}
+		}
+	}
+}
+
+func TestReconnectPolicyValidate(t *testing.T) {
+	valid := []ReconnectPolicy{defaultReconnectPolicy, {MinDelay: 1, MaxDelay: 1}, {MinDelay: 5, MaxDelay: 86400}}
+	for _, policy := range valid {
+		if err := policy.validate(); err != nil {
+			t.Errorf("%+v: %v", policy, err)
+		}
+	}
+	invalid := []ReconnectPolicy{{MinDelay: 0, MaxDelay: 10}, {MinDelay: 10, MaxDelay: 5}, {MinDelay: 1, MaxDelay: 86401}}
+	for _, policy := range invalid {
+		if err := policy.validate(); err == nil {
+			t.Errorf("%+v: expected an error", policy)
+		}
+	}
+}
+
+func TestSessionSupervisorEvents(t *testing.T) {
+	sup := &sessionSupervisor{mycli: &MyClient{userID: "u1"}, policy: defaultReconnectPolicy, wake: make(chan struct{}, 1)}
+
+	sup.handleEvent(&events.TemporaryBan{Expire: time.Hour})
+	select {
+	case <-sup.wake:
+	default:
+		t.Fatal("expected the supervisor to be woken up")
+	}
+	if sup.downSince.IsZero() || time.Until(sup.banUntil) < 59*time.Minute {
+		t.Errorf("ban not recorded: down since %v, banned until %v", sup.downSince, sup.banUntil)
+	}
+
+	sup.handleEvent(&events.Disconnected{})
+	sup.handleEvent(&events.Disconnected{})
+	if len(sup.wake) != 1 {
+		t.Errorf("expected one pending wake up, got %d", len(sup.wake))
+	}
+
+	sup.handleEvent(&events.StreamReplaced{})
+	if !sup.isFinished() {
+		t.Error("expected the supervisor to give up after the stream was replaced")
+	}
+}
+
+func TestStopSessionSupervisor(t *testing.T) {
+	mycli := &MyClient{userID: "supervised", WAClient: whatsmeow.NewClient(&store.Device{}, nil)}
+	sup := startSessionSupervisor(mycli, defaultReconnectPolicy, false)
+	replaced := startSessionSupervisor(&MyClient{userID: "supervised", WAClient: whatsmeow.NewClient(&store.Device{}, nil)}, defaultReconnectPolicy, false)
+
+	// Stopping a replaced supervisor leaves the current one registered
+	sup.Stop()
+	if !stopSessionSupervisor("supervised") {
+		t.Fatal("expected the running supervisor to be stopped")
+	}
+	select {
+	case <-replaced.stop:
+	default:
+		t.Error("expected the supervisor's stop channel to be closed")
+	}
+	if stopSessionSupervisor("supervised") {
+		t.Error("expected no supervisor after it was stopped")
+	}
+	if stopSessionSupervisor("unsupervised") {
+		t.Error("expected no supervisor for a user without one")
+	}
+}
@@ -48,18 +48,36 @@ func (s *server) routes() {
 	}
 
 	s.router.Handle("/health", s.GetHealth()).Methods("GET")
+	s.router.Handle("/metrics", s.GetMetrics()).Methods("GET")
 
 	adminRoutes := s.router.PathPrefix("/admin").Subrouter()
-	adminRoutes.Use(s.authadmin)
+	adminRoutes.Use(s.tracehttp, s.authadmin, s.auditadmin)
 	adminRoutes.Handle("/users", s.ListUsers()).Methods("GET")
 	adminRoutes.Handle("/users/{id}", s.ListUsers()).Methods("GET")
 	adminRoutes.Handle("/users", s.AddUser()).Methods("POST")
 	adminRoutes.Handle("/users/{id}", s.EditUser()).Methods("PUT")
 	adminRoutes.Handle("/users/{id}", s.DeleteUser()).Methods("DELETE")
 	adminRoutes.Handle("/users/{id}/full", s.DeleteUserComplete()).Methods("DELETE")
+	adminRoutes.Handle("/users/{id}/rotate-token", s.AdminRotateToken()).Methods("POST")
+	adminRoutes.Handle("/users/{id}/session-token", s.AdminSessionToken()).Methods("POST")
+	adminRoutes.Handle("/users/{id}/usage", s.GetUserUsage()).Methods("GET")
+	adminRoutes.Handle("/usage", s.ExportUsage()).Methods("GET")
+	adminRoutes.Handle("/s3/retention", s.GetS3Retention()).Methods("GET")
+	adminRoutes.Handle("/s3/retention/sweep", s.RunS3RetentionSweep()).Methods("POST")
+	adminRoutes.Handle("/me", s.GetAdminSelf()).Methods("GET")
+	adminRoutes.Handle("/admins", s.ListAdmins()).Methods("GET")
+	adminRoutes.Handle("/admins", s.AddAdmin()).Methods("POST")
+	adminRoutes.Handle("/admins/{id}", s.EditAdmin()).Methods("PUT")
+	adminRoutes.Handle("/admins/{id}", s.DeleteAdmin()).Methods("DELETE")
+	adminRoutes.Handle("/admins/{id}/rotate-token", s.RotateAdminToken()).Methods("POST")
+	adminRoutes.Handle("/audit", s.GetAdminAudit()).Methods("GET")
 
 	c := alice.New()
+	c = c.Append(s.tracehttp)
 	c = c.Append(s.authalice)
+	c = c.Append(s.authscope)
+	c = c.Append(s.authquota)
+	c = c.Append(s.meterapi)
 	c = c.Append(hlog.NewHandler(routerLog))
 
 	c = c.Append(hlog.AccessHandler(func(r *http.Request, status, size int, duration time.Duration) {
@@ -82,6 +100,9 @@ func (s *server) routes() {
 	s.router.Handle("/session/disconnect", c.Then(s.Disconnect())).Methods("POST")
 	s.router.Handle("/session/logout", c.Then(s.Logout())).Methods("POST")
 	s.router.Handle("/session/status", c.Then(s.GetStatus())).Methods("GET")
+	s.router.Handle("/session/diagnostics", c.Then(s.GetSessionDiagnostics())).Methods("GET")
+	s.router.Handle("/session/reconnect", c.Then(s.SetReconnectPolicy())).Methods("POST")
+	s.router.Handle("/session/reconnect", c.Then(s.GetReconnectPolicy())).Methods("GET")
 	s.router.Handle("/session/qr", c.Then(s.GetQR())).Methods("GET")
 	s.router.Handle("/session/pairphone", c.Then(s.PairPhone())).Methods("POST")
 	s.router.Handle("/session/history", c.Then(s.RequestHistorySync())).Methods("GET")
@@ -98,20 +119,62 @@ func (s *server) routes() {
 	s.router.Handle("/session/s3/config", c.Then(s.GetS3Config())).Methods("GET")
 	s.router.Handle("/session/s3/config", c.Then(s.DeleteS3Config())).Methods("DELETE")
 	s.router.Handle("/session/s3/test", c.Then(s.TestS3Connection())).Methods("POST")
+	s.router.Handle("/session/s3/migrate-keys", c.Then(s.MigrateS3Keys())).Methods("POST")
+	s.router.Handle("/session/s3/migrate-keys", c.Then(s.GetS3KeyMigration())).Methods("GET")
 
 	s.router.Handle("/session/hmac/config", c.Then(s.ConfigureHmac())).Methods("POST")
+	s.router.Handle("/session/token/rotate", c.Then(s.RotateToken())).Methods("POST")
 	s.router.Handle("/session/hmac/config", c.Then(s.GetHmacConfig())).Methods("GET")
 	s.router.Handle("/session/hmac/config", c.Then(s.DeleteHmacConfig())).Methods("DELETE")
 
+	s.router.Handle("/session/connectors", c.Then(s.SetConnector())).Methods("POST")
+	s.router.Handle("/session/connectors", c.Then(s.GetConnectors())).Methods("GET")
+	s.router.Handle("/session/connectors/{type}", c.Then(s.DeleteConnector())).Methods("DELETE")
+	s.router.Handle("/connectors/{type}/webhook", c.Then(s.ConnectorWebhook())).Methods("POST")
+
+	s.router.Handle("/flows", c.Then(s.SaveFlow())).Methods("POST")
+	s.router.Handle("/flows", c.Then(s.ListFlows())).Methods("GET")
+	s.router.Handle("/flows/sessions", c.Then(s.GetFlowSessions())).Methods("GET")
+	s.router.Handle("/flows/sessions", c.Then(s.DeleteFlowSession())).Methods("DELETE")
+	s.router.Handle("/flows/{id}", c.Then(s.GetFlow())).Methods("GET")
+	s.router.Handle("/flows/{id}", c.Then(s.DeleteFlow())).Methods("DELETE")
+	s.router.Handle("/flows/{id}/enable", c.Then(s.SetFlowEnabled(true))).Methods("POST")
+	s.router.Handle("/flows/{id}/disable", c.Then(s.SetFlowEnabled(false))).Methods("POST")
+
+	s.router.Handle("/autoreply", c.Then(s.SaveAutoReplyRule())).Methods("POST")
+	s.router.Handle("/autoreply", c.Then(s.ListAutoReplyRules())).Methods("GET")
+	s.router.Handle("/autoreply/schedule", c.Then(s.SetAutoReplySchedule())).Methods("POST")
+	s.router.Handle("/autoreply/schedule", c.Then(s.GetAutoReplySchedule())).Methods("GET")
+	s.router.Handle("/autoreply/{id}", c.Then(s.GetAutoReplyRule())).Methods("GET")
+	s.router.Handle("/autoreply/{id}", c.Then(s.DeleteAutoReplyRule())).Methods("DELETE")
+
+	s.router.Handle("/session/ai", c.Then(s.SetAIAgent())).Methods("POST")
+	s.router.Handle("/session/ai", c.Then(s.GetAIAgent())).Methods("GET")
+	s.router.Handle("/session/ai", c.Then(s.DeleteAIAgent())).Methods("DELETE")
+	s.router.Handle("/session/ai/handoffs", c.Then(s.GetAIHandoffs())).Methods("GET")
+	s.router.Handle("/session/ai/handoffs", c.Then(s.DeleteAIHandoff())).Methods("DELETE")
+
+	s.router.Handle("/apikeys", c.Then(s.CreateAPIKey())).Methods("POST")
+	s.router.Handle("/apikeys", c.Then(s.ListAPIKeys())).Methods("GET")
+	s.router.Handle("/apikeys/{id}", c.Then(s.DeleteAPIKey())).Methods("DELETE")
+
+	s.router.Handle("/media/local/{key:.+}", s.ServeLocalMedia()).Methods("GET").Queries("sig", "{sig}")
+	s.router.Handle("/media/local/{key:.+}", c.Then(s.GetLocalMedia())).Methods("GET")
+	s.router.Handle("/media/s3/{key:.+}", c.Then(s.GetS3Media())).Methods("GET")
+	s.router.Handle("/media", c.Then(s.UploadLibraryMedia())).Methods("POST")
+	s.router.Handle("/media", c.Then(s.ListLibraryMedia())).Methods("GET")
+	s.router.Handle("/media/{id}", c.Then(s.GetLibraryMedia())).Methods("GET")
+	s.router.Handle("/media/{id}", c.Then(s.DeleteLibraryMedia())).Methods("DELETE")
+
 	// =================================================================
 	// ROTAS CHATWOOT (WEBHOOK + CONFIGURAÇÃO DINÂMICA)
 	// =================================================================
 	// Configurar via API (POST) e Consultar (GET)
-	s.router.Handle("/chatwoot/config", s.HandleSetChatwootConfig()).Methods("POST")
-	s.router.Handle("/chatwoot/config", s.HandleGetChatwootConfig()).Methods("GET")
+	s.router.Handle("/chatwoot/config", s.authadmin(s.auditadmin(s.HandleSetChatwootConfig()))).Methods("POST")
+	s.router.Handle("/chatwoot/config", s.authadmin(s.HandleGetChatwootConfig())).Methods("GET")
 
 	// Rota para CRIAR CAIXA AUTOMATICAMENTE (NOVO)
-	s.router.Handle("/chatwoot/auto-create", s.HandleAutoCreateInbox()).Methods("POST")
+	s.router.Handle("/chatwoot/auto-create", s.authadmin(s.auditadmin(s.HandleAutoCreateInbox()))).Methods("POST")
 	
 	// Receber mensagens do Chatwoot
 	s.router.HandleFunc("/chatwoot/webhook", s.HandleChatwootWebhook()).Methods("POST")
@@ -154,6 +217,7 @@ func (s *server) routes() {
 	s.router.Handle("/chat/downloadaudio", c.Then(s.DownloadAudio())).Methods("POST")
 	s.router.Handle("/chat/downloaddocument", c.Then(s.DownloadDocument())).Methods("POST")
 	s.router.Handle("/chat/downloadsticker", c.Then(s.DownloadSticker())).Methods("POST")
+	s.router.Handle("/chat/media/{messageId}", c.Then(s.GetChatMedia())).Methods("GET")
 
 	s.router.Handle("/group/create", c.Then(s.CreateGroup())).Methods("POST")
 	s.router.Handle("/group/list", c.Then(s.ListGroups())).Methods("GET")
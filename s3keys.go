@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/rs/zerolog/log"
+)
+
+// Object keys are always "users/" followed by the rendered template, so retention rules,
+// presigned access checks and user removal can rely on the users/<id>/ prefix
+const defaultS3KeyTemplate = "{user}/{direction}/{chat}/{yyyy}/{mm}/{dd}/{type}/{msgid}{ext}"
+
+var s3KeyPlaceholder = regexp.MustCompile(`\{[a-z]+\}`)
+
+var s3KeyPlaceholders = map[string]bool{
+	"{user}": true, "{direction}": true, "{chat}": true, "{yyyy}": true, "{mm}": true,
+	"{dd}": true, "{type}": true, "{msgid}": true, "{ext}": true,
+}
+
+// Preferred extensions where the system MIME table lists several (image/jpeg has .jfif first)
+var preferredExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"audio/ogg":  ".ogg",
+	"audio/mpeg": ".mp3",
+	"audio/mp4":  ".m4a",
+	"video/mp4":  ".mp4",
+	"video/3gpp": ".3gp",
+	"text/plain": ".txt",
+}
+
+// Values that fill a key template
+type s3KeyFields struct {
+	UserID     string
+	Incoming   bool
+	ContactJID string
+	MessageID  string
+	MimeType   string
+	Time       time.Time
+	Extension  string // Overrides the extension derived from MimeType
+}
+
+func validateS3KeyTemplate(template string) error {
+	if !strings.HasPrefix(template, "{user}/") {
+		return errors.New("key template must start with {user}/")
+	}
+	if !strings.Contains(template, "{msgid}") {
+		return errors.New("key template must contain {msgid}")
+	}
+	if strings.Contains(template, "..") || strings.Contains(template, "//") || strings.HasPrefix(template, "/") {
+		return errors.New("key template can't contain empty or relative path segments")
+	}
+	for _, placeholder := range s3KeyPlaceholder.FindAllString(template, -1) {
+		if !s3KeyPlaceholders[placeholder] {
+			return fmt.Errorf("unknown placeholder %s in key template", placeholder)
+		}
+	}
+	return nil
+}
+
+// Folder name for the {type} placeholder
+func mediaTypeFolder(mimeType string) string {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return "images"
+	case strings.HasPrefix(mimeType, "video/"):
+		return "videos"
+	case strings.HasPrefix(mimeType, "audio/"):
+		return "audio"
+	}
+	return "documents"
+}
+
+func mediaFileExtension(mimeType string) string {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return ".bin"
+	}
+	if ext, ok := preferredExtensions[mediaType]; ok {
+		return ext
+	}
+	exts, _ := mime.ExtensionsByType(mediaType)
+	if len(exts) == 0 {
+		return ".bin"
+	}
+	// Prefer the extension named after the subtype (.pdf, .webp, .docx) when listed
+	if slash := strings.Index(mediaType, "/"); slash >= 0 {
+		for _, ext := range exts {
+			if ext == "."+mediaType[slash+1:] {
+				return ext
+			}
+		}
+	}
+	return exts[0]
+}
+
+func renderS3Key(template string, fields s3KeyFields) string {
+	if template == "" {
+		template = defaultS3KeyTemplate
+	}
+
+	direction := "outbox"
+	if fields.Incoming {
+		direction = "inbox"
+	}
+	chat := strings.NewReplacer("@", "_", ":", "_", "/", "_").Replace(fields.ContactJID)
+	ext := fields.Extension
+	if ext == "" {
+		ext = mediaFileExtension(fields.MimeType)
+	}
+
+	key := strings.NewReplacer(
+		"{user}", fields.UserID,
+		"{direction}", direction,
+		"{chat}", chat,
+		"{yyyy}", fields.Time.Format("2006"),
+		"{mm}", fields.Time.Format("01"),
+		"{dd}", fields.Time.Format("02"),
+		"{type}", mediaTypeFolder(fields.MimeType),
+		"{msgid}", strings.ReplaceAll(fields.MessageID, "/", "_"),
+		"{ext}", ext,
+	).Replace(template)
+	return "users/" + key
+}
+
+// Old layout: users/<id>/<direction>/<chat>/<year>/<month>/<day>/<type>/<msgid><ext>. The date
+// segments were written with broken layouts, so the object's modification time replaces them.
+// Keys of the default template share the shape, only the broken date segments tell them apart.
+func parseLegacyS3Key(userID, key string, modified time.Time) (s3KeyFields, bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 9 || parts[0] != "users" || parts[1] != userID {
+		return s3KeyFields{}, false
+	}
+	if parts[2] != "inbox" && parts[2] != "outbox" {
+		return s3KeyFields{}, false
+	}
+	if !isLegacyS3DatePath(parts[4], parts[5], parts[6], modified) {
+		return s3KeyFields{}, false
+	}
+
+	// The folder only tells the media class, the object keeps the extension it was stored with
+	fileName := parts[8]
+	ext := path.Ext(fileName)
+	fields := s3KeyFields{
+		UserID:     userID,
+		Incoming:   parts[2] == "inbox",
+		ContactJID: parts[3],
+		MessageID:  strings.TrimSuffix(fileName, ext),
+		Time:       modified.Local(),
+		Extension:  ext,
+	}
+	switch parts[7] {
+	case "images":
+		fields.MimeType = "image/"
+	case "videos":
+		fields.MimeType = "video/"
+	case "audio":
+		fields.MimeType = "audio/"
+	case "documents":
+		fields.MimeType = "application/"
+	default:
+		return s3KeyFields{}, false
+	}
+	return fields, fields.MessageID != "" && ext != ""
+}
+
+// The old layouts "2025", "05" and "25" rendered as day+zero padded day+second, zero padded
+// second and day+second. A real date only matches them by chance (2026/06/26 reads as day 2,
+// second 6), so the day must also be the one the object was written on.
+func isLegacyS3DatePath(year, month, day string, modified time.Time) bool {
+	second, err := strconv.Atoi(month)
+	if err != nil || len(month) != 2 || second > 59 {
+		return false
+	}
+	local := modified.Local()
+	// The key was rendered just before the upload finished, possibly on the previous day
+	for _, written := range []time.Time{local, local.Add(-time.Hour)} {
+		d := written.Day()
+		if year == fmt.Sprintf("%d%02d%d", d, d, second) && day == fmt.Sprintf("%d%d", d, second) {
+			return true
+		}
+	}
+	return false
+}
+
+// S3KeyMigration reports the outcome of renaming a user's objects to the current key template
+type S3KeyMigration struct {
+	DryRun  bool              `json:"dry_run"`
+	Scanned int               `json:"scanned"`
+	Renamed map[string]string `json:"renamed"`
+	Skipped int               `json:"skipped"`
+	// Message history links pointing to renamed objects, rewritten unless it is a dry run
+	HistoryLinks int      `json:"history_links"`
+	Errors       []string `json:"errors,omitempty"`
+}
+
+// Key migrations run in the background, the last one of each user is kept for the status endpoint
+type s3KeyMigrationJob struct {
+	Status     string          `json:"status"` // running, finished or failed
+	DryRun     bool            `json:"dry_run"`
+	StartedAt  time.Time       `json:"started_at"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+	Result     *S3KeyMigration `json:"result,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+const s3KeyMigrationTimeout = 6 * time.Hour
+
+var (
+	s3KeyMigrationJobs   = map[string]*s3KeyMigrationJob{}
+	s3KeyMigrationJobsMu sync.Mutex
+)
+
+// Escapes a key for the x-amz-copy-source header, keeping the slashes
+func copySourcePath(bucket, key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return bucket + "/" + strings.Join(segments, "/")
+}
+
+// MigrateKeys renames objects written with the old key layout to the user's key template
+func (m *S3Manager) MigrateKeys(ctx context.Context, userID string, dryRun bool) (*S3KeyMigration, error) {
+	client, config, ok := m.GetClient(userID)
+	if !ok {
+		return nil, fmt.Errorf("S3 client not initialized for user %s", userID)
+	}
+
+	result := &S3KeyMigration{DryRun: dryRun, Renamed: map[string]string{}}
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(config.Bucket),
+		Prefix: aws.String(fmt.Sprintf("users/%s/", userID)),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return result, fmt.Errorf("failed to list objects for user %s: %w", userID, err)
+		}
+		for _, obj := range page.Contents {
+			result.Scanned++
+			oldKey := aws.ToString(obj.Key)
+			fields, ok := parseLegacyS3Key(userID, oldKey, aws.ToTime(obj.LastModified))
+			if !ok {
+				result.Skipped++
+				continue
+			}
+
+			newKey := renderS3Key(config.KeyTemplate, fields)
+			if newKey == oldKey {
+				result.Skipped++
+				continue
+			}
+			if dryRun {
+				result.Renamed[oldKey] = newKey
+				continue
+			}
+
+			if err := m.renameObject(ctx, client, config, oldKey, newKey); err != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", oldKey, err))
+				continue
+			}
+			result.Renamed[oldKey] = newKey
+		}
+	}
+
+	log.Info().Str("userID", userID).Int("renamed", len(result.Renamed)).Bool("dryRun", dryRun).Msg("S3 key migration finished")
+	return result, nil
+}
+
+func (m *S3Manager) renameObject(ctx context.Context, client *s3.Client, config *S3Config, oldKey, newKey string) error {
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(config.Bucket),
+		Key:        aws.String(newKey),
+		CopySource: aws.String(copySourcePath(config.Bucket, oldKey)),
+	}
+	// ACLs are not copied with the object
+	if !config.Presigned() {
+		input.ACL = types.ObjectCannedACLPublicRead
+	}
+	if _, err := client.CopyObject(ctx, input); err != nil {
+		return fmt.Errorf("copy failed: %w", err)
+	}
+	if _, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(config.Bucket),
+		Key:    aws.String(oldKey),
+	}); err != nil {
+		return fmt.Errorf("delete of the old key failed: %w", err)
+	}
+	return nil
+}
+
+// Points the message history links of renamed objects to their new keys. Public and
+// /media/s3/ links contain the key as is. Returns the number of links found.
+func (s *server) migrateMediaLinks(userID string, renamed map[string]string, dryRun bool) (int, error) {
+	total := 0
+	for oldKey, newKey := range renamed {
+		pattern := "%" + oldKey + "%"
+		var count int64
+		if dryRun {
+			if err := s.db.Get(&count, "SELECT COUNT(*) FROM message_history WHERE user_id = $1 AND media_link LIKE $2", userID, pattern); err != nil {
+				return total, err
+			}
+		} else {
+			result, err := s.db.Exec("UPDATE message_history SET media_link = REPLACE(media_link, $1, $2) WHERE user_id = $3 AND media_link LIKE $4",
+				oldKey, newKey, userID, pattern)
+			if err != nil {
+				return total, err
+			}
+			if count, err = result.RowsAffected(); err != nil {
+				return total, err
+			}
+		}
+		total += int(count)
+	}
+	return total, nil
+}
+
+func (s *server) runS3KeyMigration(userID string, job *s3KeyMigrationJob) {
+	ctx, cancel := context.WithTimeout(context.Background(), s3KeyMigrationTimeout)
+	defer cancel()
+
+	result, err := GetS3Manager().MigrateKeys(ctx, userID, job.DryRun)
+	// Objects renamed before a failure still need their links updated
+	if result != nil {
+		links, linkErr := s.migrateMediaLinks(userID, result.Renamed, job.DryRun)
+		result.HistoryLinks = links
+		if linkErr != nil && err == nil {
+			err = fmt.Errorf("objects renamed but history links could not be updated: %w", linkErr)
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Str("userID", userID).Msg("S3 key migration failed")
+	}
+
+	s3KeyMigrationJobsMu.Lock()
+	defer s3KeyMigrationJobsMu.Unlock()
+	now := time.Now()
+	job.FinishedAt = &now
+	job.Result = result
+	job.Status = "finished"
+	if err != nil {
+		job.Status = "failed"
+		job.Error = err.Error()
+	}
+}
+
+func s3KeyMigrationStatus(userID string) ([]byte, bool) {
+	s3KeyMigrationJobsMu.Lock()
+	defer s3KeyMigrationJobsMu.Unlock()
+	job, ok := s3KeyMigrationJobs[userID]
+	if !ok {
+		return nil, false
+	}
+	responseJson, _ := json.Marshal(job)
+	return responseJson, true
+}
+
+// Starts renaming the user's objects from the old key layout to the configured key template.
+// Large buckets take longer than a request may last, progress is read from the status endpoint.
+func (s *server) MigrateS3Keys() http.HandlerFunc {
+	type migrateKeysStruct struct {
+		DryRun bool `json:"dry_run"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		var t migrateKeysStruct
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode payload"))
+				return
+			}
+		}
+
+		if _, _, ok := GetS3Manager().GetClient(txtid); !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("S3 is not enabled for this user"))
+			return
+		}
+
+		s3KeyMigrationJobsMu.Lock()
+		if job, ok := s3KeyMigrationJobs[txtid]; ok && job.Status == "running" {
+			s3KeyMigrationJobsMu.Unlock()
+			s.Respond(w, r, http.StatusConflict, errors.New("a key migration is already running"))
+			return
+		}
+		job := &s3KeyMigrationJob{Status: "running", DryRun: t.DryRun, StartedAt: time.Now()}
+		s3KeyMigrationJobs[txtid] = job
+		s3KeyMigrationJobsMu.Unlock()
+
+		go s.runS3KeyMigration(txtid, job)
+
+		responseJson, _ := s3KeyMigrationStatus(txtid)
+		s.Respond(w, r, http.StatusAccepted, string(responseJson))
+	}
+}
+
+// Status and result of the user's last key migration
+func (s *server) GetS3KeyMigration() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		responseJson, ok := s3KeyMigrationStatus(txtid)
+		if !ok {
+			s.Respond(w, r, http.StatusNotFound, errors.New("no key migration was started"))
+			return
+		}
+		s.Respond(w, r, http.StatusOK, string(responseJson))
+	}
+}
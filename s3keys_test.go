@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRenderS3Key(t *testing.T) {
+	fields := s3KeyFields{
+		UserID:     "abc123",
+		Incoming:   true,
+		ContactJID: "5491155553934@s.whatsapp.net",
+		MessageID:  "3EB06F9067F80BAB89FF",
+		MimeType:   "image/jpeg",
+		Time:       time.Date(2024, 12, 5, 10, 30, 45, 0, time.Local),
+	}
+
+	got := renderS3Key("", fields)
+	want := "users/abc123/inbox/5491155553934_s.whatsapp.net/2024/12/05/images/3EB06F9067F80BAB89FF.jpg"
+	if got != want {
+		t.Errorf("default template: got %q, want %q", got, want)
+	}
+
+	fields.Incoming = false
+	fields.MimeType = "application/pdf"
+	got = renderS3Key("{user}/{yyyy}-{mm}/{type}/{msgid}{ext}", fields)
+	want = "users/abc123/2024-12/documents/3EB06F9067F80BAB89FF.pdf"
+	if got != want {
+		t.Errorf("custom template: got %q, want %q", got, want)
+	}
+}
+
+func TestMediaFileExtension(t *testing.T) {
+	tests := map[string]string{
+		"image/jpeg":             ".jpg",
+		"image/png":              ".png",
+		"audio/ogg; codecs=opus": ".ogg",
+		"application/pdf":        ".pdf",
+		"application/x-unknown":  ".bin",
+		"":                       ".bin",
+	}
+	for mimeType, want := range tests {
+		if got := mediaFileExtension(mimeType); got != want {
+			t.Errorf("mediaFileExtension(%q) = %q, want %q", mimeType, got, want)
+		}
+	}
+}
+
+func TestValidateS3KeyTemplate(t *testing.T) {
+	valid := []string{defaultS3KeyTemplate, "{user}/{msgid}{ext}"}
+	for _, template := range valid {
+		if err := validateS3KeyTemplate(template); err != nil {
+			t.Errorf("%q: unexpected error %v", template, err)
+		}
+	}
+
+	invalid := []string{
+		"{direction}/{user}/{msgid}",
+		"{user}/{type}",
+		"{user}/../{msgid}",
+		"{user}//{msgid}",
+		"{user}/{month}/{msgid}",
+	}
+	for _, template := range invalid {
+		if err := validateS3KeyTemplate(template); err == nil {
+			t.Errorf("%q: expected an error", template)
+		}
+	}
+}
+
+func TestParseLegacyS3Key(t *testing.T) {
+	// Written on the 9th at second 45
+	modified := time.Date(2024, 3, 9, 12, 0, 45, 0, time.Local)
+	key := "users/abc123/outbox/5491155553934_s.whatsapp.net/90945/45/945/audio/3EB0AAAA.ogg"
+
+	fields, ok := parseLegacyS3Key("abc123", key, modified)
+	if !ok {
+		t.Fatal("expected the legacy key to parse")
+	}
+	if fields.Incoming || fields.MessageID != "3EB0AAAA" || fields.Extension != ".ogg" {
+		t.Errorf("unexpected fields %+v", fields)
+	}
+
+	got := renderS3Key("", fields)
+	want := "users/abc123/outbox/5491155553934_s.whatsapp.net/" + modified.Local().Format("2006/01/02") + "/audio/3EB0AAAA.ogg"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	for _, other := range []string{
+		"users/other/outbox/chat/90945/45/945/audio/3EB0AAAA.ogg",
+		"users/abc123/library/file.pdf",
+		"users/abc123/outbox/chat/90945/45/945/misc/3EB0AAAA.ogg",
+		// Already migrated, also when the date reads like the old layout
+		"users/abc123/outbox/chat/2024/03/09/audio/3EB0AAAA.ogg",
+		"users/abc123/outbox/chat/2026/06/26/audio/3EB0AAAA.ogg",
+	} {
+		if _, ok := parseLegacyS3Key("abc123", other, modified); ok {
+			t.Errorf("%q should not parse as a legacy key", other)
+		}
+	}
+	current := "users/abc123/outbox/chat/2026/06/26/audio/3EB0AAAA.ogg"
+	if _, ok := parseLegacyS3Key("abc123", current, time.Date(2026, 6, 26, 12, 0, 6, 0, time.Local)); ok {
+		t.Errorf("%q should not be migrated again", current)
+	}
+}
+
+func TestMigrateMediaLinks(t *testing.T) {
+	s := makeTestServer(t)
+	oldKey := "users/abc123/inbox/chat/90945/45/945/images/MSG1.jpg"
+	newKey := "users/abc123/inbox/chat/2024/03/09/images/MSG1.jpg"
+	for i, row := range []struct{ user, link string }{
+		{"abc123", "http://localhost:8080/media/s3/" + oldKey},
+		{"abc123", "https://bucket.s3.amazonaws.com/users/abc123/inbox/chat/2024/03/08/images/OTHER.jpg"},
+		{"other", "http://localhost:8080/media/s3/" + oldKey},
+	} {
+		if _, err := s.db.Exec("INSERT INTO message_history (user_id, chat_jid, sender_jid, message_id, timestamp, message_type, text_content, media_link) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+			row.user, "chat", "me", fmt.Sprintf("m%d", i), time.Now(), "image", "", row.link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	renamed := map[string]string{oldKey: newKey}
+	if count, err := s.migrateMediaLinks("abc123", renamed, true); err != nil || count != 1 {
+		t.Fatalf("dry run: expected 1 link, got %d (%v)", count, err)
+	}
+	if count, err := s.migrateMediaLinks("abc123", renamed, false); err != nil || count != 1 {
+		t.Fatalf("expected 1 link updated, got %d (%v)", count, err)
+	}
+
+	var links []string
+	if err := s.db.Select(&links, "SELECT media_link FROM message_history ORDER BY message_id"); err != nil {
+		t.Fatal(err)
+	}
+	if links[0] != "http://localhost:8080/media/s3/"+newKey || links[2] != "http://localhost:8080/media/s3/"+oldKey {
+		t.Errorf("unexpected links %v", links)
+	}
+}
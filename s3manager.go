@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"strings"
 	"sync"
 	"time"
@@ -27,6 +28,24 @@ type S3Config struct {
 	PublicURL     string
 	MediaDelivery string
 	RetentionDays int
+	URLMode       string // "public" or "presigned" for private buckets
+	PresignTTL    int    // Seconds a presigned URL stays valid
+	KeyTemplate   string // Object key layout after "users/", see defaultS3KeyTemplate
+}
+
+// Default lifetime of presigned URLs, in seconds
+const defaultS3PresignTTL = 3600
+
+// Presigned mode keeps the bucket private and hands out time-limited URLs
+func (c *S3Config) Presigned() bool {
+	return c.URLMode == "presigned"
+}
+
+func (c *S3Config) presignTTL() time.Duration {
+	if c.PresignTTL <= 0 {
+		return defaultS3PresignTTL * time.Second
+	}
+	return time.Duration(c.PresignTTL) * time.Second
 }
 
 // S3Manager manages S3 operations
@@ -102,6 +121,7 @@ func (m *S3Manager) RemoveClient(userID string) {
 
 	delete(m.clients, userID)
 	delete(m.configs, userID)
+	m.removeRetentionStatus(userID)
 }
 
 // GetClient returns S3 client for a user
@@ -115,81 +135,25 @@ func (m *S3Manager) GetClient(userID string) (*s3.Client, *S3Config, bool) {
 	return client, config, clientOk && configOk
 }
 
-// GenerateS3Key generates S3 object key based on message metadata
+// GenerateS3Key generates S3 object key from the user's key template and message metadata
 func (m *S3Manager) GenerateS3Key(userID, contactJID, messageID string, mimeType string, isIncoming bool) string {
-	// Determine direction
-	direction := "outbox"
-	if isIncoming {
-		direction = "inbox"
-	}
-
-	// Clean contact JID
-	contactJID = strings.ReplaceAll(contactJID, "@", "_")
-	contactJID = strings.ReplaceAll(contactJID, ":", "_")
-
-	// Get current time
-	now := time.Now()
-	year := now.Format("2025")
-	month := now.Format("05")
-	day := now.Format("25")
-
-	// Determine media type folder
-	mediaType := "documents"
-	if strings.HasPrefix(mimeType, "image/") {
-		mediaType = "images"
-	} else if strings.HasPrefix(mimeType, "video/") {
-		mediaType = "videos"
-	} else if strings.HasPrefix(mimeType, "audio/") {
-		mediaType = "audio"
+	template := defaultS3KeyTemplate
+	if _, config, ok := m.GetClient(userID); ok && config.KeyTemplate != "" {
+		template = config.KeyTemplate
 	}
 
-	// Get file extension
-	ext := ".bin"
-	switch {
-	case strings.Contains(mimeType, "jpeg"), strings.Contains(mimeType, "jpg"):
-		ext = ".jpg"
-	case strings.Contains(mimeType, "png"):
-		ext = ".png"
-	case strings.Contains(mimeType, "gif"):
-		ext = ".gif"
-	case strings.Contains(mimeType, "webp"):
-		ext = ".webp"
-	case strings.Contains(mimeType, "mp4"):
-		ext = ".mp4"
-	case strings.Contains(mimeType, "webm"):
-		ext = ".webm"
-	case strings.Contains(mimeType, "ogg"):
-		ext = ".ogg"
-	case strings.Contains(mimeType, "opus"):
-		ext = ".opus"
-	case strings.Contains(mimeType, "pdf"):
-		ext = ".pdf"
-	case strings.Contains(mimeType, "doc"):
-		if strings.Contains(mimeType, "docx") {
-			ext = ".docx"
-		} else {
-			ext = ".doc"
-		}
-	}
-
-	// Build S3 key
-	key := fmt.Sprintf("users/%s/%s/%s/%s/%s/%s/%s/%s%s",
-		userID,
-		direction,
-		contactJID,
-		year,
-		month,
-		day,
-		mediaType,
-		messageID,
-		ext,
-	)
-
-	return key
+	return renderS3Key(template, s3KeyFields{
+		UserID:     userID,
+		Incoming:   isIncoming,
+		ContactJID: contactJID,
+		MessageID:  messageID,
+		MimeType:   mimeType,
+		Time:       time.Now(),
+	})
 }
 
 // UploadToS3 uploads file to S3 and returns the key
-func (m *S3Manager) UploadToS3(ctx context.Context, userID string, key string, data []byte, mimeType string) error {
+func (m *S3Manager) UploadToS3(ctx context.Context, userID string, key string, body io.Reader, size int64, mimeType string) error {
 	client, config, ok := m.GetClient(userID)
 	if !ok {
 		return fmt.Errorf("S3 client not initialized for user %s", userID)
@@ -209,12 +173,19 @@ func (m *S3Manager) UploadToS3(ctx context.Context, userID string, key string, d
 	}
 
 	input := &s3.PutObjectInput{
-		Bucket:       aws.String(config.Bucket),
-		Key:          aws.String(key),
-		Body:         bytes.NewReader(data),
-		ContentType:  aws.String(contentType),
-		CacheControl: aws.String("public, max-age=3600"),
-		ACL:          types.ObjectCannedACLPublicRead,
+		Bucket:        aws.String(config.Bucket),
+		Key:           aws.String(key),
+		Body:          body,
+		ContentLength: aws.Int64(size),
+		ContentType:   aws.String(contentType),
+		CacheControl:  aws.String("public, max-age=3600"),
+		ACL:           types.ObjectCannedACLPublicRead,
+	}
+
+	// Private buckets reject public ACLs, objects are reached through presigned URLs
+	if config.Presigned() {
+		input.ACL = ""
+		input.CacheControl = aws.String("private, max-age=3600")
 	}
 
 	if expires != nil {
@@ -226,10 +197,21 @@ func (m *S3Manager) UploadToS3(ctx context.Context, userID string, key string, d
 		input.ContentDisposition = aws.String("inline")
 	}
 
+	ctx, sp := startSpan(ctx, "s3.PutObject", spanKindClient)
+	sp.SetAttr("aws.s3.bucket", config.Bucket)
+	sp.SetAttr("aws.s3.key", key)
+	sp.SetAttr("aws.s3.bytes", size)
+	defer sp.End()
+
+	started := time.Now()
 	_, err := client.PutObject(ctx, input)
 	if err != nil {
+		observeSince(metricS3UploadDuration.WithLabelValues("failure"), started)
+		sp.SetError(err)
 		return fmt.Errorf("failed to upload to S3: %w", err)
 	}
+	observeSince(metricS3UploadDuration.WithLabelValues("success"), started)
+	metricS3UploadBytes.Add(float64(size))
 
 	return nil
 }
@@ -268,6 +250,42 @@ func (m *S3Manager) GetPublicURL(userID, key string) string {
 	return fmt.Sprintf("https://%s.%s/%s", config.Bucket, endpoint, key)
 }
 
+// PresignURL returns a time-limited GET URL for an object in a private bucket
+func (m *S3Manager) PresignURL(ctx context.Context, userID, key string) (string, error) {
+	client, config, ok := m.GetClient(userID)
+	if !ok {
+		return "", fmt.Errorf("S3 client not initialized for user %s", userID)
+	}
+
+	presigner := s3.NewPresignClient(client)
+	req, err := presigner.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(config.Bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(config.presignTTL()))
+	if err != nil {
+		return "", fmt.Errorf("failed to presign S3 URL: %w", err)
+	}
+	return req.URL, nil
+}
+
+// GetObjectURL returns the URL handed to consumers: presigned or public depending on the URL mode
+func (m *S3Manager) GetObjectURL(ctx context.Context, userID, key string) string {
+	_, config, ok := m.GetClient(userID)
+	if !ok {
+		return ""
+	}
+	if !config.Presigned() {
+		return m.GetPublicURL(userID, key)
+	}
+
+	url, err := m.PresignURL(ctx, userID, key)
+	if err != nil {
+		log.Error().Err(err).Str("userID", userID).Str("key", key).Msg("Failed to presign S3 URL")
+		return ""
+	}
+	return url
+}
+
 // TestConnection tests S3 connection
 func (m *S3Manager) TestConnection(ctx context.Context, userID string) error {
 	client, config, ok := m.GetClient(userID)
@@ -293,13 +311,13 @@ func (m *S3Manager) ProcessMediaForS3(ctx context.Context, userID, contactJID, m
 	key := m.GenerateS3Key(userID, contactJID, messageID, mimeType, isIncoming)
 
 	// Upload to S3
-	err := m.UploadToS3(ctx, userID, key, data, mimeType)
+	err := m.UploadToS3(ctx, userID, key, bytes.NewReader(data), int64(len(data)), mimeType)
 	if err != nil {
 		return nil, fmt.Errorf("failed to upload to S3: %w", err)
 	}
 
-	// Generate public URL
-	publicURL := m.GetPublicURL(userID, key)
+	// Generate public or presigned URL
+	publicURL := m.GetObjectURL(ctx, userID, key)
 
 	// Return S3 metadata
 	s3Data := map[string]interface{}{
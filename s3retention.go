@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/rs/zerolog/log"
+)
+
+// How retention is enforced for a user
+const (
+	retentionModeDisabled  = "disabled"
+	retentionModeLifecycle = "lifecycle"
+	retentionModeSweeper   = "sweeper"
+)
+
+// S3RetentionStatus reports how a user's retention is applied and what the sweeper removed
+type S3RetentionStatus struct {
+	UserID        string    `json:"user_id"`
+	Bucket        string    `json:"bucket"`
+	RetentionDays int       `json:"retention_days"`
+	Mode          string    `json:"mode"`
+	LifecycleErr  string    `json:"lifecycle_error,omitempty"`
+	LastSweep     time.Time `json:"last_sweep,omitempty"`
+	LastDeleted   int       `json:"last_deleted"`
+	TotalDeleted  int       `json:"total_deleted"`
+	LastError     string    `json:"last_error,omitempty"`
+}
+
+var (
+	retentionMu     sync.Mutex
+	retentionStatus = map[string]*S3RetentionStatus{}
+	// Lifecycle configurations are bucket wide, updates for users sharing a bucket must not interleave
+	lifecycleMu sync.Mutex
+)
+
+func retentionRuleID(userID string) string {
+	return "wuzapi-retention-" + userID
+}
+
+// ApplyRetention installs the lifecycle rule for the user's prefix, falling back to the
+// background sweeper when the provider doesn't support lifecycle configuration
+func (m *S3Manager) ApplyRetention(ctx context.Context, userID string) *S3RetentionStatus {
+	_, config, ok := m.GetClient(userID)
+	if !ok {
+		return nil
+	}
+
+	status := &S3RetentionStatus{UserID: userID, Bucket: config.Bucket, RetentionDays: config.RetentionDays}
+	retentionMu.Lock()
+	if previous, found := retentionStatus[userID]; found {
+		status.LastSweep, status.LastDeleted, status.TotalDeleted = previous.LastSweep, previous.LastDeleted, previous.TotalDeleted
+	}
+	retentionMu.Unlock()
+
+	err := m.putRetentionRule(ctx, userID)
+	switch {
+	case config.RetentionDays <= 0:
+		status.Mode = retentionModeDisabled
+	case err != nil:
+		status.Mode = retentionModeSweeper
+		status.LifecycleErr = err.Error()
+		log.Warn().Err(err).Str("userID", userID).Msg("Could not install S3 lifecycle rule, retention will be enforced by the sweeper")
+	default:
+		status.Mode = retentionModeLifecycle
+		log.Info().Str("userID", userID).Int("days", config.RetentionDays).Msg("S3 lifecycle rule installed")
+	}
+
+	retentionMu.Lock()
+	retentionStatus[userID] = status
+	retentionMu.Unlock()
+	return status
+}
+
+// Adds, updates or (with no retention) removes the user's rule, keeping the other rules of the bucket
+func (m *S3Manager) putRetentionRule(ctx context.Context, userID string) error {
+	client, config, ok := m.GetClient(userID)
+	if !ok {
+		return fmt.Errorf("S3 client not initialized for user %s", userID)
+	}
+
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+
+	var rules []types.LifecycleRule
+	current, err := client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{
+		Bucket: aws.String(config.Bucket),
+	})
+	var apiErr smithy.APIError
+	if err != nil && !(errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchLifecycleConfiguration") {
+		return fmt.Errorf("failed to read bucket lifecycle: %w", err)
+	}
+	if err == nil {
+		for _, rule := range current.Rules {
+			if aws.ToString(rule.ID) != retentionRuleID(userID) {
+				rules = append(rules, rule)
+			}
+		}
+	}
+
+	if config.RetentionDays > 0 {
+		rules = append(rules, types.LifecycleRule{
+			ID:         aws.String(retentionRuleID(userID)),
+			Status:     types.ExpirationStatusEnabled,
+			Filter:     &types.LifecycleRuleFilter{Prefix: aws.String(fmt.Sprintf("users/%s/", userID))},
+			Expiration: &types.LifecycleExpiration{Days: aws.Int32(int32(config.RetentionDays))},
+		})
+	}
+
+	if len(rules) == 0 {
+		if err != nil {
+			// Nothing configured and nothing to configure
+			return nil
+		}
+		_, err = client.DeleteBucketLifecycle(ctx, &s3.DeleteBucketLifecycleInput{Bucket: aws.String(config.Bucket)})
+		return err
+	}
+
+	_, err = client.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 aws.String(config.Bucket),
+		LifecycleConfiguration: &types.BucketLifecycleConfiguration{Rules: rules},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write bucket lifecycle: %w", err)
+	}
+	return nil
+}
+
+// SweepExpiredObjects deletes the user's objects older than the retention period
+func (m *S3Manager) SweepExpiredObjects(ctx context.Context, userID string) (int, error) {
+	client, config, ok := m.GetClient(userID)
+	if !ok {
+		return 0, fmt.Errorf("S3 client not initialized for user %s", userID)
+	}
+	if config.RetentionDays <= 0 {
+		return 0, nil
+	}
+
+	cutoff := time.Now().Add(-time.Duration(config.RetentionDays) * 24 * time.Hour)
+	prefix := fmt.Sprintf("users/%s/", userID)
+	deleted := 0
+	var batch []types.ObjectIdentifier
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		_, err := client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(config.Bucket),
+			Delete: &types.Delete{Objects: batch, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete expired objects: %w", err)
+		}
+		deleted += len(batch)
+		batch = nil
+		return nil
+	}
+
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(config.Bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to list objects for user %s: %w", userID, err)
+		}
+		for _, obj := range page.Contents {
+			if obj.LastModified == nil || obj.LastModified.After(cutoff) {
+				continue
+			}
+			batch = append(batch, types.ObjectIdentifier{Key: obj.Key})
+			// Delete in batches of 1000 (S3 limit)
+			if len(batch) == 1000 {
+				if err := flush(); err != nil {
+					return deleted, err
+				}
+			}
+		}
+	}
+	return deleted, flush()
+}
+
+// Sweeps a user and records the outcome in the retention status
+func (m *S3Manager) sweepUser(ctx context.Context, userID string) *S3RetentionStatus {
+	deleted, err := m.SweepExpiredObjects(ctx, userID)
+
+	retentionMu.Lock()
+	defer retentionMu.Unlock()
+	status, found := retentionStatus[userID]
+	if !found {
+		status = &S3RetentionStatus{UserID: userID, Mode: retentionModeSweeper}
+		if _, config, ok := m.GetClient(userID); ok {
+			status.Bucket, status.RetentionDays = config.Bucket, config.RetentionDays
+		}
+		retentionStatus[userID] = status
+	}
+	status.LastSweep = time.Now()
+	status.LastDeleted = deleted
+	status.TotalDeleted += deleted
+	status.LastError = ""
+	if err != nil {
+		status.LastError = err.Error()
+		log.Error().Err(err).Str("userID", userID).Msg("S3 retention sweep failed")
+	} else if deleted > 0 {
+		log.Info().Str("userID", userID).Int("deleted", deleted).Msg("S3 retention sweep removed expired objects")
+	}
+	copied := *status
+	return &copied
+}
+
+// Users whose retention is not covered by a lifecycle rule
+func (m *S3Manager) usersNeedingSweep() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	retentionMu.Lock()
+	defer retentionMu.Unlock()
+
+	var users []string
+	for userID, config := range m.configs {
+		if config.RetentionDays <= 0 {
+			continue
+		}
+		if status, found := retentionStatus[userID]; found && status.Mode == retentionModeLifecycle {
+			continue
+		}
+		users = append(users, userID)
+	}
+	return users
+}
+
+// StartRetentionSweeper periodically removes expired objects for providers without lifecycle support
+func (m *S3Manager) StartRetentionSweeper(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			for _, userID := range m.usersNeedingSweep() {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+				m.sweepUser(ctx, userID)
+				cancel()
+			}
+		}
+	}()
+	log.Info().Dur("interval", interval).Msg("S3 retention sweeper started")
+}
+
+func (m *S3Manager) removeRetentionStatus(userID string) {
+	retentionMu.Lock()
+	delete(retentionStatus, userID)
+	retentionMu.Unlock()
+}
+
+// Lists how retention is enforced for every user with S3 enabled
+func (s *server) GetS3Retention() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		retentionMu.Lock()
+		statuses := make([]S3RetentionStatus, 0, len(retentionStatus))
+		for _, status := range retentionStatus {
+			statuses = append(statuses, *status)
+		}
+		retentionMu.Unlock()
+		sort.Slice(statuses, func(i, j int) bool { return statuses[i].UserID < statuses[j].UserID })
+
+		s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"code":    http.StatusOK,
+			"data":    statuses,
+			"success": true,
+		})
+	}
+}
+
+// Runs the sweeper now, for one user or for every user not covered by a lifecycle rule
+func (s *server) RunS3RetentionSweep() http.HandlerFunc {
+	type sweepRequest struct {
+		UserID string `json:"user_id"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var t sweepRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+				s.respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+					"code":    http.StatusBadRequest,
+					"error":   "could not decode payload",
+					"success": false,
+				})
+				return
+			}
+		}
+
+		users := GetS3Manager().usersNeedingSweep()
+		if t.UserID != "" {
+			if _, _, ok := GetS3Manager().GetClient(t.UserID); !ok {
+				s.respondWithJSON(w, http.StatusNotFound, map[string]interface{}{
+					"code":    http.StatusNotFound,
+					"error":   "S3 is not enabled for this user",
+					"success": false,
+				})
+				return
+			}
+			users = []string{t.UserID}
+		}
+
+		results := make([]*S3RetentionStatus, 0, len(users))
+		for _, userID := range users {
+			ctx, cancel := context.WithTimeout(r.Context(), 10*time.Minute)
+			results = append(results, GetS3Manager().sweepUser(ctx, userID))
+			cancel()
+		}
+
+		s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"code":    http.StatusOK,
+			"data":    results,
+			"success": true,
+		})
+	}
+}
@@ -761,7 +761,31 @@ function showDeleteSuccess() {
   });
 }
 
-function openDashboard(id,token) {
+// Tokens are only stored hashed, the admin API issues a short-lived one to open an instance
+async function instanceSessionToken(id) {
+  const admintoken = getLocalStorageItem('admintoken');
+  if(admintoken===null) {
+    return getLocalStorageItem('token');
+  }
+  const myHeaders = new Headers();
+  myHeaders.append('authorization', admintoken);
+  res = await fetch(baseUrl + "/admin/users/"+id+"/session-token", {
+    method: "POST",
+    headers: myHeaders
+  });
+  data = await res.json();
+  if(data.success!==true) {
+    return null;
+  }
+  return data.data.token;
+}
+
+async function openDashboard(id) {
+  const token = await instanceSessionToken(id);
+  if(token===null) {
+    showError('Error opening instance');
+    return;
+  }
   setLocalStorageItem('currentInstance', id, 6);
   setLocalStorageItem('token', token, 6);
   $(`#instance-card-${id}`).removeClass('hidden');
@@ -774,6 +798,25 @@ function openDashboard(id,token) {
   $('.adminlogin').show();
 }
 
+// The card buttons act on their own instance, not on whichever one was opened last
+async function connectInstance(id) {
+  const token = await instanceSessionToken(id);
+  if(token===null) {
+    showError('Error connecting instance');
+    return;
+  }
+  return connect(token);
+}
+
+async function logoutInstance(id) {
+  const token = await instanceSessionToken(id);
+  if(token===null) {
+    showError('Error logging out instance');
+    return;
+  }
+  return logout(token);
+}
+
 function goBackToList() {
   $('#instances-cards > div').addClass('hidden');
   removeLocalStorageItem('currentInstance');
@@ -1195,7 +1238,7 @@ function populateInstances(instances) {
         <td><i class="${instance.connected ? 'check green' : 'times red'} icon"></i> <span class="status ${instance.connected}">${instance.connected ? 'Yes' : 'No'}</span></td>
         <td><i class="${instance.loggedIn ? 'check green' : 'times red'} icon"></i> <span class="status ${instance.loggedIn}">${instance.loggedIn ? 'Yes' : 'No'}</span></td>
         <td>
-          <button class="ui primary button dashboard-button" onclick="openDashboard('${instance.id}', '${instance.token}')">
+          <button class="ui primary button dashboard-button" onclick="openDashboard('${instance.id}')">
             <i class="external alternate icon"></i> Open
           </button>
           <button class="ui negative button dashboard-button" onclick="deleteInstance('${instance.id}')">
@@ -1229,10 +1272,6 @@ function populateInstances(instances) {
                       <div class="meta" style="margin-bottom: 1rem;">Instance ID: ${instance.id}</div>
                       
                       <div class="ui list">
-                          <div class="item">
-                              <div class="header">Token</div>
-                              <div class="content" style="word-break: break-all;">${instance.token}</div>
-                          </div>
                           <div class="item">
                               <div class="header">JID</div>
                               <div class="content">${instance.jid || 'Not available'}</div>
@@ -1296,8 +1335,8 @@ function populateInstances(instances) {
             </div>
             
             <div class="extra content">
-              <button class="ui primary positive button dashboard-button ${instance.connected === true ? 'hidden' : ''}" id="button-connect-${instance.id}" onclick="connect('${instance.token}')">Connect</button>
-              <button class="ui primary negative button dashboard-button ${instance.connected === true ? '' : 'hidden'}" id="button-logout-${instance.id}" onclick="logout('${instance.token}')">Logout</button>
+              <button class="ui primary positive button dashboard-button ${instance.connected === true ? 'hidden' : ''}" id="button-connect-${instance.id}" onclick="connectInstance('${instance.id}')">Connect</button>
+              <button class="ui primary negative button dashboard-button ${instance.connected === true ? '' : 'hidden'}" id="button-logout-${instance.id}" onclick="logoutInstance('${instance.id}')">Logout</button>
               <button class="ui primary positive button dashboard-button ${instance.connected === true && instance.loggedIn === false ? '' : 'hidden'} id="button-logout-${instance.id}" onclick="modalPairPhone()">Login with Pairing Code</button>
               </div>
         </div>
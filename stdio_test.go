@@ -57,6 +57,9 @@ func TestAdminUsersAddAndList(t *testing.T) {
 	if addResponse["error"] != nil {
 		t.Fatalf("Failed to add user: %v", addResponse["error"])
 	}
+	if token := addResponse["result"].(map[string]interface{})["token"]; token != "alice-token-123" {
+		t.Errorf("Expected the token in the add response, got %v", token)
+	}
 
 	// Now list users to verify the user was added
 	listRequest := newRequest("2", "admin.users.list", map[string]interface{}{
@@ -83,12 +86,15 @@ func TestAdminUsersAddAndList(t *testing.T) {
 
 	user := users[0].(map[string]interface{})
 	expectedUser := map[string]interface{}{
-		"name":  "Alice",
-		"token": "alice-token-123",
+		"name": "Alice",
 	}
 	if diff := compareJSON(expectedUser, user); diff != "" {
 		t.Errorf("User data mismatch:\n%s", diff)
 	}
+	// Only the hash is stored, the token is shown once when the user is added
+	if _, ok := user["token"]; ok {
+		t.Errorf("Expected the token to be left out of the list, got %v", user["token"])
+	}
 }
 
 func TestAdminUsersGet(t *testing.T) {
@@ -137,12 +143,14 @@ func TestAdminUsersGet(t *testing.T) {
 
 	user := users[0].(map[string]interface{})
 	expectedUser := map[string]interface{}{
-		"name":  "Bob",
-		"token": "bob-token-456",
+		"name": "Bob",
 	}
 	if diff := compareJSON(expectedUser, user); diff != "" {
 		t.Errorf("User data mismatch:\n%s", diff)
 	}
+	if _, ok := user["token"]; ok {
+		t.Errorf("Expected the token to be left out, got %v", user["token"])
+	}
 }
 
 func TestAdminUsersDelete(t *testing.T) {
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// MediaStorage keeps media delivered to webhooks as links instead of base64
+type MediaStorage interface {
+	// Field of the webhook payload that holds the stored media details
+	PayloadKey() string
+	Put(ctx context.Context, userID, key string, body io.Reader, size int64, mimeType string) error
+	URL(userID, key string) string
+	// Link kept in the message history, it must not expire
+	HistoryURL(userID, key string) string
+	DeleteAll(ctx context.Context, userID string) error
+}
+
+// Media delivery modes that send a link to stored media
+func deliversMediaLink(mediaDelivery string) bool {
+	return mediaDelivery == "s3" || mediaDelivery == "both" || mediaDelivery == "local"
+}
+
+// Returns the storage backend selected by the user's media_delivery, or nil for base64 only
+func mediaStorageFor(userID, mediaDelivery string, s3Enabled bool) MediaStorage {
+	switch mediaDelivery {
+	case "local":
+		return localMediaStore
+	case "s3", "both":
+		if !s3Enabled {
+			return nil
+		}
+		return &s3MediaStorage{manager: GetS3Manager()}
+	}
+	return nil
+}
+
+// Stores a media file and returns the details added to the webhook payload
+func storeMediaForDelivery(ctx context.Context, storage MediaStorage, userID, contactJID, messageID string,
+	data []byte, mimeType string, fileName string, isIncoming bool) (map[string]interface{}, error) {
+
+	key := GetS3Manager().GenerateS3Key(userID, contactJID, messageID, mimeType, isIncoming)
+	if err := storage.Put(ctx, userID, key, bytes.NewReader(data), int64(len(data)), mimeType); err != nil {
+		return nil, err
+	}
+
+	mediaData := map[string]interface{}{
+		"url":      storage.URL(userID, key),
+		"key":      key,
+		"size":     len(data),
+		"mimeType": mimeType,
+		"fileName": fileName,
+	}
+	if s3Storage, ok := storage.(*s3MediaStorage); ok {
+		if _, config, ok := s3Storage.manager.GetClient(userID); ok {
+			mediaData["bucket"] = config.Bucket
+		}
+	}
+	return mediaData, nil
+}
+
+// History link of the media stored for a webhook payload, from S3 or local storage
+func storedMediaLink(userID string, postmap map[string]interface{}) string {
+	storages := map[string]MediaStorage{"s3": &s3MediaStorage{manager: GetS3Manager()}}
+	if localMediaStore != nil {
+		storages["media"] = localMediaStore
+	}
+	for field, storage := range storages {
+		if data, ok := postmap[field].(map[string]interface{}); ok {
+			if key, ok := data["key"].(string); ok && key != "" {
+				return storage.HistoryURL(userID, key)
+			}
+		}
+	}
+	return ""
+}
+
+type s3MediaStorage struct {
+	manager *S3Manager
+}
+
+func (st *s3MediaStorage) PayloadKey() string {
+	return "s3"
+}
+
+func (st *s3MediaStorage) Put(ctx context.Context, userID, key string, body io.Reader, size int64, mimeType string) error {
+	return st.manager.UploadToS3(ctx, userID, key, body, size, mimeType)
+}
+
+func (st *s3MediaStorage) URL(userID, key string) string {
+	return st.manager.GetObjectURL(context.Background(), userID, key)
+}
+
+// Public objects keep their URL, presigned ones go through /media/s3/ which signs a fresh one
+func (st *s3MediaStorage) HistoryURL(userID, key string) string {
+	if _, config, ok := st.manager.GetClient(userID); ok && !config.Presigned() {
+		return st.manager.GetPublicURL(userID, key)
+	}
+	return serverBaseURL() + "/media/s3/" + key
+}
+
+func (st *s3MediaStorage) DeleteAll(ctx context.Context, userID string) error {
+	return st.manager.DeleteAllUserObjects(ctx, userID)
+}
+
+// Keeps media on disk and hands out signed, expiring links served by WuzAPI itself
+type localMediaStorage struct {
+	root   string
+	secret []byte
+	ttl    time.Duration
+}
+
+// Set up in main once the executable path is known
+var localMediaStore *localMediaStorage
+
+func newLocalMediaStorage(root string) *localMediaStorage {
+	secret := []byte(*mediaURLSecret)
+	if len(secret) == 0 {
+		secret = []byte(*globalEncryptionKey)
+	}
+	if len(secret) == 0 {
+		// Links will stop working after a restart
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatal().Err(err).Msg("Failed to generate media URL secret")
+		}
+		log.Warn().Msg("No media URL secret configured, local media links will expire on restart")
+	}
+	return &localMediaStorage{
+		root:   root,
+		secret: secret,
+		ttl:    time.Duration(*localMediaTTLHours) * time.Hour,
+	}
+}
+
+func (st *localMediaStorage) PayloadKey() string {
+	return "media"
+}
+
+// Keys come from GenerateS3Key and already start with users/<id>/
+func (st *localMediaStorage) path(key string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(key))
+	if clean == "." || filepath.IsAbs(clean) || strings.HasPrefix(clean, "..") {
+		return "", errors.New("invalid media key")
+	}
+	return filepath.Join(st.root, clean), nil
+}
+
+func (st *localMediaStorage) Put(ctx context.Context, userID, key string, body io.Reader, size int64, mimeType string) error {
+	path, err := st.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0751); err != nil {
+		return fmt.Errorf("could not create media directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return fmt.Errorf("could not store media: %w", err)
+	}
+	if _, err := io.Copy(file, body); err != nil {
+		file.Close()
+		os.Remove(path)
+		return fmt.Errorf("could not store media: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("could not store media: %w", err)
+	}
+	return nil
+}
+
+func (st *localMediaStorage) sign(key string, expires int64) string {
+	mac := hmac.New(sha256.New, st.secret)
+	mac.Write([]byte(key + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (st *localMediaStorage) URL(userID, key string) string {
+	expires := time.Now().Add(st.ttl).Unix()
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("sig", st.sign(key, expires))
+	return fmt.Sprintf("%s/media/local/%s?%s", serverBaseURL(), key, query.Encode())
+}
+
+// Unsigned link, served to the owner's token like /media/s3/
+func (st *localMediaStorage) HistoryURL(userID, key string) string {
+	return serverBaseURL() + "/media/local/" + key
+}
+
+func (st *localMediaStorage) verify(key, expiresParam, signature string) bool {
+	expires, err := strconv.ParseInt(expiresParam, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(st.sign(key, expires)), []byte(signature))
+}
+
+func (st *localMediaStorage) DeleteAll(ctx context.Context, userID string) error {
+	return os.RemoveAll(filepath.Join(st.root, "users", userID))
+}
+
+// Base URL used in links to this server, the listen address when no public URL is set
+func serverBaseURL() string {
+	if *publicURL != "" {
+		return strings.TrimRight(*publicURL, "/")
+	}
+	scheme := "http"
+	if *sslcert != "" && *sslprivkey != "" {
+		scheme = "https"
+	}
+	host := *address
+	if host == "0.0.0.0" || host == "" {
+		host = "localhost"
+	}
+	return fmt.Sprintf("%s://%s:%s", scheme, host, *port)
+}
+
+// Serves locally stored media, the signature in the link is the only authorization
+func (s *server) ServeLocalMedia() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := mux.Vars(r)["key"]
+		query := r.URL.Query()
+
+		if localMediaStore == nil || !localMediaStore.verify(key, query.Get("expires"), query.Get("sig")) {
+			s.Respond(w, r, http.StatusForbidden, errors.New("invalid or expired link"))
+			return
+		}
+		s.serveLocalMediaFile(w, r, key)
+	}
+}
+
+// Serves the unsigned history links of locally stored media to the owner
+func (s *server) GetLocalMedia() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		key := mux.Vars(r)["key"]
+
+		if !strings.HasPrefix(key, "users/"+txtid+"/") {
+			s.Respond(w, r, http.StatusForbidden, errors.New("media does not belong to this user"))
+			return
+		}
+		if localMediaStore == nil {
+			s.Respond(w, r, http.StatusNotFound, errors.New("media not found"))
+			return
+		}
+		s.serveLocalMediaFile(w, r, key)
+	}
+}
+
+func (s *server) serveLocalMediaFile(w http.ResponseWriter, r *http.Request, key string) {
+	path, err := localMediaStore.path(key)
+	if err != nil {
+		s.Respond(w, r, http.StatusBadRequest, err)
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		s.Respond(w, r, http.StatusNotFound, errors.New("media not found"))
+		return
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil || stat.IsDir() {
+		s.Respond(w, r, http.StatusNotFound, errors.New("media not found"))
+		return
+	}
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	http.ServeContent(w, r, stat.Name(), stat.ModTime(), file)
+}
+
+// Redirects to a freshly presigned URL, so links to a private bucket never go stale
+func (s *server) GetS3Media() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		key := mux.Vars(r)["key"]
+
+		// Users can only reach their own objects
+		if !strings.HasPrefix(key, "users/"+txtid+"/") || strings.Contains(key, "..") {
+			s.Respond(w, r, http.StatusForbidden, errors.New("object does not belong to this user"))
+			return
+		}
+
+		link, err := GetS3Manager().PresignURL(r.Context(), txtid, key)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		http.Redirect(w, r, link, http.StatusFound)
+	}
+}
+
+// Time allowed to archive one sent media file
+const outgoingMediaArchiveTimeout = 10 * time.Minute
+
+// Opens a media file for archiving, returning its content and size
+type mediaOpener func() (io.ReadCloser, int64, error)
+
+// Opener for media already in memory
+func bytesMediaOpener(data []byte) mediaOpener {
+	return func() (io.ReadCloser, int64, error) {
+		return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+	}
+}
+
+// Opener for media on disk. The open handle keeps the file readable if the
+// request removes it (multipart temp files) before the upload finishes.
+func fileMediaOpener(path string) mediaOpener {
+	return func() (io.ReadCloser, int64, error) {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		stat, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, 0, err
+		}
+		return file, stat.Size(), nil
+	}
+}
+
+// Archives a sent media file under the outbox direction and returns the link saved in the
+// history. The file is only opened when the user stores media and is uploaded in the
+// background, so sends don't wait on the storage backend.
+func (s *server) archiveOutgoingMedia(userID string, chat types.JID, messageID, mimeType string, open mediaOpener) string {
+	storage := outgoingMediaStorage(userID, s.db)
+	if storage == nil {
+		return ""
+	}
+	body, size, err := open()
+	if err != nil {
+		log.Error().Err(err).Str("id", messageID).Msg("Failed to read outgoing media for archiving")
+		return ""
+	}
+
+	// Outgoing messages are always in outbox
+	key := GetS3Manager().GenerateS3Key(userID, chat.String(), messageID, mimeType, false)
+	go func() {
+		defer body.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), outgoingMediaArchiveTimeout)
+		defer cancel()
+		if err := storage.Put(ctx, userID, key, body, size, mimeType); err != nil {
+			log.Error().Err(err).Str("id", messageID).Str("key", key).Msg("Failed to store outgoing media")
+		}
+	}()
+	return storage.HistoryURL(userID, key)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mau.fi/whatsmeow/types"
+)
+
+func withLocalMediaStore(t *testing.T) *localMediaStorage {
+	previous := localMediaStore
+	localMediaStore = &localMediaStorage{root: t.TempDir(), secret: []byte("secret"), ttl: time.Hour}
+	t.Cleanup(func() { localMediaStore = previous })
+	return localMediaStore
+}
+
+func TestLocalMediaStoragePut(t *testing.T) {
+	store := withLocalMediaStore(t)
+	key := "users/user1/outbox/chat/2025/01/02/documents/m1.pdf"
+	if err := store.Put(context.Background(), "user1", key, strings.NewReader("%PDF-1.4"), 8, "application/pdf"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(store.root, filepath.FromSlash(key)))
+	if err != nil || string(data) != "%PDF-1.4" {
+		t.Errorf("Expected the streamed content on disk, got %q (%v)", data, err)
+	}
+	if err := store.Put(context.Background(), "user1", "../escape", strings.NewReader("x"), 1, ""); err == nil {
+		t.Error("Expected a key outside the root to be refused")
+	}
+}
+
+func TestArchiveOutgoingMediaLocal(t *testing.T) {
+	s := makeTestServer(t)
+	store := withLocalMediaStore(t)
+	if _, err := s.db.Exec("INSERT INTO users (id, name, token, media_delivery) VALUES ($1, $2, $3, $4)", "user1", "u", "tok1", "local"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The link is returned before the background upload finishes and never expires
+	chat := types.NewJID("5511999999999", types.DefaultUserServer)
+	link := s.archiveOutgoingMedia("user1", chat, "m1", "image/jpeg", bytesMediaOpener([]byte("jpeg")))
+	prefix := serverBaseURL() + "/media/local/users/user1/outbox/"
+	if !strings.HasPrefix(link, prefix) || strings.Contains(link, "?") {
+		t.Fatalf("Expected an unsigned local history link, got %q", link)
+	}
+	key := strings.TrimPrefix(link, serverBaseURL()+"/media/local/")
+	path := filepath.Join(store.root, filepath.FromSlash(key))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if data, err := os.ReadFile(path); err == nil && string(data) == "jpeg" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the media to be archived in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	get := func(userID string) int {
+		r := httptest.NewRequest(http.MethodGet, "/media/local/"+key, nil)
+		r = mux.SetURLVars(r, map[string]string{"key": key})
+		r = r.WithContext(context.WithValue(r.Context(), "userinfo", Values{map[string]string{"Id": userID}}))
+		w := httptest.NewRecorder()
+		s.GetLocalMedia().ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := get("user1"); code != http.StatusOK {
+		t.Errorf("Expected the owner to read the history link, got %d", code)
+	}
+	if code := get("user2"); code != http.StatusForbidden {
+		t.Errorf("Expected another user to be refused, got %d", code)
+	}
+
+	// Signed webhook links keep working without a token
+	signed, _ := url.Parse(store.URL("user1", key))
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, signed.RequestURI(), nil))
+	if w.Code != http.StatusOK || w.Body.String() != "jpeg" {
+		t.Errorf("Expected the signed link to be served, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/media/local/"+key, nil))
+	if w.Code == http.StatusOK {
+		t.Error("Expected the unsigned link to need a token")
+	}
+}
+
+func TestStoredMediaLink(t *testing.T) {
+	withLocalMediaStore(t)
+	key := "users/user1/inbox/chat/2025/01/02/images/m1.jpg"
+	postmap := map[string]interface{}{"media": map[string]interface{}{"url": "https://example.com/signed?sig=x", "key": key}}
+	if link := storedMediaLink("user1", postmap); link != serverBaseURL()+"/media/local/"+key {
+		t.Errorf("Expected the unsigned history link, got %q", link)
+	}
+	if link := storedMediaLink("user1", map[string]interface{}{}); link != "" {
+		t.Errorf("Expected no link without stored media, got %q", link)
+	}
+}
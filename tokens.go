@@ -0,0 +1,454 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+)
+
+// Default and maximum time the old token keeps working after a rotation
+const (
+	defaultTokenGraceMinutes = 60
+	maxTokenGraceMinutes     = 7 * 24 * 60
+)
+
+// Key derivation for stored token hashes
+const (
+	tokenHashPrefix     = "pbkdf2$"
+	tokenHashIterations = 100000
+)
+
+var errInvalidToken = errors.New("unauthorized")
+
+// Verified credentials by token digest, so the slow hash runs once per cache period
+var tokencache = cache.New(5*time.Minute, 10*time.Minute)
+
+// Lifetime of the tokens the dashboard gets to open a user, matching its local storage
+const sessionTokenTTL = 6 * time.Hour
+
+// User ids by the digest of a session token issued to an admin. They live in memory only.
+var sessiontokencache = cache.New(sessionTokenTTL, 10*time.Minute)
+
+// A verified token. Expires is zero for the current token and set for a rotated one in its grace period.
+type tokenCredential struct {
+	UserID  string
+	Expires time.Time
+}
+
+func (c *tokenCredential) expired() bool {
+	return !c.Expires.IsZero() && time.Now().After(c.Expires)
+}
+
+// A stored token hash found by its lookup id
+type storedToken struct {
+	ID      string       `db:"id"`
+	Hash    string       `db:"token_hash"`
+	Salt    string       `db:"token_salt"`
+	Expires sql.NullTime `db:"token_expires"`
+}
+
+// Issued tokens carry a random public id in front of the secret
+func newToken() (string, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return "", err
+	}
+	secret, err := randomHex(24)
+	if err != nil {
+		return "", err
+	}
+	return id + "." + secret, nil
+}
+
+// Issued tokens are found by their public id. Tokens chosen by an admin or kept from earlier versions have
+// none and are found by a two byte bucket of their hash, which tells next to nothing about them.
+func tokenLookupID(token string) string {
+	if id, _, found := strings.Cut(token, "."); found && len(id) == 16 {
+		if _, err := hex.DecodeString(id); err == nil {
+			return id
+		}
+	}
+	sum := sha256.Sum256([]byte("wuzapi-token-lookup:" + token))
+	return hex.EncodeToString(sum[:2])
+}
+
+// Key for the in-memory caches, never stored
+func tokenDigest(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func hashToken(token, salt string) (string, error) {
+	key, err := pbkdf2.Key(sha256.New, token, []byte(salt), tokenHashIterations, 32)
+	if err != nil {
+		return "", err
+	}
+	return tokenHashPrefix + hex.EncodeToString(key), nil
+}
+
+func randomHex(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Checks a token against its stored hash. Hashes from earlier versions are a single salted sha256
+// and are reported as legacy so they get replaced.
+func tokenHashMatches(token, salt, hash string) (matches, legacy bool) {
+	if strings.HasPrefix(hash, tokenHashPrefix) {
+		computed, err := hashToken(token, salt)
+		return err == nil && subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1, false
+	}
+	sum := sha256.Sum256([]byte(salt + token))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(hash)) == 1, true
+}
+
+// Returns the stored token the given one matches, upgrading a legacy hash in the given columns
+func matchStoredToken(db *sqlx.DB, table, hashColumn, token string, candidates []storedToken) (*storedToken, bool) {
+	for i := range candidates {
+		candidate := &candidates[i]
+		if candidate.Expires.Valid && time.Now().After(candidate.Expires.Time) {
+			continue
+		}
+		matches, legacy := tokenHashMatches(token, candidate.Salt, candidate.Hash)
+		if !matches {
+			continue
+		}
+		if legacy {
+			if hash, err := hashToken(token, candidate.Salt); err == nil {
+				if _, err := db.Exec("UPDATE "+table+" SET "+hashColumn+" = $1 WHERE id = $2 AND "+hashColumn+" = $3", hash, candidate.ID, candidate.Hash); err != nil {
+					log.Warn().Err(err).Str("table", table).Msg("Failed to upgrade token hash")
+				}
+			}
+		}
+		return candidate, true
+	}
+	return nil, false
+}
+
+// Finds the user holding a token, accepting the previous token during its grace period
+func findUserToken(db *sqlx.DB, token string) (*tokenCredential, error) {
+	lookup := tokenLookupID(token)
+
+	var current []storedToken
+	if err := db.Select(&current, "SELECT id, token_hash, token_salt FROM users WHERE token_lookup = $1", lookup); err != nil {
+		return nil, err
+	}
+	if match, ok := matchStoredToken(db, "users", "token_hash", token, current); ok {
+		return &tokenCredential{UserID: match.ID}, nil
+	}
+
+	var previous []storedToken
+	if err := db.Select(&previous, `SELECT id, previous_token_hash AS token_hash, previous_token_salt AS token_salt,
+		previous_token_expires AS token_expires FROM users WHERE previous_token_lookup = $1 AND previous_token_expires IS NOT NULL`, lookup); err != nil {
+		return nil, err
+	}
+	if match, ok := matchStoredToken(db, "users", "previous_token_hash", token, previous); ok {
+		return &tokenCredential{UserID: match.ID, Expires: match.Expires.Time}, nil
+	}
+	return nil, errInvalidToken
+}
+
+// Resolves a user token to the user id, accepting the previous token during its grace period
+func (s *server) resolveUserToken(token string) (string, error) {
+	if token == "" {
+		return "", errInvalidToken
+	}
+	digest := tokenDigest(token)
+	if userID, found := sessiontokencache.Get(digest); found {
+		return userID.(string), nil
+	}
+
+	if cached, found := tokencache.Get(digest); found {
+		cred := cached.(*tokenCredential)
+		if cred.expired() {
+			return "", errInvalidToken
+		}
+		return cred.UserID, nil
+	}
+
+	cred, err := findUserToken(s.db, token)
+	if err != nil {
+		return "", err
+	}
+	tokencache.Set(digest, cred, cache.DefaultExpiration)
+	return cred.UserID, nil
+}
+
+// Drops the verified tokens of a user so a rotation or removal applies at once
+func forgetUserTokens(userID string) {
+	for digest, item := range tokencache.Items() {
+		if item.Object.(*tokenCredential).UserID == userID {
+			tokencache.Delete(digest)
+		}
+	}
+}
+
+// Returns whether another user already uses this token
+func tokenInUse(db *sqlx.DB, token, exceptUserID string) (bool, error) {
+	cred, err := findUserToken(db, token)
+	if errors.Is(err, errInvalidToken) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return cred.UserID != exceptUserID, nil
+}
+
+// Hashed token columns for a new token
+func newTokenColumns(token string) (lookup, hash, salt string, err error) {
+	salt, err = randomHex(16)
+	if err != nil {
+		return "", "", "", err
+	}
+	hash, err = hashToken(token, salt)
+	if err != nil {
+		return "", "", "", err
+	}
+	return tokenLookupID(token), hash, salt, nil
+}
+
+// Replaces the user's token. With a grace period the current token keeps working until it ends.
+func setUserToken(db *sqlx.DB, userID, token string, grace time.Duration) error {
+	lookup, hash, salt, err := newTokenColumns(token)
+	if err != nil {
+		return err
+	}
+
+	if grace > 0 {
+		_, err = db.Exec(`UPDATE users SET previous_token_lookup = token_lookup, previous_token_hash = token_hash,
+			previous_token_salt = token_salt, previous_token_expires = $1,
+			token = '', token_lookup = $2, token_hash = $3, token_salt = $4 WHERE id = $5`,
+			time.Now().Add(grace), lookup, hash, salt, userID)
+	} else {
+		_, err = db.Exec(`UPDATE users SET previous_token_lookup = NULL, previous_token_hash = NULL,
+			previous_token_salt = NULL, previous_token_expires = NULL,
+			token = '', token_lookup = $1, token_hash = $2, token_salt = $3 WHERE id = $4`,
+			lookup, hash, salt, userID)
+	}
+	if err != nil {
+		return err
+	}
+
+	forgetUserTokens(userID)
+	return nil
+}
+
+// Hashes the plaintext tokens left by earlier versions
+func hashExistingTokens(tx *sqlx.Tx) error {
+	type plainToken struct {
+		ID    string `db:"id"`
+		Token string `db:"token"`
+	}
+	var rows []plainToken
+	if err := tx.Select(&rows, "SELECT id, token FROM users WHERE token != '' AND (token_hash IS NULL OR token_hash = '')"); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		lookup, hash, salt, err := newTokenColumns(row.Token)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE users SET token = '', token_lookup = $1, token_hash = $2, token_salt = $3 WHERE id = $4",
+			lookup, hash, salt, row.ID); err != nil {
+			return err
+		}
+	}
+	if len(rows) > 0 {
+		log.Info().Int("users", len(rows)).Msg("Hashed stored user tokens")
+	}
+	return nil
+}
+
+func tokenGrace(minutes *int) (time.Duration, error) {
+	if minutes == nil {
+		return defaultTokenGraceMinutes * time.Minute, nil
+	}
+	if *minutes < 0 || *minutes > maxTokenGraceMinutes {
+		return 0, errors.New("grace_minutes must be between 0 and 10080")
+	}
+	return time.Duration(*minutes) * time.Minute, nil
+}
+
+// Issues a new token for the calling user, the old one keeps working for the grace period
+func (s *server) RotateToken() http.HandlerFunc {
+	type rotateStruct struct {
+		GraceMinutes *int `json:"grace_minutes"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		if _, ok := r.Context().Value("apikey").(*APIKey); ok {
+			s.Respond(w, r, http.StatusForbidden, errors.New("tokens can only be rotated with the user token"))
+			return
+		}
+
+		var t rotateStruct
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode payload"))
+				return
+			}
+		}
+		grace, err := tokenGrace(t.GraceMinutes)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		token, err := newToken()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if err := setUserToken(s.db, txtid, token, grace); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		log.Info().Str("userID", txtid).Dur("grace", grace).Msg("User token rotated")
+
+		response := map[string]interface{}{"Details": "Token rotated, store it now as it won't be shown again", "Token": token, "OldTokenExpires": time.Now().Add(grace)}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Sets a new token for a user, generated unless given in the payload
+func (s *server) AdminRotateToken() http.HandlerFunc {
+	type rotateStruct struct {
+		Token        string `json:"token"`
+		GraceMinutes *int   `json:"grace_minutes"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := mux.Vars(r)["id"]
+
+		var t rotateStruct
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+				s.respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+					"code":    http.StatusBadRequest,
+					"error":   "could not decode payload",
+					"success": false,
+				})
+				return
+			}
+		}
+		grace, err := tokenGrace(t.GraceMinutes)
+		if err != nil {
+			s.respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"code":    http.StatusBadRequest,
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+
+		var exists int
+		if err := s.db.Get(&exists, "SELECT COUNT(*) FROM users WHERE id = $1", userID); err != nil || exists == 0 {
+			s.respondWithJSON(w, http.StatusNotFound, map[string]interface{}{
+				"code":    http.StatusNotFound,
+				"error":   "user not found",
+				"success": false,
+			})
+			return
+		}
+
+		if t.Token == "" {
+			if t.Token, err = newToken(); err != nil {
+				s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
+					"code":    http.StatusInternalServerError,
+					"error":   err.Error(),
+					"success": false,
+				})
+				return
+			}
+		} else if inUse, err := tokenInUse(s.db, t.Token, userID); err != nil || inUse {
+			s.respondWithJSON(w, http.StatusConflict, map[string]interface{}{
+				"code":    http.StatusConflict,
+				"error":   "token already in use",
+				"success": false,
+			})
+			return
+		}
+
+		if err := setUserToken(s.db, userID, t.Token, grace); err != nil {
+			s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"code":    http.StatusInternalServerError,
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		log.Info().Str("userID", userID).Dur("grace", grace).Msg("User token rotated by admin")
+
+		s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"code": http.StatusOK,
+			"data": map[string]interface{}{
+				"id":                userID,
+				"token":             t.Token,
+				"old_token_expires": time.Now().Add(grace),
+			},
+			"success": true,
+		})
+	}
+}
+
+// Issues a short-lived token so admins can act on a user without knowing its token
+func (s *server) AdminSessionToken() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := mux.Vars(r)["id"]
+
+		var exists int
+		if err := s.db.Get(&exists, "SELECT COUNT(*) FROM users WHERE id = $1", userID); err != nil || exists == 0 {
+			s.respondWithJSON(w, http.StatusNotFound, map[string]interface{}{
+				"code":    http.StatusNotFound,
+				"error":   "user not found",
+				"success": false,
+			})
+			return
+		}
+
+		token, err := randomHex(24)
+		if err != nil {
+			s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"code":    http.StatusInternalServerError,
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		sessiontokencache.Set(tokenDigest(token), userID, cache.DefaultExpiration)
+
+		s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"code": http.StatusOK,
+			"data": map[string]interface{}{
+				"id":      userID,
+				"token":   token,
+				"expires": time.Now().Add(sessionTokenTTL),
+			},
+			"success": true,
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestTokenHashing(t *testing.T) {
+	lookup, hash, salt, err := newTokenColumns("alice-token-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lookup != tokenLookupID("alice-token-123") || len(lookup) != 4 {
+		t.Errorf("expected a stable bucket for a token without an id, got %q", lookup)
+	}
+	if other, _ := hashToken("alice-token-123", ""); hash == other {
+		t.Errorf("hash is not salted")
+	}
+	if matches, legacy := tokenHashMatches("alice-token-123", salt, hash); !matches || legacy {
+		t.Errorf("current token rejected")
+	}
+	if matches, _ := tokenHashMatches("alice-token-124", salt, hash); matches {
+		t.Errorf("wrong token accepted")
+	}
+
+	sum := sha256.Sum256([]byte(salt + "alice-token-123"))
+	if matches, legacy := tokenHashMatches("alice-token-123", salt, hex.EncodeToString(sum[:])); !matches || !legacy {
+		t.Errorf("expected a hash of an earlier version to match as legacy")
+	}
+
+	token, err := newToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _, _ := strings.Cut(token, "."); tokenLookupID(token) != id || len(id) != 16 {
+		t.Errorf("expected an issued token to be found by its public id, got %q for %q", tokenLookupID(token), token)
+	}
+
+	cred := &tokenCredential{UserID: "abc123", Expires: time.Now().Add(time.Minute)}
+	if cred.expired() {
+		t.Errorf("previous token rejected during its grace period")
+	}
+	cred.Expires = time.Now().Add(-time.Minute)
+	if !cred.expired() {
+		t.Errorf("previous token accepted after its grace period")
+	}
+}
+
+func TestTokenGrace(t *testing.T) {
+	if grace, err := tokenGrace(nil); err != nil || grace != time.Hour {
+		t.Errorf("default grace: got %v, %v", grace, err)
+	}
+	zero := 0
+	if grace, err := tokenGrace(&zero); err != nil || grace != 0 {
+		t.Errorf("no grace: got %v, %v", grace, err)
+	}
+	tooLong := maxTokenGraceMinutes + 1
+	if _, err := tokenGrace(&tooLong); err == nil {
+		t.Errorf("grace above the maximum accepted")
+	}
+}
+
+func TestResolveUserToken(t *testing.T) {
+	s := makeTestServer(t)
+	if _, err := s.db.Exec("INSERT INTO users (id, name, token) VALUES ($1, $2, $3)", "tokenuser", "u", "plain-token-1"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { forgetUserTokens("tokenuser") })
+
+	// Plaintext tokens of earlier versions are hashed by the migration
+	tx := s.db.MustBegin()
+	if err := hashExistingTokens(tx); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	var stored string
+	if err := s.db.Get(&stored, "SELECT token FROM users WHERE id = $1", "tokenuser"); err != nil || stored != "" {
+		t.Fatalf("Expected the plaintext token to be cleared, got %q (%v)", stored, err)
+	}
+	if userID, err := s.resolveUserToken("plain-token-1"); err != nil || userID != "tokenuser" {
+		t.Fatalf("Expected the migrated token to resolve, got %q (%v)", userID, err)
+	}
+	// Hashes of earlier versions are replaced once the token is used
+	var salt string
+	if err := s.db.Get(&salt, "SELECT token_salt FROM users WHERE id = $1", "tokenuser"); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(salt + "plain-token-1"))
+	if _, err := s.db.Exec("UPDATE users SET token_hash = $1 WHERE id = $2", hex.EncodeToString(sum[:]), "tokenuser"); err != nil {
+		t.Fatal(err)
+	}
+	forgetUserTokens("tokenuser")
+	if userID, err := s.resolveUserToken("plain-token-1"); err != nil || userID != "tokenuser" {
+		t.Fatalf("Expected a token with a legacy hash to resolve, got %q (%v)", userID, err)
+	}
+	var upgraded string
+	if err := s.db.Get(&upgraded, "SELECT token_hash FROM users WHERE id = $1", "tokenuser"); err != nil || !strings.HasPrefix(upgraded, tokenHashPrefix) {
+		t.Errorf("Expected the stored hash to use the key derivation, got %q (%v)", upgraded, err)
+	}
+	if _, err := s.resolveUserToken("plain-token-x"); err != errInvalidToken {
+		t.Errorf("Expected an unknown token to be refused, got %v", err)
+	}
+
+	// The old token keeps working during the grace period
+	if err := setUserToken(s.db, "tokenuser", "rotated-token-2", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"plain-token-1", "rotated-token-2"} {
+		if userID, err := s.resolveUserToken(token); err != nil || userID != "tokenuser" {
+			t.Errorf("Expected %s to resolve during the grace period, got %q (%v)", token, userID, err)
+		}
+	}
+	if _, err := s.db.Exec("UPDATE users SET previous_token_expires = $1 WHERE id = $2", time.Now().Add(-time.Minute), "tokenuser"); err != nil {
+		t.Fatal(err)
+	}
+	forgetUserTokens("tokenuser")
+	if _, err := s.resolveUserToken("plain-token-1"); err != errInvalidToken {
+		t.Errorf("Expected the old token to be refused after the grace period, got %v", err)
+	}
+
+	// Without a grace period the current token stops working at once
+	if err := setUserToken(s.db, "tokenuser", "rotated-token-3", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.resolveUserToken("rotated-token-2"); err != errInvalidToken {
+		t.Errorf("Expected the replaced token to be refused, got %v", err)
+	}
+	if userID, err := s.resolveUserToken("rotated-token-3"); err != nil || userID != "tokenuser" {
+		t.Errorf("Expected the new token to resolve, got %q (%v)", userID, err)
+	}
+}
+
+func TestAdminSessionToken(t *testing.T) {
+	s := makeTestServer(t)
+	if _, err := s.db.Exec("INSERT INTO users (id, name, token) VALUES ($1, $2, $3)", "sessionuser", "u", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	issue := func(userID string) (int, map[string]interface{}) {
+		r := httptest.NewRequest(http.MethodPost, "/admin/users/"+userID+"/session-token", nil)
+		r = mux.SetURLVars(r, map[string]string{"id": userID})
+		w := httptest.NewRecorder()
+		s.AdminSessionToken().ServeHTTP(w, r)
+		var response struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response.Data
+	}
+
+	if code, _ := issue("missing"); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown user, got %d", code)
+	}
+	code, data := issue("sessionuser")
+	token, _ := data["token"].(string)
+	if code != http.StatusOK || token == "" {
+		t.Fatalf("Expected a session token, got %d %v", code, data)
+	}
+	defer sessiontokencache.Delete(tokenDigest(token))
+	if userID, err := s.resolveUserToken(token); err != nil || userID != "sessionuser" {
+		t.Errorf("Expected the session token to resolve, got %q (%v)", userID, err)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing with the OpenTelemetry SDK. Spans are exported over OTLP (HTTP or gRPC) or written to
+// stdout, and the SDK and exporters read the standard OTEL_* variables (endpoint, headers,
+// sampler, batching, resource attributes)
+
+const (
+	spanKindInternal = trace.SpanKindInternal
+	spanKindServer   = trace.SpanKindServer
+	spanKindClient   = trace.SpanKindClient
+)
+
+// Set up in main when an exporter is configured, nil disables tracing
+var (
+	activeTracer   trace.Tracer
+	tracerProvider *sdktrace.TracerProvider
+)
+
+// Trace context is read from and passed on in W3C traceparent/tracestate and baggage headers
+var tracePropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+func newTraceExporter(ctx context.Context, exporter, endpoint string, out io.Writer) (sdktrace.SpanExporter, error) {
+	switch exporter {
+	case "stdout", "console":
+		return stdouttrace.New(stdouttrace.WithWriter(out))
+	case "otlp":
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q (otlp or stdout)", exporter)
+	}
+
+	protocol := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL")
+	if protocol == "" {
+		protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	switch protocol {
+	case "grpc":
+		var opts []otlptracegrpc.Option
+		if endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpointURL(endpoint))
+		}
+		return otlptracegrpc.New(ctx, opts...)
+	case "", "http/protobuf":
+		var opts []otlptracehttp.Option
+		if endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+		}
+		return otlptracehttp.New(ctx, opts...)
+	}
+	return nil, fmt.Errorf("unsupported OTLP protocol %q (grpc or http/protobuf)", protocol)
+}
+
+// Service name and version, overridden by OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES, plus
+// host, OS and process details. The command line is left out, it may carry tokens
+func newTraceResource(ctx context.Context) (*resource.Resource, error) {
+	return resource.New(ctx,
+		resource.WithSchemaURL(semconv.SchemaURL),
+		resource.WithAttributes(semconv.ServiceName("wuzapi"), semconv.ServiceVersion(version)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+		resource.WithOS(),
+		resource.WithProcessPID(),
+		resource.WithProcessExecutableName(),
+		resource.WithProcessRuntimeName(),
+		resource.WithProcessRuntimeVersion(),
+	)
+}
+
+// Sets up the tracer provider. Root traces are sampled by trace id with the given ratio unless
+// OTEL_TRACES_SAMPLER picks a sampler, traces continued from a caller follow its decision
+func setupTracing(exporter, endpoint string, ratio float64, out io.Writer) error {
+	if ratio < 0 || ratio > 1 {
+		return errors.New("trace sample ratio must be between 0 and 1")
+	}
+	ctx := context.Background()
+	spanExporter, err := newTraceExporter(ctx, exporter, endpoint, out)
+	if err != nil {
+		return err
+	}
+	res, err := newTraceResource(ctx)
+	if err != nil {
+		// Partial resources are still usable, e.g. when the host name can't be read
+		log.Warn().Err(err).Msg("Failed to detect some trace resource attributes")
+	}
+
+	opts := []sdktrace.TracerProviderOption{sdktrace.WithBatcher(spanExporter), sdktrace.WithResource(res)}
+	if os.Getenv("OTEL_TRACES_SAMPLER") == "" {
+		opts = append(opts, sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))))
+	}
+	tracerProvider = sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(tracePropagator)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Warn().Err(err).Msg("Tracing error")
+	}))
+	activeTracer = tracerProvider.Tracer("wuzapi")
+	return nil
+}
+
+// Exports the spans still queued, spans ended afterwards are dropped
+func shutdownTracing(ctx context.Context) error {
+	if tracerProvider == nil {
+		return nil
+	}
+	return tracerProvider.Shutdown(ctx)
+}
+
+type span struct {
+	trace.Span
+}
+
+// Starts a span, child of the one in ctx if any. Returns a nil span, on which every method is a
+// no-op, when tracing is disabled
+func startSpan(ctx context.Context, name string, kind trace.SpanKind) (context.Context, *span) {
+	if activeTracer == nil {
+		return ctx, nil
+	}
+	ctx, sp := activeTracer.Start(ctx, name, trace.WithSpanKind(kind))
+	return ctx, &span{sp}
+}
+
+func spanFromContext(ctx context.Context) *span {
+	sp := trace.SpanFromContext(ctx)
+	if !sp.IsRecording() {
+		return nil
+	}
+	return &span{sp}
+}
+
+func (sp *span) SetAttr(key string, value interface{}) {
+	if sp == nil {
+		return
+	}
+	var attr attribute.KeyValue
+	switch v := value.(type) {
+	case bool:
+		attr = attribute.Bool(key, v)
+	case int:
+		attr = attribute.Int(key, v)
+	case int64:
+		attr = attribute.Int64(key, v)
+	case float64:
+		attr = attribute.Float64(key, v)
+	case string:
+		attr = attribute.String(key, v)
+	default:
+		attr = attribute.String(key, fmt.Sprint(value))
+	}
+	sp.SetAttributes(attr)
+}
+
+func (sp *span) SetError(err error) {
+	if sp == nil || err == nil {
+		return
+	}
+	sp.RecordError(err)
+	sp.SetStatus(codes.Error, err.Error())
+}
+
+func (sp *span) End() {
+	if sp == nil {
+		return
+	}
+	sp.Span.End()
+}
+
+// One server span per API request, continuing the caller's trace when it sends a traceparent header
+func (s *server) tracehttp(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if activeTracer == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		template := routeTemplate(r)
+		ctx, sp := startSpan(ctx, r.Method+" "+template, spanKindServer)
+		sp.SetAttr("http.request.method", r.Method)
+		sp.SetAttr("http.route", template)
+		sp.SetAttr("url.path", r.URL.Path)
+
+		recorder := &auditResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		sp.SetAttr("http.response.status_code", recorder.status)
+		if recorder.status >= http.StatusInternalServerError {
+			sp.SetError(errors.New(http.StatusText(recorder.status)))
+		}
+		sp.End()
+	})
+}
+
+// The whatsmeow calls below run in a child span of ctx. Callers that must not be canceled with the
+// request pass context.WithoutCancel(r.Context()), which keeps the trace
+
+func tracedUpload(ctx context.Context, client *whatsmeow.Client, data []byte, mediaType whatsmeow.MediaType) (whatsmeow.UploadResponse, error) {
+	ctx, sp := startSpan(ctx, "whatsmeow.Upload", spanKindClient)
+	sp.SetAttr("whatsmeow.media_type", string(mediaType))
+	sp.SetAttr("whatsmeow.media_bytes", len(data))
+	uploaded, err := client.Upload(ctx, data, mediaType)
+	sp.SetError(err)
+	sp.End()
+	return uploaded, err
+}
+
+func tracedUploadReader(ctx context.Context, client *whatsmeow.Client, reader io.Reader, tempFile io.ReadWriteSeeker, mediaType whatsmeow.MediaType) (whatsmeow.UploadResponse, error) {
+	ctx, sp := startSpan(ctx, "whatsmeow.Upload", spanKindClient)
+	sp.SetAttr("whatsmeow.media_type", string(mediaType))
+	uploaded, err := client.UploadReader(ctx, reader, tempFile, mediaType)
+	if err == nil {
+		sp.SetAttr("whatsmeow.media_bytes", int64(uploaded.FileLength))
+	}
+	sp.SetError(err)
+	sp.End()
+	return uploaded, err
+}
+
+func tracedSendMessage(ctx context.Context, client *whatsmeow.Client, to types.JID, msg *waE2E.Message, extra ...whatsmeow.SendRequestExtra) (whatsmeow.SendResponse, error) {
+	ctx, sp := startSpan(ctx, "whatsmeow.SendMessage", spanKindClient)
+	messageType, _ := usageMessageType(msg)
+	sp.SetAttr("whatsmeow.message_type", messageType)
+	sp.SetAttr("whatsmeow.recipient_server", to.Server)
+	resp, err := client.SendMessage(ctx, to, msg, extra...)
+	if err == nil {
+		sp.SetAttr("whatsmeow.message_id", resp.ID)
+	}
+	sp.SetError(err)
+	sp.End()
+	return resp, err
+}
+
+// Webhook URLs may carry credentials in the userinfo or query string, spans keep the rest
+func redactedURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.ForceQuery = false
+	u.Fragment = ""
+	u.RawFragment = ""
+	return u.String()
+}
+
+// Webhook deliveries start their own trace, with a child span per attempt
+func startWebhookSpan(webhookURL, userID string) (context.Context, *span) {
+	ctx, sp := startSpan(context.Background(), "webhook", spanKindInternal)
+	sp.SetAttr("url.full", redactedURL(webhookURL))
+	sp.SetAttr("wuzapi.user_id", userID)
+	return ctx, sp
+}
+
+// Starts the span of a webhook attempt and passes its trace context on to the receiver
+func startWebhookAttemptSpan(ctx context.Context, req *resty.Request, attempt int) *span {
+	ctx, sp := startSpan(ctx, "webhook POST", spanKindClient)
+	sp.SetAttr("webhook.attempt", attempt+1)
+	if sp != nil {
+		tracePropagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	}
+	return sp
+}
+
+func endWebhookAttemptSpan(sp *span, resp *resty.Response, err error) {
+	if sp == nil {
+		return
+	}
+	if err != nil {
+		sp.SetError(err)
+	} else {
+		sp.SetAttr("http.response.status_code", resp.StatusCode())
+		if resp.StatusCode() < 200 || resp.StatusCode() >= 300 {
+			sp.SetError(fmt.Errorf("unexpected status code: %d", resp.StatusCode()))
+		}
+	}
+	sp.End()
+}
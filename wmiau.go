@@ -25,6 +25,7 @@ import (
 	"go.mau.fi/whatsmeow"
 	"go.mau.fi/whatsmeow/appstate"
 	"go.mau.fi/whatsmeow/proto/waCompanionReg"
+	"go.mau.fi/whatsmeow/proto/waE2E"
 	"go.mau.fi/whatsmeow/store"
 	"go.mau.fi/whatsmeow/types"
 	"go.mau.fi/whatsmeow/types/events"
@@ -37,17 +38,16 @@ type MyClient struct {
 	WAClient       *whatsmeow.Client
 	eventHandlerID uint32
 	userID         string
-	token          string
 	subscriptions  []string
 	db             *sqlx.DB
 	s              *server
 }
 
-func sendToGlobalWebHook(jsonData []byte, token string, userID string) {
+func sendToGlobalWebHook(jsonData []byte, userID string) {
 	jsonDataStr := string(jsonData)
 
 	instance_name := ""
-	userinfo, found := userinfocache.Get(token)
+	userinfo, found := userinfocache.Get(userID)
 	if found {
 		instance_name = userinfo.(Values).Get("Name")
 	}
@@ -64,14 +64,14 @@ func sendToGlobalWebHook(jsonData []byte, token string, userID string) {
 	}
 }
 
-func sendToUserWebHook(webhookurl string, path string, jsonData []byte, userID string, token string) {
-	sendToUserWebHookWithHmac(webhookurl, path, jsonData, userID, token, nil)
+func sendToUserWebHook(webhookurl string, path string, jsonData []byte, userID string) {
+	sendToUserWebHookWithHmac(webhookurl, path, jsonData, userID, nil)
 }
 
-func sendToUserWebHookWithHmac(webhookurl string, path string, jsonData []byte, userID string, token string, encryptedHmacKey []byte) {
+func sendToUserWebHookWithHmac(webhookurl string, path string, jsonData []byte, userID string, encryptedHmacKey []byte) {
 
 	instance_name := ""
-	userinfo, found := userinfocache.Get(token)
+	userinfo, found := userinfocache.Get(userID)
 	if found {
 		instance_name = userinfo.(Values).Get("Name")
 	}
@@ -109,7 +109,7 @@ func sendToUserWebHookWithHmac(webhookurl string, path string, jsonData []byte,
 func updateAndGetUserSubscriptions(mycli *MyClient) ([]string, error) {
 	// Get updated events from cache/database
 	currentEvents := ""
-	userinfo2, found2 := userinfocache.Get(mycli.token)
+	userinfo2, found2 := userinfocache.Get(mycli.userID)
 	if found2 {
 		currentEvents = userinfo2.(Values).Get("Events")
 	} else {
@@ -140,11 +140,11 @@ func updateAndGetUserSubscriptions(mycli *MyClient) ([]string, error) {
 	return subscribedEvents, nil
 }
 
-func getUserWebhookUrl(token string) string {
+func getUserWebhookUrl(userID string) string {
 	webhookurl := ""
-	myuserinfo, found := userinfocache.Get(token)
+	myuserinfo, found := userinfocache.Get(userID)
 	if !found {
-		log.Warn().Str("token", token).Msg("Could not call webhook as there is no user for this token")
+		log.Warn().Str("userID", userID).Msg("Could not call webhook as there is no cached info for this user")
 	} else {
 		webhookurl = myuserinfo.(Values).Get("Webhook")
 	}
@@ -152,7 +152,7 @@ func getUserWebhookUrl(token string) string {
 }
 
 func sendEventWithWebHook(mycli *MyClient, postmap map[string]interface{}, path string) {
-	webhookurl := getUserWebhookUrl(mycli.token)
+	webhookurl := getUserWebhookUrl(mycli.userID)
 
 	// Get updated events from cache/database
 	subscribedEvents, err := updateAndGetUserSubscriptions(mycli)
@@ -194,7 +194,7 @@ func sendEventWithWebHook(mycli *MyClient, postmap map[string]interface{}, path
 
 	// Get HMAC key for this user
 	var encryptedHmacKey []byte
-	if userinfo, found := userinfocache.Get(mycli.token); found {
+	if userinfo, found := userinfocache.Get(mycli.userID); found {
 		encryptedB64 := userinfo.(Values).Get("HmacKeyEncrypted")
 		if encryptedB64 != "" {
 			var err error
@@ -205,12 +205,12 @@ func sendEventWithWebHook(mycli *MyClient, postmap map[string]interface{}, path
 		}
 	}
 
-	sendToUserWebHookWithHmac(webhookurl, path, jsonData, mycli.userID, mycli.token, encryptedHmacKey)
+	sendToUserWebHookWithHmac(webhookurl, path, jsonData, mycli.userID, encryptedHmacKey)
 
 	// Get global webhook if configured
-	go sendToGlobalWebHook(jsonData, mycli.token, mycli.userID)
+	go sendToGlobalWebHook(jsonData, mycli.userID)
 
-	go sendToGlobalRabbit(jsonData, mycli.token, mycli.userID)
+	go sendToGlobalRabbit(jsonData, mycli.userID)
 }
 
 func checkIfSubscribedToEvent(subscribedEvents []string, eventType string, userId string) bool {
@@ -227,7 +227,8 @@ func checkIfSubscribedToEvent(subscribedEvents []string, eventType string, userI
 
 // Connects to Whatsapp Websocket on server startup if last state was connected
 func (s *server) connectOnStartup() {
-	rows, err := s.db.Queryx("SELECT id,name,token,jid,webhook,events,proxy_url,CASE WHEN s3_enabled THEN 'true' ELSE 'false' END AS s3_enabled,media_delivery,COALESCE(history, 0) as history,hmac_key FROM users WHERE connected=1")
+	// Expired accounts stay disconnected, the expiry watcher notifies them and clears their state
+	rows, err := s.db.Queryx("SELECT id,name,jid,webhook,events,proxy_url,CASE WHEN s3_enabled THEN 'true' ELSE 'false' END AS s3_enabled,media_delivery,COALESCE(history, 0) as history,hmac_key FROM users WHERE connected=1 AND (COALESCE(expiration, 0) = 0 OR expiration > $1)", time.Now().Unix())
 	if err != nil {
 		log.Error().Err(err).Msg("DB Problem")
 		return
@@ -235,7 +236,6 @@ func (s *server) connectOnStartup() {
 	defer rows.Close()
 	for rows.Next() {
 		txtid := ""
-		token := ""
 		jid := ""
 		name := ""
 		webhook := ""
@@ -245,7 +245,7 @@ func (s *server) connectOnStartup() {
 		media_delivery := ""
 		var history int
 		var hmac_key []byte
-		err = rows.Scan(&txtid, &name, &token, &jid, &webhook, &events, &proxy_url, &s3_enabled, &media_delivery, &history, &hmac_key)
+		err = rows.Scan(&txtid, &name, &jid, &webhook, &events, &proxy_url, &s3_enabled, &media_delivery, &history, &hmac_key)
 		if err != nil {
 			log.Error().Err(err).Msg("DB Problem")
 			return
@@ -255,13 +255,12 @@ func (s *server) connectOnStartup() {
 				hmacKeyEncrypted = base64.StdEncoding.EncodeToString(hmac_key)
 			}
 
-			log.Info().Str("token", token).Msg("Connect to Whatsapp on startup")
+			log.Info().Str("userid", txtid).Msg("Connect to Whatsapp on startup")
 			v := Values{map[string]string{
 				"Id":               txtid,
 				"Name":             name,
 				"Jid":              jid,
 				"Webhook":          webhook,
-				"Token":            token,
 				"Proxy":            proxy_url,
 				"Events":           events,
 				"S3Enabled":        s3_enabled,
@@ -269,7 +268,7 @@ func (s *server) connectOnStartup() {
 				"History":          fmt.Sprintf("%d", history),
 				"HmacKeyEncrypted": hmacKeyEncrypted,
 			}}
-			userinfocache.Set(token, v, cache.NoExpiration)
+			userinfocache.Set(txtid, v, cache.NoExpiration)
 			// Gets and set subscription to webhook events
 			eventarray := strings.Split(events, ",")
 
@@ -290,8 +289,8 @@ func (s *server) connectOnStartup() {
 			}
 			eventstring := strings.Join(subscribedEvents, ",")
 			log.Info().Str("events", eventstring).Str("jid", jid).Msg("Attempt to connect")
-			killchannel[txtid] = make(chan bool, 1)
-			go s.startClient(txtid, jid, token, subscribedEvents)
+			openKillChannel(txtid)
+			go s.startClient(txtid, jid, subscribedEvents)
 
 			// Initialize S3 client if configured
 			go func(userID string) {
@@ -305,12 +304,18 @@ func (s *server) connectOnStartup() {
 					PathStyle     bool   `db:"s3_path_style"`
 					PublicURL     string `db:"s3_public_url"`
 					RetentionDays int    `db:"s3_retention_days"`
+					URLMode       string `db:"s3_url_mode"`
+					PresignTTL    int    `db:"s3_presign_ttl"`
+					KeyTemplate   string `db:"s3_key_template"`
 				}
 
 				err := s.db.Get(&s3Config, `
 					SELECT s3_enabled, s3_endpoint, s3_region, s3_bucket, 
 						   s3_access_key, s3_secret_key, s3_path_style, 
-						   s3_public_url, s3_retention_days
+						   s3_public_url, s3_retention_days,
+						   COALESCE(s3_url_mode, 'public') AS s3_url_mode,
+						   COALESCE(s3_presign_ttl, 3600) AS s3_presign_ttl,
+						   COALESCE(s3_key_template, '') AS s3_key_template
 					FROM users WHERE id = $1`, userID)
 
 				if err != nil {
@@ -329,6 +334,9 @@ func (s *server) connectOnStartup() {
 						PathStyle:     s3Config.PathStyle,
 						PublicURL:     s3Config.PublicURL,
 						RetentionDays: s3Config.RetentionDays,
+						URLMode:       s3Config.URLMode,
+						PresignTTL:    s3Config.PresignTTL,
+						KeyTemplate:   s3Config.KeyTemplate,
 					}
 
 					err = GetS3Manager().InitializeS3Client(userID, config)
@@ -336,6 +344,7 @@ func (s *server) connectOnStartup() {
 						log.Error().Err(err).Str("userID", userID).Msg("Failed to initialize S3 client on startup")
 					} else {
 						log.Info().Str("userID", userID).Msg("S3 client initialized on startup")
+						GetS3Manager().ApplyRetention(context.Background(), userID)
 					}
 				}
 			}(txtid)
@@ -366,7 +375,46 @@ func parseJID(arg string) (types.JID, bool) {
 	}
 }
 
-func (s *server) startClient(userID string, textjid string, token string, subscriptions []string) {
+// Creates the channel that stops a session about to start
+func openKillChannel(userID string) chan bool {
+	killchannelMu.Lock()
+	defer killchannelMu.Unlock()
+	ch := make(chan bool, 1)
+	killchannel[userID] = ch
+	return ch
+}
+
+// Asks a running session to stop, returns whether there was one
+func signalKill(userID string) bool {
+	killchannelMu.Lock()
+	ch, running := killchannel[userID]
+	killchannelMu.Unlock()
+	if !running {
+		return false
+	}
+	select {
+	case ch <- true:
+	default:
+	}
+	return true
+}
+
+func killChannel(userID string) chan bool {
+	killchannelMu.Lock()
+	defer killchannelMu.Unlock()
+	return killchannel[userID]
+}
+
+// Removes the channel of a session that ended, unless a new session replaced it
+func closeKillChannel(userID string, ch chan bool) {
+	killchannelMu.Lock()
+	defer killchannelMu.Unlock()
+	if killchannel[userID] == ch {
+		delete(killchannel, userID)
+	}
+}
+
+func (s *server) startClient(userID string, textjid string, subscriptions []string) {
 	log.Info().Str("userid", userID).Str("jid", textjid).Msg("Starting websocket connection to Whatsapp")
 
 	// Connection retry constants
@@ -410,7 +458,7 @@ func (s *server) startClient(userID string, textjid string, token string, subscr
 	store.DeviceProps.PlatformType = waCompanionReg.DeviceProps_DESKTOP.Enum()
 	store.DeviceProps.Os = osName
 
-	mycli := MyClient{client, 1, userID, token, subscriptions, s.db, s}
+	mycli := MyClient{client, 1, userID, subscriptions, s.db, s}
 	mycli.eventHandlerID = mycli.WAClient.AddEventHandler(mycli.myEventHandler)
 
 	// Store the MyClient in clientManager
@@ -461,6 +509,13 @@ func (s *server) startClient(userID string, textjid string, token string, subscr
 	}
 	clientManager.SetHTTPClient(userID, httpClient)
 
+	policy, err := s.reconnectPolicy(userID)
+	if err != nil {
+		log.Warn().Err(err).Str("userid", userID).Msg("Failed to load reconnect policy, using the default one")
+		policy = defaultReconnectPolicy
+	}
+	var supervisor *sessionSupervisor
+
 	if client.Store.ID == nil {
 		// No ID stored, new login
 		qrChan, err := client.GetQRChannel(context.Background())
@@ -477,7 +532,7 @@ func (s *server) startClient(userID string, textjid string, token string, subscr
 				return
 			}
 
-			myuserinfo, found := userinfocache.Get(token)
+			myuserinfo, found := userinfocache.Get(userID)
 
 			for evt := range qrChan {
 				if evt.Event == "code" {
@@ -497,7 +552,7 @@ func (s *server) startClient(userID string, textjid string, token string, subscr
 					} else {
 						if found {
 							v := updateUserInfo(myuserinfo, "Qrcode", base64qrcode)
-							userinfocache.Set(token, v, cache.NoExpiration)
+							userinfocache.Set(userID, v, cache.NoExpiration)
 							log.Info().Str("qrcode", base64qrcode).Msg("update cache userinfo with qr code")
 						}
 					}
@@ -525,17 +580,14 @@ func (s *server) startClient(userID string, textjid string, token string, subscr
 					} else {
 						if found {
 							v := updateUserInfo(myuserinfo, "Qrcode", "")
-							userinfocache.Set(token, v, cache.NoExpiration)
+							userinfocache.Set(userID, v, cache.NoExpiration)
 						}
 					}
 					log.Warn().Msg("QR timeout killing channel")
 					clientManager.DeleteWhatsmeowClient(userID)
 					clientManager.DeleteMyClient(userID)
 					clientManager.DeleteHTTPClient(userID)
-					select {
-					case killchannel[userID] <- true:
-					default:
-					}
+					signalKill(userID)
 				} else if evt.Event == "success" {
 					log.Info().Msg("QR pairing ok!")
 					// Clear QR code after pairing
@@ -546,84 +598,93 @@ func (s *server) startClient(userID string, textjid string, token string, subscr
 					} else {
 						if found {
 							v := updateUserInfo(myuserinfo, "Qrcode", "")
-							userinfocache.Set(token, v, cache.NoExpiration)
+							userinfocache.Set(userID, v, cache.NoExpiration)
 						}
 					}
 				} else {
 					log.Info().Str("event", evt.Event).Msg("Login event")
 				}
 			}
+			if client.Store.ID != nil && policy.Enabled {
+				supervisor = startSessionSupervisor(&mycli, policy, false)
+			}
 		}
 
 	} else {
 		// Already logged in, just connect
 		log.Info().Msg("Already logged in, just connect")
 
-		// Retry logic with linear backoff
-		var lastErr error
+		if policy.Enabled {
+			supervisor = startSessionSupervisor(&mycli, policy, true)
+		} else {
+			// Retry logic with linear backoff
+			var lastErr error
+
+			for attempt := 0; attempt < maxConnectionRetries; attempt++ {
+				if attempt > 0 {
+					waitTime := time.Duration(attempt) * connectionRetryBaseWait
+					log.Warn().
+						Int("attempt", attempt+1).
+						Int("max_retries", maxConnectionRetries).
+						Dur("wait_time", waitTime).
+						Msg("Retrying connection after delay")
+					time.Sleep(waitTime)
+				}
 
-		for attempt := 0; attempt < maxConnectionRetries; attempt++ {
-			if attempt > 0 {
-				waitTime := time.Duration(attempt) * connectionRetryBaseWait
+				err = client.Connect()
+				if err == nil {
+					log.Info().
+						Int("attempt", attempt+1).
+						Msg("Successfully connected to WhatsApp")
+					break
+				}
+
+				lastErr = err
 				log.Warn().
+					Err(err).
 					Int("attempt", attempt+1).
 					Int("max_retries", maxConnectionRetries).
-					Dur("wait_time", waitTime).
-					Msg("Retrying connection after delay")
-				time.Sleep(waitTime)
+					Msg("Failed to connect to WhatsApp")
 			}
 
-			err = client.Connect()
-			if err == nil {
-				log.Info().
-					Int("attempt", attempt+1).
-					Msg("Successfully connected to WhatsApp")
-				break
-			}
-
-			lastErr = err
-			log.Warn().
-				Err(err).
-				Int("attempt", attempt+1).
-				Int("max_retries", maxConnectionRetries).
-				Msg("Failed to connect to WhatsApp")
-		}
-
-		if lastErr != nil {
-			log.Error().
-				Err(lastErr).
-				Str("userid", userID).
-				Int("attempts", maxConnectionRetries).
-				Msg("Failed to connect to WhatsApp after all retry attempts")
+			if lastErr != nil {
+				log.Error().
+					Err(lastErr).
+					Str("userid", userID).
+					Int("attempts", maxConnectionRetries).
+					Msg("Failed to connect to WhatsApp after all retry attempts")
+
+				clientManager.DeleteWhatsmeowClient(userID)
+				clientManager.DeleteMyClient(userID)
+				clientManager.DeleteHTTPClient(userID)
+
+				sqlStmt := `UPDATE users SET qrcode='', connected=0 WHERE id=$1`
+				_, dbErr := s.db.Exec(sqlStmt, userID)
+				if dbErr != nil {
+					log.Error().Err(dbErr).Msg("Failed to update user status after connection error")
+				}
 
-			clientManager.DeleteWhatsmeowClient(userID)
-			clientManager.DeleteMyClient(userID)
-			clientManager.DeleteHTTPClient(userID)
+				// Use the existing mycli instance from outer scope
+				postmap := make(map[string]interface{})
+				postmap["event"] = "ConnectFailure"
+				postmap["error"] = lastErr.Error()
+				postmap["type"] = "ConnectFailure"
+				postmap["attempts"] = maxConnectionRetries
+				postmap["reason"] = "Failed to connect after retry attempts"
+				sendEventWithWebHook(&mycli, postmap, "")
 
-			sqlStmt := `UPDATE users SET qrcode='', connected=0 WHERE id=$1`
-			_, dbErr := s.db.Exec(sqlStmt, userID)
-			if dbErr != nil {
-				log.Error().Err(dbErr).Msg("Failed to update user status after connection error")
+				return
 			}
-
-			// Use the existing mycli instance from outer scope
-			postmap := make(map[string]interface{})
-			postmap["event"] = "ConnectFailure"
-			postmap["error"] = lastErr.Error()
-			postmap["type"] = "ConnectFailure"
-			postmap["attempts"] = maxConnectionRetries
-			postmap["reason"] = "Failed to connect after retry attempts"
-			sendEventWithWebHook(&mycli, postmap, "")
-
-			return
 		}
 	}
 
 	// Keep connected client live until disconnected/killed
+	kill := killChannel(userID)
 	for {
 		select {
-		case <-killchannel[userID]:
+		case <-kill:
 			log.Info().Str("userid", userID).Msg("Received kill signal")
+			supervisor.Stop()
 			client.Disconnect()
 			clientManager.DeleteWhatsmeowClient(userID)
 			clientManager.DeleteMyClient(userID)
@@ -633,7 +694,7 @@ func (s *server) startClient(userID string, textjid string, token string, subscr
 			if err != nil {
 				log.Error().Err(err).Msg(sqlStmt)
 			}
-			delete(killchannel, userID)
+			closeKillChannel(userID, kill)
 			return
 		default:
 			time.Sleep(1000 * time.Millisecond)
@@ -651,6 +712,30 @@ func fileToBase64(filepath string) (string, string, error) {
 	return base64.StdEncoding.EncodeToString(data), mimeType, nil
 }
 
+// Sends a message on behalf of an automation (flows, auto-replies, AI agent, helpdesk replies) and records it in
+// history. It counts against the monthly message quota like the send endpoints.
+func (mycli *MyClient) sendAutomatedMessage(chat types.JID, msg *waE2E.Message, messageType string, textContent string) (string, error) {
+	if err := mycli.s.consumeUsage(mycli.userID, 1, 0); err != nil {
+		return "", err
+	}
+	msgid := mycli.WAClient.GenerateMessageID()
+	resp, err := tracedSendMessage(context.Background(), mycli.WAClient, chat, msg, whatsmeow.SendRequestExtra{ID: msgid})
+	if err != nil {
+		mycli.s.refundUsage(mycli.userID, 1, 0)
+		return "", err
+	}
+	meterUsage(mycli.userID, metricMessagesSent+messageType, 1)
+
+	historyLimit := 0
+	if userinfo, found := userinfocache.Get(mycli.userID); found {
+		historyLimit, _ = strconv.Atoi(userinfo.(Values).Get("History"))
+	}
+	mycli.s.saveOutgoingMessageToHistory(mycli.userID, chat.String(), msgid, messageType, textContent, "", historyLimit)
+
+	log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Str("chat", chat.String()).Msg("Automated message sent")
+	return msgid, nil
+}
+
 func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 	txtid := mycli.userID
 	postmap := make(map[string]interface{})
@@ -671,6 +756,7 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 	case *events.Connected, *events.PushNameSetting:
 		postmap["type"] = "Connected"
 		dowebhook = 1
+		sessionDiagnosticsFor(mycli.userID).recordEvent(evt)
 		if len(mycli.WAClient.Store.PushName) == 0 {
 			break
 		}
@@ -689,7 +775,7 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 			return
 		}
 	case *events.PairSuccess:
-		log.Info().Str("userid", mycli.userID).Str("token", mycli.token).Str("ID", evt.ID.String()).Str("BusinessName", evt.BusinessName).Str("Platform", evt.Platform).Msg("QR Pair Success")
+		log.Info().Str("userid", mycli.userID).Str("ID", evt.ID.String()).Str("BusinessName", evt.BusinessName).Str("Platform", evt.Platform).Msg("QR Pair Success")
 		jid := evt.ID
 		sqlStmt := `UPDATE users SET jid=$1 WHERE id=$2`
 		_, err := mycli.db.Exec(sqlStmt, jid, mycli.userID)
@@ -701,15 +787,14 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 		postmap["type"] = "PairSuccess"
 		dowebhook = 1
 
-		myuserinfo, found := userinfocache.Get(mycli.token)
+		myuserinfo, found := userinfocache.Get(mycli.userID)
 		if !found {
 			log.Warn().Msg("No user info cached on pairing?")
 		} else {
 			txtid = myuserinfo.(Values).Get("Id")
-			token := myuserinfo.(Values).Get("Token")
 			v := updateUserInfo(myuserinfo, "Jid", fmt.Sprintf("%s", jid))
-			userinfocache.Set(token, v, cache.NoExpiration)
-			log.Info().Str("jid", jid.String()).Str("userid", txtid).Str("token", token).Msg("User information set")
+			userinfocache.Set(txtid, v, cache.NoExpiration)
+			log.Info().Str("jid", jid.String()).Str("userid", txtid).Msg("User information set")
 		}
 
 		// Check if automatic history sync is enabled and trigger it after QR code is scanned
@@ -798,13 +883,19 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 		return
 	case *events.Message:
 
+		if !evt.Info.IsFromMe {
+			messageType, mediaBytes := usageMessageType(evt.Message)
+			meterUsage(mycli.userID, metricMessagesReceived+messageType, 1)
+			meterUsage(mycli.userID, metricMediaBytesIn, mediaBytes)
+		}
+
 		var s3Config struct {
 			Enabled       string `db:"s3_enabled"`
 			MediaDelivery string `db:"media_delivery"`
 		}
 
 		lastMessageCache.Set(mycli.userID, &evt.Info, cache.DefaultExpiration)
-		myuserinfo, found := userinfocache.Get(mycli.token)
+		myuserinfo, found := userinfocache.Get(mycli.userID)
 		if !found {
 			err := mycli.db.Get(&s3Config, "SELECT CASE WHEN s3_enabled = 1 THEN 'true' ELSE 'false' END AS s3_enabled, media_delivery FROM users WHERE id = $1", txtid)
 			if err != nil {
@@ -835,49 +926,11 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 
 		log.Info().Str("id", evt.Info.ID).Str("source", evt.Info.SourceString()).Str("parts", strings.Join(metaParts, ", ")).Msg("Message Received")
 
-		// --- INÍCIO DA INTEGRAÇÃO CHATWOOT ---
-		// Verifica se a mensagem não é antiga (para evitar flood na inicialização)
+		// Forward to helpdesk connectors, skipping old messages to avoid a flood on startup
 		isRecent := evt.Info.Timestamp.After(time.Now().Add(-5 * time.Minute))
-		
 		if isRecent && !evt.Info.IsFromMe {
-			// Tenta extrair o texto da mensagem
-			cwText := ""
-			if evt.Message.GetConversation() != "" {
-				cwText = evt.Message.GetConversation()
-			} else if evt.Message.GetExtendedTextMessage() != nil {
-				cwText = evt.Message.GetExtendedTextMessage().GetText()
-			} else {
-				// Se for mídia, coloca um texto descritivo
-				if evt.Message.GetImageMessage() != nil { cwText = "[Imagem]" }
-				if evt.Message.GetAudioMessage() != nil { cwText = "[Áudio]" }
-				if evt.Message.GetVideoMessage() != nil { cwText = "[Vídeo]" }
-				if evt.Message.GetDocumentMessage() != nil { cwText = "[Documento]" }
-				if evt.Message.GetStickerMessage() != nil { cwText = "[Sticker]" }
-			}
-
-			// Se tiver texto (ou descrição de mídia), envia para o Chatwoot
-			if cwText != "" {
-				go SendToChatwoot(evt.Info.PushName, evt.Info.Sender.User, cwText)
-			}
-		}
-		// --- FIM DA INTEGRAÇÃO CHATWOOT ---
-
-		// Sincronizar mensagens enviadas pelo celular para o Chatwoot
-		if isRecent && evt.Info.IsFromMe {
-			cwText := ""
-			if evt.Message.GetConversation() != "" {
-				cwText = evt.Message.GetConversation()
-			} else if evt.Message.GetExtendedTextMessage() != nil {
-				cwText = evt.Message.GetExtendedTextMessage().GetText()
-			}
-			
-			if cwText != "" {
-				// AQUI precisaria de uma função diferente no chatwoot.go para "criar mensagem como usuário"
-				// Se usar a mesma função, vai aparecer como se o cliente tivesse enviado a mensagem.
-				// Por enquanto, vamos ignorar para não complicar, ou você pode descomentar abaixo:
-				
-				// go SendToChatwoot("Eu (Celular)", evt.Info.RemoteJid.User, cwText) 
-			}
+			go dispatchInboundToConnectors(mycli.db, buildConnectorMessage(mycli, evt))
+			go mycli.runAutomations(evt)
 		}
 
 		if !*skipMedia {
@@ -910,8 +963,8 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 					return
 				}
 
-				// Process S3 upload if enabled
-				if s3Config.Enabled == "true" && (s3Config.MediaDelivery == "s3" || s3Config.MediaDelivery == "both") {
+				// Store the media if it is delivered as a link (S3 or local)
+				if storage := mediaStorageFor(txtid, s3Config.MediaDelivery, s3Config.Enabled == "true"); storage != nil {
 					// Get sender JID for inbox/outbox determination
 					isIncoming := evt.Info.IsFromMe == false
 					contactJID := evt.Info.Sender.String()
@@ -919,9 +972,10 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 						contactJID = evt.Info.Chat.String()
 					}
 
-					// Process S3 upload
-					s3Data, err := GetS3Manager().ProcessMediaForS3(
+					// Store the media
+					mediaData, err := storeMediaForDelivery(
 						context.Background(),
+						storage,
 						txtid,
 						contactJID,
 						evt.Info.ID,
@@ -931,9 +985,9 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 						isIncoming,
 					)
 					if err != nil {
-						log.Error().Err(err).Msg("Failed to upload image to S3")
+						log.Error().Err(err).Msg("Failed to store image for delivery")
 					} else {
-						postmap["s3"] = s3Data
+						postmap[storage.PayloadKey()] = mediaData
 					}
 				}
 
@@ -998,8 +1052,8 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 					return
 				}
 
-				// Process S3 upload if enabled
-				if s3Config.Enabled == "true" && (s3Config.MediaDelivery == "s3" || s3Config.MediaDelivery == "both") {
+				// Store the media if it is delivered as a link (S3 or local)
+				if storage := mediaStorageFor(txtid, s3Config.MediaDelivery, s3Config.Enabled == "true"); storage != nil {
 					// Get sender JID for inbox/outbox determination
 					isIncoming := evt.Info.IsFromMe == false
 					contactJID := evt.Info.Sender.String()
@@ -1007,9 +1061,10 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 						contactJID = evt.Info.Chat.String()
 					}
 
-					// Process S3 upload
-					s3Data, err := GetS3Manager().ProcessMediaForS3(
+					// Store the media
+					mediaData, err := storeMediaForDelivery(
 						context.Background(),
+						storage,
 						txtid,
 						contactJID,
 						evt.Info.ID,
@@ -1019,9 +1074,9 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 						isIncoming,
 					)
 					if err != nil {
-						log.Error().Err(err).Msg("Failed to upload audio to S3")
+						log.Error().Err(err).Msg("Failed to store audio for delivery")
 					} else {
-						postmap["s3"] = s3Data
+						postmap[storage.PayloadKey()] = mediaData
 					}
 				}
 
@@ -1091,8 +1146,8 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 					return
 				}
 
-				// Process S3 upload if enabled
-				if s3Config.Enabled == "true" && (s3Config.MediaDelivery == "s3" || s3Config.MediaDelivery == "both") {
+				// Store the media if it is delivered as a link (S3 or local)
+				if storage := mediaStorageFor(txtid, s3Config.MediaDelivery, s3Config.Enabled == "true"); storage != nil {
 					// Get sender JID for inbox/outbox determination
 					isIncoming := evt.Info.IsFromMe == false
 					contactJID := evt.Info.Sender.String()
@@ -1100,9 +1155,10 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 						contactJID = evt.Info.Chat.String()
 					}
 
-					// Process S3 upload
-					s3Data, err := GetS3Manager().ProcessMediaForS3(
+					// Store the media
+					mediaData, err := storeMediaForDelivery(
 						context.Background(),
+						storage,
 						txtid,
 						contactJID,
 						evt.Info.ID,
@@ -1112,9 +1168,9 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 						isIncoming,
 					)
 					if err != nil {
-						log.Error().Err(err).Msg("Failed to upload document to S3")
+						log.Error().Err(err).Msg("Failed to store document for delivery")
 					} else {
-						postmap["s3"] = s3Data
+						postmap[storage.PayloadKey()] = mediaData
 					}
 				}
 
@@ -1173,8 +1229,8 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 					return
 				}
 
-				// Process S3 upload if enabled
-				if s3Config.Enabled == "true" && (s3Config.MediaDelivery == "s3" || s3Config.MediaDelivery == "both") {
+				// Store the media if it is delivered as a link (S3 or local)
+				if storage := mediaStorageFor(txtid, s3Config.MediaDelivery, s3Config.Enabled == "true"); storage != nil {
 					// Get sender JID for inbox/outbox determination
 					isIncoming := evt.Info.IsFromMe == false
 					contactJID := evt.Info.Sender.String()
@@ -1182,9 +1238,10 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 						contactJID = evt.Info.Chat.String()
 					}
 
-					// Process S3 upload
-					s3Data, err := GetS3Manager().ProcessMediaForS3(
+					// Store the media
+					mediaData, err := storeMediaForDelivery(
 						context.Background(),
+						storage,
 						txtid,
 						contactJID,
 						evt.Info.ID,
@@ -1194,9 +1251,9 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 						isIncoming,
 					)
 					if err != nil {
-						log.Error().Err(err).Msg("Failed to upload video to S3")
+						log.Error().Err(err).Msg("Failed to store video for delivery")
 					} else {
-						postmap["s3"] = s3Data
+						postmap[storage.PayloadKey()] = mediaData
 					}
 				}
 
@@ -1255,15 +1312,16 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 					return
 				}
 
-				// if using S3 (same stream as other media)
-				if s3Config.Enabled == "true" && (s3Config.MediaDelivery == "s3" || s3Config.MediaDelivery == "both") {
+				// if delivered as a link (same stream as other media)
+				if storage := mediaStorageFor(txtid, s3Config.MediaDelivery, s3Config.Enabled == "true"); storage != nil {
 					isIncoming := evt.Info.IsFromMe == false
 					contactJID := evt.Info.Sender.String()
 					if evt.Info.IsGroup {
 						contactJID = evt.Info.Chat.String()
 					}
-					s3Data, err := GetS3Manager().ProcessMediaForS3(
+					mediaData, err := storeMediaForDelivery(
 						context.Background(),
+						storage,
 						txtid,
 						contactJID,
 						evt.Info.ID,
@@ -1273,9 +1331,9 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 						isIncoming,
 					)
 					if err != nil {
-						log.Error().Err(err).Msg("Failed to upload sticker to S3")
+						log.Error().Err(err).Msg("Failed to store sticker for delivery")
 					} else {
-						postmap["s3"] = s3Data
+						postmap[storage.PayloadKey()] = mediaData
 					}
 				}
 
@@ -1305,7 +1363,7 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 		// Save message to history regardless of skipMedia setting
 		// Get user's history setting from cache
 		var historyLimit int
-		userinfo, found := userinfocache.Get(mycli.token)
+		userinfo, found := userinfocache.Get(mycli.userID)
 		if found {
 			historyStr := userinfo.(Values).Get("History")
 			historyLimit, _ = strconv.Atoi(historyStr)
@@ -1403,12 +1461,8 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 				}
 			}
 
-			// Try to get media link from S3 data if available
-			if s3Data, ok := postmap["s3"].(map[string]interface{}); ok {
-				if url, ok := s3Data["url"].(string); ok {
-					mediaLink = url
-				}
-			}
+			// Try to get media link from stored media if available
+			mediaLink = storedMediaLink(txtid, postmap)
 
 			// Only save if there's meaningful content (including delete messages)
 			if textContent != "" || mediaLink != "" || (messageType != "text" && messageType != "reaction") || messageType == "delete" {
@@ -1463,6 +1517,14 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 			// Discard webhooks for inactive or other delivery types
 			return
 		}
+		go dispatchReceiptToConnectors(mycli.db, ConnectorReceipt{
+			UserID:     mycli.userID,
+			MessageIDs: evt.MessageIDs,
+			Chat:       evt.Chat,
+			Phone:      evt.Chat.User,
+			State:      postmap["state"].(string),
+			Timestamp:  evt.Timestamp,
+		})
 	case *events.Presence:
 		postmap["type"] = "Presence"
 		dowebhook = 1
@@ -1752,13 +1814,7 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 		postmap["type"] = "LoggedOut"
 		dowebhook = 1
 		log.Info().Str("reason", evt.Reason.String()).Msg("Logged out")
-		defer func() {
-			// Use a non-blocking send to prevent a deadlock if the receiver has already terminated.
-			select {
-			case killchannel[mycli.userID] <- true:
-			default:
-			}
-		}()
+		defer signalKill(mycli.userID)
 		sqlStmt := `UPDATE users SET connected=0 WHERE id=$1`
 		_, err := mycli.db.Exec(sqlStmt, mycli.userID)
 		if err != nil {
@@ -1769,6 +1825,9 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 		postmap["type"] = "ChatPresence"
 		dowebhook = 1
 		log.Info().Str("state", fmt.Sprintf("%s", evt.State)).Str("media", fmt.Sprintf("%s", evt.Media)).Str("chat", evt.MessageSource.Chat.String()).Str("sender", evt.MessageSource.Sender.String()).Msg("Chat Presence received")
+		if !evt.IsGroup && !evt.IsFromMe {
+			go dispatchPresenceToConnectors(mycli.db, mycli.userID, evt.MessageSource.Sender.User, evt.State == types.ChatPresenceComposing)
+		}
 	case *events.CallOffer:
 		postmap["type"] = "CallOffer"
 		dowebhook = 1
@@ -1792,6 +1851,8 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 	case *events.Disconnected:
 		postmap["type"] = "Disconnected"
 		dowebhook = 1
+		metricConnectionEvents.WithLabelValues(mycli.userID, "Disconnected").Inc()
+		sessionDiagnosticsFor(mycli.userID).recordEvent(evt)
 		log.Info().Str("reason", fmt.Sprintf("%+v", evt)).Msg("Disconnected from Whatsapp")
 	case *events.ConnectFailure:
 		postmap["type"] = "ConnectFailure"
@@ -1805,6 +1866,7 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 		postmap["type"] = "MediaRetry"
 		dowebhook = 1
 		log.Info().Str("messageID", evt.MessageID).Msg("Media retry event")
+		deliverMediaRetry(mycli.userID, evt)
 	case *events.GroupInfo:
 		postmap["type"] = "GroupInfo"
 		dowebhook = 1
@@ -1832,6 +1894,8 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 	case *events.KeepAliveTimeout:
 		postmap["type"] = "KeepAliveTimeout"
 		dowebhook = 1
+		metricConnectionEvents.WithLabelValues(mycli.userID, "KeepAliveTimeout").Inc()
+		sessionDiagnosticsFor(mycli.userID).recordEvent(evt)
 		log.Warn().Msg("Keep alive timeout")
 	case *events.ClientOutdated:
 		postmap["type"] = "ClientOutdated"
@@ -1844,6 +1908,7 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 	case *events.StreamError:
 		postmap["type"] = "StreamError"
 		dowebhook = 1
+		sessionDiagnosticsFor(mycli.userID).recordEvent(evt)
 		log.Error().Str("code", evt.Code).Msg("Stream error")
 	case *events.PairError:
 		postmap["type"] = "PairError"